@@ -139,6 +139,9 @@ func (s *AcmeSession) StartChallenge() error {
 		return err
 	}
 	if len(ags) == 1 && ags[0].GrantType == authgrants.Acme && time.Now().Before(ags[0].ExpTime) {
+		if _, err := s.server.UseAuthGrant(ags[0]); err != nil {
+			return err
+		}
 		s.log.Info("client authorized to receive challenge")
 		uaTube.Write([]byte{userauth.UserAuthConf})
 	} else {
@@ -0,0 +1,418 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"goji.io"
+	"goji.io/pat"
+
+	"hop.computer/hop/common"
+	"hop.computer/hop/pkg/thunks"
+)
+
+// Authgrant approvals: a principal without a terminal to prompt on sends the
+// intents it is asked to approve to the agent. They wait there until they are
+// approved or denied over the API, by the approval hook, or time out.
+//
+// Anyone who can reach the approval API can approve requests, so it is not
+// served on the TCP port of the agent but on a unix socket that only the user
+// can open, and requests from browsers are refused.
+
+// ApprovalSocketName is the name of the approval socket in the hop directory
+// of the user
+const ApprovalSocketName = "agent-approvals.sock"
+
+// DefaultApprovalTimeout is how long approval requests wait for an answer
+// unless configured otherwise
+const DefaultApprovalTimeout = 2 * time.Minute
+
+// ErrNoApproval indicates there is no pending approval request with an ID
+var ErrNoApproval = errors.New("no such approval request")
+
+// ApprovalRequest is a JSON structure describing an authgrant intent waiting
+// for approval
+type ApprovalRequest struct {
+	ID        string    `json:"id"`       // set by the agent
+	Delegate  string    `json:"delegate"` // the host the delegate runs on
+	Target    string    `json:"target"`
+	User      string    `json:"user"`
+	Grant     string    `json:"grant"`            // the grant type, e.g. "command"
+	Action    string    `json:"action,omitempty"` // the command or address of the grant
+	Usage     string    `json:"usage"`            // e.g. "up to 10 times"
+	Delegable bool      `json:"delegable,omitempty"`
+	Start     time.Time `json:"start"`
+	Expires   time.Time `json:"expires"`
+	Received  time.Time `json:"received"` // set by the agent
+}
+
+// String summarizes r in one line
+func (r *ApprovalRequest) String() string {
+	s := fmt.Sprintf("%s: allow %s to %s", r.ID, r.Delegate, r.Grant)
+	if r.Action != "" {
+		s += " " + r.Action
+	}
+	s += fmt.Sprintf(" as %s on %s %s until %s", r.User, r.Target, r.Usage, r.Expires.Format(time.RFC3339))
+	if r.Delegable {
+		s += ", delegable"
+	}
+	return s
+}
+
+// ApprovalDecision is a JSON structure answering an approval request
+type ApprovalDecision struct {
+	ID       string `json:"id"`
+	Approved bool   `json:"approved"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// ApprovalListResponse is the JSON structure returned by GET /approvals
+type ApprovalListResponse struct {
+	Approvals []ApprovalRequest `json:"approvals"`
+}
+
+// Approvals holds the pending approval requests of an agent
+type Approvals struct {
+	// Hook, if set, is a shell command run for each new request, with the
+	// request as JSON on stdin and its ID in HOP_APPROVAL_ID. If the first line
+	// it prints is "approve" or "deny", that answers the request.
+	Hook string
+	// Timeout is how long requests wait before they are denied. It also
+	// bounds how long the hook runs.
+	Timeout time.Duration
+
+	lock sync.Mutex
+	// +checklocks:lock
+	pending map[string]*pendingApproval
+}
+
+type pendingApproval struct {
+	req     ApprovalRequest
+	decided chan ApprovalDecision // buffered, receives at most one decision
+}
+
+// NewApprovals creates an empty set of approval requests
+func NewApprovals(hook string, timeout time.Duration) *Approvals {
+	if timeout <= 0 {
+		timeout = DefaultApprovalTimeout
+	}
+	return &Approvals{
+		Hook:    hook,
+		Timeout: timeout,
+		pending: make(map[string]*pendingApproval),
+	}
+}
+
+// Request adds req and waits until it is answered, times out or ctx is done.
+// Requests that are not approved are denied.
+func (a *Approvals) Request(ctx context.Context, req ApprovalRequest) ApprovalDecision {
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		panic(err.Error())
+	}
+	req.ID = hex.EncodeToString(id[:])
+	req.Received = time.Now()
+	p := &pendingApproval{
+		req:     req,
+		decided: make(chan ApprovalDecision, 1),
+	}
+	a.lock.Lock()
+	a.pending[req.ID] = p
+	a.lock.Unlock()
+	defer func() {
+		a.lock.Lock()
+		delete(a.pending, req.ID)
+		a.lock.Unlock()
+	}()
+	logrus.Infof("agent: approval requested: %s", &req)
+
+	ctx, cancel := context.WithTimeout(ctx, a.Timeout)
+	defer cancel()
+	if a.Hook != "" {
+		go a.runHook(ctx, &req)
+	}
+
+	select {
+	case d := <-p.decided:
+		logrus.Infof("agent: approval %s answered: approved=%t %s", req.ID, d.Approved, d.Reason)
+		return d
+	case <-ctx.Done():
+		logrus.Infof("agent: approval %s not answered: %s", req.ID, ctx.Err())
+		reason := "canceled"
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			reason = "timed out waiting for approval"
+		}
+		return ApprovalDecision{ID: req.ID, Reason: reason}
+	}
+}
+
+// Decide answers the pending request with id
+func (a *Approvals) Decide(id string, approved bool, reason string) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	p, ok := a.pending[id]
+	if !ok {
+		return ErrNoApproval
+	}
+	select {
+	case p.decided <- ApprovalDecision{ID: id, Approved: approved, Reason: reason}:
+		delete(a.pending, id)
+		return nil
+	default:
+		// already answered, but the requester has not picked it up yet
+		return ErrNoApproval
+	}
+}
+
+// List returns the pending requests, oldest first
+func (a *Approvals) List() []ApprovalRequest {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	out := []ApprovalRequest{}
+	for _, p := range a.pending {
+		out = append(out, p.req)
+	}
+	for i := 1; i < len(out); i++ {
+		for j := i; j > 0 && out[j].Received.Before(out[j-1].Received); j-- {
+			out[j], out[j-1] = out[j-1], out[j]
+		}
+	}
+	return out
+}
+
+// runHook runs the hook for req, and answers req if the hook does
+func (a *Approvals) runHook(ctx context.Context, req *ApprovalRequest) {
+	in, err := json.Marshal(req)
+	if err != nil {
+		logrus.Errorf("agent: approval hook: %s", err)
+		return
+	}
+	cmd := exec.CommandContext(ctx, "sh", "-c", a.Hook)
+	cmd.Stdin = bytes.NewReader(in)
+	cmd.Env = append(os.Environ(), "HOP_APPROVAL_ID="+req.ID, "HOP_APPROVAL_SUMMARY="+req.String())
+	out, err := cmd.Output()
+	if err != nil {
+		logrus.Errorf("agent: approval hook for %s: %s", req.ID, err)
+		return
+	}
+	line, _, _ := strings.Cut(string(out), "\n")
+	switch strings.TrimSpace(line) {
+	case "approve":
+		err = a.Decide(req.ID, true, "approved by hook")
+	case "deny":
+		err = a.Decide(req.ID, false, "denied by hook")
+	default:
+		return
+	}
+	if err != nil {
+		logrus.Infof("agent: approval hook answered %s too late: %s", req.ID, err)
+	}
+}
+
+// DefaultApprovalSocket returns the path of the approval socket of the user
+func DefaultApprovalSocket() (string, error) {
+	home, err := thunks.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, common.UserConfigDirectory, ApprovalSocketName), nil
+}
+
+// ListenApprovals opens the approval socket at path, replacing a stale socket
+// left behind by an agent that exited. Only the user can connect to it.
+func ListenApprovals(path string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// ApprovalServer is an http.Handler that serves the approval endpoints
+type ApprovalServer struct {
+	*goji.Mux
+	a *Approvals
+}
+
+// NewApprovalServer creates an ApprovalServer for a. Serve it on a listener
+// from ListenApprovals.
+func NewApprovalServer(a *Approvals) ApprovalServer {
+	s := ApprovalServer{
+		Mux: goji.NewMux(),
+		a:   a,
+	}
+	s.Use(refuseBrowsers)
+	s.Handle(pat.Post("/approvals"), http.HandlerFunc(s.requestApproval))
+	s.Handle(pat.Get("/approvals"), http.HandlerFunc(s.listApprovals))
+	s.Handle(pat.Post("/approvals/:id/approve"), s.decideApproval(true))
+	s.Handle(pat.Post("/approvals/:id/deny"), s.decideApproval(false))
+	return s
+}
+
+// refuseBrowsers refuses requests with an Origin header, which browsers add
+// to requests that web pages make
+func refuseBrowsers(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Origin") != "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (s *ApprovalServer) requestApproval(w http.ResponseWriter, r *http.Request) {
+	var req ApprovalRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	d := s.a.Request(r.Context(), req)
+	if err := json.NewEncoder(w).Encode(&d); err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+}
+
+func (s *ApprovalServer) listApprovals(w http.ResponseWriter, r *http.Request) {
+	out := ApprovalListResponse{Approvals: s.a.List()}
+	if err := json.NewEncoder(w).Encode(&out); err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+}
+
+func (s *ApprovalServer) decideApproval(approved bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		reason := "denied over the agent API"
+		if approved {
+			reason = "approved over the agent API"
+		}
+		if given := r.URL.Query().Get("reason"); given != "" {
+			reason = given
+		}
+		err := s.a.Decide(pat.Param(r, "id"), approved, reason)
+		if errors.Is(err, ErrNoApproval) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// NewApprovalClient returns a Client for the approval socket at path
+func NewApprovalClient(path string) *Client {
+	return &Client{
+		BaseURL: "hop-agent",
+		HTTPClient: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", path)
+				},
+			},
+		},
+	}
+}
+
+// RequestApproval asks the agent to approve req, and waits for the answer
+func (c *Client) RequestApproval(ctx context.Context, req *ApprovalRequest) (*ApprovalDecision, error) {
+	buf := bytes.Buffer{}
+	if err := json.NewEncoder(&buf).Encode(req); err != nil {
+		return nil, err
+	}
+	u := fmt.Sprintf("http://%s/approvals", c.BaseURL)
+	hreq, err := http.NewRequestWithContext(ctx, "POST", u, &buf)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.HTTPClient.Do(hreq)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("requesting approval: %s", res.Status)
+	}
+	out := ApprovalDecision{}
+	if err := json.NewDecoder(res.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ListApprovals returns the pending approval requests of the agent
+func (c *Client) ListApprovals(ctx context.Context) ([]ApprovalRequest, error) {
+	u := fmt.Sprintf("http://%s/approvals", c.BaseURL)
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("listing approvals: %s", res.Status)
+	}
+	out := ApprovalListResponse{}
+	if err := json.NewDecoder(res.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+	return out.Approvals, nil
+}
+
+// DecideApproval approves or denies the pending approval request with id
+func (c *Client) DecideApproval(ctx context.Context, id string, approved bool, reason string) error {
+	action := "deny"
+	if approved {
+		action = "approve"
+	}
+	u := fmt.Sprintf("http://%s/approvals/%s/%s", c.BaseURL, url.PathEscape(id), action)
+	if reason != "" {
+		u += "?" + url.Values{"reason": {reason}}.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", u, nil)
+	if err != nil {
+		return err
+	}
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusNoContent:
+		return nil
+	case http.StatusNotFound:
+		return ErrNoApproval
+	default:
+		return fmt.Errorf("answering approval %s: %s", id, res.Status)
+	}
+}
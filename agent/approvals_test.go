@@ -0,0 +1,126 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func newApprovalsServer(t *testing.T, a *Approvals) *Client {
+	path := filepath.Join(t.TempDir(), ApprovalSocketName)
+	l, err := ListenApprovals(path)
+	assert.NilError(t, err)
+	s := &http.Server{Handler: NewApprovalServer(a)}
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+	return NewApprovalClient(path)
+}
+
+// waitPending waits until c lists a pending request and returns it
+func waitPending(t *testing.T, c *Client) ApprovalRequest {
+	for {
+		reqs, err := c.ListApprovals(context.Background())
+		assert.NilError(t, err)
+		if len(reqs) > 0 {
+			return reqs[0]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestApprovalAPI(t *testing.T) {
+	c := newApprovalsServer(t, NewApprovals("", time.Minute))
+
+	for _, approve := range []bool{true, false} {
+		res := make(chan *ApprovalDecision)
+		go func() {
+			d, err := c.RequestApproval(context.Background(), &ApprovalRequest{Delegate: "delegate", User: "user", Grant: "shell"})
+			assert.Check(t, err)
+			res <- d
+		}()
+		req := waitPending(t, c)
+		assert.Equal(t, req.Delegate, "delegate")
+		assert.Assert(t, req.ID != "")
+
+		assert.NilError(t, c.DecideApproval(context.Background(), req.ID, approve, "because"))
+		d := <-res
+		assert.Equal(t, d.ID, req.ID)
+		assert.Equal(t, d.Approved, approve)
+		assert.Equal(t, d.Reason, "because")
+
+		err := c.DecideApproval(context.Background(), req.ID, approve, "")
+		assert.Assert(t, errors.Is(err, ErrNoApproval))
+		reqs, err := c.ListApprovals(context.Background())
+		assert.NilError(t, err)
+		assert.Equal(t, len(reqs), 0)
+	}
+}
+
+func TestApprovalTimeout(t *testing.T) {
+	c := newApprovalsServer(t, NewApprovals("", 50*time.Millisecond))
+	d, err := c.RequestApproval(context.Background(), &ApprovalRequest{Grant: "shell"})
+	assert.NilError(t, err)
+	assert.Assert(t, !d.Approved)
+	assert.Equal(t, d.Reason, "timed out waiting for approval")
+}
+
+func TestApprovalHook(t *testing.T) {
+	tests := []struct {
+		hook     string
+		approved bool
+	}{
+		{hook: `grep -q '"grant":"shell"' && echo approve`, approved: true},
+		{hook: `test -n "$HOP_APPROVAL_ID" && echo deny`},
+		{hook: `true`}, // leaves the request pending until it times out
+	}
+	for _, tc := range tests {
+		c := newApprovalsServer(t, NewApprovals(tc.hook, 500*time.Millisecond))
+		d, err := c.RequestApproval(context.Background(), &ApprovalRequest{Grant: "shell"})
+		assert.NilError(t, err)
+		assert.Equal(t, d.Approved, tc.approved, tc.hook)
+		if tc.hook == "true" {
+			assert.Equal(t, d.Reason, "timed out waiting for approval")
+		}
+	}
+}
+
+func TestApprovalSocket(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, ApprovalSocketName)
+	// a stale socket is replaced
+	stale, err := net.Listen("unix", path)
+	assert.NilError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	l, err := ListenApprovals(path)
+	assert.NilError(t, err)
+	defer l.Close()
+	info, err := os.Stat(path)
+	assert.NilError(t, err)
+	assert.Equal(t, info.Mode().Perm(), os.FileMode(0o600))
+
+	s := httptest.NewServer(NewApprovalServer(NewApprovals("", time.Minute)))
+	defer s.Close()
+	req, err := http.NewRequest("GET", s.URL+"/approvals", nil)
+	assert.NilError(t, err)
+	res, err := http.DefaultClient.Do(req)
+	assert.NilError(t, err)
+	res.Body.Close()
+	assert.Equal(t, res.StatusCode, http.StatusOK)
+
+	// requests that web pages make are refused
+	req.Header.Set("Origin", "https://example.com")
+	res, err = http.DefaultClient.Do(req)
+	assert.NilError(t, err)
+	res.Body.Close()
+	assert.Equal(t, res.StatusCode, http.StatusForbidden)
+}
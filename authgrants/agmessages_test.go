@@ -6,10 +6,12 @@ import (
 	"net"
 	"sync"
 	"testing"
+	"time"
 
 	"gotest.tools/assert"
 
 	"hop.computer/hop/certs"
+	"hop.computer/hop/core"
 )
 
 func TestAgMessageDenialEncodeDecode(t *testing.T) {
@@ -45,6 +47,8 @@ func TestAgMessageIntentEncodeDecode(t *testing.T) {
 	rand.Read(testKeyPair.public[:])
 	rand.Read(testKeyPair.private[:])
 	msg := getTestCmdIntentRequest(t, "cmd")
+	msg.Data.Intent.MaxUses = 10
+	msg.Data.Intent.MinInterval = 90 * time.Second
 
 	recMsg := new(AgMessage)
 	n, err := msg.WriteTo(b)
@@ -55,10 +59,12 @@ func TestAgMessageIntentEncodeDecode(t *testing.T) {
 	assert.Equal(t, msg.MsgType, recMsg.MsgType)
 	assert.Equal(t, msg.Data.Denial, recMsg.Data.Denial)
 	assert.Equal(t, msg.Data.Intent.GrantType, recMsg.Data.Intent.GrantType)
-	assert.Equal(t, msg.Data.Intent.Reserved, recMsg.Data.Intent.Reserved)
+	assert.Equal(t, msg.Data.Intent.Flags, recMsg.Data.Intent.Flags)
 	assert.Equal(t, msg.Data.Intent.TargetPort, recMsg.Data.Intent.TargetPort)
 	assert.DeepEqual(t, msg.Data.Intent.StartTime, recMsg.Data.Intent.StartTime)
 	assert.DeepEqual(t, msg.Data.Intent.ExpTime, recMsg.Data.Intent.ExpTime)
+	assert.Equal(t, msg.Data.Intent.MaxUses, recMsg.Data.Intent.MaxUses)
+	assert.Equal(t, msg.Data.Intent.MinInterval, recMsg.Data.Intent.MinInterval)
 	assert.DeepEqual(t, msg.Data.Intent.TargetSNI, recMsg.Data.Intent.TargetSNI)
 	assert.Equal(t, msg.Data.Intent.TargetUsername, recMsg.Data.Intent.TargetUsername)
 	buf, err := msg.Data.Intent.DelegateCert.Marshal()
@@ -68,10 +74,50 @@ func TestAgMessageIntentEncodeDecode(t *testing.T) {
 	assert.DeepEqual(t, buf, recBuf)
 }
 
+// TestIntentOptionalFields checks that usage limits and command patterns are
+// only sent when an intent has them, so that other intents keep the format
+// that older peers read
+func TestIntentOptionalFields(t *testing.T) {
+	plain := getTestCmdIntentRequest(t, "cmd").Data.Intent
+	b := &bytes.Buffer{}
+	plainLen, err := plain.WriteTo(b)
+	assert.NilError(t, err)
+	assert.Equal(t, b.Bytes()[1], byte(0))
+
+	limited := plain
+	limited.MaxUses = 3
+	limited.Flags = FlagDelegable
+	b.Reset()
+	n, err := limited.WriteTo(b)
+	assert.NilError(t, err)
+	assert.Equal(t, n, plainLen+6)
+	assert.Equal(t, b.Bytes()[1], FlagDelegable|FlagUsageLimits)
+	var read Intent
+	_, err = read.ReadFrom(b)
+	assert.NilError(t, err)
+	assert.Equal(t, read.Flags, FlagDelegable)
+	assert.Equal(t, read.MaxUses, uint16(3))
+
+	pattern := plain
+	pattern.AssociatedData.CommandGrantData, err = ParseCommandPattern("git fetch *", []string{"-q"})
+	assert.NilError(t, err)
+	b.Reset()
+	_, err = pattern.WriteTo(b)
+	assert.NilError(t, err)
+	assert.Equal(t, b.Bytes()[1], FlagCommandPatterns)
+	read = Intent{}
+	_, err = read.ReadFrom(b)
+	assert.NilError(t, err)
+	assert.Equal(t, read.Flags, byte(0))
+	assert.Equal(t, read.MaxUses, uint16(0))
+	assert.DeepEqual(t, read.AssociatedData.CommandGrantData, pattern.AssociatedData.CommandGrantData)
+}
+
 func TestAgMessageConforDenial(t *testing.T) {
 	c, s := net.Pipe()
 	msg := AgMessage{
 		MsgType: IntentConfirmation,
+		Data:    MessageData{GrantID: 0x0123456789abcdef},
 	}
 
 	wg := sync.WaitGroup{}
@@ -80,7 +126,7 @@ func TestAgMessageConforDenial(t *testing.T) {
 		recmsg, err := ReadConfOrDenial(c)
 		assert.NilError(t, err)
 		assert.Equal(t, msg.MsgType, recmsg.MsgType)
-		assert.Equal(t, msg.MsgType, recmsg.MsgType)
+		assert.Equal(t, msg.Data.GrantID, recmsg.Data.GrantID)
 		wg.Done()
 	}()
 
@@ -89,3 +135,103 @@ func TestAgMessageConforDenial(t *testing.T) {
 
 	wg.Wait()
 }
+
+func TestAgMessagePFIntentEncodeDecode(t *testing.T) {
+	for _, grantType := range []GrantType{LocalPF, RemotePF} {
+		b := &bytes.Buffer{}
+		msg := getTestCmdIntentRequest(t, "")
+		msg.Data.Intent.GrantType = grantType
+		msg.Data.Intent.AssociatedData = GrantData{
+			LocalPFGrantData:  LocalPFGrantData{Network: 1, Address: "127.0.0.1:8080"},
+			RemotePFGrantData: RemotePFGrantData{Network: 3, Address: "/tmp/pf.sock"},
+		}
+
+		recMsg := new(AgMessage)
+		n, err := msg.WriteTo(b)
+		assert.NilError(t, err)
+		m, err := recMsg.ReadFrom(b)
+		assert.NilError(t, err)
+		assert.Equal(t, n, m)
+		assert.Equal(t, recMsg.Data.Intent.GrantType, grantType)
+		if grantType == LocalPF {
+			assert.Equal(t, recMsg.Data.Intent.AssociatedData.LocalPFGrantData, msg.Data.Intent.AssociatedData.LocalPFGrantData)
+		} else {
+			assert.Equal(t, recMsg.Data.Intent.AssociatedData.RemotePFGrantData, msg.Data.Intent.AssociatedData.RemotePFGrantData)
+		}
+	}
+}
+
+func TestAgMessageSubsystemIntentEncodeDecode(t *testing.T) {
+	b := &bytes.Buffer{}
+	msg := getTestCmdIntentRequest(t, "")
+	msg.Data.Intent.GrantType = Subsystem
+	msg.Data.Intent.AssociatedData = GrantData{
+		SubsystemGrantData: SubsystemGrantData{Name: "sftp"},
+	}
+
+	recMsg := new(AgMessage)
+	n, err := msg.WriteTo(b)
+	assert.NilError(t, err)
+	m, err := recMsg.ReadFrom(b)
+	assert.NilError(t, err)
+	assert.Equal(t, n, m)
+	assert.Equal(t, recMsg.Data.Intent.GrantType, Subsystem)
+	assert.Equal(t, recMsg.Data.Intent.AssociatedData.SubsystemGrantData.Name, "sftp")
+}
+
+func TestAgMessageSubGrantEncodeDecode(t *testing.T) {
+	b := &bytes.Buffer{}
+	msg := getTestCmdIntentRequest(t, "cmd")
+	msg.MsgType = IntentSubGrant
+	msg.Data.GrantID = 0x0123456789abcdef
+	msg.Data.Intent.Flags = FlagDelegable
+
+	recMsg := new(AgMessage)
+	n, err := msg.WriteTo(b)
+	assert.NilError(t, err)
+	m, err := recMsg.ReadFrom(b)
+	assert.NilError(t, err)
+	assert.Equal(t, n, m)
+	assert.Equal(t, recMsg.MsgType, IntentSubGrant)
+	assert.Equal(t, recMsg.Data.GrantID, msg.Data.GrantID)
+	assert.Assert(t, recMsg.Data.Intent.Delegable())
+	assert.Equal(t, recMsg.Data.Intent.AssociatedData.CommandGrantData.Cmd, "cmd")
+}
+
+func TestIntentUsageString(t *testing.T) {
+	for _, tc := range []struct {
+		maxUses     uint16
+		minInterval time.Duration
+		usage       string
+	}{
+		{0, 0, "once"},
+		{1, time.Minute, "once"},
+		{10, 0, "up to 10 times"},
+		{10, time.Minute, "up to 10 times, at most once every 1m0s"},
+		{UnlimitedUses, 30 * time.Second, "any number of times, at most once every 30s"},
+	} {
+		i := Intent{MaxUses: tc.maxUses, MinInterval: tc.minInterval}
+		assert.Equal(t, i.UsageString(), tc.usage)
+	}
+}
+
+func TestReadDelegateToken(t *testing.T) {
+	b := &bytes.Buffer{}
+	assert.NilError(t, WriteDelegateToken("secret", b))
+	assert.NilError(t, WriteTargetInfo(core.URL{Host: "target", Port: "7777", User: "user"}, b))
+	token, targetURL, err := ReadDelegateToken(b)
+	assert.NilError(t, err)
+	assert.Equal(t, token, "secret")
+	assert.Assert(t, targetURL == nil)
+	targetURL, err = ReadTargetInfo(b)
+	assert.NilError(t, err)
+	assert.Equal(t, targetURL.Host, "target")
+
+	// Older delegates send their target first and have no token
+	assert.NilError(t, WriteTargetInfo(core.URL{Host: "target", Port: "7777", User: "user"}, b))
+	token, targetURL, err = ReadDelegateToken(b)
+	assert.NilError(t, err)
+	assert.Equal(t, token, "")
+	assert.Equal(t, targetURL.Host, "target")
+	assert.Equal(t, b.Len(), 0)
+}
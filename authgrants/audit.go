@@ -0,0 +1,327 @@
+package authgrants
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"hop.computer/hop/certs"
+	"hop.computer/hop/pkg/thunks"
+)
+
+// Roles that write audit records
+const (
+	AuditPrincipal      = "principal"
+	AuditDelegateServer = "delegate-server"
+	AuditTarget         = "target"
+)
+
+// Audit events
+const (
+	AuditIntentRequest = "intent-request" // a principal decided an intent request
+	AuditProxy         = "proxy"          // a delegate server proxied a delegate to its principal
+	AuditIntent        = "intent"         // a target decided an intent communication
+	AuditGrantAdded    = "grant-added"
+	AuditGrantRevoked  = "grant-revoked"
+	AuditGrantExpired  = "grant-expired"
+	AuditGrantUse      = "grant-use" // a delegate asked to use a grant on a target
+)
+
+// Audit outcomes
+const (
+	AuditGranted = "granted" // the target confirmed the grant
+	AuditDenied  = "denied"  // the role writing the record refused
+	AuditRefused = "refused" // the target refused an intent the principal approved
+	AuditFailed  = "failed"  // an error stopped the request
+	AuditAllowed = "allowed"
+)
+
+// maxAuditRecord is the longest record OpenAuditLog reads back
+const maxAuditRecord = 1 << 20
+
+// AuditRecord is an entry of an authgrant audit log
+type AuditRecord struct {
+	Time    time.Time `json:"time"`
+	Role    string    `json:"role"`
+	Event   string    `json:"event"`
+	Outcome string    `json:"outcome,omitempty"`
+	Reason  string    `json:"reason,omitempty"`
+	Request string    `json:"request,omitempty"` // what a delegate asked to do with a grant
+
+	GrantID GrantID `json:"grant,omitempty"`
+	Parent  GrantID `json:"parent,omitempty"`
+	Uses    uint16  `json:"uses,omitempty"`
+
+	// the intent or grant
+	GrantType string    `json:"type,omitempty"`
+	User      string    `json:"user,omitempty"`
+	Target    string    `json:"target,omitempty"`
+	Action    string    `json:"action,omitempty"`
+	Start     time.Time `json:"start,omitzero"`
+	Expires   time.Time `json:"expires,omitzero"`
+	Limits    string    `json:"limits,omitempty"`
+	Delegable bool      `json:"delegable,omitempty"`
+
+	Delegate     string `json:"delegate,omitempty"` // SHA3 fingerprint of the delegate certificate
+	DelegateName string `json:"delegate_name,omitempty"`
+	Principal    string `json:"principal,omitempty"`
+	PrincipalKey string `json:"principal_key,omitempty"`
+
+	// Prev is the hash of the previous record and Hash the hash of this one,
+	// if the log is chained
+	Prev string `json:"prev,omitempty"`
+	Hash string `json:"hash,omitempty"`
+}
+
+// IntentAuditRecord returns a record of event for i
+func IntentAuditRecord(role, event string, i *Intent) AuditRecord {
+	r := AuditRecord{
+		Role:      role,
+		Event:     event,
+		GrantType: i.GrantType.String(),
+		User:      i.TargetUsername,
+		Target:    i.TargetURL().String(),
+		Action:    grantAction(i.GrantType, &i.AssociatedData),
+		Start:     i.StartTime.UTC(),
+		Expires:   i.ExpTime.UTC(),
+		Limits:    i.UsageString(),
+		Delegable: i.Delegable(),
+	}
+	r.SetDelegate(&i.DelegateCert)
+	return r
+}
+
+// GrantAuditRecord returns a record of event for ag
+func GrantAuditRecord(role, event string, ag *Authgrant) AuditRecord {
+	r := AuditRecord{
+		Role:      role,
+		Event:     event,
+		GrantID:   ag.ID,
+		Parent:    ag.Parent,
+		Uses:      ag.Uses,
+		GrantType: ag.GrantType.String(),
+		User:      ag.User,
+		Target:    ag.TargetSNI.String(),
+		Action:    grantAction(ag.GrantType, &ag.AssociatedData),
+		Start:     ag.StartTime.UTC(),
+		Expires:   ag.ExpTime.UTC(),
+		Limits:    ag.UsageString(),
+		Delegable: ag.Delegable,
+	}
+	r.SetDelegate(&ag.DelegateCert)
+	if len(ag.Chain) > 0 {
+		r.PrincipalKey = ag.Chain[0].String()
+	}
+	return r
+}
+
+// SetDelegate records c as the certificate of the delegate
+func (r *AuditRecord) SetDelegate(c *certs.Certificate) {
+	if c == nil {
+		return
+	}
+	r.Delegate, r.DelegateName = certIdentity(c)
+}
+
+// SetPrincipal records c as the certificate of the principal
+func (r *AuditRecord) SetPrincipal(c *certs.Certificate) {
+	if c == nil {
+		return
+	}
+	r.Principal, _ = certIdentity(c)
+	r.PrincipalKey = c.PublicKey.String()
+}
+
+// certIdentity returns the fingerprint of c, if it is known, and its first
+// name
+func certIdentity(c *certs.Certificate) (fingerprint, name string) {
+	if c.Fingerprint != (certs.SHA3Fingerprint{}) {
+		fingerprint = hex.EncodeToString(c.Fingerprint[:])
+	}
+	if len(c.IDChunk.Blocks) > 0 {
+		name = c.IDChunk.Blocks[0].String()
+	}
+	return fingerprint, name
+}
+
+// grantAction describes what a grant of grantType with data allows
+func grantAction(grantType GrantType, data *GrantData) string {
+	switch grantType {
+	case Command:
+		return data.CommandGrantData.String()
+	case LocalPF:
+		return data.LocalPFGrantData.Address
+	case RemotePF:
+		return data.RemotePFGrantData.Address
+	case FileRead, FileWrite:
+		return data.FileGrantData.String()
+	case Subsystem:
+		return data.SubsystemGrantData.Name
+	}
+	return ""
+}
+
+// hash returns the hash of r, leaving out its Hash
+func (r AuditRecord) hash() (string, error) {
+	r.Hash = ""
+	b, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// AuditLog appends records of authgrant decisions to a file as JSON lines.
+// If it is chained, every record holds the hash of the record before it and
+// its own hash, so that changing, removing or reordering records breaks the
+// chain. A nil *AuditLog discards records.
+type AuditLog struct {
+	// +checklocks:lock
+	w io.Writer
+	// +checklocks:lock
+	last    string // hash of the last record, if chained
+	chained bool
+	lock    sync.Mutex
+}
+
+// NewAuditLog returns a log that writes records to w
+func NewAuditLog(w io.Writer, chained bool) *AuditLog {
+	return &AuditLog{w: w, chained: chained}
+}
+
+// OpenAuditLog returns a log that appends records to the file at path. The
+// file is created if it does not exist. A chained log continues the chain of
+// the records already in the file.
+func OpenAuditLog(path string, chained bool) (*AuditLog, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	l := NewAuditLog(f, chained)
+	if !chained {
+		return l, nil
+	}
+	var last *AuditRecord
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, maxAuditRecord)
+	for s.Scan() {
+		if len(s.Bytes()) == 0 {
+			continue
+		}
+		last = &AuditRecord{}
+		if err := json.Unmarshal(s.Bytes(), last); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if err := s.Err(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if last != nil && last.Hash == "" {
+		f.Close()
+		return nil, fmt.Errorf("%s: the log is not chained", path)
+	}
+	if last != nil {
+		l.lock.Lock()
+		l.last = last.Hash
+		l.lock.Unlock()
+	}
+	return l, nil
+}
+
+// Record stamps r with the current time, chains it if the log is chained,
+// and appends it to the log. Errors are logged, so that an unwritable log
+// does not stop authgrants from working.
+func (l *AuditLog) Record(r AuditRecord) {
+	if l == nil {
+		return
+	}
+	if err := l.write(r); err != nil {
+		logrus.Errorf("authgrants: unable to write audit record: %s", err)
+	}
+}
+
+func (l *AuditLog) write(r AuditRecord) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	r.Time = thunks.TimeNow().UTC()
+	r.Prev, r.Hash = "", ""
+	if l.chained {
+		r.Prev = l.last
+		hash, err := r.hash()
+		if err != nil {
+			return err
+		}
+		r.Hash = hash
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err := l.w.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	l.last = r.Hash
+	return nil
+}
+
+// Close closes the file of the log, if it has one
+func (l *AuditLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if c, ok := l.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// ErrAuditChainBroken is returned when a chained audit log was tampered with
+var ErrAuditChainBroken = errors.New("audit log chain is broken")
+
+// VerifyAuditLog checks the chain of a chained audit log read from r, and
+// returns how many records it holds
+func VerifyAuditLog(r io.Reader) (int, error) {
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, maxAuditRecord)
+	n := 0
+	last := ""
+	for s.Scan() {
+		if len(s.Bytes()) == 0 {
+			continue
+		}
+		n++
+		var rec AuditRecord
+		if err := json.Unmarshal(s.Bytes(), &rec); err != nil {
+			return n - 1, fmt.Errorf("record %d: %w", n, err)
+		}
+		if rec.Hash == "" {
+			return n - 1, fmt.Errorf("%w: record %d is not chained", ErrAuditChainBroken, n)
+		}
+		if rec.Prev != last {
+			return n - 1, fmt.Errorf("%w: record %d does not follow record %d", ErrAuditChainBroken, n, n-1)
+		}
+		hash, err := rec.hash()
+		if err != nil {
+			return n - 1, fmt.Errorf("record %d: %w", n, err)
+		}
+		if hash != rec.Hash {
+			return n - 1, fmt.Errorf("%w: record %d was changed", ErrAuditChainBroken, n)
+		}
+		last = rec.Hash
+	}
+	return n, s.Err()
+}
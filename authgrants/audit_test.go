@@ -0,0 +1,92 @@
+package authgrants
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestAuditLogChain(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := NewAuditLog(buf, true)
+	for _, cmd := range []string{"cmd1", "cmd2", "cmd3"} {
+		i := getTestCmdIntentRequest(t, cmd).Data.Intent
+		r := IntentAuditRecord(AuditPrincipal, AuditIntentRequest, &i)
+		r.Outcome = AuditGranted
+		l.Record(r)
+	}
+	n, err := VerifyAuditLog(bytes.NewReader(buf.Bytes()))
+	assert.NilError(t, err)
+	assert.Equal(t, n, 3)
+
+	lines := strings.SplitAfter(buf.String(), "\n")
+	changed := strings.Replace(buf.String(), `"action":"cmd2"`, `"action":"cmd9"`, 1)
+	removed := lines[0] + lines[2]
+	reordered := lines[0] + lines[2] + lines[1]
+	for _, tampered := range []string{changed, removed, reordered} {
+		_, err := VerifyAuditLog(strings.NewReader(tampered))
+		assert.Assert(t, errors.Is(err, ErrAuditChainBroken))
+	}
+
+	unchained := &bytes.Buffer{}
+	NewAuditLog(unchained, false).Record(AuditRecord{Role: AuditTarget, Event: AuditGrantAdded})
+	_, err = VerifyAuditLog(unchained)
+	assert.Assert(t, errors.Is(err, ErrAuditChainBroken))
+}
+
+func TestOpenAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := OpenAuditLog(path, true)
+	assert.NilError(t, err)
+	l.Record(AuditRecord{Role: AuditTarget, Event: AuditGrantAdded})
+	assert.NilError(t, l.Close())
+
+	l, err = OpenAuditLog(path, true)
+	assert.NilError(t, err)
+	l.Record(AuditRecord{Role: AuditTarget, Event: AuditGrantRevoked})
+	assert.NilError(t, l.Close())
+
+	f, err := os.Open(path)
+	assert.NilError(t, err)
+	defer f.Close()
+	n, err := VerifyAuditLog(f)
+	assert.NilError(t, err)
+	assert.Equal(t, n, 2)
+
+	unchained := filepath.Join(t.TempDir(), "unchained.log")
+	l, err = OpenAuditLog(unchained, false)
+	assert.NilError(t, err)
+	l.Record(AuditRecord{Role: AuditTarget, Event: AuditGrantAdded})
+	assert.NilError(t, l.Close())
+	_, err = OpenAuditLog(unchained, true)
+	assert.ErrorContains(t, err, "not chained")
+}
+
+func TestAuthgrantMapAudit(t *testing.T) {
+	buf := &bytes.Buffer{}
+	m := NewAuthgrantMapSync()
+	m.SetAuditLog(NewAuditLog(buf, false))
+
+	i := getTestCmdIntentRequest(t, "ls").Data.Intent
+	ag, err := m.AddAuthGrant(&i, 0, &i.DelegateCert.PublicKey)
+	assert.NilError(t, err)
+	_, err = m.RemoveAuthgrant(ag.ID, "")
+	assert.NilError(t, err)
+
+	events := []string{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var r AuditRecord
+		assert.NilError(t, json.Unmarshal([]byte(line), &r))
+		assert.Equal(t, r.GrantID, ag.ID)
+		assert.Equal(t, r.Action, "ls")
+		assert.Equal(t, r.PrincipalKey, i.DelegateCert.PublicKey.String())
+		events = append(events, r.Event)
+	}
+	assert.DeepEqual(t, events, []string{AuditGrantAdded, AuditGrantRevoked})
+}
@@ -1,32 +1,117 @@
 package authgrants
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
+	"github.com/sirupsen/logrus"
+
 	"hop.computer/hop/certs"
 	"hop.computer/hop/keys"
+	"hop.computer/hop/pkg/thunks"
 )
 
 // PrincipalID identifier used to keep track of granting principal
 type PrincipalID uint32
 
+// GrantID identifies an authgrant on the target. The target assigns it when
+// it accepts an intent, and principals and admins revoke grants by ID.
+type GrantID uint64
+
+// String formats id as hex
+func (id GrantID) String() string {
+	return fmt.Sprintf("%016x", uint64(id))
+}
+
+// MarshalText implements encoding.TextMarshaler
+func (id GrantID) MarshalText() ([]byte, error) {
+	return []byte(id.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler
+func (id *GrantID) UnmarshalText(text []byte) error {
+	parsed, err := ParseGrantID(string(text))
+	if err != nil {
+		return err
+	}
+	*id = parsed
+	return nil
+}
+
+// ParseGrantID parses a GrantID formatted by GrantID.String
+func ParseGrantID(s string) (GrantID, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 8 {
+		return 0, fmt.Errorf("invalid grant ID %q", s)
+	}
+	return GrantID(binary.BigEndian.Uint64(b)), nil
+}
+
+// newGrantID returns a random GrantID
+func newGrantID() GrantID {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err.Error())
+	}
+	return GrantID(binary.BigEndian.Uint64(b[:]))
+}
+
 // Authgrant holds just the information needed to be stored on target
 type Authgrant struct {
+	ID             GrantID
+	User           string
 	GrantType      GrantType
 	StartTime      time.Time
 	ExpTime        time.Time
+	MaxUses        uint16        // as in Intent
+	MinInterval    time.Duration // as in Intent
+	Uses           uint16        // how many times the grant was used, or reserved by sub-grants
+	LastUsed       time.Time
+	TargetSNI      certs.Name
+	Delegable      bool // the delegate may pass on sub-grants
 	DelegateCert   certs.Certificate
 	AssociatedData GrantData
 	PrincipalID    PrincipalID
+
+	// Parent is the grant this is a sub-grant of, or 0
+	Parent GrantID
+	// Chain holds the keys that issued the grant: the principal, followed by
+	// the delegate of every ancestor. It is empty if the principal is unknown.
+	Chain []keys.DHPublicKey
 }
 
-// AuthgrantMapSync holds current authgrants
+// UsageString describes the usage limits of ag, as Intent.UsageString
+func (ag *Authgrant) UsageString() string {
+	return usageString(ag.MaxUses, ag.MinInterval)
+}
+
+// UsedUp reports whether ag was used as many times as it allows. Uses
+// reserved for sub-grants count as uses of ag.
+func (ag *Authgrant) UsedUp() bool {
+	return ag.MaxUses != UnlimitedUses && ag.Uses >= max(ag.MaxUses, 1)
+}
+
+// AuthgrantMapSync holds current authgrants. Grants stay in the map until
+// they are used up, revoked or expire, and their sub-grants leave the map with
+// them. A used up grant stays while it has sub-grants, so that their chain can
+// be checked. If the map has a store path, it is saved there on every change.
 type AuthgrantMapSync struct {
 	// +checklocks:agLock
-	agMap  map[string]map[keys.DHPublicKey][]Authgrant
+	agMap map[string]map[keys.DHPublicKey][]Authgrant
+	// +checklocks:agLock
+	path   string
 	agLock sync.Mutex
+
+	audit *AuditLog
 }
 
 // NewAuthgrantMapSync creates a new map
@@ -37,38 +122,419 @@ func NewAuthgrantMapSync() *AuthgrantMapSync {
 	}
 }
 
-// AddAuthGrant adds a new authgrant to the map
-func (m *AuthgrantMapSync) AddAuthGrant(i *Intent, p PrincipalID) {
+// OpenAuthgrantMapSync returns a map saved to the store at path, holding the
+// unexpired grants already in the store. The store is created if it does not
+// exist.
+func OpenAuthgrantMapSync(path string) (*AuthgrantMapSync, error) {
+	m := NewAuthgrantMapSync()
 	m.agLock.Lock()
 	defer m.agLock.Unlock()
-	user := i.TargetUsername
-	if _, ok := m.agMap[user]; !ok {
-		m.agMap[user] = make(map[keys.DHPublicKey][]Authgrant)
+	m.path = path
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return m, m.saveLocked()
 	}
-	ag := newAuthgrant(i, p)
-	m.agMap[user][i.DelegateCert.PublicKey] = append(m.agMap[user][i.DelegateCert.PublicKey], ag)
+	if err != nil {
+		return nil, err
+	}
+	var stored []storedAuthgrant
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for _, s := range stored {
+		ag, err := s.authgrant()
+		if err != nil {
+			return nil, fmt.Errorf("%s: grant %s: %w", path, s.ID, err)
+		}
+		m.addLocked(ag)
+	}
+	if m.removeExpiredLocked() {
+		return m, m.saveLocked()
+	}
+	return m, nil
+}
+
+// SetAuditLog makes the map record grants that are added, revoked or expire
+// to l. It must be called before the map is used.
+func (m *AuthgrantMapSync) SetAuditLog(l *AuditLog) {
+	m.audit = l
 }
 
-// RemoveAuthgrants removes and returns authgrants for user:key if they exist
-func (m *AuthgrantMapSync) RemoveAuthgrants(user string, key keys.DHPublicKey) ([]Authgrant, error) {
+// record adds a record of event for ag to the audit log of the map
+func (m *AuthgrantMapSync) record(event string, ag *Authgrant) {
+	if m.audit != nil {
+		m.audit.Record(GrantAuditRecord(AuditTarget, event, ag))
+	}
+}
+
+// AddAuthGrant adds a new authgrant to the map and returns it. principal is
+// the key of the principal that issued it, if known.
+func (m *AuthgrantMapSync) AddAuthGrant(i *Intent, p PrincipalID, principal *keys.DHPublicKey) (Authgrant, error) {
 	m.agLock.Lock()
 	defer m.agLock.Unlock()
+	m.removeExpiredLocked()
+	ag := newAuthgrant(i, p)
+	if principal != nil {
+		ag.Chain = []keys.DHPublicKey{*principal}
+	}
+	m.addLocked(ag)
+	m.record(AuditGrantAdded, &ag)
+	return ag, m.saveLocked()
+}
+
+// +checklocks:m.agLock
+func (m *AuthgrantMapSync) addLocked(ag Authgrant) {
+	if _, ok := m.agMap[ag.User]; !ok {
+		m.agMap[ag.User] = make(map[keys.DHPublicKey][]Authgrant)
+	}
+	key := ag.DelegateCert.PublicKey
+	m.agMap[ag.User][key] = append(m.agMap[ag.User][key], ag)
+}
 
-	if ags, ok := m.agMap[user]; ok { // if user has any authgrants
-		if val, ok := ags[key]; ok { // if key has an entry
-			delete(ags, key) // remove from server mapping
-			return val, nil
+// Authgrants returns the unexpired authgrants for user:key that have uses
+// left, leaving them in the map. Use UseAuthgrant to record a use of a grant.
+func (m *AuthgrantMapSync) Authgrants(user string, key keys.DHPublicKey) ([]Authgrant, error) {
+	m.agLock.Lock()
+	defer m.agLock.Unlock()
+	m.gcLocked()
+	var ags []Authgrant
+	for _, ag := range m.agMap[user][key] {
+		if !ag.UsedUp() {
+			ags = append(ags, ag)
 		}
 	}
+	if len(ags) > 0 {
+		return ags, nil
+	}
 	return []Authgrant{}, fmt.Errorf("no authgrant for user %s found for provided key", user)
 }
 
+// RemoveAuthgrant revokes the authgrant with id and its sub-grants, and
+// returns them, starting with the grant with id. If user is not empty, the
+// grant must be for user. Other grants for the same key are kept.
+func (m *AuthgrantMapSync) RemoveAuthgrant(id GrantID, user string) ([]Authgrant, error) {
+	m.agLock.Lock()
+	defer m.agLock.Unlock()
+	for u := range m.agMap {
+		if user != "" && u != user {
+			continue
+		}
+		removed, ok := m.dropLocked(u, func(ag *Authgrant) bool { return ag.ID == id })
+		if !ok {
+			continue
+		}
+		for n := range removed {
+			m.record(AuditGrantRevoked, &removed[n])
+		}
+		return removed, m.saveLocked()
+	}
+	return nil, ErrNoAuthgrant
+}
+
+// UseAuthgrant records a use of the authgrant with id for user, and returns
+// the updated grant. The grant is removed once it is used up. It errors with
+// ErrNoAuthgrant if the grant was used up, revoked or expired, with
+// ErrAuthgrantNotStarted before its start time, and with
+// ErrAuthgrantRateLimited if it was last used less than its MinInterval ago.
+func (m *AuthgrantMapSync) UseAuthgrant(id GrantID, user string) (Authgrant, error) {
+	m.agLock.Lock()
+	defer m.agLock.Unlock()
+	m.gcLocked()
+	now := thunks.TimeNow()
+	key, n, ok := m.findLocked(user, id)
+	if !ok {
+		return Authgrant{}, ErrNoAuthgrant
+	}
+	ag := &m.agMap[user][key][n]
+	if ag.UsedUp() {
+		// its sub-grants hold the uses it has left
+		return Authgrant{}, ErrNoAuthgrant
+	}
+	if now.Before(ag.StartTime) {
+		return *ag, ErrAuthgrantNotStarted
+	}
+	if ag.Uses > 0 && now.Sub(ag.LastUsed) < ag.MinInterval {
+		return *ag, ErrAuthgrantRateLimited
+	}
+	ag.Uses++
+	ag.LastUsed = now
+	used := *ag
+	if used.UsedUp() && !m.hasSubGrantsLocked(user, id) {
+		m.dropLocked(user, func(ag *Authgrant) bool { return ag.ID == id })
+	}
+	return used, m.saveLocked()
+}
+
+// findLocked returns the key and index of the grant with id for user
+// +checklocks:m.agLock
+func (m *AuthgrantMapSync) findLocked(user string, id GrantID) (keys.DHPublicKey, int, bool) {
+	for key, ags := range m.agMap[user] {
+		for n := range ags {
+			if ags[n].ID == id {
+				return key, n, true
+			}
+		}
+	}
+	return keys.DHPublicKey{}, 0, false
+}
+
+// +checklocks:m.agLock
+func (m *AuthgrantMapSync) removeLocked(user string, key keys.DHPublicKey, n int) {
+	ags := m.agMap[user][key]
+	ags = append(ags[:n:n], ags[n+1:]...)
+	if len(ags) > 0 {
+		m.agMap[user][key] = ags
+		return
+	}
+	delete(m.agMap[user], key)
+	if len(m.agMap[user]) == 0 {
+		delete(m.agMap, user)
+	}
+}
+
+// dropLocked removes the first grant of user that matches together with its
+// sub-grants, and returns them, starting with that grant. Ancestors that are
+// used up and have no sub-grants left are removed too.
+// +checklocks:m.agLock
+func (m *AuthgrantMapSync) dropLocked(user string, match func(*Authgrant) bool) ([]Authgrant, bool) {
+	ag, ok := m.takeLocked(user, match)
+	if !ok {
+		return nil, false
+	}
+	removed := append([]Authgrant{ag}, m.removeSubGrantsLocked(user, ag.ID)...)
+	for parent := ag.Parent; parent != 0; {
+		p, ok := m.lookupLocked(user, parent)
+		if !ok || !p.UsedUp() || m.hasSubGrantsLocked(user, parent) {
+			break
+		}
+		m.takeLocked(user, func(ag *Authgrant) bool { return ag.ID == parent })
+		parent = p.Parent
+	}
+	return removed, true
+}
+
+// hasSubGrantsLocked reports whether the grant with id for user has
+// sub-grants
+// +checklocks:m.agLock
+func (m *AuthgrantMapSync) hasSubGrantsLocked(user string, id GrantID) bool {
+	for _, ags := range m.agMap[user] {
+		for n := range ags {
+			if ags[n].Parent == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// removeSubGrantsLocked removes the sub-grants of the grant with parent for
+// user, and their sub-grants in turn, and returns them
+// +checklocks:m.agLock
+func (m *AuthgrantMapSync) removeSubGrantsLocked(user string, parent GrantID) []Authgrant {
+	var removed []Authgrant
+	for {
+		sub, ok := m.takeLocked(user, func(ag *Authgrant) bool { return ag.Parent == parent })
+		if !ok {
+			return removed
+		}
+		removed = append(removed, sub)
+		removed = append(removed, m.removeSubGrantsLocked(user, sub.ID)...)
+	}
+}
+
+// takeLocked removes and returns the first grant of user that matches
+// +checklocks:m.agLock
+func (m *AuthgrantMapSync) takeLocked(user string, match func(*Authgrant) bool) (Authgrant, bool) {
+	for key, ags := range m.agMap[user] {
+		for n := range ags {
+			if match(&ags[n]) {
+				ag := ags[n]
+				m.removeLocked(user, key, n)
+				return ag, true
+			}
+		}
+	}
+	return Authgrant{}, false
+}
+
+// List returns the unexpired authgrants for user, or for every user if user
+// is empty
+func (m *AuthgrantMapSync) List(user string) []Authgrant {
+	m.agLock.Lock()
+	defer m.agLock.Unlock()
+	m.gcLocked()
+	out := []Authgrant{}
+	for u, byKey := range m.agMap {
+		if user != "" && u != user {
+			continue
+		}
+		for _, ags := range byKey {
+			out = append(out, ags...)
+		}
+	}
+	return out
+}
+
+// HasKey reports whether any user has an authgrant with uses left for key
+func (m *AuthgrantMapSync) HasKey(key keys.DHPublicKey) bool {
+	m.agLock.Lock()
+	defer m.agLock.Unlock()
+	for _, byKey := range m.agMap {
+		for _, ag := range byKey[key] {
+			if !ag.UsedUp() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// removeExpiredLocked removes expired grants and their sub-grants, and
+// reports whether there were any
+// +checklocks:m.agLock
+func (m *AuthgrantMapSync) removeExpiredLocked() bool {
+	now := thunks.TimeNow()
+	removed := false
+	for user := range m.agMap {
+		for {
+			expired, ok := m.dropLocked(user, func(ag *Authgrant) bool { return !now.Before(ag.ExpTime) })
+			if !ok {
+				break
+			}
+			for n := range expired {
+				m.record(AuditGrantExpired, &expired[n])
+			}
+			removed = true
+		}
+	}
+	return removed
+}
+
+// gcLocked removes expired grants and saves the map if there were any
+// +checklocks:m.agLock
+func (m *AuthgrantMapSync) gcLocked() {
+	if !m.removeExpiredLocked() {
+		return
+	}
+	if err := m.saveLocked(); err != nil {
+		logrus.Errorf("authgrants: unable to save store %s: %s", m.path, err)
+	}
+}
+
+// storedAuthgrant is the representation of an Authgrant in the store
+type storedAuthgrant struct {
+	ID             GrantID
+	User           string
+	GrantType      GrantType
+	StartTime      time.Time
+	ExpTime        time.Time
+	MaxUses        uint16
+	MinInterval    time.Duration
+	Uses           uint16
+	LastUsed       time.Time
+	TargetSNI      certs.Name
+	Delegable      bool
+	DelegateCert   []byte
+	AssociatedData GrantData
+	PrincipalID    PrincipalID
+	Parent         GrantID
+	Chain          []keys.DHPublicKey
+}
+
+func (s *storedAuthgrant) authgrant() (Authgrant, error) {
+	ag := Authgrant{
+		ID:             s.ID,
+		User:           s.User,
+		GrantType:      s.GrantType,
+		StartTime:      s.StartTime,
+		ExpTime:        s.ExpTime,
+		MaxUses:        s.MaxUses,
+		MinInterval:    s.MinInterval,
+		Uses:           s.Uses,
+		LastUsed:       s.LastUsed,
+		TargetSNI:      s.TargetSNI,
+		Delegable:      s.Delegable,
+		AssociatedData: s.AssociatedData,
+		PrincipalID:    s.PrincipalID,
+		Parent:         s.Parent,
+		Chain:          s.Chain,
+	}
+	_, err := ag.DelegateCert.ReadFrom(bytes.NewReader(s.DelegateCert))
+	return ag, err
+}
+
+// saveLocked writes the map to its store, if it has one. The store is
+// replaced atomically, so a crash never leaves it half written.
+// +checklocks:m.agLock
+func (m *AuthgrantMapSync) saveLocked() error {
+	if m.path == "" {
+		return nil
+	}
+	stored := []storedAuthgrant{}
+	for _, byKey := range m.agMap {
+		for _, ags := range byKey {
+			for _, ag := range ags {
+				cert, err := ag.DelegateCert.Marshal()
+				if err != nil {
+					return err
+				}
+				stored = append(stored, storedAuthgrant{
+					ID:             ag.ID,
+					User:           ag.User,
+					GrantType:      ag.GrantType,
+					StartTime:      ag.StartTime,
+					ExpTime:        ag.ExpTime,
+					MaxUses:        ag.MaxUses,
+					MinInterval:    ag.MinInterval,
+					Uses:           ag.Uses,
+					LastUsed:       ag.LastUsed,
+					TargetSNI:      ag.TargetSNI,
+					Delegable:      ag.Delegable,
+					DelegateCert:   cert,
+					AssociatedData: ag.AssociatedData,
+					PrincipalID:    ag.PrincipalID,
+					Parent:         ag.Parent,
+					Chain:          ag.Chain,
+				})
+			}
+		}
+	}
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(m.path), filepath.Base(m.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), m.path)
+}
+
 // newAuthgrant returns authgrant built from an intent obj
 func newAuthgrant(i *Intent, p PrincipalID) Authgrant {
 	return Authgrant{
+		ID:             newGrantID(),
+		User:           i.TargetUsername,
 		GrantType:      i.GrantType,
 		StartTime:      i.StartTime,
 		ExpTime:        i.ExpTime,
+		MaxUses:        i.MaxUses,
+		MinInterval:    i.MinInterval,
+		TargetSNI:      i.TargetSNI,
+		Delegable:      i.Delegable(),
 		DelegateCert:   i.DelegateCert,
 		AssociatedData: i.AssociatedData,
 		PrincipalID:    p,
@@ -1,16 +1,23 @@
 package authgrants
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"gotest.tools/assert"
 
 	"hop.computer/hop/certs"
 	"hop.computer/hop/core"
+	"hop.computer/hop/pkg/thunks"
 )
 
 func TestFlow(t *testing.T) {
@@ -42,30 +49,235 @@ func TestFlow(t *testing.T) {
 	correctApprovals := []string{"cmd1", "cmd3"}
 	approved := []string{}
 
-	addag := func(i *Intent) error {
+	addag := func(i *Intent) (GrantID, error) {
 		logrus.Infof("target: adding ag for %s", i.TargetUsername)
 		approved = append(approved, i.AssociatedData.CommandGrantData.Cmd)
-		return nil
+		return GrantID(len(approved)), nil
 	}
 
+	audit := &bytes.Buffer{}
+
 	wg := sync.WaitGroup{}
 	wg.Add(2)
 
 	go func() {
-		StartTargetInstance(tcT, nil, ciFuncTarget, addag)
+		StartTargetInstance(tcT, nil, ciFuncTarget, addag, nil, nil)
 		wg.Done()
 	}()
 
 	go func() {
-		StartPrincipalInstance(pcP, ciFuncPrincipal, setupTarg)
+		StartPrincipalInstance(pcP, ciFuncPrincipal, setupTarg, NewAuditLog(audit, false), nil)
 		tc.Close()
 		wg.Done()
 	}()
 
-	err := StartDelegateInstance(pc, []Intent{ir1.Data.Intent, ir2.Data.Intent, ir3.Data.Intent})
+	granted, err := StartDelegateInstance(pc, []Intent{ir1.Data.Intent, ir2.Data.Intent, ir3.Data.Intent})
 	assert.NilError(t, err)
 	pc.Close()
 
 	wg.Wait()
 	assert.DeepEqual(t, correctApprovals, approved)
+	assert.Equal(t, len(granted), 2)
+	assert.Equal(t, granted[0].ID, GrantID(1))
+	assert.Equal(t, granted[1].AssociatedData.CommandGrantData.Cmd, "cmd3")
+
+	outcomes := []string{}
+	for _, line := range strings.Split(strings.TrimSpace(audit.String()), "\n") {
+		var r AuditRecord
+		assert.NilError(t, json.Unmarshal([]byte(line), &r))
+		assert.Equal(t, r.Role, AuditPrincipal)
+		outcomes = append(outcomes, r.Outcome+" "+r.Action)
+	}
+	assert.DeepEqual(t, outcomes, []string{"granted cmd1", "refused cmd2", "granted cmd3"})
+}
+
+func TestChainedFlow(t *testing.T) {
+	pc, pcP := net.Pipe() // principal conn (delegate, chained principal)
+	tc, tcT := net.Pipe() // target conn (chained principal, target)
+
+	heldIntent := getTestCmdIntentRequest(t, "deploy").Data.Intent
+	held := newAuthgrant(&heldIntent, 0)
+	held.Delegable = true
+	parentFor := func(i Intent) (GrantID, bool) {
+		return held.ID, held.Attenuates(&i) == nil
+	}
+	setupTarg := func(u core.URL, verify AdditionalVerifyCallback) (net.Conn, error) {
+		return tc, verify(nil)
+	}
+
+	parents := []GrantID{}
+	addSub := func(parent GrantID, i *Intent) (GrantID, error) {
+		parents = append(parents, parent)
+		return 7, nil
+	}
+
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		StartTargetInstance(tcT, nil, nil, nil, nil, addSub)
+		wg.Done()
+	}()
+	go func() {
+		StartChainedPrincipalInstance(pcP, insecureAcceptAll, parentFor, setupTarg, nil, nil)
+		tc.Close()
+		wg.Done()
+	}()
+
+	ir := heldIntent
+	denied := heldIntent
+	denied.AssociatedData.CommandGrantData.Cmd = "rm -rf /"
+	granted, err := StartDelegateInstance(pc, []Intent{ir, denied})
+	assert.NilError(t, err)
+	pc.Close()
+
+	wg.Wait()
+	assert.DeepEqual(t, parents, []GrantID{held.ID})
+	assert.Equal(t, len(granted), 1)
+	assert.Equal(t, granted[0].ID, GrantID(7))
+}
+
+func TestRevoke(t *testing.T) {
+	pc, tc := net.Pipe()
+	revoked := []GrantID{}
+	revoke := func(id GrantID) error {
+		if id != 7 {
+			return ErrNoAuthgrant
+		}
+		revoked = append(revoked, id)
+		return nil
+	}
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		StartTargetInstance(tc, nil, nil, nil, revoke, nil)
+		wg.Done()
+	}()
+
+	assert.NilError(t, RevokeAuthgrant(pc, 7))
+	assert.ErrorContains(t, RevokeAuthgrant(pc, 8), ErrNoAuthgrant.Error())
+	pc.Close()
+	wg.Wait()
+	assert.DeepEqual(t, revoked, []GrantID{7})
+}
+
+func TestAuthgrantMapStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "authgrants.json")
+	m, err := OpenAuthgrantMapSync(path)
+	assert.NilError(t, err)
+
+	i1 := getTestCmdIntentRequest(t, "cmd1").Data.Intent
+	i2 := i1
+	i2.AssociatedData.CommandGrantData.Cmd = "cmd2"
+	expired := i1
+	expired.ExpTime = time.Now().Add(-time.Minute)
+	ag1, err := m.AddAuthGrant(&i1, 1, nil)
+	assert.NilError(t, err)
+	ag2, err := m.AddAuthGrant(&i2, 1, nil)
+	assert.NilError(t, err)
+	_, err = m.AddAuthGrant(&expired, 1, nil)
+	assert.NilError(t, err)
+	key := i1.DelegateCert.PublicKey
+
+	// Removing one grant keeps the others for the key
+	_, err = m.RemoveAuthgrant(ag1.ID, "other")
+	assert.Assert(t, errors.Is(err, ErrNoAuthgrant))
+	removed, err := m.RemoveAuthgrant(ag1.ID, "user")
+	assert.NilError(t, err)
+	assert.Equal(t, len(removed), 1)
+	assert.Equal(t, removed[0].AssociatedData.CommandGrantData.Cmd, "cmd1")
+	_, err = m.RemoveAuthgrant(ag1.ID, "")
+	assert.Assert(t, errors.Is(err, ErrNoAuthgrant))
+	assert.Assert(t, m.HasKey(key))
+
+	// The store keeps unexpired grants across a reload
+	reloaded, err := OpenAuthgrantMapSync(path)
+	assert.NilError(t, err)
+	ags, err := reloaded.Authgrants("user", key)
+	assert.NilError(t, err)
+	assert.Equal(t, len(ags), 1)
+	assert.Equal(t, ags[0].ID, ag2.ID)
+	assert.Equal(t, ags[0].AssociatedData.CommandGrantData.Cmd, "cmd2")
+	assert.Equal(t, ags[0].ExpTime.Unix(), i2.ExpTime.Unix())
+	assert.Equal(t, len(reloaded.List("")), 1)
+	assert.Equal(t, len(reloaded.List("other")), 0)
+
+	_, err = reloaded.RemoveAuthgrant(ag2.ID, "")
+	assert.NilError(t, err)
+	assert.Assert(t, !reloaded.HasKey(key))
+	_, err = reloaded.Authgrants("user", key)
+	assert.Assert(t, err != nil)
+}
+
+func TestUseAuthgrant(t *testing.T) {
+	now := time.Now()
+	thunks.TimeNow = func() time.Time { return now }
+	defer func() { thunks.TimeNow = time.Now }()
+
+	m := NewAuthgrantMapSync()
+	once := getTestCmdIntentRequest(t, "once").Data.Intent
+	limited := once
+	limited.AssociatedData.CommandGrantData.Cmd = "limited"
+	limited.MaxUses = 3
+	limited.MinInterval = time.Minute
+	agOnce, err := m.AddAuthGrant(&once, 0, nil)
+	assert.NilError(t, err)
+	agLimited, err := m.AddAuthGrant(&limited, 0, nil)
+	assert.NilError(t, err)
+
+	used, err := m.UseAuthgrant(agOnce.ID, "user")
+	assert.NilError(t, err)
+	assert.Assert(t, used.UsedUp())
+	_, err = m.UseAuthgrant(agOnce.ID, "user")
+	assert.Assert(t, errors.Is(err, ErrNoAuthgrant))
+
+	_, err = m.UseAuthgrant(agLimited.ID, "other")
+	assert.Assert(t, errors.Is(err, ErrNoAuthgrant))
+	for n := uint16(1); n <= 3; n++ {
+		used, err = m.UseAuthgrant(agLimited.ID, "user")
+		assert.NilError(t, err)
+		assert.Equal(t, used.Uses, n)
+		// Uses must be a minute apart
+		_, err = m.UseAuthgrant(agLimited.ID, "user")
+		if n < 3 {
+			assert.Assert(t, errors.Is(err, ErrAuthgrantRateLimited))
+		}
+		now = now.Add(time.Minute)
+	}
+	_, err = m.UseAuthgrant(agLimited.ID, "user")
+	assert.Assert(t, errors.Is(err, ErrNoAuthgrant))
+	assert.Assert(t, !m.HasKey(once.DelegateCert.PublicKey))
+}
+
+func TestAuthgrantMapStoreUses(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "authgrants.json")
+	m, err := OpenAuthgrantMapSync(path)
+	assert.NilError(t, err)
+	i := getTestCmdIntentRequest(t, "cmd").Data.Intent
+	i.MaxUses = 3
+	i.MinInterval = time.Minute
+	ag, err := m.AddAuthGrant(&i, 0, nil)
+	assert.NilError(t, err)
+	_, err = m.UseAuthgrant(ag.ID, "user")
+	assert.NilError(t, err)
+
+	// Uses and limits survive a reload
+	reloaded, err := OpenAuthgrantMapSync(path)
+	assert.NilError(t, err)
+	_, err = reloaded.UseAuthgrant(ag.ID, "user")
+	assert.Assert(t, errors.Is(err, ErrAuthgrantRateLimited))
+	ags := reloaded.List("user")
+	assert.Equal(t, len(ags), 1)
+	assert.Equal(t, ags[0].Uses, uint16(1))
+	assert.Equal(t, ags[0].MaxUses, uint16(3))
+	assert.Equal(t, ags[0].MinInterval, time.Minute)
+}
+
+func TestGrantIDText(t *testing.T) {
+	id := newGrantID()
+	parsed, err := ParseGrantID(id.String())
+	assert.NilError(t, err)
+	assert.Equal(t, parsed, id)
+	_, err = ParseGrantID("1234")
+	assert.Assert(t, err != nil)
 }
@@ -0,0 +1,171 @@
+package authgrants
+
+import (
+	"fmt"
+
+	"hop.computer/hop/keys"
+	"hop.computer/hop/pkg/thunks"
+)
+
+// Chained delegation: a delegate holding a delegable grant acts as principal
+// for a further delegate, and asks the target for a sub-grant of its grant
+// with an IntentSubGrant. A sub-grant can only narrow its parent, and the
+// target checks the chain of issuers from the principal down to the
+// delegate before adding it.
+
+// MaxChainLength is the most grants a chain may hold, counting the grant
+// issued by the principal
+const MaxChainLength = 8
+
+// Attenuates checks that a sub-grant for i would be no broader than ag: the
+// same user and target, a command, forwarding or files ag allows, no more
+// uses than ag has left, and a validity within that of ag. It errors with
+// ErrNotAttenuated wrapped in the reason if not.
+func (ag *Authgrant) Attenuates(i *Intent) error {
+	deny := func(format string, args ...any) error {
+		return fmt.Errorf("%w: %s", ErrNotAttenuated, fmt.Sprintf(format, args...))
+	}
+	if !ag.Delegable {
+		return deny("grant %s is not delegable", ag.ID)
+	}
+	if i.TargetUsername != ag.User {
+		return deny("user %s differs from %s", i.TargetUsername, ag.User)
+	}
+	if i.TargetSNI.Type != ag.TargetSNI.Type || string(i.TargetSNI.Label) != string(ag.TargetSNI.Label) {
+		return deny("target %s differs from %s", i.TargetSNI.String(), ag.TargetSNI.String())
+	}
+	if i.StartTime.Before(ag.StartTime) || i.ExpTime.After(ag.ExpTime) {
+		return deny("validity outside of %s to %s", ag.StartTime, ag.ExpTime)
+	}
+	if i.MinInterval < ag.MinInterval {
+		return deny("interval %s shorter than %s", i.MinInterval, ag.MinInterval)
+	}
+	if ag.MaxUses != UnlimitedUses {
+		left := max(ag.MaxUses, 1) - min(ag.Uses, max(ag.MaxUses, 1))
+		if i.MaxUses == UnlimitedUses || max(i.MaxUses, 1) > left {
+			return deny("%s exceeds the %d uses left", i.UsageString(), left)
+		}
+	}
+
+	switch {
+	case ag.GrantType == Shell && (i.GrantType == Shell || i.GrantType == Command || i.GrantType == FileRead || i.GrantType == FileWrite || i.GrantType == Subsystem):
+	case ag.GrantType == Command && i.GrantType == Command:
+		if !ag.AssociatedData.CommandGrantData.Covers(&i.AssociatedData.CommandGrantData) {
+			return deny("command %q not allowed by %q", i.AssociatedData.CommandGrantData.String(), ag.AssociatedData.CommandGrantData.String())
+		}
+	case ag.GrantType == LocalPF && i.GrantType == LocalPF:
+		if i.AssociatedData.LocalPFGrantData != ag.AssociatedData.LocalPFGrantData {
+			return deny("forwarding to %s differs from %s", i.AssociatedData.LocalPFGrantData.Address, ag.AssociatedData.LocalPFGrantData.Address)
+		}
+	case ag.GrantType == RemotePF && i.GrantType == RemotePF:
+		if i.AssociatedData.RemotePFGrantData != ag.AssociatedData.RemotePFGrantData {
+			return deny("forwarding from %s differs from %s", i.AssociatedData.RemotePFGrantData.Address, ag.AssociatedData.RemotePFGrantData.Address)
+		}
+	case (ag.GrantType == FileRead || ag.GrantType == FileWrite) && i.GrantType == ag.GrantType:
+		if !ag.AssociatedData.FileGrantData.Covers(&i.AssociatedData.FileGrantData) {
+			return deny("files %s not allowed by %s", i.AssociatedData.FileGrantData.String(), ag.AssociatedData.FileGrantData.String())
+		}
+	case ag.GrantType == Subsystem && i.GrantType == Subsystem:
+		if i.AssociatedData.SubsystemGrantData != ag.AssociatedData.SubsystemGrantData {
+			return deny("subsystem %s differs from %s", i.AssociatedData.SubsystemGrantData.Name, ag.AssociatedData.SubsystemGrantData.Name)
+		}
+	default:
+		return deny("%s grant does not allow %s", ag.GrantType, i.GrantType)
+	}
+	return nil
+}
+
+// AddSubAuthgrant adds a sub-grant for i of the grant with parent, issued by
+// the delegate of parent with key issuer, and returns it. The chain of the
+// parent must lead back to its principal through grants that are all still
+// outstanding. If the parent has limited uses, the uses of the sub-grant are
+// reserved from it, whether or not the sub-grant ends up using them.
+func (m *AuthgrantMapSync) AddSubAuthgrant(parent GrantID, issuer keys.DHPublicKey, i *Intent) (Authgrant, error) {
+	m.agLock.Lock()
+	defer m.agLock.Unlock()
+	m.gcLocked()
+
+	key, n, ok := m.findLocked(i.TargetUsername, parent)
+	if !ok {
+		return Authgrant{}, ErrNoAuthgrant
+	}
+	p := &m.agMap[i.TargetUsername][key][n]
+	if p.DelegateCert.PublicKey != issuer {
+		return Authgrant{}, fmt.Errorf("%w: grant %s was not issued to the requesting delegate", ErrBrokenChain, parent)
+	}
+	if i.DelegateCert.PublicKey == issuer {
+		return Authgrant{}, fmt.Errorf("%w: the delegate of grant %s cannot issue a sub-grant to itself", ErrBrokenChain, parent)
+	}
+	if err := m.verifyChainLocked(p); err != nil {
+		return Authgrant{}, err
+	}
+	if len(p.Chain) >= MaxChainLength {
+		return Authgrant{}, fmt.Errorf("%w: longer than %d grants", ErrBrokenChain, MaxChainLength)
+	}
+	if err := p.Attenuates(i); err != nil {
+		return Authgrant{}, err
+	}
+
+	ag := newAuthgrant(i, p.PrincipalID)
+	ag.Parent = parent
+	ag.Chain = append(append([]keys.DHPublicKey(nil), p.Chain...), issuer)
+	if p.MaxUses != UnlimitedUses {
+		p.Uses += max(i.MaxUses, 1)
+	}
+	m.addLocked(ag)
+	m.record(AuditGrantAdded, &ag)
+	return ag, m.saveLocked()
+}
+
+// verifyChainLocked checks that each ancestor of ag is outstanding and issued
+// the next grant of the chain to its delegate, up to a grant issued by a
+// known principal
+// +checklocks:m.agLock
+func (m *AuthgrantMapSync) verifyChainLocked(ag *Authgrant) error {
+	now := thunks.TimeNow()
+	for cur := *ag; ; {
+		if len(cur.Chain) == 0 {
+			return fmt.Errorf("%w: grant %s has no known principal", ErrBrokenChain, cur.ID)
+		}
+		if now.Before(cur.StartTime) {
+			return fmt.Errorf("%w: grant %s is not valid yet", ErrBrokenChain, cur.ID)
+		}
+		if cur.Parent == 0 {
+			if len(cur.Chain) != 1 {
+				return fmt.Errorf("%w: grant %s has a chain but no parent", ErrBrokenChain, cur.ID)
+			}
+			return nil
+		}
+		up, ok := m.lookupLocked(cur.User, cur.Parent)
+		if !ok {
+			return fmt.Errorf("%w: parent %s of grant %s is gone", ErrBrokenChain, cur.Parent, cur.ID)
+		}
+		if !chainExtends(cur.Chain, up.Chain, up.DelegateCert.PublicKey) {
+			return fmt.Errorf("%w: grant %s was not issued by the delegate of %s", ErrBrokenChain, cur.ID, up.ID)
+		}
+		cur = up
+	}
+}
+
+// chainExtends reports whether chain is parent followed by issuer
+func chainExtends(chain, parent []keys.DHPublicKey, issuer keys.DHPublicKey) bool {
+	if len(chain) != len(parent)+1 || chain[len(parent)] != issuer {
+		return false
+	}
+	for n := range parent {
+		if chain[n] != parent[n] {
+			return false
+		}
+	}
+	return true
+}
+
+// lookupLocked returns the grant with id for user
+// +checklocks:m.agLock
+func (m *AuthgrantMapSync) lookupLocked(user string, id GrantID) (Authgrant, bool) {
+	key, n, ok := m.findLocked(user, id)
+	if !ok {
+		return Authgrant{}, false
+	}
+	return m.agMap[user][key][n], true
+}
@@ -0,0 +1,220 @@
+package authgrants
+
+import (
+	"crypto/rand"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+
+	"hop.computer/hop/keys"
+)
+
+// subIntent returns an intent like parent for a new delegate key
+func subIntent(t *testing.T, parent Intent) Intent {
+	i := parent
+	rand.Read(i.DelegateCert.PublicKey[:])
+	i.Flags = 0
+	return i
+}
+
+func TestAttenuates(t *testing.T) {
+	i := getTestCmdIntentRequest(t, "deploy").Data.Intent
+	i.Flags = FlagDelegable
+	i.MaxUses = 3
+	i.MinInterval = time.Second
+	ag := newAuthgrant(&i, 0)
+	ag.Uses = 1
+
+	sub := subIntent(t, i)
+	sub.MaxUses = 2
+	sub.MinInterval = time.Minute
+	sub.ExpTime = i.ExpTime.Add(-time.Minute)
+	assert.NilError(t, ag.Attenuates(&sub))
+
+	for name, change := range map[string]func(*Intent){
+		"command":  func(s *Intent) { s.AssociatedData.CommandGrantData.Cmd = "rm -rf /" },
+		"shell":    func(s *Intent) { s.GrantType = Shell },
+		"user":     func(s *Intent) { s.TargetUsername = "root" },
+		"target":   func(s *Intent) { s.TargetSNI.Label = []byte("other") },
+		"expiry":   func(s *Intent) { s.ExpTime = i.ExpTime.Add(time.Second) },
+		"start":    func(s *Intent) { s.StartTime = i.StartTime.Add(-time.Second) },
+		"uses":     func(s *Intent) { s.MaxUses = 3 },
+		"any uses": func(s *Intent) { s.MaxUses = UnlimitedUses },
+		"interval": func(s *Intent) { s.MinInterval = 0 },
+	} {
+		broader := sub
+		change(&broader)
+		assert.Assert(t, errors.Is(ag.Attenuates(&broader), ErrNotAttenuated), name)
+	}
+
+	// A shell grant can be narrowed to a command
+	shell := ag
+	shell.GrantType = Shell
+	assert.NilError(t, shell.Attenuates(&sub))
+
+	// A subsystem grant can only be passed on for the same subsystem
+	shell.AssociatedData.SubsystemGrantData.Name = "sftp"
+	subsystem := sub
+	subsystem.GrantType = Subsystem
+	subsystem.AssociatedData.SubsystemGrantData.Name = "sftp"
+	assert.NilError(t, shell.Attenuates(&subsystem))
+	shell.GrantType = Subsystem
+	assert.NilError(t, shell.Attenuates(&subsystem))
+	subsystem.AssociatedData.SubsystemGrantData.Name = "backup"
+	assert.Assert(t, errors.Is(shell.Attenuates(&subsystem), ErrNotAttenuated))
+	assert.Assert(t, errors.Is(shell.Attenuates(&sub), ErrNotAttenuated))
+
+	ag.Delegable = false
+	assert.Assert(t, errors.Is(ag.Attenuates(&sub), ErrNotAttenuated))
+}
+
+func TestAddSubAuthgrant(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "authgrants.json")
+	m, err := OpenAuthgrantMapSync(path)
+	assert.NilError(t, err)
+
+	var principal keys.DHPublicKey
+	rand.Read(principal[:])
+	i := getTestCmdIntentRequest(t, "deploy").Data.Intent
+	i.Flags = FlagDelegable
+	i.MaxUses = UnlimitedUses
+	root, err := m.AddAuthGrant(&i, 1, &principal)
+	assert.NilError(t, err)
+	delegate := i.DelegateCert.PublicKey
+
+	// Only the delegate of the parent may ask for a sub-grant
+	child := subIntent(t, i)
+	child.Flags = FlagDelegable
+	_, err = m.AddSubAuthgrant(root.ID, principal, &child)
+	assert.Assert(t, errors.Is(err, ErrBrokenChain))
+	_, err = m.AddSubAuthgrant(root.ID+1, delegate, &child)
+	assert.Assert(t, errors.Is(err, ErrNoAuthgrant))
+
+	sub, err := m.AddSubAuthgrant(root.ID, delegate, &child)
+	assert.NilError(t, err)
+	assert.Equal(t, sub.Parent, root.ID)
+	assert.Equal(t, sub.PrincipalID, root.PrincipalID)
+	assert.DeepEqual(t, sub.Chain, []keys.DHPublicKey{principal, delegate})
+
+	// The chain survives a reload, and continues through the sub-grant
+	reloaded, err := OpenAuthgrantMapSync(path)
+	assert.NilError(t, err)
+	grandchild := subIntent(t, child)
+	subsub, err := reloaded.AddSubAuthgrant(sub.ID, child.DelegateCert.PublicKey, &grandchild)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, subsub.Chain, []keys.DHPublicKey{principal, delegate, child.DelegateCert.PublicKey})
+
+	// The grandchild is not delegable
+	further := subIntent(t, grandchild)
+	_, err = reloaded.AddSubAuthgrant(subsub.ID, grandchild.DelegateCert.PublicKey, &further)
+	assert.Assert(t, errors.Is(err, ErrNotAttenuated))
+
+	// Revoking the root revokes the whole chain
+	removed, err := reloaded.RemoveAuthgrant(root.ID, "")
+	assert.NilError(t, err)
+	assert.Equal(t, len(removed), 3)
+	assert.Equal(t, removed[0].ID, root.ID)
+	assert.Equal(t, len(reloaded.List("")), 0)
+}
+
+func TestAddSubAuthgrantUnknownPrincipal(t *testing.T) {
+	m := NewAuthgrantMapSync()
+	i := getTestCmdIntentRequest(t, "deploy").Data.Intent
+	i.Flags = FlagDelegable
+	root, err := m.AddAuthGrant(&i, 0, nil)
+	assert.NilError(t, err)
+	child := subIntent(t, i)
+	_, err = m.AddSubAuthgrant(root.ID, i.DelegateCert.PublicKey, &child)
+	assert.Assert(t, errors.Is(err, ErrBrokenChain))
+}
+
+func TestSubAuthgrantUses(t *testing.T) {
+	m := NewAuthgrantMapSync()
+	var principal keys.DHPublicKey
+	rand.Read(principal[:])
+	i := getTestCmdIntentRequest(t, "deploy").Data.Intent
+	i.Flags = FlagDelegable
+	i.MaxUses = 1
+	root, err := m.AddAuthGrant(&i, 1, &principal)
+	assert.NilError(t, err)
+	delegate := i.DelegateCert.PublicKey
+
+	// A delegate cannot issue a sub-grant to itself
+	self := i
+	self.Flags = 0
+	_, err = m.AddSubAuthgrant(root.ID, delegate, &self)
+	assert.Assert(t, errors.Is(err, ErrBrokenChain))
+
+	// The only use of the root goes to the first sub-grant
+	first := subIntent(t, i)
+	first.MaxUses = 1
+	sub, err := m.AddSubAuthgrant(root.ID, delegate, &first)
+	assert.NilError(t, err)
+	second := subIntent(t, i)
+	second.MaxUses = 1
+	_, err = m.AddSubAuthgrant(root.ID, delegate, &second)
+	assert.Assert(t, errors.Is(err, ErrNotAttenuated))
+	_, err = m.UseAuthgrant(root.ID, "user")
+	assert.Assert(t, errors.Is(err, ErrNoAuthgrant))
+	_, err = m.Authgrants("user", delegate)
+	assert.ErrorContains(t, err, "no authgrant")
+	assert.Assert(t, !m.HasKey(delegate))
+
+	uses := 0
+	for _, id := range []GrantID{root.ID, sub.ID, root.ID, sub.ID} {
+		if _, err := m.UseAuthgrant(id, "user"); err == nil {
+			uses++
+		}
+	}
+	assert.Equal(t, uses, 1)
+
+	// The used up root left with its last sub-grant
+	assert.Equal(t, len(m.List("")), 0)
+}
+
+func TestSubAuthgrantsLeaveWithParent(t *testing.T) {
+	m := NewAuthgrantMapSync()
+	var principal keys.DHPublicKey
+	rand.Read(principal[:])
+	i := getTestCmdIntentRequest(t, "deploy").Data.Intent
+	i.Flags = FlagDelegable
+	i.MaxUses = 2
+	root, err := m.AddAuthGrant(&i, 1, &principal)
+	assert.NilError(t, err)
+	child := subIntent(t, i)
+	child.MaxUses = 1
+	sub, err := m.AddSubAuthgrant(root.ID, i.DelegateCert.PublicKey, &child)
+	assert.NilError(t, err)
+
+	// The root keeps its sub-grant while it is used up
+	used, err := m.UseAuthgrant(root.ID, "user")
+	assert.NilError(t, err)
+	assert.Assert(t, used.UsedUp())
+	assert.Equal(t, len(m.List("")), 2)
+
+	// Expired grants take their sub-grants with them
+	i.ExpTime = time.Now().Add(time.Hour)
+	other, err := m.AddAuthGrant(&i, 1, &principal)
+	assert.NilError(t, err)
+	child = subIntent(t, i)
+	child.ExpTime = i.ExpTime
+	_, err = m.AddSubAuthgrant(other.ID, i.DelegateCert.PublicKey, &child)
+	assert.NilError(t, err)
+	m.agLock.Lock()
+	for _, ags := range m.agMap["user"] {
+		for n := range ags {
+			if ags[n].ID == other.ID {
+				ags[n].ExpTime = time.Now()
+			}
+		}
+	}
+	m.agLock.Unlock()
+	assert.Equal(t, len(m.List("")), 2)
+
+	_, err = m.UseAuthgrant(sub.ID, "user")
+	assert.NilError(t, err)
+	assert.Equal(t, len(m.List("")), 0)
+}
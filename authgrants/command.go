@@ -0,0 +1,298 @@
+package authgrants
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Command patterns: instead of an exact command string, a command grant can
+// hold a pattern for each argument and a list of allowed flags. The target
+// splits the command the delegate asks for into arguments without a shell,
+// and runs commands allowed by a pattern without a shell too, so shell syntax
+// like ; or $() can not smuggle in other commands.
+
+// Argument pattern kinds
+const (
+	ArgGlob  = byte(1) // a glob as in path.Match, so * does not match /
+	ArgRegex = byte(2) // a regular expression that must match the whole argument
+)
+
+// ArgPattern matches one argument of a command
+type ArgPattern struct {
+	Kind    byte
+	Pattern string
+}
+
+// ErrUnsafeCommand indicates a command uses shell syntax that is not allowed
+// in commands matched against patterns
+var ErrUnsafeCommand = errors.New("command uses shell syntax")
+
+// Matches reports whether arg matches p. Arguments starting with - only match
+// patterns that start with - too, so a wildcard can not match a flag.
+func (p *ArgPattern) Matches(arg string) bool {
+	if strings.HasPrefix(arg, "-") && !strings.HasPrefix(p.Pattern, "-") {
+		return false
+	}
+	switch p.Kind {
+	case ArgGlob:
+		ok, err := path.Match(p.Pattern, arg)
+		return err == nil && ok
+	case ArgRegex:
+		re, err := regexp.Compile(`^(?:` + p.Pattern + `)$`)
+		return err == nil && re.MatchString(arg)
+	default:
+		return false
+	}
+}
+
+// String formats p as in ParseCommandPattern
+func (p *ArgPattern) String() string {
+	if p.Kind == ArgRegex {
+		return "/" + p.Pattern + "/"
+	}
+	return quoteArg(p.Pattern)
+}
+
+func (p *ArgPattern) validate() error {
+	switch p.Kind {
+	case ArgGlob:
+		_, err := path.Match(p.Pattern, "")
+		return err
+	case ArgRegex:
+		_, err := regexp.Compile(p.Pattern)
+		return err
+	default:
+		return fmt.Errorf("unknown argument pattern kind %d", p.Kind)
+	}
+}
+
+// IsPattern reports whether the grant matches commands against argument
+// patterns rather than an exact command
+func (d *CommandGrantData) IsPattern() bool {
+	return len(d.Argv) > 0
+}
+
+// Validate checks that the patterns of d are well formed, and that the program
+// it runs is a literal
+func (d *CommandGrantData) Validate() error {
+	if !d.IsPattern() {
+		if len(d.AllowedFlags) > 0 {
+			return fmt.Errorf("allowed flags without argument patterns")
+		}
+		return nil
+	}
+	if d.Cmd != "" {
+		return fmt.Errorf("both a command and argument patterns")
+	}
+	for n := range d.Argv {
+		if err := d.Argv[n].validate(); err != nil {
+			return fmt.Errorf("argument %d: %w", n, err)
+		}
+	}
+	if prog := d.Argv[0]; prog.Kind != ArgGlob || strings.ContainsAny(prog.Pattern, `*?[\`) || prog.Pattern == "" {
+		return fmt.Errorf("the program must be a literal")
+	}
+	for _, f := range d.AllowedFlags {
+		if !strings.HasPrefix(f, "-") || strings.Contains(f, "=") {
+			return fmt.Errorf("invalid allowed flag %q", f)
+		}
+	}
+	return nil
+}
+
+// Matches reports whether argv is allowed by the patterns of d. Allowed flags
+// may appear anywhere after the program, also as --flag=value, until an
+// allowed --. The other arguments must match the patterns in order.
+func (d *CommandGrantData) Matches(argv []string) bool {
+	if !d.IsPattern() || len(argv) == 0 {
+		return false
+	}
+	positional := []string{argv[0]}
+	flags := true
+	for _, arg := range argv[1:] {
+		if flags && d.flagAllowed(arg) {
+			flags = arg != "--"
+			continue
+		}
+		positional = append(positional, arg)
+	}
+	if len(positional) != len(d.Argv) {
+		return false
+	}
+	for n := range positional {
+		if !d.Argv[n].Matches(positional[n]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *CommandGrantData) flagAllowed(arg string) bool {
+	if !strings.HasPrefix(arg, "-") || arg == "-" {
+		return false
+	}
+	name, _, _ := strings.Cut(arg, "=")
+	return slices.Contains(d.AllowedFlags, name)
+}
+
+// Allows reports whether d allows running cmd. For pattern grants it returns
+// the arguments of cmd, which must be run without a shell.
+func (d *CommandGrantData) Allows(cmd string) ([]string, bool) {
+	if !d.IsPattern() {
+		return nil, cmd == d.Cmd
+	}
+	argv, err := SplitCommand(cmd)
+	if err != nil || !d.Matches(argv) {
+		return nil, false
+	}
+	return argv, true
+}
+
+// Covers reports whether d allows every command sub allows: the same exact
+// command, an exact command that matches the patterns of d, or the same
+// patterns with fewer allowed flags
+func (d *CommandGrantData) Covers(sub *CommandGrantData) bool {
+	if !d.IsPattern() {
+		return !sub.IsPattern() && sub.Cmd == d.Cmd
+	}
+	if !sub.IsPattern() {
+		argv, ok := shellLiteral(sub.Cmd)
+		return ok && d.Matches(argv)
+	}
+	if !slices.Equal(d.Argv, sub.Argv) {
+		return false
+	}
+	for _, f := range sub.AllowedFlags {
+		if !slices.Contains(d.AllowedFlags, f) {
+			return false
+		}
+	}
+	return true
+}
+
+// String describes the commands d allows
+func (d *CommandGrantData) String() string {
+	s := d.argvString()
+	if len(d.AllowedFlags) > 0 {
+		s += " [" + strings.Join(d.AllowedFlags, " ") + "]"
+	}
+	return s
+}
+
+// argvString returns the command of d, or its argument patterns formatted as
+// in ParseCommandPattern
+func (d *CommandGrantData) argvString() string {
+	if !d.IsPattern() {
+		return d.Cmd
+	}
+	args := make([]string, len(d.Argv))
+	for n := range d.Argv {
+		args[n] = d.Argv[n].String()
+	}
+	return strings.Join(args, " ")
+}
+
+// ParseCommandPattern parses a command pattern into command grant data. The
+// pattern is split into words as by SplitCommand. Words between slashes, like
+// /v[0-9]+/, are regular expressions, and other words are globs. flags are the
+// allowed flags.
+func ParseCommandPattern(pattern string, flags []string) (CommandGrantData, error) {
+	words, err := SplitCommand(pattern)
+	if err != nil {
+		return CommandGrantData{}, err
+	}
+	d := CommandGrantData{AllowedFlags: flags}
+	for _, w := range words {
+		if len(w) >= 2 && strings.HasPrefix(w, "/") && strings.HasSuffix(w, "/") {
+			d.Argv = append(d.Argv, ArgPattern{Kind: ArgRegex, Pattern: w[1 : len(w)-1]})
+		} else {
+			d.Argv = append(d.Argv, ArgPattern{Kind: ArgGlob, Pattern: w})
+		}
+	}
+	if len(d.Argv) == 0 {
+		return CommandGrantData{}, fmt.Errorf("empty command pattern")
+	}
+	return d, d.Validate()
+}
+
+// SplitCommand splits cmd into arguments like a shell would, without
+// expanding anything. Words are separated by spaces and tabs, and can be
+// quoted with ' or ", or escaped with \. It errors with ErrUnsafeCommand on
+// unquoted shell operators, or $ and ` in double quotes.
+func SplitCommand(cmd string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	for i := 0; i < len(cmd); i++ {
+		c := cmd[i]
+		switch {
+		case c == ' ' || c == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+			continue
+		case c == '\\':
+			if i+1 == len(cmd) {
+				return nil, fmt.Errorf("%w: trailing \\", ErrUnsafeCommand)
+			}
+			i++
+			word.WriteByte(cmd[i])
+		case c == '\'':
+			end := strings.IndexByte(cmd[i+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated ' in command")
+			}
+			word.WriteString(cmd[i+1 : i+1+end])
+			i += end + 1
+		case c == '"':
+			i++
+			for ; i < len(cmd) && cmd[i] != '"'; i++ {
+				switch cmd[i] {
+				case '$', '`':
+					return nil, fmt.Errorf("%w: %c", ErrUnsafeCommand, cmd[i])
+				case '\\':
+					if i+1 < len(cmd) && strings.IndexByte(`"\`, cmd[i+1]) >= 0 {
+						i++
+					}
+				}
+				word.WriteByte(cmd[i])
+			}
+			if i == len(cmd) {
+				return nil, fmt.Errorf("unterminated \" in command")
+			}
+		case strings.IndexByte(";&|<>()$`#\n\r", c) >= 0:
+			return nil, fmt.Errorf("%w: %q", ErrUnsafeCommand, c)
+		default:
+			word.WriteByte(c)
+		}
+		inWord = true
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// shellLiteral splits cmd into arguments as SplitCommand does, if a shell
+// would run cmd as those arguments without expanding anything
+func shellLiteral(cmd string) ([]string, bool) {
+	if strings.ContainsAny(cmd, "*?[]{}~") {
+		return nil, false
+	}
+	argv, err := SplitCommand(cmd)
+	return argv, err == nil
+}
+
+// quoteArg quotes arg for display if it is empty or would be split
+func quoteArg(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t'\"\\;&|<>()$`#\n\r") {
+		return arg
+	}
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
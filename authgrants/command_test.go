@@ -0,0 +1,112 @@
+package authgrants
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestSplitCommand(t *testing.T) {
+	for _, tc := range []struct {
+		cmd  string
+		argv []string
+	}{
+		{"git fetch origin", []string{"git", "fetch", "origin"}},
+		{"  echo\t'a b'  \"c d\" e\\ f ", []string{"echo", "a b", "c d", "e f"}},
+		{`echo "a \"b\" \c" ''`, []string{"echo", `a "b" \c`, ""}},
+		{"echo 'a;b' \"$\"x", nil},
+	} {
+		argv, err := SplitCommand(tc.cmd)
+		if tc.argv == nil {
+			assert.Assert(t, errors.Is(err, ErrUnsafeCommand), tc.cmd)
+			continue
+		}
+		assert.NilError(t, err, tc.cmd)
+		assert.DeepEqual(t, argv, tc.argv)
+	}
+
+	for _, cmd := range []string{"a; b", "a && b", "a | b", "a > f", "a $(b)", "a `b`", "a\nb", "a # b", `a "$b"`} {
+		_, err := SplitCommand(cmd)
+		assert.Assert(t, errors.Is(err, ErrUnsafeCommand), cmd)
+	}
+	_, err := SplitCommand("echo 'a")
+	assert.Assert(t, err != nil)
+}
+
+func TestCommandPattern(t *testing.T) {
+	d, err := ParseCommandPattern("git fetch /[a-z]+/", []string{"--prune", "-q"})
+	assert.NilError(t, err)
+	assert.Equal(t, d.String(), "git fetch /[a-z]+/ [--prune -q]")
+
+	for _, tc := range []struct {
+		cmd string
+		ok  bool
+	}{
+		{"git fetch origin", true},
+		{"git -q fetch --prune origin", true},
+		{"git fetch --prune=false upstream", true},
+		{"git fetch", false},
+		{"git fetch Origin", false},
+		{"git fetch origin main", false},
+		{"git fetch --upload-pack=evil origin", false},
+		{"git push origin", false},
+		{"git fetch origin; reboot", false},
+	} {
+		argv, ok := d.Allows(tc.cmd)
+		assert.Equal(t, ok, tc.ok, tc.cmd)
+		if ok {
+			assert.Equal(t, argv[0], "git")
+		}
+	}
+
+	// Wildcards do not match flags
+	d, err = ParseCommandPattern("ls *", nil)
+	assert.NilError(t, err)
+	_, ok := d.Allows("ls -la")
+	assert.Assert(t, !ok)
+	_, ok = d.Allows("ls src")
+	assert.Assert(t, ok)
+
+	for _, bad := range []string{"", "* x", "/ls/ x", "ls /[/", "ls [", "echo a; b"} {
+		_, err := ParseCommandPattern(bad, nil)
+		assert.Assert(t, err != nil, bad)
+	}
+	_, err = ParseCommandPattern("ls", []string{"l"})
+	assert.Assert(t, err != nil)
+}
+
+func TestCommandCovers(t *testing.T) {
+	parent, err := ParseCommandPattern("systemctl restart app-*", []string{"--no-block", "-q"})
+	assert.NilError(t, err)
+	narrower, err := ParseCommandPattern("systemctl restart app-*", []string{"-q"})
+	assert.NilError(t, err)
+	other, err := ParseCommandPattern("systemctl stop app-*", nil)
+	assert.NilError(t, err)
+
+	assert.Assert(t, parent.Covers(&narrower))
+	assert.Assert(t, !narrower.Covers(&parent))
+	assert.Assert(t, !parent.Covers(&other))
+	assert.Assert(t, parent.Covers(&CommandGrantData{Cmd: "systemctl restart app-web"}))
+	assert.Assert(t, !parent.Covers(&CommandGrantData{Cmd: "systemctl restart app-?"}))
+	assert.Assert(t, !parent.Covers(&CommandGrantData{Cmd: "systemctl restart db"}))
+
+	exact := CommandGrantData{Cmd: "uptime"}
+	assert.Assert(t, exact.Covers(&CommandGrantData{Cmd: "uptime"}))
+	assert.Assert(t, !exact.Covers(&parent))
+}
+
+func TestCommandGrantDataEncodeDecode(t *testing.T) {
+	d, err := ParseCommandPattern("deploy /v[0-9]+/ 'with space'", []string{"--dry-run"})
+	assert.NilError(t, err)
+	b := &bytes.Buffer{}
+	n, err := d.WriteTo(b)
+	assert.NilError(t, err)
+	var read CommandGrantData
+	m, err := read.ReadFrom(b)
+	assert.NilError(t, err)
+	assert.Equal(t, n, m)
+	assert.DeepEqual(t, read, d)
+	assert.Equal(t, read.String(), "deploy /v[0-9]+/ 'with space' [--dry-run]")
+}
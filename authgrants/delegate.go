@@ -20,14 +20,15 @@ type delegateInstance struct {
 	intentRequests []Intent
 }
 
-// StartDelegateInstance sends all intent requests to the principal. Caller
-// responsible for closing pc when done with it.
-func StartDelegateInstance(pc net.Conn, irs []Intent) error {
+// StartDelegateInstance sends all intent requests to the principal, and
+// returns the grants the target confirmed. Caller responsible for closing pc
+// when done with it.
+func StartDelegateInstance(pc net.Conn, irs []Intent) ([]Authgrant, error) {
 	if pc == nil {
-		return fmt.Errorf("delegate: must provide non-nil connection to principal")
+		return nil, fmt.Errorf("delegate: must provide non-nil connection to principal")
 	}
 	if len(irs) == 0 {
-		return fmt.Errorf("delegate: must provide at least one intent request")
+		return nil, fmt.Errorf("delegate: must provide at least one intent request")
 	}
 
 	di := delegateInstance{
@@ -38,12 +39,12 @@ func StartDelegateInstance(pc net.Conn, irs []Intent) error {
 	return di.sendIntentRequests()
 }
 
-func (d *delegateInstance) sendIntentRequests() error {
+func (d *delegateInstance) sendIntentRequests() ([]Authgrant, error) {
 	if d.principalConn == nil {
-		return fmt.Errorf("delegate: not connected to principal")
+		return nil, fmt.Errorf("delegate: not connected to principal")
 	}
 
-	oneApproved := false
+	var granted []Authgrant
 	for _, ir := range d.intentRequests {
 		err := WriteIntentRequest(d.principalConn, ir)
 		if err != nil {
@@ -56,16 +57,17 @@ func (d *delegateInstance) sendIntentRequests() error {
 			continue
 		}
 		if resp.MsgType == IntentConfirmation {
-			logrus.Info("delegate: intent request confirmed")
-			oneApproved = true
+			logrus.Infof("delegate: intent request confirmed as grant %s", resp.Data.GrantID)
+			ag := newAuthgrant(&ir, 0)
+			ag.ID = resp.Data.GrantID
+			granted = append(granted, ag)
 		} else {
 			logrus.Infof("delegate: intent request denied with reason: %s", resp.Data.Denial)
 		}
 	}
 	logrus.Info("delegate: done sending intent requests")
-	if oneApproved {
-		return nil
+	if len(granted) > 0 {
+		return granted, nil
 	}
-	return fmt.Errorf("delegate: no intent requests confirmed")
-
+	return nil, fmt.Errorf("delegate: no intent requests confirmed")
 }
@@ -30,9 +30,9 @@ func TestDelegate(t *testing.T) {
 	// Start "Target"
 	go fakeTarget(t, tcT)
 
-	go StartPrincipalInstance(pcP, ciFunc, setupTarg)
+	go StartPrincipalInstance(pcP, ciFunc, setupTarg, nil, nil)
 
-	err := StartDelegateInstance(pc, []Intent{ir1.Data.Intent})
+	_, err := StartDelegateInstance(pc, []Intent{ir1.Data.Intent})
 	assert.NilError(t, err)
 }
 
@@ -57,9 +57,9 @@ func TestDelegateMultipleIRs(t *testing.T) {
 	// Start "Target"
 	go fakeTargetLoop(t, tcT)
 
-	go StartPrincipalInstance(pcP, ciFunc, setupTarg)
+	go StartPrincipalInstance(pcP, ciFunc, setupTarg, nil, nil)
 
-	err := StartDelegateInstance(pc, []Intent{ir1.Data.Intent, ir2.Data.Intent, ir3.Data.Intent})
+	_, err := StartDelegateInstance(pc, []Intent{ir1.Data.Intent, ir2.Data.Intent, ir3.Data.Intent})
 	assert.NilError(t, err)
 
 }
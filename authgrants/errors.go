@@ -7,3 +7,21 @@ var ErrUnknownMessage = errors.New("received message with unknown message type")
 
 // ErrIntentDenied indicates an intent request was denied
 var ErrIntentDenied = errors.New("received intent denied message")
+
+// ErrNoAuthgrant indicates there is no authgrant with the requested ID
+var ErrNoAuthgrant = errors.New("no such authgrant")
+
+// ErrAuthgrantRateLimited indicates an authgrant was used again before its
+// MinInterval passed
+var ErrAuthgrantRateLimited = errors.New("authgrant used too soon after its last use")
+
+// ErrAuthgrantNotStarted indicates an authgrant was used before its start
+// time
+var ErrAuthgrantNotStarted = errors.New("authgrant used before its start time")
+
+// ErrNotAttenuated indicates a sub-grant would be broader than its parent
+var ErrNotAttenuated = errors.New("sub-grant not narrower than its parent")
+
+// ErrBrokenChain indicates the chain of a sub-grant does not lead back to its
+// principal
+var ErrBrokenChain = errors.New("authgrant chain broken")
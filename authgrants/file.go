@@ -0,0 +1,70 @@
+package authgrants
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// File grants: FileRead and FileWrite grants let a delegate read or write
+// the files under a path, instead of running cat or tee with a command grant.
+// Write grants also limit the size of the files and the permission bits they
+// may be created with.
+
+// maxFilePath is the longest path that fits in file grant data
+const maxFilePath = 255
+
+// Validate checks that d names a clean absolute path, and only permission bits
+func (d *FileGrantData) Validate() error {
+	if !filepath.IsAbs(d.Path) || filepath.Clean(d.Path) != d.Path {
+		return fmt.Errorf("%q is not a clean absolute path", d.Path)
+	}
+	if len(d.Path) > maxFilePath {
+		return fmt.Errorf("path longer than %d bytes", maxFilePath)
+	}
+	if d.Mode&^0o777 != 0 {
+		return fmt.Errorf("mode %#o has more than permission bits", d.Mode)
+	}
+	return nil
+}
+
+// Allows reports whether d allows transferring the file at path of size bytes,
+// created with mode if it is written
+func (d *FileGrantData) Allows(path string, size uint64, mode uint32) bool {
+	return pathUnder(d.Path, path) &&
+		(d.MaxSize == 0 || size <= d.MaxSize) &&
+		mode&^d.Mode == 0
+}
+
+// Covers reports whether d allows every transfer sub allows: a path under
+// the path of d, no larger files and no more permission bits
+func (d *FileGrantData) Covers(sub *FileGrantData) bool {
+	return pathUnder(d.Path, sub.Path) &&
+		(d.MaxSize == 0 || (sub.MaxSize != 0 && sub.MaxSize <= d.MaxSize)) &&
+		sub.Mode&^d.Mode == 0
+}
+
+// String describes the files d allows transferring, e.g. "/srv/releases
+// (up to 1048576 bytes, mode 0644)"
+func (d *FileGrantData) String() string {
+	var limits []string
+	if d.MaxSize > 0 {
+		limits = append(limits, fmt.Sprintf("up to %d bytes", d.MaxSize))
+	}
+	if d.Mode != 0 {
+		limits = append(limits, fmt.Sprintf("mode %04o", d.Mode))
+	}
+	if len(limits) == 0 {
+		return d.Path
+	}
+	return fmt.Sprintf("%s (%s)", d.Path, strings.Join(limits, ", "))
+}
+
+// pathUnder reports whether path is dir or a path under dir. Both must be
+// clean and absolute.
+func pathUnder(dir, path string) bool {
+	if !filepath.IsAbs(path) || filepath.Clean(path) != path {
+		return false
+	}
+	return path == dir || dir == "/" || strings.HasPrefix(path, dir+"/")
+}
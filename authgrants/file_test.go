@@ -0,0 +1,66 @@
+package authgrants
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestFileGrantData(t *testing.T) {
+	d := FileGrantData{Path: "/srv/releases", MaxSize: 1 << 20, Mode: 0o644}
+	assert.NilError(t, d.Validate())
+	assert.Equal(t, d.String(), "/srv/releases (up to 1048576 bytes, mode 0644)")
+
+	for _, tc := range []struct {
+		path string
+		size uint64
+		mode uint32
+		ok   bool
+	}{
+		{"/srv/releases/app.tar", 1 << 20, 0o640, true},
+		{"/srv/releases", 0, 0, true},
+		{"/srv/releases/v1/app.tar", 0, 0o600, true},
+		{"/srv/releases/app.tar", 1<<20 + 1, 0o644, false},
+		{"/srv/releases/app.tar", 0, 0o755, false},
+		{"/srv/releases-old/app.tar", 0, 0, false},
+		{"/srv/releases/../app.tar", 0, 0, false},
+		{"srv/releases/app.tar", 0, 0, false},
+	} {
+		assert.Equal(t, d.Allows(tc.path, tc.size, tc.mode), tc.ok, tc.path)
+	}
+
+	for _, invalid := range []FileGrantData{
+		{Path: "srv"},
+		{Path: "/srv/"},
+		{Path: "/srv", Mode: 0o4755},
+		{Path: "/" + strings.Repeat("a", maxFilePath)},
+	} {
+		assert.Assert(t, invalid.Validate() != nil, invalid.Path)
+	}
+}
+
+func TestFileGrantCovers(t *testing.T) {
+	d := FileGrantData{Path: "/srv", MaxSize: 100, Mode: 0o644}
+	assert.Assert(t, d.Covers(&FileGrantData{Path: "/srv/releases", MaxSize: 10, Mode: 0o600}))
+	assert.Assert(t, !d.Covers(&FileGrantData{Path: "/srv/releases", MaxSize: 0, Mode: 0o600}))
+	assert.Assert(t, !d.Covers(&FileGrantData{Path: "/srv/releases", MaxSize: 10, Mode: 0o700}))
+	assert.Assert(t, !d.Covers(&FileGrantData{Path: "/etc", MaxSize: 10}))
+
+	root := FileGrantData{Path: "/"}
+	assert.Assert(t, root.Covers(&FileGrantData{Path: "/etc", MaxSize: 10}))
+	assert.Assert(t, !root.Covers(&FileGrantData{Path: "/etc", Mode: 0o644}))
+}
+
+func TestFileGrantDataEncodeDecode(t *testing.T) {
+	d := FileGrantData{Path: "/srv/releases", MaxSize: 1 << 40, Mode: 0o640}
+	b := &bytes.Buffer{}
+	n, err := d.WriteTo(b)
+	assert.NilError(t, err)
+	var read FileGrantData
+	m, err := read.ReadFrom(b)
+	assert.NilError(t, err)
+	assert.Equal(t, n, m)
+	assert.Equal(t, read, d)
+}
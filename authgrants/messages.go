@@ -19,19 +19,24 @@ import (
 // IntentRequest: Delegate -> Principal
 // IntentCommunication: Principal -> Target
 // IntentConfirmation/IntentDenied: Target -> Principal and/or Principal -> Delegate
+// IntentRevoke: Principal -> Target, answered with IntentConfirmation/IntentDenied
+// IntentSubGrant: Delegate acting as Principal -> Target, answered with IntentConfirmation/IntentDenied
 const (
 	IntentRequest       = msgType(1)
 	IntentCommunication = msgType(2)
 	IntentConfirmation  = msgType(3)
 	IntentDenied        = msgType(4)
+	IntentRevoke        = msgType(5)
+	IntentSubGrant      = msgType(6)
 )
 
 type msgType byte
 
-// MessageData represents either intent or denial reason
+// MessageData represents either intent, denial reason or grant ID
 type MessageData struct {
-	Intent Intent
-	Denial string
+	Intent  Intent
+	Denial  string
+	GrantID GrantID // the confirmed or revoked grant, or the parent of a sub-grant
 }
 
 // TargetDenial reason msg for when Target has policy against authgrants
@@ -59,18 +64,46 @@ const (
 	LocalPF  = GrantType(3)
 	RemotePF = GrantType(4)
 	Acme     = GrantType(5)
+	// FileRead and FileWrite grants allow reading or writing the files under
+	// a path over a file transfer tube
+	FileRead  = GrantType(6)
+	FileWrite = GrantType(7)
+	// Subsystem grants allow starting a subsystem of the target by name
+	Subsystem = GrantType(8)
 )
 
 // GrantType differentiates between types of actions
 type GrantType byte
 
+// UnlimitedUses as the MaxUses of an intent allows any number of uses until
+// the grant expires
+const UnlimitedUses = math.MaxUint16
+
+// Intent flags
+const (
+	// FlagDelegable lets the delegate pass on narrower sub-grants of the
+	// grant to further delegates
+	FlagDelegable = byte(1 << 0)
+	// FlagUsageLimits marks intents that carry MaxUses and MinInterval after
+	// their expiration time. Intents without it may be used once.
+	FlagUsageLimits = byte(1 << 1)
+	// FlagCommandPatterns marks command intents whose associated data carries
+	// argument patterns and allowed flags after the command
+	FlagCommandPatterns = byte(1 << 2)
+)
+
 // Intent contains body of an Intent Request or Intent Communication
 type Intent struct {
-	GrantType      GrantType
-	Reserved       byte
-	TargetPort     uint16
-	StartTime      time.Time
-	ExpTime        time.Time
+	GrantType  GrantType
+	Flags      byte
+	TargetPort uint16
+	StartTime  time.Time
+	ExpTime    time.Time
+	// MaxUses is how many times the grant may be used. 0 is treated as 1.
+	MaxUses uint16
+	// MinInterval is the least time between two uses of the grant, in whole
+	// seconds. 0 means no limit.
+	MinInterval    time.Duration
 	TargetSNI      certs.Name
 	TargetUsername string
 	DelegateCert   certs.Certificate
@@ -84,27 +117,52 @@ type Intent struct {
 
 // GrantData is a struct for Intent Associated data for diff grant types
 type GrantData struct {
-	ShellGrantData    ShellGrantData
-	CommandGrantData  CommandGrantData
-	LocalPFGrantData  LocalPFGrantData
-	RemotePFGrantData RemotePFGrantData
+	ShellGrantData     ShellGrantData
+	CommandGrantData   CommandGrantData
+	LocalPFGrantData   LocalPFGrantData
+	RemotePFGrantData  RemotePFGrantData
+	FileGrantData      FileGrantData
+	SubsystemGrantData SubsystemGrantData
 }
 
 // ShellGrantData info needed for authgrant for shell access
 type ShellGrantData struct {
 }
 
-// CommandGrantData info needed for authgrant for executing a cmd
+// CommandGrantData info needed for authgrant for executing a cmd: either an
+// exact command, run by the user's shell, or patterns for its arguments
 type CommandGrantData struct {
-	Cmd string
+	Cmd          string
+	Argv         []ArgPattern // a pattern for each argument, starting with the program
+	AllowedFlags []string     // flags allowed anywhere after the program
 }
 
-// LocalPFGrantData info for local pf authgrant
+// LocalPFGrantData info for local pf authgrant: the address the target
+// connects to on behalf of the delegate
 type LocalPFGrantData struct {
+	Network byte   // a portforwarding network type (PfTCP, PfUDP or PfUNIX)
+	Address string // host:port, or the path of a unix socket
 }
 
-// RemotePFGrantData info for remote pf authgrant
+// RemotePFGrantData info for remote pf authgrant: the address the target
+// listens on for the delegate
 type RemotePFGrantData struct {
+	Network byte   // a portforwarding network type (PfTCP, PfUDP or PfUNIX)
+	Address string // host:port, or the path of a unix socket
+}
+
+// FileGrantData info for file read and write authgrants: the files the
+// delegate may transfer
+type FileGrantData struct {
+	Path    string // a clean absolute path. Covers the path and everything under it.
+	MaxSize uint64 // the largest file that may be transferred. 0 allows any size.
+	Mode    uint32 // the permission bits written files may be created with
+}
+
+// SubsystemGrantData info for subsystem authgrants: the name of the
+// subsystem the delegate may start
+type SubsystemGrantData struct {
+	Name string
 }
 
 // NewAuthGrantMessage makes an agMessage with type and data
@@ -129,8 +187,17 @@ func (m *AgMessage) WriteTo(w io.Writer) (int64, error) {
 		dataLen, err = m.Data.Intent.WriteTo(w)
 	case IntentCommunication:
 		dataLen, err = m.Data.Intent.WriteTo(w)
-	case IntentConfirmation:
-		dataLen = 0
+	case IntentSubGrant:
+		err = binary.Write(w, binary.BigEndian, m.Data.GrantID)
+		if err == nil {
+			dataLen, err = m.Data.Intent.WriteTo(w)
+			dataLen += 8
+		}
+	case IntentConfirmation, IntentRevoke:
+		err = binary.Write(w, binary.BigEndian, m.Data.GrantID)
+		if err == nil {
+			dataLen = 8
+		}
 	case IntentDenied:
 		dataLen, err = common.WriteString(m.Data.Denial, w)
 	}
@@ -161,6 +228,17 @@ func (m *AgMessage) ReadFrom(r io.Reader) (int64, error) {
 		dataBytes, err = m.Data.Intent.ReadFrom(r)
 	case IntentCommunication:
 		dataBytes, err = m.Data.Intent.ReadFrom(r)
+	case IntentSubGrant:
+		err = binary.Read(r, binary.BigEndian, &m.Data.GrantID)
+		if err == nil {
+			dataBytes, err = m.Data.Intent.ReadFrom(r)
+			dataBytes += 8
+		}
+	case IntentConfirmation, IntentRevoke:
+		err = binary.Read(r, binary.BigEndian, &m.Data.GrantID)
+		if err == nil {
+			dataBytes = 8
+		}
 	case IntentDenied:
 		m.Data.Denial, dataBytes, err = common.ReadString(r)
 	}
@@ -169,11 +247,25 @@ func (m *AgMessage) ReadFrom(r io.Reader) (int64, error) {
 	return bytesRead, err
 }
 
+// wireFlags returns the flags of i with the bits that mark optional fields set
+// if i has those fields, so that intents without them keep the older format
+func (i *Intent) wireFlags() byte {
+	flags := i.Flags &^ (FlagUsageLimits | FlagCommandPatterns)
+	if i.MaxUses != 0 || i.MinInterval != 0 {
+		flags |= FlagUsageLimits
+	}
+	if d := &i.AssociatedData.CommandGrantData; i.GrantType == Command && (d.IsPattern() || len(d.AllowedFlags) > 0) {
+		flags |= FlagCommandPatterns
+	}
+	return flags
+}
+
 // WriteTo serializes an intent block and implements the io.WriterTo interface
 func (i *Intent) WriteTo(w io.Writer) (int64, error) {
 	var written int64
-	// write grantType and reserved byte
-	n, err := w.Write([]byte{byte(i.GrantType), i.Reserved})
+	// write grantType and flags
+	flags := i.wireFlags()
+	n, err := w.Write([]byte{byte(i.GrantType), flags})
 	written += int64(n)
 	if err != nil {
 		return written, err
@@ -196,6 +288,19 @@ func (i *Intent) WriteTo(w io.Writer) (int64, error) {
 		return written, err
 	}
 	written += 8
+	// write usage limits
+	if flags&FlagUsageLimits != 0 {
+		err = binary.Write(w, binary.BigEndian, i.MaxUses)
+		if err != nil {
+			return written, err
+		}
+		written += 2
+		err = binary.Write(w, binary.BigEndian, uint32(i.MinInterval/time.Second))
+		if err != nil {
+			return written, err
+		}
+		written += 4
+	}
 	// write targetSNI
 	targetSNILen, err := i.TargetSNI.WriteTo(w)
 	written += targetSNILen
@@ -218,13 +323,21 @@ func (i *Intent) WriteTo(w io.Writer) (int64, error) {
 	var assocDataLen int64
 	switch i.GrantType {
 	case Command:
-		assocDataLen, err = i.AssociatedData.CommandGrantData.WriteTo(w)
+		if flags&FlagCommandPatterns != 0 {
+			assocDataLen, err = i.AssociatedData.CommandGrantData.WriteTo(w)
+		} else {
+			assocDataLen, err = common.WriteString(i.AssociatedData.CommandGrantData.Cmd, w)
+		}
 	case Shell:
 		assocDataLen, err = i.AssociatedData.ShellGrantData.WriteTo(w)
 	case LocalPF:
 		assocDataLen, err = i.AssociatedData.LocalPFGrantData.WriteTo(w)
 	case RemotePF:
 		assocDataLen, err = i.AssociatedData.RemotePFGrantData.WriteTo(w)
+	case FileRead, FileWrite:
+		assocDataLen, err = i.AssociatedData.FileGrantData.WriteTo(w)
+	case Subsystem:
+		assocDataLen, err = common.WriteString(i.AssociatedData.SubsystemGrantData.Name, w)
 	}
 	written += assocDataLen
 	if err != nil {
@@ -237,18 +350,20 @@ func (i *Intent) WriteTo(w io.Writer) (int64, error) {
 // ReadFrom reads a serialized intent block
 func (i *Intent) ReadFrom(r io.Reader) (int64, error) {
 	var bytesRead int64
-	// read grantType and reserved byte
+	// read grantType and flags
 	err := binary.Read(r, binary.BigEndian, &i.GrantType)
 	if err != nil {
 		return bytesRead, err
 	}
 	bytesRead++
 
-	err = binary.Read(r, binary.BigEndian, &i.Reserved)
+	var flags byte
+	err = binary.Read(r, binary.BigEndian, &flags)
 	if err != nil {
 		return bytesRead, err
 	}
 	bytesRead++
+	i.Flags = flags &^ (FlagUsageLimits | FlagCommandPatterns)
 	// read target port
 	err = binary.Read(r, binary.BigEndian, &i.TargetPort)
 	if err != nil {
@@ -281,6 +396,22 @@ func (i *Intent) ReadFrom(r io.Reader) (int64, error) {
 	bytesRead += 8
 	logrus.Debugf("after reading exp time of intent request, read %v bytes so far.", bytesRead)
 	i.ExpTime = time.Unix(int64(t), 0)
+	// read usage limits
+	i.MaxUses, i.MinInterval = 0, 0
+	if flags&FlagUsageLimits != 0 {
+		err = binary.Read(r, binary.BigEndian, &i.MaxUses)
+		if err != nil {
+			return bytesRead, err
+		}
+		bytesRead += 2
+		var interval uint32
+		err = binary.Read(r, binary.BigEndian, &interval)
+		if err != nil {
+			return bytesRead, err
+		}
+		bytesRead += 4
+		i.MinInterval = time.Duration(interval) * time.Second
+	}
 	// read targetSNI
 	n, err := i.TargetSNI.ReadFrom(r)
 	if err != nil {
@@ -307,13 +438,22 @@ func (i *Intent) ReadFrom(r io.Reader) (int64, error) {
 	var assocDataBytes int64
 	switch i.GrantType {
 	case Command:
-		assocDataBytes, err = i.AssociatedData.CommandGrantData.ReadFrom(r)
+		if flags&FlagCommandPatterns != 0 {
+			assocDataBytes, err = i.AssociatedData.CommandGrantData.ReadFrom(r)
+		} else {
+			i.AssociatedData.CommandGrantData = CommandGrantData{}
+			i.AssociatedData.CommandGrantData.Cmd, assocDataBytes, err = common.ReadString(r)
+		}
 	case Shell:
 		assocDataBytes, err = i.AssociatedData.ShellGrantData.ReadFrom(r)
 	case LocalPF:
 		assocDataBytes, err = i.AssociatedData.LocalPFGrantData.ReadFrom(r)
 	case RemotePF:
 		assocDataBytes, err = i.AssociatedData.RemotePFGrantData.ReadFrom(r)
+	case FileRead, FileWrite:
+		assocDataBytes, err = i.AssociatedData.FileGrantData.ReadFrom(r)
+	case Subsystem:
+		i.AssociatedData.SubsystemGrantData.Name, assocDataBytes, err = common.ReadString(r)
 	}
 
 	if err != nil {
@@ -324,18 +464,92 @@ func (i *Intent) ReadFrom(r io.Reader) (int64, error) {
 	return bytesRead, nil
 }
 
-// WriteTo serializes command grant data  and implements the io.WriterTo interface
+// WriteTo serializes command grant data as cmd || pattern count || (kind ||
+// pattern)* || flag count || flag*, and implements the io.WriterTo interface
 func (d *CommandGrantData) WriteTo(w io.Writer) (int64, error) {
-	return common.WriteString(d.Cmd, w)
+	if len(d.Argv) > math.MaxUint8 || len(d.AllowedFlags) > math.MaxUint8 {
+		return 0, fmt.Errorf("too many argument patterns or flags")
+	}
+	written, err := common.WriteString(d.Cmd, w)
+	if err != nil {
+		return written, err
+	}
+	n, err := w.Write([]byte{byte(len(d.Argv))})
+	written += int64(n)
+	if err != nil {
+		return written, err
+	}
+	for _, p := range d.Argv {
+		n, err := w.Write([]byte{p.Kind})
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+		patLen, err := common.WriteString(p.Pattern, w)
+		written += patLen
+		if err != nil {
+			return written, err
+		}
+	}
+	n, err = w.Write([]byte{byte(len(d.AllowedFlags))})
+	written += int64(n)
+	if err != nil {
+		return written, err
+	}
+	for _, f := range d.AllowedFlags {
+		flagLen, err := common.WriteString(f, w)
+		written += flagLen
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
 }
 
 // ReadFrom reads a serialized commandgrantdata block
 func (d *CommandGrantData) ReadFrom(r io.Reader) (int64, error) {
 	// read command
-	cmd, cmdBytes, err := common.ReadString(r)
+	cmd, bytesRead, err := common.ReadString(r)
 	d.Cmd = cmd
-	return cmdBytes, err
-
+	if err != nil {
+		return bytesRead, err
+	}
+	// read argument patterns
+	var count byte
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return bytesRead, err
+	}
+	bytesRead++
+	d.Argv = nil
+	for range count {
+		var p ArgPattern
+		if err := binary.Read(r, binary.BigEndian, &p.Kind); err != nil {
+			return bytesRead, err
+		}
+		bytesRead++
+		var patLen int64
+		p.Pattern, patLen, err = common.ReadString(r)
+		bytesRead += patLen
+		if err != nil {
+			return bytesRead, err
+		}
+		d.Argv = append(d.Argv, p)
+	}
+	// read allowed flags
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return bytesRead, err
+	}
+	bytesRead++
+	d.AllowedFlags = nil
+	for range count {
+		f, flagLen, err := common.ReadString(r)
+		bytesRead += flagLen
+		if err != nil {
+			return bytesRead, err
+		}
+		d.AllowedFlags = append(d.AllowedFlags, f)
+	}
+	return bytesRead, nil
 }
 
 // WriteTo writes serialized shell grant data
@@ -348,26 +562,87 @@ func (d *ShellGrantData) ReadFrom(r io.Reader) (int64, error) {
 	return 0, nil
 }
 
+// writePFGrantData writes network || address
+func writePFGrantData(w io.Writer, network byte, address string) (int64, error) {
+	n, err := w.Write([]byte{network})
+	if err != nil {
+		return int64(n), err
+	}
+	addrLen, err := common.WriteString(address, w)
+	return int64(n) + addrLen, err
+}
+
+// readPFGrantData reads network || address
+func readPFGrantData(r io.Reader) (byte, string, int64, error) {
+	var network byte
+	err := binary.Read(r, binary.BigEndian, &network)
+	if err != nil {
+		return 0, "", 0, err
+	}
+	address, addrBytes, err := common.ReadString(r)
+	return network, address, 1 + addrBytes, err
+}
+
 // WriteTo writes serialized local pf grant data
 func (d *LocalPFGrantData) WriteTo(w io.Writer) (int64, error) {
-	panic("LocalPFGrantData WriteTo: unimplemented")
+	return writePFGrantData(w, d.Network, d.Address)
 }
 
-// ReadFrom reads a serialized commandgrantdata block
+// ReadFrom reads a serialized localpfgrantdata block
 func (d *LocalPFGrantData) ReadFrom(r io.Reader) (int64, error) {
-	// read command
-	panic("LocalPFGrantData ReadFrom: unimplemented")
+	var n int64
+	var err error
+	d.Network, d.Address, n, err = readPFGrantData(r)
+	return n, err
 }
 
 // WriteTo writes serialized remote pf grant data
 func (d *RemotePFGrantData) WriteTo(w io.Writer) (int64, error) {
-	panic("RemotePFGrantData WriteTo: unimplemented")
+	return writePFGrantData(w, d.Network, d.Address)
 }
 
-// ReadFrom reads a serialized commandgrantdata block
+// ReadFrom reads a serialized remotepfgrantdata block
 func (d *RemotePFGrantData) ReadFrom(r io.Reader) (int64, error) {
-	// read command
-	panic("RemotePFGrantData ReadFrom: unimplemented")
+	var n int64
+	var err error
+	d.Network, d.Address, n, err = readPFGrantData(r)
+	return n, err
+}
+
+// WriteTo serializes file grant data as path || max size || mode
+func (d *FileGrantData) WriteTo(w io.Writer) (int64, error) {
+	if len(d.Path) > maxFilePath {
+		return 0, fmt.Errorf("file grant path too long")
+	}
+	written, err := common.WriteString(d.Path, w)
+	if err != nil {
+		return written, err
+	}
+	if err := binary.Write(w, binary.BigEndian, d.MaxSize); err != nil {
+		return written, err
+	}
+	written += 8
+	if err := binary.Write(w, binary.BigEndian, d.Mode); err != nil {
+		return written, err
+	}
+	return written + 4, nil
+}
+
+// ReadFrom reads a serialized filegrantdata block
+func (d *FileGrantData) ReadFrom(r io.Reader) (int64, error) {
+	path, bytesRead, err := common.ReadString(r)
+	d.Path = path
+	if err != nil {
+		return bytesRead, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &d.MaxSize); err != nil {
+		return bytesRead, err
+	}
+	bytesRead += 8
+	if err := binary.Read(r, binary.BigEndian, &d.Mode); err != nil {
+		return bytesRead, err
+	}
+	return bytesRead + 4, nil
 }
 
 // ReadIntentRequest reads intent request and returns intent
@@ -425,16 +700,51 @@ func WriteIntentDenied(w io.Writer, reason string) error {
 	return err
 }
 
-// WriteIntentConfirmation writes intent confirmation
-func WriteIntentConfirmation(w io.Writer) error {
+// WriteIntentConfirmation writes intent confirmation of the grant with id
+func WriteIntentConfirmation(w io.Writer, id GrantID) error {
 	m := AgMessage{
 		MsgType: IntentConfirmation,
+		Data: MessageData{
+			GrantID: id,
+		},
 	}
 	n, err := m.WriteTo(w)
 	logrus.Debugf("wrote %v bytes of intent confirmation", n)
 	return err
 }
 
+// WriteIntentRevoke writes intent revoke message for the grant with id
+func WriteIntentRevoke(w io.Writer, id GrantID) error {
+	m := AgMessage{
+		MsgType: IntentRevoke,
+		Data: MessageData{
+			GrantID: id,
+		},
+	}
+	n, err := m.WriteTo(w)
+	logrus.Debugf("wrote %v bytes of intent revoke", n)
+	return err
+}
+
+// RevokeAuthgrant asks the target at the other end of rw to revoke the grant
+// with id, and errors with the reason if the target refuses
+func RevokeAuthgrant(rw io.ReadWriter, id GrantID) error {
+	if err := WriteIntentRevoke(rw, id); err != nil {
+		return err
+	}
+	resp, err := ReadConfOrDenial(rw)
+	if err != nil {
+		return err
+	}
+	if resp.MsgType == IntentDenied {
+		return fmt.Errorf("target refused to revoke grant %s: %s", id, resp.Data.Denial)
+	}
+	if resp.Data.GrantID != id {
+		return fmt.Errorf("target confirmed revoking grant %s, not %s", resp.Data.GrantID, id)
+	}
+	return nil
+}
+
 // WriteIntentCommunication writes intent communication messages
 func WriteIntentCommunication(w io.Writer, i Intent) error {
 	m := AgMessage{
@@ -448,6 +758,21 @@ func WriteIntentCommunication(w io.Writer, i Intent) error {
 	return err
 }
 
+// WriteIntentSubGrant writes an intent sub-grant message, asking for a
+// sub-grant of the grant with parent
+func WriteIntentSubGrant(w io.Writer, parent GrantID, i Intent) error {
+	m := AgMessage{
+		MsgType: IntentSubGrant,
+		Data: MessageData{
+			Intent:  i,
+			GrantID: parent,
+		},
+	}
+	n, err := m.WriteTo(w)
+	logrus.Debugf("wrote %v bytes of intent sub-grant", n)
+	return err
+}
+
 // WriteIntentRequest writes intent request message
 func WriteIntentRequest(w io.Writer, i Intent) error {
 	m := AgMessage{
@@ -460,6 +785,34 @@ func WriteIntentRequest(w io.Writer, i Intent) error {
 	return err
 }
 
+// Delegable reports whether the intent asks for a grant the delegate may pass
+// on sub-grants of
+func (i *Intent) Delegable() bool {
+	return i.Flags&FlagDelegable != 0
+}
+
+// UsageString describes the usage limits of the intent, e.g. "up to 10 times,
+// at most once every 1m0s"
+func (i *Intent) UsageString() string {
+	return usageString(i.MaxUses, i.MinInterval)
+}
+
+func usageString(maxUses uint16, minInterval time.Duration) string {
+	var uses string
+	switch maxUses {
+	case 0, 1:
+		uses = "once"
+	case UnlimitedUses:
+		uses = "any number of times"
+	default:
+		uses = fmt.Sprintf("up to %d times", maxUses)
+	}
+	if minInterval > 0 && maxUses > 1 {
+		uses += fmt.Sprintf(", at most once every %s", minInterval)
+	}
+	return uses
+}
+
 // TargetURL gives url of target of intent
 func (i Intent) TargetURL() core.URL {
 	return core.URL{
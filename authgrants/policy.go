@@ -0,0 +1,316 @@
+package authgrants
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/sirupsen/logrus"
+
+	"hop.computer/hop/certs"
+	"hop.computer/hop/pkg/glob"
+	"hop.computer/hop/pkg/thunks"
+)
+
+// Principal policy: a list of rules that decide intent requests without asking
+// the user. The first rule that matches an intent decides it, and intents that
+// match no rule get the default action. Every decision is logged.
+//
+// An example policy file:
+//
+//	Default = "prompt"
+//
+//	[[Rules]]
+//	Delegate = "bastion.example.com"
+//	Target = "git.example.com"
+//	User = "git"
+//	GrantTypes = ["command"]
+//	Command = "git-upload-pack *"
+//	MaxLifetime = "10m"
+//	Action = "allow"
+//
+//	[[Rules]]
+//	GrantTypes = ["shell"]
+//	Action = "deny"
+
+// PolicyAction is the decision of a policy rule
+type PolicyAction string
+
+// Policy actions
+const (
+	PolicyAllow  = PolicyAction("allow")
+	PolicyDeny   = PolicyAction("deny")
+	PolicyPrompt = PolicyAction("prompt")
+)
+
+// ErrPolicyDenied is returned for intents denied by a Policy
+var ErrPolicyDenied = errors.New("denied by authgrant policy")
+
+// PolicyRule matches intent requests. Empty patterns match anything. Patterns
+// are globs, where * matches any string. Exact commands run in a shell, so an
+// allow rule with a Command only allows commands without shell syntax or glob
+// characters, and prompts for the others.
+type PolicyRule struct {
+	Delegate string // the server the delegate is connected to
+	Target   string // the target SNI
+	User     string // the target username
+	Command  string // the command, or the argument patterns, of command grants
+	Address  string // the address of port forwarding grants
+	Path     string // the path of file grants
+
+	// Subsystem matches the name of subsystem grants
+	Subsystem string
+
+	// GrantTypes are from "shell", "command", "localpf", "remotepf",
+	// "fileread", "filewrite", "subsystem" and "acme". Empty matches every grant type.
+	GrantTypes []string
+
+	// Flags are the allowed flags a command pattern grant may have for an
+	// allow rule with a Command to allow it without asking
+	Flags []string
+
+	// MaxLifetime, if set, only matches intents that expire at most
+	// MaxLifetime from now
+	MaxLifetime time.Duration
+
+	// AllowDelegation lets an allow rule match delegable intents, whose
+	// delegates may pass on sub-grants
+	AllowDelegation bool
+
+	Action PolicyAction
+}
+
+// Policy decides intent requests on the principal
+type Policy struct {
+	Default PolicyAction // the action for intents that match no rule. Prompt if empty.
+	Rules   []PolicyRule
+}
+
+// String returns the name of the grant type used in policies
+func (t GrantType) String() string {
+	switch t {
+	case Shell:
+		return "shell"
+	case Command:
+		return "command"
+	case LocalPF:
+		return "localpf"
+	case RemotePF:
+		return "remotepf"
+	case Acme:
+		return "acme"
+	case FileRead:
+		return "fileread"
+	case FileWrite:
+		return "filewrite"
+	case Subsystem:
+		return "subsystem"
+	default:
+		return fmt.Sprintf("GrantType(%d)", byte(t))
+	}
+}
+
+// ParsePolicy parses a TOML policy
+func ParsePolicy(data []byte) (*Policy, error) {
+	p := new(Policy)
+	meta, err := toml.NewDecoder(bytes.NewReader(data)).Decode(p)
+	if err != nil {
+		return nil, err
+	}
+	if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+		return nil, fmt.Errorf("unknown policy key %q", undecoded[0].String())
+	}
+	if p.Default == "" {
+		p.Default = PolicyPrompt
+	}
+	if !validPolicyAction(p.Default) {
+		return nil, fmt.Errorf("invalid default action %q", p.Default)
+	}
+	for i, r := range p.Rules {
+		if !validPolicyAction(r.Action) {
+			return nil, fmt.Errorf("rule %d: invalid action %q", i+1, r.Action)
+		}
+		for _, g := range r.GrantTypes {
+			if !validGrantName(g) {
+				return nil, fmt.Errorf("rule %d: unknown grant type %q", i+1, g)
+			}
+		}
+		for _, f := range r.Flags {
+			if !strings.HasPrefix(f, "-") {
+				return nil, fmt.Errorf("rule %d: invalid flag %q", i+1, f)
+			}
+		}
+	}
+	return p, nil
+}
+
+// LoadPolicyFile reads and parses the policy file at path
+func LoadPolicyFile(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p, err := ParsePolicy(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return p, nil
+}
+
+func validPolicyAction(a PolicyAction) bool {
+	return a == PolicyAllow || a == PolicyDeny || a == PolicyPrompt
+}
+
+func validGrantName(name string) bool {
+	for _, t := range []GrantType{Shell, Command, LocalPF, RemotePF, Acme, FileRead, FileWrite, Subsystem} {
+		if t.String() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPattern matches input against a policy pattern. An empty pattern
+// matches anything.
+func matchPattern(pattern, input string) bool {
+	if pattern == "" {
+		return true
+	}
+	if input == "" {
+		return strings.Trim(pattern, "*") == ""
+	}
+	return glob.Glob(pattern, input)
+}
+
+// intentAddress returns the address of a port forwarding intent
+func intentAddress(i *Intent) string {
+	switch i.GrantType {
+	case LocalPF:
+		return i.AssociatedData.LocalPFGrantData.Address
+	case RemotePF:
+		return i.AssociatedData.RemotePFGrantData.Address
+	}
+	return ""
+}
+
+// matches reports whether r matches an intent from a delegate connected to
+// delegateHost
+func (r *PolicyRule) matches(delegateHost string, i *Intent) bool {
+	if len(r.GrantTypes) > 0 {
+		found := false
+		for _, g := range r.GrantTypes {
+			found = found || g == i.GrantType.String()
+		}
+		if !found {
+			return false
+		}
+	}
+	if r.Command != "" && (i.GrantType != Command || !matchPattern(r.Command, i.AssociatedData.CommandGrantData.argvString())) {
+		return false
+	}
+	if r.Address != "" && !matchPattern(r.Address, intentAddress(i)) {
+		return false
+	}
+	if r.Path != "" && ((i.GrantType != FileRead && i.GrantType != FileWrite) || !matchPattern(r.Path, i.AssociatedData.FileGrantData.Path)) {
+		return false
+	}
+	if r.Subsystem != "" && (i.GrantType != Subsystem || !matchPattern(r.Subsystem, i.AssociatedData.SubsystemGrantData.Name)) {
+		return false
+	}
+	if r.MaxLifetime > 0 && i.ExpTime.Sub(thunks.TimeNow()) > r.MaxLifetime {
+		return false
+	}
+	if r.Action == PolicyAllow && i.Delegable() && !r.AllowDelegation {
+		return false
+	}
+	return matchPattern(r.Delegate, delegateHost) &&
+		matchPattern(r.Target, string(i.TargetSNI.Label)) &&
+		matchPattern(r.User, i.TargetUsername)
+}
+
+// allowsCommand reports whether an allow rule with a Command may allow the
+// command intent i without asking the user
+func (r *PolicyRule) allowsCommand(i *Intent) bool {
+	d := &i.AssociatedData.CommandGrantData
+	if d.IsPattern() {
+		for _, f := range d.AllowedFlags {
+			if !slices.Contains(r.Flags, f) {
+				return false
+			}
+		}
+		return true
+	}
+	_, ok := shellLiteral(d.Cmd)
+	return ok
+}
+
+// Decide returns the action for an intent from a delegate connected to
+// delegateHost, and the index of the rule that decided it, or -1 for the
+// default action.
+func (p *Policy) Decide(delegateHost string, i *Intent) (PolicyAction, int) {
+	for n := range p.Rules {
+		r := &p.Rules[n]
+		if !r.matches(delegateHost, i) {
+			continue
+		}
+		if r.Action == PolicyAllow && r.Command != "" && !r.allowsCommand(i) {
+			return PolicyPrompt, n
+		}
+		return r.Action, n
+	}
+	return p.Default, -1
+}
+
+// CheckIntentCallback returns a CheckIntentCallback for intents from delegates
+// connected to delegateHost. Intents that the policy neither allows nor denies
+// are passed to prompt, and denied if prompt is nil.
+func (p *Policy) CheckIntentCallback(delegateHost string, prompt CheckIntentCallback) CheckIntentCallback {
+	return func(i Intent, c *certs.Certificate) error {
+		action, rule := p.Decide(delegateHost, &i)
+		log := logrus.WithFields(logrus.Fields{
+			"delegate":  delegateHost,
+			"target":    string(i.TargetSNI.Label),
+			"user":      i.TargetUsername,
+			"grant":     i.GrantType.String(),
+			"expires":   i.ExpTime,
+			"uses":      i.UsageString(),
+			"delegable": i.Delegable(),
+			"rule":      rule + 1, // 0 for the default action
+		})
+		switch i.GrantType {
+		case Command:
+			log = log.WithField("command", i.AssociatedData.CommandGrantData.String())
+		case LocalPF, RemotePF:
+			log = log.WithField("address", intentAddress(&i))
+		case FileRead, FileWrite:
+			log = log.WithField("file", i.AssociatedData.FileGrantData.String())
+		case Subsystem:
+			log = log.WithField("subsystem", i.AssociatedData.SubsystemGrantData.Name)
+		}
+
+		switch action {
+		case PolicyAllow:
+			log.Info("principal: policy allowed intent")
+			return nil
+		case PolicyPrompt:
+			if prompt == nil {
+				log.Info("principal: policy denied intent: nobody to prompt")
+				return ErrPolicyDenied
+			}
+			if err := prompt(i, c); err != nil {
+				log.Infof("principal: user denied intent: %s", err)
+				return err
+			}
+			log.Info("principal: user allowed intent")
+			return nil
+		default:
+			log.Info("principal: policy denied intent")
+			return ErrPolicyDenied
+		}
+	}
+}
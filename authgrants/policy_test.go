@@ -0,0 +1,177 @@
+package authgrants
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+
+	"hop.computer/hop/certs"
+)
+
+const testPolicy = `
+[[Rules]]
+Delegate = "bastion.example.com"
+Target = "git.example.com"
+User = "git"
+GrantTypes = ["command"]
+Command = "git-upload-pack *"
+MaxLifetime = "10m"
+Action = "allow"
+
+[[Rules]]
+GrantTypes = ["localpf", "remotepf"]
+Address = "127.0.0.1:*"
+Action = "prompt"
+
+[[Rules]]
+Target = "*.prod.example.com"
+Action = "deny"
+
+[[Rules]]
+GrantTypes = ["filewrite"]
+Path = "/srv/releases/*"
+Action = "allow"
+
+[[Rules]]
+Subsystem = "sftp"
+Action = "allow"
+`
+
+func policyTestIntent(grantType GrantType, target, cmd string, lifetime time.Duration) Intent {
+	start := time.Now()
+	i := Intent{
+		GrantType:      grantType,
+		StartTime:      start,
+		ExpTime:        start.Add(lifetime),
+		TargetSNI:      certs.DNSName(target),
+		TargetUsername: "git",
+	}
+	i.AssociatedData.CommandGrantData.Cmd = cmd
+	i.AssociatedData.LocalPFGrantData.Address = cmd
+	i.AssociatedData.FileGrantData.Path = cmd
+	i.AssociatedData.SubsystemGrantData.Name = cmd
+	return i
+}
+
+func TestPolicyDecide(t *testing.T) {
+	p, err := ParsePolicy([]byte(testPolicy))
+	assert.NilError(t, err)
+	assert.Equal(t, p.Default, PolicyPrompt)
+	delegable := policyTestIntent(Command, "git.example.com", "git-upload-pack 'hop.git'", time.Minute)
+	delegable.Flags = FlagDelegable
+	later := policyTestIntent(Command, "git.example.com", "git-upload-pack 'hop.git'", time.Minute)
+	later.StartTime = later.StartTime.Add(time.Hour)
+	later.ExpTime = later.ExpTime.Add(time.Hour)
+
+	for _, tc := range []struct {
+		delegate string
+		intent   Intent
+		action   PolicyAction
+		rule     int
+	}{
+		{"bastion.example.com", policyTestIntent(Command, "git.example.com", "git-upload-pack 'hop.git'", time.Minute), PolicyAllow, 0},
+		// Too long a lifetime, the wrong delegate or the wrong command fall through
+		{"bastion.example.com", policyTestIntent(Command, "git.example.com", "git-upload-pack 'hop.git'", time.Hour), PolicyPrompt, -1},
+		{"bastion.example.com", later, PolicyPrompt, -1},
+		{"laptop.example.com", policyTestIntent(Command, "git.example.com", "git-upload-pack 'hop.git'", time.Minute), PolicyPrompt, -1},
+		{"bastion.example.com", policyTestIntent(Command, "git.example.com", "git-receive-pack 'hop.git'", time.Minute), PolicyPrompt, -1},
+		{"bastion.example.com", policyTestIntent(Shell, "git.example.com", "", time.Minute), PolicyPrompt, -1},
+		// Commands that a shell would not run as they read are not allowed
+		{"bastion.example.com", policyTestIntent(Command, "git.example.com", "git-upload-pack x; rm -rf ~", time.Minute), PolicyPrompt, 0},
+		{"bastion.example.com", policyTestIntent(Command, "git.example.com", "git-upload-pack $(id)", time.Minute), PolicyPrompt, 0},
+		{"bastion.example.com", policyTestIntent(Command, "git.example.com", "git-upload-pack /*", time.Minute), PolicyPrompt, 0},
+		// Allow rules only match delegable intents with AllowDelegation
+		{"bastion.example.com", delegable, PolicyPrompt, -1},
+		{"bastion.example.com", policyTestIntent(LocalPF, "db.prod.example.com", "127.0.0.1:5432", time.Minute), PolicyPrompt, 1},
+		{"bastion.example.com", policyTestIntent(LocalPF, "db.prod.example.com", "10.0.0.1:5432", time.Minute), PolicyDeny, 2},
+		{"bastion.example.com", policyTestIntent(Shell, "web.prod.example.com", "", time.Minute), PolicyDeny, 2},
+		// File rules match the path of file grants of the right type
+		{"bastion.example.com", policyTestIntent(FileWrite, "web.example.com", "/srv/releases/app.tar", time.Minute), PolicyAllow, 3},
+		{"bastion.example.com", policyTestIntent(FileWrite, "web.example.com", "/srv/app.tar", time.Minute), PolicyPrompt, -1},
+		{"bastion.example.com", policyTestIntent(FileRead, "web.example.com", "/srv/releases/app.tar", time.Minute), PolicyPrompt, -1},
+		// Subsystem rules match the name of subsystem grants
+		{"bastion.example.com", policyTestIntent(Subsystem, "web.example.com", "sftp", time.Minute), PolicyAllow, 4},
+		{"bastion.example.com", policyTestIntent(Subsystem, "web.example.com", "backup", time.Minute), PolicyPrompt, -1},
+		{"bastion.example.com", policyTestIntent(Command, "web.example.com", "sftp", time.Minute), PolicyPrompt, -1},
+	} {
+		action, rule := p.Decide(tc.delegate, &tc.intent)
+		assert.Equal(t, action, tc.action, "%s %s %q", tc.intent.GrantType, tc.intent.TargetSNI.Label, tc.intent.AssociatedData.CommandGrantData.Cmd)
+		assert.Equal(t, rule, tc.rule)
+	}
+}
+
+func TestPolicyCommandPatterns(t *testing.T) {
+	p, err := ParsePolicy([]byte(`
+[[Rules]]
+GrantTypes = ["command"]
+Command = "rsync * /srv/backup/*"
+Flags = ["-a", "--delete"]
+Action = "allow"
+`))
+	assert.NilError(t, err)
+	for _, tc := range []struct {
+		pattern string
+		flags   []string
+		action  PolicyAction
+		rule    int
+	}{
+		{"rsync * /srv/backup/*", []string{"-a"}, PolicyAllow, 0},
+		{"rsync * /srv/backup/*", nil, PolicyAllow, 0},
+		// Flags the rule does not list need the user to allow them
+		{"rsync * /srv/backup/*", []string{"-a", "-e"}, PolicyPrompt, 0},
+		{"rsync * /srv/*", []string{"-a"}, PolicyPrompt, -1},
+	} {
+		i := policyTestIntent(Command, "web.example.com", "", time.Minute)
+		i.AssociatedData.CommandGrantData, err = ParseCommandPattern(tc.pattern, tc.flags)
+		assert.NilError(t, err)
+		action, rule := p.Decide("bastion.example.com", &i)
+		assert.Equal(t, action, tc.action, "%s %v", tc.pattern, tc.flags)
+		assert.Equal(t, rule, tc.rule)
+	}
+
+	_, err = ParsePolicy([]byte("[[Rules]]\nFlags = [\"a\"]\nAction = \"allow\""))
+	assert.ErrorContains(t, err, "invalid flag")
+}
+
+func TestPolicyCheckIntentCallback(t *testing.T) {
+	p, err := ParsePolicy([]byte(testPolicy))
+	assert.NilError(t, err)
+	prompted := 0
+	errNo := errors.New("no")
+	prompt := func(Intent, *certs.Certificate) error {
+		prompted++
+		return errNo
+	}
+
+	check := p.CheckIntentCallback("bastion.example.com", prompt)
+	assert.NilError(t, check(policyTestIntent(Command, "git.example.com", "git-upload-pack 'hop.git'", time.Minute), nil))
+	assert.Equal(t, prompted, 0)
+	err = check(policyTestIntent(Shell, "web.prod.example.com", "", time.Minute), nil)
+	assert.Assert(t, errors.Is(err, ErrPolicyDenied))
+	assert.Equal(t, prompted, 0)
+	err = check(policyTestIntent(Shell, "git.example.com", "", time.Minute), nil)
+	assert.Assert(t, errors.Is(err, errNo))
+	assert.Equal(t, prompted, 1)
+
+	// Without a prompt, undecided intents are denied
+	check = p.CheckIntentCallback("bastion.example.com", nil)
+	err = check(policyTestIntent(Shell, "git.example.com", "", time.Minute), nil)
+	assert.Assert(t, errors.Is(err, ErrPolicyDenied))
+}
+
+func TestParsePolicyErrors(t *testing.T) {
+	for _, policy := range []string{
+		`Default = "maybe"`,
+		"[[Rules]]\nAction = \"sure\"",
+		"[[Rules]]\nGrantTypes = [\"sudo\"]\nAction = \"allow\"",
+		"[[Rules]]\nCmd = \"ls\"\nAction = \"allow\"",
+	} {
+		_, err := ParsePolicy([]byte(policy))
+		assert.Assert(t, err != nil, policy)
+	}
+	p, err := ParsePolicy([]byte(`Default = "deny"`))
+	assert.NilError(t, err)
+	assert.Equal(t, p.Default, PolicyDeny)
+}
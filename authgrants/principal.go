@@ -28,10 +28,23 @@ type principalInstance struct {
 
 	checkIntent     CheckIntentCallback
 	setUpTargetConn setUpTargetConnCallback
+
+	// parentFor, if set, makes the instance a delegate acting as principal:
+	// it returns the held grant that intents are sub-grants of
+	parentFor ParentGrantCallback
+
+	audit     *AuditLog
+	principal *certs.Certificate // the certificate of this principal, if known
 }
 
+// ParentGrantCallback returns the ID of a held delegable grant that
+// attenuates i, if there is one
+type ParentGrantCallback func(i Intent) (GrantID, bool)
+
 // StartPrincipalInstance creates and runs a new principal instance. errors if su is nil. Caller responsible for closing delegateConn
-func StartPrincipalInstance(dc net.Conn, ci CheckIntentCallback, su setUpTargetConnCallback) error {
+// The outcome of every intent request is recorded to audit as made by the
+// principal with certificate principal.
+func StartPrincipalInstance(dc net.Conn, ci CheckIntentCallback, su setUpTargetConnCallback, audit *AuditLog, principal *certs.Certificate) error {
 	if su == nil {
 		return fmt.Errorf("principal: must provide non-nil set up target function")
 	}
@@ -40,6 +53,8 @@ func StartPrincipalInstance(dc net.Conn, ci CheckIntentCallback, su setUpTargetC
 		delegateConn:    dc,
 		checkIntent:     ci,
 		setUpTargetConn: su,
+		audit:           audit,
+		principal:       principal,
 	}
 
 	if ci == nil {
@@ -51,6 +66,32 @@ func StartPrincipalInstance(dc net.Conn, ci CheckIntentCallback, su setUpTargetC
 	return nil
 }
 
+// StartChainedPrincipalInstance runs a principal instance for a delegate that
+// passes on sub-grants of the grants it holds. Intents are sent to the target
+// as sub-grants of the grant parentFor returns for them, and denied if it
+// returns none. su, audit and principal are as in StartPrincipalInstance.
+func StartChainedPrincipalInstance(dc net.Conn, ci CheckIntentCallback, parentFor ParentGrantCallback, su setUpTargetConnCallback, audit *AuditLog, principal *certs.Certificate) error {
+	if su == nil || parentFor == nil {
+		return fmt.Errorf("principal: must provide non-nil set up target and parent grant functions")
+	}
+
+	pi := principalInstance{
+		delegateConn:    dc,
+		checkIntent:     ci,
+		setUpTargetConn: su,
+		parentFor:       parentFor,
+		audit:           audit,
+		principal:       principal,
+	}
+
+	if ci == nil {
+		pi.checkIntent = defaultRejectAll
+	}
+
+	pi.run()
+	return nil
+}
+
 func defaultRejectAll(i Intent, c *certs.Certificate) error {
 	return fmt.Errorf("default checkIntent func rejects all intent requests")
 }
@@ -89,15 +130,25 @@ func (p *principalInstance) handleIntentRequest() error {
 func (p *principalInstance) doIntentRequestChecks(i Intent) error {
 	targURL := i.TargetURL()
 	if p.targetConnected && p.targetInfo != targURL {
-		return WriteIntentDenied(p.delegateConn, "principal: received intent request for different target")
+		return p.deny(&i, 0, AuditDenied, "principal: received intent request for different target")
+	}
+
+	var parent GrantID
+	if p.parentFor != nil {
+		var ok bool
+		if parent, ok = p.parentFor(i); !ok {
+			return p.deny(&i, 0, AuditDenied, "principal: no held grant can be narrowed to the intent")
+		}
 	}
 
 	if !p.targetConnected {
 		logrus.Info("principal: not connected to target")
+		var denied error
 		checkIntentWithCert := func(cert *certs.Certificate) error {
 			p.targetCert = cert
 			err := p.checkIntent(i, cert)
 			if err != nil {
+				denied = err
 				WriteIntentDenied(p.delegateConn, err.Error())
 			}
 			return err
@@ -105,33 +156,63 @@ func (p *principalInstance) doIntentRequestChecks(i Intent) error {
 		tc, err := p.setUpTargetConn(targURL, checkIntentWithCert)
 		if err != nil {
 			logrus.Info("principal: error setting up target connection")
+			if denied != nil {
+				p.record(&i, parent, AuditDenied, denied.Error(), 0)
+			} else {
+				p.record(&i, parent, AuditFailed, err.Error(), 0)
+			}
 			return WriteIntentDenied(p.delegateConn, fmt.Sprintf("principal: target setup failed: %s", err))
 		}
 		p.targetConn = tc
 		p.targetInfo = targURL
 		p.targetConnected = true
 		logrus.Info("principal: connected to target")
-	} else {
-		p.checkIntent(i, p.targetCert)
+	} else if err := p.checkIntent(i, p.targetCert); err != nil {
+		return p.deny(&i, parent, AuditDenied, err.Error())
 	}
 
-	err := WriteIntentCommunication(p.targetConn, i)
+	var err error
+	if p.parentFor != nil {
+		logrus.Infof("principal: requesting sub-grant of grant %s", parent)
+		err = WriteIntentSubGrant(p.targetConn, parent, i)
+	} else {
+		err = WriteIntentCommunication(p.targetConn, i)
+	}
 	if err != nil {
 		logrus.Error("principal: error writing intent communication")
-		return WriteIntentDenied(p.delegateConn, fmt.Sprintf("principal: error sending intent comm: %s", err))
+		return p.deny(&i, parent, AuditFailed, fmt.Sprintf("principal: error sending intent comm: %s", err))
 	}
 	logrus.Info("principal: wrote intent communication")
 
 	resp, err := ReadConfOrDenial(p.targetConn)
 	if err != nil {
 		logrus.Error("principal: error reading conf or denial")
-		return WriteIntentDenied(p.delegateConn, fmt.Sprintf("principal: error reading target response: %s", err))
+		return p.deny(&i, parent, AuditFailed, fmt.Sprintf("principal: error reading target response: %s", err))
 	}
 
 	if resp.MsgType == IntentDenied {
 		logrus.Info("principal: read Intent denied")
-		return WriteIntentDenied(p.delegateConn, resp.Data.Denial)
+		return p.deny(&i, parent, AuditRefused, resp.Data.Denial)
+	}
+	logrus.Infof("principal: read Intent Confirmation for grant %s", resp.Data.GrantID)
+	p.record(&i, parent, AuditGranted, "", resp.Data.GrantID)
+	return WriteIntentConfirmation(p.delegateConn, resp.Data.GrantID)
+}
+
+// deny records that the intent request i ended with outcome, and sends the
+// delegate a denial with reason
+func (p *principalInstance) deny(i *Intent, parent GrantID, outcome, reason string) error {
+	p.record(i, parent, outcome, reason, 0)
+	return WriteIntentDenied(p.delegateConn, reason)
+}
+
+// record adds the outcome of the intent request i to the audit log
+func (p *principalInstance) record(i *Intent, parent GrantID, outcome, reason string, id GrantID) {
+	if p.audit == nil {
+		return
 	}
-	logrus.Info("principal: read Intent Confirmation")
-	return WriteIntentConfirmation(p.delegateConn)
+	r := IntentAuditRecord(AuditPrincipal, AuditIntentRequest, i)
+	r.Outcome, r.Reason, r.GrantID, r.Parent = outcome, reason, id, parent
+	r.SetPrincipal(p.principal)
+	p.audit.Record(r)
 }
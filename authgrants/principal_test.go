@@ -26,7 +26,7 @@ func getTestCmdIntentRequest(t *testing.T, cmd string) AgMessage {
 		Data: MessageData{
 			Intent: Intent{
 				GrantType:      Command,
-				Reserved:       0,
+				Flags:          0,
 				TargetPort:     7777,
 				StartTime:      time.Unix(startTime, 0),
 				ExpTime:        time.Unix(expTime, 0),
@@ -76,7 +76,7 @@ func fakeTarget(t *testing.T, c net.Conn) {
 	_, err := ReadIntentCommunication(c)
 	assert.NilError(t, err)
 	logrus.Info("target: got intent comm")
-	err = WriteIntentConfirmation(c)
+	err = WriteIntentConfirmation(c, 1)
 	assert.NilError(t, err)
 }
 
@@ -87,7 +87,7 @@ func fakeTargetLoop(t *testing.T, c net.Conn) {
 			break
 		}
 		logrus.Info("target: got intent comm")
-		err = WriteIntentConfirmation(c)
+		err = WriteIntentConfirmation(c, 1)
 		assert.NilError(t, err)
 	}
 	logrus.Info("fake target: stopped looping")
@@ -121,7 +121,7 @@ func TestPrincipal(t *testing.T) {
 	// Start "Target"
 	go fakeTarget(t, tcT)
 
-	StartPrincipalInstance(dc, ciFunc, setupTarg)
+	StartPrincipalInstance(dc, ciFunc, setupTarg, nil, nil)
 }
 
 func TestPrincipalNilCallback(t *testing.T) {
@@ -139,7 +139,7 @@ func TestPrincipalNilCallback(t *testing.T) {
 	// Start "Target"
 	go fakeTarget(t, tcT)
 
-	StartPrincipalInstance(dc, nil, setupTarg)
+	StartPrincipalInstance(dc, nil, setupTarg, nil, nil)
 }
 
 func TestPrincipalCheckIntentFail(t *testing.T) {
@@ -162,7 +162,7 @@ func TestPrincipalCheckIntentFail(t *testing.T) {
 	// Start "Target"
 	go fakeTarget(t, tcT)
 
-	StartPrincipalInstance(dc, ciFunc, setupTarg)
+	StartPrincipalInstance(dc, ciFunc, setupTarg, nil, nil)
 }
 
 func TestPrincipalCheckTargetFail(t *testing.T) {
@@ -185,5 +185,5 @@ func TestPrincipalCheckTargetFail(t *testing.T) {
 	// Start "Target"
 	go fakeTargetDenial(t, tcT)
 
-	StartPrincipalInstance(dc, ciFunc, setupTarg)
+	StartPrincipalInstance(dc, ciFunc, setupTarg, nil, nil)
 }
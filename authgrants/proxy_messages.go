@@ -22,6 +22,54 @@ type TargetInfo struct {
 const confirmation = byte(1)
 const denial = byte(0)
 
+// Delegates that present a token start with tokenMarker and the version of
+// the token message. Older delegates start with the length-prefixed target
+// URL, which is never empty, so its first byte is never tokenMarker.
+const (
+	tokenMarker  = byte(0)
+	tokenVersion = byte(1)
+)
+
+// WriteDelegateToken writes the token a delegate presents to the agproxy of
+// the server it runs on. An empty token asks the agproxy to find the session
+// of the delegate by its process instead.
+func WriteDelegateToken(token string, w io.Writer) error {
+	if len(token) > 255 {
+		return fmt.Errorf("authgrant token too long")
+	}
+	if _, err := w.Write([]byte{tokenMarker, tokenVersion}); err != nil {
+		return err
+	}
+	_, err := common.WriteString(token, w)
+	return err
+}
+
+// ReadDelegateToken reads the token written by WriteDelegateToken. If the
+// delegate is older and sent its target info without a token, it returns an
+// empty token and the target URL instead.
+func ReadDelegateToken(r io.Reader) (string, *core.URL, error) {
+	var first [1]byte
+	if _, err := io.ReadFull(r, first[:]); err != nil {
+		return "", nil, err
+	}
+	if first[0] != tokenMarker {
+		url := make([]byte, first[0])
+		if _, err := io.ReadFull(r, url); err != nil {
+			return "", nil, err
+		}
+		targetURL, err := core.ParseURL(string(url))
+		return "", targetURL, err
+	}
+	if _, err := io.ReadFull(r, first[:]); err != nil {
+		return "", nil, err
+	}
+	if first[0] != tokenVersion {
+		return "", nil, fmt.Errorf("unknown authgrant token version %d", first[0])
+	}
+	token, _, err := common.ReadString(r)
+	return token, nil, err
+}
+
 // WriteTargetInfo writes the relevant target info from given intent
 func WriteTargetInfo(targURL core.URL, w io.Writer) error {
 	_, err := common.WriteString(targURL.String(), w)
@@ -12,25 +12,32 @@ import (
 // logic for a hop server receiving an intent comm and approving or
 // denying
 
-type addAuthGrantFunc func(*Intent) error
+type addAuthGrantFunc func(*Intent) (GrantID, error)
+type revokeAuthGrantFunc func(GrantID) error
+type addSubGrantFunc func(parent GrantID, i *Intent) (GrantID, error)
 
 type targetInstance struct {
 	principalConn net.Conn
 	principalCert *certs.Certificate
 
-	checkIntent  CheckIntentCallback
-	addAuthGrant addAuthGrantFunc
+	checkIntent     CheckIntentCallback
+	addAuthGrant    addAuthGrantFunc
+	revokeAuthGrant revokeAuthGrantFunc
+	addSubGrant     addSubGrantFunc
 }
 
-// StartTargetInstance creates and runs a new target instance
-func StartTargetInstance(pc net.Conn, pcert *certs.Certificate, ci CheckIntentCallback, f addAuthGrantFunc) error {
+// StartTargetInstance creates and runs a new target instance. Revocations are
+// refused if revoke is nil, and sub-grants if sub is nil.
+func StartTargetInstance(pc net.Conn, pcert *certs.Certificate, ci CheckIntentCallback, f addAuthGrantFunc, revoke revokeAuthGrantFunc, sub addSubGrantFunc) error {
 	defer pc.Close()
 
 	ti := targetInstance{
-		principalConn: pc,
-		principalCert: pcert,
-		checkIntent:   ci,
-		addAuthGrant:  f,
+		principalConn:   pc,
+		principalCert:   pcert,
+		checkIntent:     ci,
+		addAuthGrant:    f,
+		revokeAuthGrant: revoke,
+		addSubGrant:     sub,
 	}
 
 	if ci == nil {
@@ -43,7 +50,7 @@ func StartTargetInstance(pc net.Conn, pcert *certs.Certificate, ci CheckIntentCa
 
 func (t *targetInstance) run() {
 	for {
-		err := t.handleIntentCommunication()
+		err := t.handleMessage()
 		if err != nil {
 			logrus.Errorf("target: error handling intent communication: %v", err.Error())
 			return
@@ -51,23 +58,62 @@ func (t *targetInstance) run() {
 	}
 }
 
-func (t *targetInstance) handleIntentCommunication() error {
-	i, err := ReadIntentCommunication(t.principalConn)
+func (t *targetInstance) handleMessage() error {
+	var m AgMessage
+	_, err := m.ReadFrom(t.principalConn)
 	if err != nil {
 		logrus.Errorf("target: error reading intent communication: %v", err)
 		return fmt.Errorf("target: error reading intent communication: %s", err)
 	}
+	switch m.MsgType {
+	case IntentCommunication:
+		return t.handleIntentCommunication(m.Data.Intent)
+	case IntentRevoke:
+		return t.handleIntentRevoke(m.Data.GrantID)
+	case IntentSubGrant:
+		return t.handleIntentSubGrant(m.Data.GrantID, m.Data.Intent)
+	default:
+		return WriteIntentDenied(t.principalConn, UnexpectedMessageType)
+	}
+}
+
+func (t *targetInstance) handleIntentCommunication(i Intent) error {
 	logrus.Info("target: read intent communication")
-	err = t.checkIntent(i, t.principalCert)
+	err := t.checkIntent(i, t.principalCert)
 	if err != nil {
 		logrus.Error("target: error checking intent: ", err)
 		return WriteIntentDenied(t.principalConn, err.Error())
 	}
 	logrus.Info("target: finished checking intent")
-	err = t.addAuthGrant(&i)
+	id, err := t.addAuthGrant(&i)
 	if err != nil {
 		logrus.Errorf("target: error adding authgrant: %s", err)
 		return WriteIntentDenied(t.principalConn, err.Error())
 	}
-	return WriteIntentConfirmation(t.principalConn)
+	return WriteIntentConfirmation(t.principalConn, id)
+}
+
+func (t *targetInstance) handleIntentRevoke(id GrantID) error {
+	logrus.Infof("target: read intent revoke for grant %s", id)
+	if t.revokeAuthGrant == nil {
+		return WriteIntentDenied(t.principalConn, "revocation not allowed")
+	}
+	if err := t.revokeAuthGrant(id); err != nil {
+		logrus.Errorf("target: error revoking authgrant %s: %s", id, err)
+		return WriteIntentDenied(t.principalConn, err.Error())
+	}
+	return WriteIntentConfirmation(t.principalConn, id)
+}
+
+func (t *targetInstance) handleIntentSubGrant(parent GrantID, i Intent) error {
+	logrus.Infof("target: read intent sub-grant of grant %s", parent)
+	if t.addSubGrant == nil {
+		return WriteIntentDenied(t.principalConn, "sub-grants not allowed")
+	}
+	id, err := t.addSubGrant(parent, &i)
+	if err != nil {
+		logrus.Errorf("target: error adding sub-grant of %s: %s", parent, err)
+		return WriteIntentDenied(t.principalConn, err.Error())
+	}
+	return WriteIntentConfirmation(t.principalConn, id)
 }
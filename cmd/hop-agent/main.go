@@ -1,8 +1,13 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"net"
 	"net/http"
+	"os"
+	"strings"
 
 	"github.com/sirupsen/logrus"
 
@@ -10,7 +15,33 @@ import (
 	"hop.computer/hop/common"
 )
 
+const usage = `usage: hop-agent [-approval-socket path] [-approval-hook cmd] [-approval-timeout duration]
+       hop-agent [-approval-socket path] pending
+       hop-agent [-approval-socket path] approve|deny id [reason]`
+
 func main() {
+	fs := flag.NewFlagSet("hop-agent", flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprintln(os.Stderr, usage) }
+	hook := fs.String("approval-hook", "", "shell command run for each authgrant approval request")
+	timeout := fs.Duration("approval-timeout", agent.DefaultApprovalTimeout, "how long approval requests wait before they are denied")
+	socket := fs.String("approval-socket", "", "unix socket serving authgrant approvals (default ~/.hop/"+agent.ApprovalSocketName+")")
+	fs.Parse(os.Args[1:])
+
+	if *socket == "" {
+		var err error
+		*socket, err = agent.DefaultApprovalSocket()
+		if err != nil {
+			logrus.Fatalf("unable to find approval socket: %s", err)
+		}
+	}
+	if fs.NArg() > 0 {
+		if err := approvals(*socket, fs.Args()); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	logrus.SetLevel(logrus.InfoLevel)
 	d := agent.Data{}
 	err := d.Init()
@@ -23,6 +54,35 @@ func main() {
 	if err != nil {
 		logrus.Fatalf("unable to open tcp socket %s: %s", address, err)
 	}
+	// only replace the approval socket once no other agent holds the port
+	approvalSock, err := agent.ListenApprovals(*socket)
+	if err != nil {
+		logrus.Fatalf("unable to open approval socket %s: %s", *socket, err)
+	}
+	logrus.Infof("serving approvals on %s", *socket)
+	go http.Serve(approvalSock, agent.NewApprovalServer(agent.NewApprovals(*hook, *timeout)))
+
 	logrus.Infof("listening on %s", sock.Addr().String())
 	http.Serve(sock, s)
 }
+
+// approvals lists or answers the approval requests of the running agent
+func approvals(socket string, args []string) error {
+	c := agent.NewApprovalClient(socket)
+	ctx := context.Background()
+	switch {
+	case args[0] == "pending" && len(args) == 1:
+		reqs, err := c.ListApprovals(ctx)
+		if err != nil {
+			return err
+		}
+		for n := range reqs {
+			fmt.Println(reqs[n].String())
+		}
+		return nil
+	case (args[0] == "approve" || args[0] == "deny") && len(args) >= 2:
+		return c.DecideApproval(ctx, args[1], args[0] == "approve", strings.Join(args[2:], " "))
+	default:
+		return fmt.Errorf("%s", usage)
+	}
+}
@@ -0,0 +1,150 @@
+// hop-grants lists and revokes the outstanding authgrants of a hopd.
+//
+// It talks to the authgrant admin API that hopd serves on its
+// AuthgrantAdminSocket:
+//
+//	hop-grants -socket /run/hopd/authgrants.sock list [user]
+//	hop-grants -socket /run/hopd/authgrants.sock revoke [-user user] id
+//
+// It also checks the hash chain of an AuthgrantAuditLog:
+//
+//	hop-grants verify-audit /var/log/hopd/authgrants.log
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"hop.computer/hop/authgrants"
+	"hop.computer/hop/hopserver"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s [-socket path] list [user]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s [-socket path] revoke [-user user] id\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s verify-audit file\n", os.Args[0])
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func main() {
+	socket := flag.String("socket", "/run/hopd/authgrants.sock", "the AuthgrantAdminSocket of hopd")
+	flag.Usage = usage
+	flag.Parse()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", *socket)
+			},
+		},
+		Timeout: 10 * time.Second,
+	}
+
+	var err error
+	switch flag.Arg(0) {
+	case "list":
+		err = list(client, flag.Arg(1))
+	case "revoke":
+		fs := flag.NewFlagSet("revoke", flag.ExitOnError)
+		user := fs.String("user", "", "only revoke the grant if it is for this user")
+		fs.Parse(flag.Args()[1:])
+		if fs.NArg() != 1 {
+			usage()
+		}
+		err = revoke(client, fs.Arg(0), *user)
+	case "verify-audit":
+		if flag.NArg() != 2 {
+			usage()
+		}
+		err = verifyAudit(flag.Arg(1))
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", os.Args[0], err)
+		os.Exit(1)
+	}
+}
+
+func list(client *http.Client, user string) error {
+	u := url.URL{Scheme: "http", Host: "hopd", Path: "/grants"}
+	if user != "" {
+		u.RawQuery = url.Values{"user": {user}}.Encode()
+	}
+	resp, err := client.Get(u.String())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("listing grants: %s", resp.Status)
+	}
+	var grants hopserver.GrantListResponse
+	if err := json.NewDecoder(resp.Body).Decode(&grants); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tUSER\tTYPE\tEXPIRES\tUSES\tLIMITS\tDELEGATE\tACTION")
+	for _, g := range grants.Grants {
+		action := g.Command
+		if g.Address != "" {
+			action = g.Address
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n", g.ID, g.User, g.Type, g.Expires.Format(time.RFC3339), g.Uses, g.Limits, g.Delegate, action)
+	}
+	return w.Flush()
+}
+
+func revoke(client *http.Client, arg, user string) error {
+	id, err := authgrants.ParseGrantID(arg)
+	if err != nil {
+		return err
+	}
+	u := url.URL{Scheme: "http", Host: "hopd", Path: "/grants/" + id.String()}
+	if user != "" {
+		u.RawQuery = url.Values{"user": {user}}.Encode()
+	}
+	req, err := http.NewRequest(http.MethodDelete, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		fmt.Printf("revoked authgrant %s\n", id)
+		return nil
+	case http.StatusNotFound:
+		return fmt.Errorf("no authgrant %s", id)
+	default:
+		return fmt.Errorf("revoking grant %s: %s", id, resp.Status)
+	}
+}
+
+func verifyAudit(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	n, err := authgrants.VerifyAuditLog(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	fmt.Printf("%s: %d records, chain intact\n", path, n)
+	return nil
+}
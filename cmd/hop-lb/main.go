@@ -0,0 +1,106 @@
+// hop-lb is a UDP load balancer for Hop servers that share one address.
+//
+// Every backend is a hopd with a distinct ServerID. hopd embeds its ServerID in
+// the session IDs it assigns, so hop-lb sends every packet of an established
+// session to the server that owns it, even after the client's address changes.
+// Handshakes are spread over the healthy backends that are not draining. If the
+// backends set ServerIDSecretFile, hop-lb needs the same secret in -secret-file
+// to decrypt the server IDs. Backends should also share a CookieSecret, so that
+// a handshake that moves between backends still completes.
+//
+// The optional admin listener serves GET /backends, and POST
+// /backends/:id/drain and /backends/:id/undrain.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"hop.computer/hop/hoplb"
+	"hop.computer/hop/transport"
+)
+
+// backendFlags collects the repeated -backend flags
+type backendFlags []hoplb.BackendConfig
+
+func (b *backendFlags) String() string {
+	parts := make([]string, 0, len(*b))
+	for _, bc := range *b {
+		parts = append(parts, fmt.Sprintf("%d=%s", bc.ID, bc.Address))
+	}
+	return strings.Join(parts, ",")
+}
+
+func (b *backendFlags) Set(value string) error {
+	id, address, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("backend %q is not of the form id=address", value)
+	}
+	n, err := strconv.ParseUint(id, 10, 8)
+	if err != nil {
+		return fmt.Errorf("backend %q: invalid server ID: %w", value, err)
+	}
+	*b = append(*b, hoplb.BackendConfig{ID: byte(n), Address: address})
+	return nil
+}
+
+func main() {
+	logrus.SetLevel(logrus.InfoLevel)
+
+	var backends backendFlags
+	var config hoplb.Config
+	listen := flag.String("listen", ":77", "UDP address to accept Hop clients on")
+	admin := flag.String("admin", "", "TCP address of the admin API. Disabled if empty")
+	secretFile := flag.String("secret-file", "", "file holding the ServerIDSecret shared with the backends")
+	flag.Var(&backends, "backend", "backend as id=address, where id is the ServerID of the backend. May be repeated")
+	flag.DurationVar(&config.HealthInterval, "health-interval", hoplb.DefaultHealthInterval, "how often to probe backends. Negative disables health checks")
+	flag.DurationVar(&config.HealthTimeout, "health-timeout", hoplb.DefaultHealthTimeout, "how long to wait for a backend to answer a probe")
+	flag.DurationVar(&config.IdleTimeout, "idle-timeout", hoplb.DefaultIdleTimeout, "how long to keep forwarding state for an idle client address")
+	flag.DurationVar(&config.UnansweredTimeout, "unanswered-timeout", hoplb.DefaultUnansweredTimeout, "how long to keep forwarding state for an idle client address the backend never replied to")
+	flag.IntVar(&config.MaxFlows, "max-flows", hoplb.DefaultMaxFlows, "largest number of client address and backend pairs to forward for")
+	flag.Parse()
+
+	config.Backends = backends
+	if *secretFile != "" {
+		secret, err := os.ReadFile(*secretFile)
+		if err != nil {
+			logrus.Fatalf("unable to read server ID secret: %s", err)
+		}
+		config.ServerIDKey = transport.ServerIDKeyFromSecret(bytes.TrimSpace(secret))
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", *listen)
+	if err != nil {
+		logrus.Fatalf("invalid listen address %s: %s", *listen, err)
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		logrus.Fatalf("unable to open udp socket %s: %s", *listen, err)
+	}
+	b, err := hoplb.New(conn, config)
+	if err != nil {
+		logrus.Fatalf("unable to start load balancer: %s", err)
+	}
+
+	if *admin != "" {
+		sock, err := net.Listen("tcp", *admin)
+		if err != nil {
+			logrus.Fatalf("unable to open tcp socket %s: %s", *admin, err)
+		}
+		logrus.Infof("admin API listening on %s", sock.Addr().String())
+		go http.Serve(sock, hoplb.NewAdminServer(b))
+	}
+
+	logrus.Infof("listening on %s", b.Addr().String())
+	if err := b.Serve(); err != nil {
+		logrus.Fatalf("load balancer stopped: %s", err)
+	}
+}
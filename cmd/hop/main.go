@@ -1,11 +1,13 @@
 package main
 
 import (
+	"fmt"
 	"os"
 
 	"github.com/BurntSushi/toml"
 	"github.com/sirupsen/logrus"
 
+	"hop.computer/hop/authgrants"
 	"hop.computer/hop/dialogue"
 	"hop.computer/hop/flags"
 	"hop.computer/hop/hopclient"
@@ -51,11 +53,42 @@ func main() {
 	}
 
 	if hc.IsPrincipal {
-		err = client.SetCheckIntentCallback(dialogue.GetUserInputForAuthgrant)
+		var checkIntent authgrants.CheckIntentCallback
+		switch hc.AuthgrantApproval {
+		case "", "prompt":
+			checkIntent = dialogue.GetUserInputForAuthgrant
+		case "agent":
+			checkIntent, err = hopclient.AgentApprover(hc, hc.Hostname)
+			if err != nil {
+				logrus.Error(err)
+				return
+			}
+		default:
+			logrus.Errorf("unknown AuthgrantApproval %q", hc.AuthgrantApproval)
+			return
+		}
+		if hc.AuthgrantPolicy != "" {
+			policy, err := authgrants.LoadPolicyFile(hc.AuthgrantPolicy)
+			if err != nil {
+				logrus.Error(err)
+				return
+			}
+			checkIntent = policy.CheckIntentCallback(hc.Hostname, checkIntent)
+		}
+		err = client.SetCheckIntentCallback(checkIntent)
 		if err != nil {
 			logrus.Error(err)
 			return
 		}
+		if hc.AuthgrantAuditLog != "" {
+			audit, err := authgrants.OpenAuditLog(hc.AuthgrantAuditLog, hc.AuthgrantAuditChain)
+			if err != nil {
+				logrus.Errorf("unable to open authgrant audit log: %s", err)
+				return
+			}
+			defer audit.Close()
+			client.SetAuditLog(audit)
+		}
 	}
 
 	client.RawConfigFilePath = f.ConfigPath
@@ -65,6 +98,32 @@ func main() {
 		logrus.Error(err)
 		return
 	}
+	if f.RevokeGrant != "" {
+		id, err := authgrants.ParseGrantID(f.RevokeGrant)
+		if err == nil {
+			err = client.RevokeAuthgrant(id)
+		}
+		client.Close()
+		// logs go to a file, so report the outcome on stderr
+		if err != nil {
+			logrus.Error(err)
+			fmt.Fprintf(os.Stderr, "unable to revoke authgrant: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "revoked authgrant %s\n", id)
+		return
+	}
+	if hc.FileCopy != nil {
+		err = client.CopyFile()
+		client.Close()
+		// logs go to a file, so report failures on stderr
+		if err != nil {
+			logrus.Error(err)
+			fmt.Fprintf(os.Stderr, "unable to copy file: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
 	err = client.Start()
 	if err != nil {
 		logrus.Error(err)
@@ -14,6 +14,7 @@ import (
 )
 
 func main() {
+	hopserver.RunFileHelper(os.Args)
 
 	f, err := flags.ParseServerArgs(os.Args)
 	if err != nil {
@@ -33,6 +33,7 @@ type ExecTube struct {
 // Config is the options required to start an ExecTube
 type Config struct {
 	Cmd        string
+	Subsystem  bool // Cmd names a subsystem of the server
 	UsePty     bool
 	StdinTube  *tubes.Reliable
 	StdoutTube *tubes.Reliable
@@ -44,8 +45,9 @@ type Config struct {
 }
 
 const (
-	usePtyFlag  = 0x1
-	hasSizeFlag = 0x2
+	usePtyFlag    = 0x1
+	hasSizeFlag   = 0x2
+	subsystemFlag = 0x4
 )
 
 const (
@@ -107,6 +109,7 @@ func NewExecTube(c Config) (*ExecTube, error) {
 		oldState = nil
 	}
 	msg := newExecInitMsg(c.UsePty, c.Cmd, termEnv, size)
+	msg.subsystem = c.Subsystem
 	_, e = c.StdinTube.Write(msg.ToBytes())
 	if e != nil {
 		logrus.Error(e)
@@ -245,12 +248,13 @@ func (e *ExecTube) ResumePipes() {
 }
 
 type execInitMsg struct {
-	usePty  bool
-	cmdLen  uint32
-	cmd     string
-	termLen uint32
-	term    string
-	size    *pty.Winsize
+	usePty    bool
+	subsystem bool
+	cmdLen    uint32
+	cmd       string
+	termLen   uint32
+	term      string
+	size      *pty.Winsize
 }
 
 func newExecInitMsg(usePty bool, c, term string, size *pty.Winsize) *execInitMsg {
@@ -276,6 +280,9 @@ func (m *execInitMsg) ToBytes() []byte {
 	if m.size != nil {
 		r[0] |= hasSizeFlag
 	}
+	if m.subsystem {
+		r[0] |= subsystemFlag
+	}
 	binary.BigEndian.PutUint32(r[1:], m.cmdLen)
 	if m.cmdLen > 0 {
 		copy(r[5:], []byte(m.cmd))
@@ -291,12 +298,24 @@ func (m *execInitMsg) ToBytes() []byte {
 	return r
 }
 
+// ExecRequest is what a client asks to run on an exec tube
+type ExecRequest struct {
+	Cmd       string
+	Term      string // the TERM of the client
+	UsePty    bool
+	Subsystem bool         // Cmd names a subsystem of the server
+	Size      *pty.Winsize // the initial window size, if known
+}
+
 // GetCmd reads execInitMsg from an EXEC_CHANNEL and returns the cmd to run
-func GetCmd(c net.Conn) (string, string, bool, *pty.Winsize, error) {
+func GetCmd(c net.Conn) (*ExecRequest, error) {
 	//TODO (drebelsky): consider handling io errors
 	t := make([]byte, 1)
 	io.ReadFull(c, t)
-	usePty := (t[0] & usePtyFlag) != 0
+	req := &ExecRequest{
+		UsePty:    (t[0] & usePtyFlag) != 0,
+		Subsystem: (t[0] & subsystemFlag) != 0,
+	}
 	hasSize := (t[0] & hasSizeFlag) != 0
 	l := make([]byte, 4)
 	io.ReadFull(c, l)
@@ -305,11 +324,12 @@ func GetCmd(c net.Conn) (string, string, bool, *pty.Winsize, error) {
 	io.ReadFull(c, l)
 	term := make([]byte, binary.BigEndian.Uint32(l))
 	io.ReadFull(c, term)
-	var size *pty.Winsize
 	if hasSize {
-		size, _ = readSize(c)
+		req.Size, _ = readSize(c)
 	}
-	return string(buf), string(term), usePty, size, nil
+	req.Cmd = string(buf)
+	req.Term = string(term)
+	return req, nil
 }
 
 func readSize(r io.Reader) (*pty.Winsize, error) {
@@ -29,6 +29,15 @@ const (
 	// unix socket address that hop servers listen on to forward delegate
 	// intent requests back to the principal
 	DefaultAgProxyListenSocket = "@hop_agproxy"
+
+	// AuthgrantSockEnv is the environment variable hop servers set in sessions
+	// to the unix socket that delegates send intent requests to
+	AuthgrantSockEnv = "HOP_AUTHGRANT_SOCK"
+
+	// AuthgrantTokenEnv is the environment variable hop servers set in
+	// sessions to the secret that tells the agproxy which session a delegate
+	// was started from
+	AuthgrantTokenEnv = "HOP_AUTHGRANT_TOKEN"
 )
 
 // TubeType constants
@@ -40,4 +49,6 @@ const (
 	PFControlTube      = 5
 	PFTube             = 6
 	WinSizeTube        = 7 // Used for notifying server of window size changes
+	JumpTube           = 8 // Used for relaying a transport connection to the next hop
+	FileTube           = 9 // Used for reading or writing a file
 )
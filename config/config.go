@@ -2,10 +2,15 @@
 package config
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"io"
+	"net/netip"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -38,6 +43,40 @@ type ServerConfig struct {
 
 	AutoSelfSign  bool
 	ListenAddress string
+	// ListenAddresses are additional addresses to listen on, e.g. a public
+	// IPv6 address and a private IPv4 address. Sockets passed in by systemd
+	// socket activation take precedence over all listen addresses.
+	ListenAddresses []string
+	// ReceiveShards is the number of SO_REUSEPORT sockets, each with its own
+	// receive loop, opened for every listen address. Zero or one opens a single
+	// socket.
+	ReceiveShards int
+
+	// Obfuscate hides Hop packets from traffic classifiers by encapsulating
+	// them with a key derived from KEMKey, which clients must also know.
+	Obfuscate          bool
+	ObfuscationPadding int           // largest number of padding bytes per packet
+	ObfuscationJitter  time.Duration // largest random delay before sending a packet
+
+	// Stream fallback listeners for clients whose networks block UDP.
+	// TCPListenAddress accepts Hop over TCP, and WebSocketListenAddress accepts
+	// WebSocket upgrades at WebSocketPath over plain HTTP.
+	TCPListenAddress       string
+	WebSocketListenAddress string
+	WebSocketPath          string
+
+	// CookieSecret derives the keys for handshake cookies, so that servers
+	// sharing it accept each other's cookies, including across restarts. Keys
+	// rotate every CookieRotation.
+	CookieSecret   []byte
+	CookieRotation time.Duration
+
+	// ServerID is embedded in the session IDs this server assigns, so that a
+	// load balancer such as hop-lb can route every packet of a session to this
+	// server. It is encrypted with a key derived from ServerIDSecret if set.
+	// Zero disables server IDs.
+	ServerID       byte
+	ServerIDSecret []byte
 
 	Names                []NameConfig
 	HiddenModeVHostNames []string
@@ -45,6 +84,14 @@ type ServerConfig struct {
 	HandshakeTimeout time.Duration
 	DataTimeout      time.Duration
 
+	// Handshake flood protection. Zero values use the transport defaults, and
+	// negative values disable the limit.
+	HandshakeRateLimit        float64 // handshake messages per second from each source prefix
+	HandshakeRateBurst        int
+	MaxConcurrentHandshakes   int
+	HandshakePuzzleThreshold  int // handshake messages per second before clients must solve puzzles
+	HandshakePuzzleDifficulty int
+
 	// transport layer client validation options
 	CACerts                      []*certs.Certificate // root and intermediate certs
 	InsecureSkipVerify           bool
@@ -52,8 +99,25 @@ type ServerConfig struct {
 	EnableAuthorizedKeys         bool
 	Users                        []string // users for whom to load their authorized_keys files into transport layer
 
-	EnableAuthgrants    bool // as an authgrant Target this server will approve authgrants and as an authgrant Delegate server will proxy ag intent requests
-	AgProxyListenSocket *string
+	EnableAuthgrants     bool // as an authgrant Target this server will approve authgrants and as an authgrant Delegate server will proxy ag intent requests
+	AgProxyListenSocket  *string
+	AuthgrantStore       string // file the outstanding authgrants are saved to. Kept in memory only if empty
+	AuthgrantAdminSocket string // unix socket of the authgrant admin API. Disabled if empty
+	AuthgrantAuditLog    string // file authgrant decisions are appended to as JSON lines. Disabled if empty
+	AuthgrantAuditChain  bool   // hash-chain the records of AuthgrantAuditLog
+
+	AgProxyRequireDescendant bool // accept delegates only if they are descendants of a process of the session whose token they present
+
+	// EnableJump lets clients use this server as a jump host, to reach the
+	// addresses matching a glob in JumpDestinations, e.g. "10.0.0.*:77".
+	// Every address may be reached if JumpDestinations is empty.
+	EnableJump       bool
+	JumpDestinations []string
+
+	// Subsystems are commands clients may start by name instead of giving a
+	// command, e.g. sftp = ["/usr/lib/openssh/sftp-server"]. They run as the
+	// user without a shell.
+	Subsystems map[string][]string
 }
 
 // NameConfig defines the keys and certificates presented by the server for a
@@ -75,8 +139,25 @@ type serverConfigSchema struct {
 	Certificate  string // path to the certificate
 	Intermediate string // path to the intermediate cert
 
-	AutoSelfSign  *bool
-	ListenAddress string
+	AutoSelfSign    *bool
+	ListenAddress   string
+	ListenAddresses []string
+	ReceiveShards   int
+
+	Obfuscate          *bool
+	ObfuscationPadding int
+	ObfuscationJitter  time.Duration
+
+	TCPListenAddress       string
+	WebSocketListenAddress string
+	WebSocketPath          string
+
+	CookieSecret     string
+	CookieSecretFile string // path to a file holding the cookie secret
+	CookieRotation   time.Duration
+
+	ServerID           int
+	ServerIDSecretFile string // path to a file holding the secret shared with the load balancer
 
 	Names                []nameConfigSchema
 	HiddenModeVHostNames []string
@@ -84,6 +165,12 @@ type serverConfigSchema struct {
 	HandshakeTimeout time.Duration
 	DataTimeout      time.Duration
 
+	HandshakeRateLimit        float64
+	HandshakeRateBurst        int
+	MaxConcurrentHandshakes   int
+	HandshakePuzzleThreshold  int
+	HandshakePuzzleDifficulty int
+
 	// transport layer client validation options
 	CAFiles                      []string // root and intermediate cert paths
 	InsecureSkipVerify           *bool
@@ -91,8 +178,19 @@ type serverConfigSchema struct {
 	EnableAuthorizedKeys         *bool
 	Users                        []string // users for whom to load their authorized_keys files into transport layer
 
-	EnableAuthgrants    *bool // as an authgrant Target this server will approve authgrants and as an authgrant Delegate server will proxy ag intent requests
-	AgProxyListenSocket *string
+	EnableAuthgrants     *bool // as an authgrant Target this server will approve authgrants and as an authgrant Delegate server will proxy ag intent requests
+	AgProxyListenSocket  *string
+	AuthgrantStore       string // file the outstanding authgrants are saved to
+	AuthgrantAdminSocket string // unix socket of the authgrant admin API
+	AuthgrantAuditLog    string // file authgrant decisions are appended to
+	AuthgrantAuditChain  *bool  // hash-chain the records of AuthgrantAuditLog
+
+	AgProxyRequireDescendant *bool // check the process of delegates as well as their token
+
+	EnableJump       *bool
+	JumpDestinations []string // globs of the host:port addresses clients may jump to
+
+	Subsystems map[string][]string // subsystem names to the arguments they run
 }
 
 // NameConfig defines the keys and certificates presented by the server for a
@@ -117,6 +215,10 @@ type HostConfigOptional struct {
 	ServerName           *string
 	ServerKEMKey         *string
 	ServerKEMKeyPath     *string
+	Obfuscate            *bool   // If set, packets are obfuscated with a key derived from the server KEM key
+	FallbackURL          *string // tcp, ws or wss URL to connect to when UDP is blocked
+	ProxyURL             *string // socks5, http or https proxy to connect through
+	ProxyJump            *string // comma separated jump hosts to connect through, or "none"
 	ServerIPv4           *string
 	ServerIPv6           *string
 	Certificate          *string
@@ -131,8 +233,20 @@ type HostConfigOptional struct {
 	RemoteFwds           *portforwarding.Forward
 	LocalFwds            *portforwarding.Forward
 	User                 *string
-	IsDelegate           *bool // If set then client will initiate authgrant protocol
-	IsPrincipal          *bool // If set then client will respond to authgrant requests
+	IsDelegate           *bool    // If set then client will initiate authgrant protocol
+	IsPrincipal          *bool    // If set then client will respond to authgrant requests
+	AuthgrantPolicy      *string  // path to a policy file deciding authgrant requests as a principal
+	AuthgrantApproval    *string  // how a principal asks to approve authgrant requests: "prompt" (default) or "agent"
+	ApprovalSocket       *string  // unix socket of the hop-agent approvals, for AuthgrantApproval = "agent"
+	AuthgrantLifetime    *string  // how long authgrants requested as a delegate last
+	AuthgrantUses        *int     // how many uses to request in authgrants as a delegate. -1 for any number
+	AuthgrantInterval    *string  // the least time between uses of authgrants requested as a delegate
+	AuthgrantDelegable   *bool    // request authgrants that can be passed on to further delegates
+	AuthgrantPattern     *string  // argument patterns to request a command authgrant for, instead of Cmd
+	AuthgrantFlags       []string // flags allowed anywhere in commands matching AuthgrantPattern
+	AuthgrantPath        *string  // path to request file authgrants for, instead of the transferred file
+	AuthgrantAuditLog    *string  // file authgrant decisions as a principal are appended to
+	AuthgrantAuditChain  *bool    // hash-chain the records of AuthgrantAuditLog
 	UsePty               *bool
 	HandshakeTimeout     *string
 	DataTimeout          *string
@@ -150,10 +264,15 @@ type HostConfig struct {
 	ServerName           string // expected name on server cert
 	ServerKEMKey         string // Server Public key path to enable Hidden mode
 	ServerKEMKeyPath     string // Server Public key to enable Hidden mode
+	Obfuscate            bool   // Obfuscate packets with a key derived from the server KEM key
+	FallbackURL          string // tcp, ws or wss URL to connect to when UDP is blocked
+	ProxyURL             string // socks5, http or https proxy to connect through
+	ProxyJump            string // comma separated jump hosts to connect through, or "none"
 	ServerIPv4           string
 	ServerIPv6           string
 	Certificate          string
 	Cmd                  string // what command to run on connect
+	Subsystem            bool   // if set, Cmd names a subsystem of the server to start instead
 	DisableAgent         bool   // TODO(baumanl): figure out a better way to get a running agent to not interfere with other tests
 	Headless             bool   // run without command
 	Hostname             string
@@ -165,6 +284,19 @@ type HostConfig struct {
 	User                 string
 	IsDelegate           bool
 	IsPrincipal          bool
+	AuthgrantPolicy      string
+	AuthgrantApproval    string
+	ApprovalSocket       string
+	AuthgrantLifetime    time.Duration
+	AuthgrantUses        int
+	AuthgrantInterval    time.Duration
+	AuthgrantDelegable   bool
+	AuthgrantPattern     string
+	AuthgrantFlags       []string
+	AuthgrantPath        string
+	AuthgrantAuditLog    string
+	AuthgrantAuditChain  bool
+	FileCopy             *FileCopy // a file to transfer instead of starting a session
 	UsePty               bool
 	HandshakeTimeout     time.Duration
 	DataTimeout          time.Duration
@@ -176,6 +308,13 @@ type HostConfig struct {
 	Output io.Writer
 }
 
+// FileCopy is a file transfer a client makes instead of starting a session
+type FileCopy struct {
+	Upload bool   // copy Local to Remote if set, or Remote to Local
+	Local  string // the path of the local file
+	Remote string // the absolute path of the file on the server
+}
+
 // MergeWith takes non-default values in another HostConfigOptional and overwrites them
 // on/merges them with the values in the receiver
 func (hc *HostConfigOptional) MergeWith(other *HostConfigOptional) {
@@ -236,6 +375,42 @@ func (hc *HostConfigOptional) MergeWith(other *HostConfigOptional) {
 	if other.IsPrincipal != nil {
 		hc.IsPrincipal = other.IsPrincipal
 	}
+	if other.AuthgrantPolicy != nil {
+		hc.AuthgrantPolicy = other.AuthgrantPolicy
+	}
+	if other.AuthgrantApproval != nil {
+		hc.AuthgrantApproval = other.AuthgrantApproval
+	}
+	if other.ApprovalSocket != nil {
+		hc.ApprovalSocket = other.ApprovalSocket
+	}
+	if other.AuthgrantLifetime != nil {
+		hc.AuthgrantLifetime = other.AuthgrantLifetime
+	}
+	if other.AuthgrantUses != nil {
+		hc.AuthgrantUses = other.AuthgrantUses
+	}
+	if other.AuthgrantInterval != nil {
+		hc.AuthgrantInterval = other.AuthgrantInterval
+	}
+	if other.AuthgrantDelegable != nil {
+		hc.AuthgrantDelegable = other.AuthgrantDelegable
+	}
+	if other.AuthgrantPattern != nil {
+		hc.AuthgrantPattern = other.AuthgrantPattern
+	}
+	if other.AuthgrantFlags != nil {
+		hc.AuthgrantFlags = other.AuthgrantFlags
+	}
+	if other.AuthgrantPath != nil {
+		hc.AuthgrantPath = other.AuthgrantPath
+	}
+	if other.AuthgrantAuditLog != nil {
+		hc.AuthgrantAuditLog = other.AuthgrantAuditLog
+	}
+	if other.AuthgrantAuditChain != nil {
+		hc.AuthgrantAuditChain = other.AuthgrantAuditChain
+	}
 	if other.UsePty != nil {
 		hc.UsePty = other.UsePty
 	}
@@ -245,6 +420,18 @@ func (hc *HostConfigOptional) MergeWith(other *HostConfigOptional) {
 	if other.DataTimeout != nil {
 		hc.DataTimeout = other.DataTimeout
 	}
+	if other.Obfuscate != nil {
+		hc.Obfuscate = other.Obfuscate
+	}
+	if other.FallbackURL != nil {
+		hc.FallbackURL = other.FallbackURL
+	}
+	if other.ProxyURL != nil {
+		hc.ProxyURL = other.ProxyURL
+	}
+	if other.ProxyJump != nil {
+		hc.ProxyJump = other.ProxyJump
+	}
 }
 
 func (hc *HostConfigOptional) Unwrap() *HostConfig {
@@ -252,6 +439,7 @@ func (hc *HostConfigOptional) Unwrap() *HostConfig {
 	newHC := HostConfig{
 		HandshakeTimeout:     15 * time.Second,
 		DataTimeout:          15 * time.Minute,
+		AuthgrantLifetime:    time.Minute,
 		Input:                os.Stdin,
 		Output:               os.Stdout,
 		RequestAuthorization: true,
@@ -312,6 +500,40 @@ func (hc *HostConfigOptional) Unwrap() *HostConfig {
 	if hc.IsPrincipal != nil {
 		newHC.IsPrincipal = *hc.IsPrincipal
 	}
+	if hc.AuthgrantPolicy != nil {
+		newHC.AuthgrantPolicy = *hc.AuthgrantPolicy
+	}
+	if hc.AuthgrantApproval != nil {
+		newHC.AuthgrantApproval = *hc.AuthgrantApproval
+	}
+	if hc.ApprovalSocket != nil {
+		newHC.ApprovalSocket = *hc.ApprovalSocket
+	}
+	if hc.AuthgrantLifetime != nil {
+		newHC.AuthgrantLifetime, _ = time.ParseDuration(*hc.AuthgrantLifetime)
+	}
+	if hc.AuthgrantUses != nil {
+		newHC.AuthgrantUses = *hc.AuthgrantUses
+	}
+	if hc.AuthgrantInterval != nil {
+		newHC.AuthgrantInterval, _ = time.ParseDuration(*hc.AuthgrantInterval)
+	}
+	if hc.AuthgrantDelegable != nil {
+		newHC.AuthgrantDelegable = *hc.AuthgrantDelegable
+	}
+	if hc.AuthgrantPattern != nil {
+		newHC.AuthgrantPattern = *hc.AuthgrantPattern
+	}
+	newHC.AuthgrantFlags = hc.AuthgrantFlags
+	if hc.AuthgrantPath != nil {
+		newHC.AuthgrantPath = *hc.AuthgrantPath
+	}
+	if hc.AuthgrantAuditLog != nil {
+		newHC.AuthgrantAuditLog = *hc.AuthgrantAuditLog
+	}
+	if hc.AuthgrantAuditChain != nil {
+		newHC.AuthgrantAuditChain = *hc.AuthgrantAuditChain
+	}
 	if hc.UsePty != nil {
 		newHC.UsePty = *hc.UsePty
 	}
@@ -324,6 +546,18 @@ func (hc *HostConfigOptional) Unwrap() *HostConfig {
 	if hc.InsecureSkipVerify != nil {
 		newHC.InsecureSkipVerify = *hc.InsecureSkipVerify
 	}
+	if hc.Obfuscate != nil {
+		newHC.Obfuscate = *hc.Obfuscate
+	}
+	if hc.FallbackURL != nil {
+		newHC.FallbackURL = *hc.FallbackURL
+	}
+	if hc.ProxyURL != nil {
+		newHC.ProxyURL = *hc.ProxyURL
+	}
+	if hc.ProxyJump != nil {
+		newHC.ProxyJump = *hc.ProxyJump
+	}
 	if hc.RequestAuthorization != nil {
 		newHC.RequestAuthorization = *hc.RequestAuthorization
 	}
@@ -356,6 +590,21 @@ func loadClientConfigFromFile(c *ClientConfig, path string) (*ClientConfig, erro
 	return c, err
 }
 
+// readSecretFile returns the contents of the file at path, without leading or
+// trailing whitespace
+func readSecretFile(path string) ([]byte, error) {
+	file, err := fileSystem.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	b, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimSpace(b), nil
+}
+
 // LoadServerConfigFromFile tokenizes and parse the file at path, and then loads
 // it as a ServerConfig.
 func LoadServerConfigFromFile(path string) (*ServerConfig, error) {
@@ -413,6 +662,46 @@ func loadServerConfigFromFile(c *ServerConfig, path string) (*ServerConfig, erro
 	}
 
 	c.ListenAddress = parsed.ListenAddress
+	c.ListenAddresses = parsed.ListenAddresses
+	c.ReceiveShards = parsed.ReceiveShards
+
+	if parsed.Obfuscate != nil {
+		c.Obfuscate = *parsed.Obfuscate
+	}
+	c.ObfuscationPadding = parsed.ObfuscationPadding
+	c.ObfuscationJitter = parsed.ObfuscationJitter
+
+	c.TCPListenAddress = parsed.TCPListenAddress
+	c.WebSocketListenAddress = parsed.WebSocketListenAddress
+	c.WebSocketPath = parsed.WebSocketPath
+
+	switch {
+	case parsed.CookieSecret != "" && parsed.CookieSecretFile != "":
+		return nil, errors.New("only one of CookieSecret and CookieSecretFile may be set")
+	case parsed.CookieSecret != "":
+		c.CookieSecret = []byte(parsed.CookieSecret)
+	case parsed.CookieSecretFile != "":
+		c.CookieSecret, err = readSecretFile(parsed.CookieSecretFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	c.CookieRotation = parsed.CookieRotation
+
+	if parsed.ServerID < 0 || parsed.ServerID > 255 {
+		return nil, fmt.Errorf("ServerID must be between 0 and 255, got %d", parsed.ServerID)
+	}
+	c.ServerID = byte(parsed.ServerID)
+	if c.ServerID != 0 && c.Obfuscate {
+		// hop-lb reads server IDs from session IDs, which obfuscation hides
+		return nil, errors.New("ServerID cannot be used with Obfuscate")
+	}
+	if parsed.ServerIDSecretFile != "" {
+		c.ServerIDSecret, err = readSecretFile(parsed.ServerIDSecretFile)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	c.Names = make([]NameConfig, 0)
 	for _, nameConf := range parsed.Names {
@@ -464,6 +753,12 @@ func loadServerConfigFromFile(c *ServerConfig, path string) (*ServerConfig, erro
 		c.DataTimeout = parsed.DataTimeout
 	}
 
+	c.HandshakeRateLimit = parsed.HandshakeRateLimit
+	c.HandshakeRateBurst = parsed.HandshakeRateBurst
+	c.MaxConcurrentHandshakes = parsed.MaxConcurrentHandshakes
+	c.HandshakePuzzleThreshold = parsed.HandshakePuzzleThreshold
+	c.HandshakePuzzleDifficulty = parsed.HandshakePuzzleDifficulty
+
 	c.CACerts = make([]*certs.Certificate, 0)
 	for _, certPath := range parsed.CAFiles {
 		cert, err := certs.ReadCertificatePEMFileFS(certPath, fileSystem)
@@ -495,6 +790,27 @@ func loadServerConfigFromFile(c *ServerConfig, path string) (*ServerConfig, erro
 		c.EnableAuthgrants = *parsed.EnableAuthgrants
 	}
 	c.AgProxyListenSocket = parsed.AgProxyListenSocket
+	if parsed.AgProxyRequireDescendant != nil {
+		c.AgProxyRequireDescendant = *parsed.AgProxyRequireDescendant
+	}
+	c.AuthgrantStore = parsed.AuthgrantStore
+	c.AuthgrantAdminSocket = parsed.AuthgrantAdminSocket
+	c.AuthgrantAuditLog = parsed.AuthgrantAuditLog
+	if parsed.AuthgrantAuditChain != nil {
+		c.AuthgrantAuditChain = *parsed.AuthgrantAuditChain
+	}
+
+	if parsed.EnableJump != nil {
+		c.EnableJump = *parsed.EnableJump
+	}
+	c.JumpDestinations = parsed.JumpDestinations
+
+	for name, argv := range parsed.Subsystems {
+		if name == "" || len(argv) == 0 || argv[0] == "" {
+			return nil, fmt.Errorf("subsystem %q: expected a name and a command", name)
+		}
+	}
+	c.Subsystems = parsed.Subsystems
 
 	return c, err
 }
@@ -617,6 +933,44 @@ func (hc *HostConfig) HostURL() core.URL {
 	return u
 }
 
+// ServerAddrs returns ServerIPv6 and ServerIPv4, if they are set, with the
+// port of the host. The client dials them instead of resolving Hostname.
+func (hc *HostConfig) ServerAddrs() ([]netip.AddrPort, error) {
+	port, err := strconv.ParseUint(hc.HostURL().Port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port: %w", err)
+	}
+	var addrs []netip.AddrPort
+	for _, s := range []string{hc.ServerIPv6, hc.ServerIPv4} {
+		if s == "" {
+			continue
+		}
+		ip, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, netip.AddrPortFrom(ip.Unmap(), uint16(port)))
+	}
+	return addrs, nil
+}
+
+// JumpHosts returns the hosts in ProxyJump in the order they are connected
+// to. A ProxyJump of "none" disables jump hosts.
+func (hc *HostConfig) JumpHosts() ([]core.URL, error) {
+	if hc.ProxyJump == "" || hc.ProxyJump == "none" {
+		return nil, nil
+	}
+	var hosts []core.URL
+	for _, s := range strings.Split(hc.ProxyJump, ",") {
+		u, err := core.ParseURL(strings.TrimSpace(s))
+		if err != nil {
+			return nil, fmt.Errorf("invalid jump host %q: %w", s, err)
+		}
+		hosts = append(hosts, *u)
+	}
+	return hosts, nil
+}
+
 // HostURL extracts the Hostname, Port, and User from the HostConfig into an
 // core.URL.
 func (hc *HostConfigOptional) HostURL() core.URL {
@@ -2,6 +2,8 @@ package config
 
 import (
 	"bytes"
+	"net/netip"
+	"strings"
 	"testing"
 	"testing/fstest"
 	"time"
@@ -10,6 +12,7 @@ import (
 	"gotest.tools/assert"
 
 	"hop.computer/hop/certs"
+	"hop.computer/hop/core"
 	"hop.computer/hop/keys"
 )
 
@@ -69,14 +72,32 @@ func TestLoadClientConfig(t *testing.T) {
 }
 
 const serverToml = `ListenAddress = ":77"
+ListenAddresses = ["127.0.0.1:77", "[::1]:77"]
+Obfuscate = false
+ObfuscationPadding = 64
+ObfuscationJitter = "20ms"
+TCPListenAddress = ":77"
+CookieSecretFile = "etc/hopd/cookie.secret"
+CookieRotation = "5m"
+ServerID = 3
+ServerIDSecretFile = "etc/hopd/cookie.secret"
 
 Key = "etc/hopd/id_hop.pem"
 Certificate = "etc/hopd/id_hop.cert"
 CAFiles = [ "etc/hopd/intermediate.cert" , "etc/hopd/root.cert"]
 
 EnableAuthgrants = false
+AuthgrantStore = "/var/lib/hopd/authgrants.json"
+AuthgrantAdminSocket = "/run/hopd/authgrants.sock"
+AuthgrantAuditLog = "/var/log/hopd/authgrants.log"
+AuthgrantAuditChain = true
+EnableJump = true
+JumpDestinations = ["10.0.0.*:77"]
 Users = ["user"]
-HiddenModeVHostNames = ["example.com"]`
+HiddenModeVHostNames = ["example.com"]
+
+[Subsystems]
+sftp = ["/usr/lib/openssh/sftp-server", "-l", "INFO"]`
 
 func TestLoadServerConfig(t *testing.T) {
 	root, intermediate, leaf, keyPair := generateCerts(t)
@@ -93,6 +114,7 @@ func TestLoadServerConfig(t *testing.T) {
 
 	fileSystem = &fstest.MapFS{
 		"etc/hopd/config.toml":       &fstest.MapFile{Data: []byte(serverToml)},
+		"etc/hopd/cookie.secret":     &fstest.MapFile{Data: []byte("0123456789abcdef0123456789abcdef\n")},
 		"etc/hopd/id_hop.pem":        &fstest.MapFile{Data: keyBytes.Bytes()},
 		"etc/hopd/id_hop.cert":       &fstest.MapFile{Data: leafBytes},
 		"etc/hopd/intermediate.cert": &fstest.MapFile{Data: intermediateBytes},
@@ -103,16 +125,76 @@ func TestLoadServerConfig(t *testing.T) {
 	assert.NilError(t, err)
 	expected := &ServerConfig{
 		ListenAddress:        ":77",
+		ListenAddresses:      []string{"127.0.0.1:77", "[::1]:77"},
+		ObfuscationPadding:   64,
+		ObfuscationJitter:    20 * time.Millisecond,
+		TCPListenAddress:     ":77",
+		CookieSecret:         []byte("0123456789abcdef0123456789abcdef"),
+		CookieRotation:       5 * time.Minute,
+		ServerID:             3,
+		ServerIDSecret:       []byte("0123456789abcdef0123456789abcdef"),
 		Key:                  keyPair,
 		Certificate:          leaf,
 		CACerts:              []*certs.Certificate{root, leaf},
 		EnableAuthgrants:     false,
+		AuthgrantStore:       "/var/lib/hopd/authgrants.json",
+		AuthgrantAdminSocket: "/run/hopd/authgrants.sock",
+		AuthgrantAuditLog:    "/var/log/hopd/authgrants.log",
+		AuthgrantAuditChain:  true,
+		EnableJump:           true,
+		JumpDestinations:     []string{"10.0.0.*:77"},
 		Users:                []string{"user"},
 		HiddenModeVHostNames: []string{"example.com"},
+		Subsystems:           map[string][]string{"sftp": {"/usr/lib/openssh/sftp-server", "-l", "INFO"}},
 		Names:                []NameConfig{},
 		HandshakeTimeout:     15 * time.Second,
 		DataTimeout:          0 * time.Second,
 	}
 	// TODO(hosono) there is currently no good way to compare certificates as equal
 	assert.DeepEqual(t, c, expected, cmpopts.IgnoreFields(ServerConfig{}, "Certificate", "Intermediate", "CACerts"))
+
+	// Obfuscation hides server IDs from hop-lb
+	obfuscated := strings.Replace(serverToml, "Obfuscate = false", "Obfuscate = true", 1)
+	(*fileSystem.(*fstest.MapFS))["etc/hopd/config.toml"] = &fstest.MapFile{Data: []byte(obfuscated)}
+	_, err = LoadServerConfigFromFile("etc/hopd/config.toml")
+	assert.ErrorContains(t, err, "ServerID cannot be used with Obfuscate")
+}
+
+func TestServerAddrs(t *testing.T) {
+	hc := &HostConfig{Hostname: "example.com"}
+	addrs, err := hc.ServerAddrs()
+	assert.NilError(t, err)
+	assert.Equal(t, len(addrs), 0)
+
+	hc.Port = 1234
+	hc.ServerIPv4 = "192.0.2.1"
+	hc.ServerIPv6 = "2001:db8::1"
+	addrs, err = hc.ServerAddrs()
+	assert.NilError(t, err)
+	assert.Equal(t, len(addrs), 2)
+	assert.Equal(t, addrs[0], netip.MustParseAddrPort("[2001:db8::1]:1234"))
+	assert.Equal(t, addrs[1], netip.MustParseAddrPort("192.0.2.1:1234"))
+
+	hc.ServerIPv4 = "not an address"
+	_, err = hc.ServerAddrs()
+	assert.Assert(t, err != nil)
+}
+
+func TestJumpHosts(t *testing.T) {
+	hc := &HostConfig{ProxyJump: "none"}
+	hosts, err := hc.JumpHosts()
+	assert.NilError(t, err)
+	assert.Equal(t, len(hosts), 0)
+
+	hc.ProxyJump = "bastion1, alice@bastion2:1234"
+	hosts, err = hc.JumpHosts()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, hosts, []core.URL{
+		{Host: "bastion1"},
+		{Host: "bastion2", Port: "1234", User: "alice"},
+	})
+
+	hc.ProxyJump = "bastion1/path"
+	_, err = hc.JumpHosts()
+	assert.Assert(t, err != nil)
 }
@@ -4,6 +4,7 @@ package dialogue
 import (
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	tea "github.com/charmbracelet/bubbletea"
@@ -11,6 +12,7 @@ import (
 
 	"hop.computer/hop/authgrants"
 	"hop.computer/hop/certs"
+	"hop.computer/hop/portforwarding"
 )
 
 // AuthgrantModel implements tea.Model and contains all the data needed to render the authgrant dialogue
@@ -65,6 +67,32 @@ func (m AuthgrantModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	return m, nil
 }
 
+// pfAddrString describes the address of a port forwarding grant
+func pfAddrString(network byte, address string) string {
+	addr, err := portforwarding.ParseAddr(portforwarding.NetType(network), address)
+	if err != nil {
+		return address
+	}
+	return addr.Network() + " " + address
+}
+
+// commandPatternString describes the arguments a command pattern allows, one
+// per line
+func commandPatternString(d *authgrants.CommandGrantData) string {
+	lines := make([]string, 0, len(d.Argv)+1)
+	for n := range d.Argv {
+		kind := "glob"
+		if d.Argv[n].Kind == authgrants.ArgRegex {
+			kind = "regex"
+		}
+		lines = append(lines, fmt.Sprintf("%s (%s)", d.Argv[n].String(), kind))
+	}
+	if len(d.AllowedFlags) > 0 {
+		lines = append(lines, "with the flags "+strings.Join(d.AllowedFlags, " "))
+	}
+	return strings.Join(lines, "\n    ")
+}
+
 // View renders the UI with the data contained in model
 func (m AuthgrantModel) View() string {
 	delegateSNI := delegateStyle.Render(m.Intent.DelegateCert.IDChunk.Blocks[0].String())
@@ -78,19 +106,45 @@ func (m AuthgrantModel) View() string {
 	case authgrants.Shell:
 		intentStr = intentStyle.Render("open a shell")
 	case authgrants.Command:
-		cmd := intentStyle.Render(m.Intent.AssociatedData.CommandGrantData.Cmd)
-		intentStr = fmt.Sprintf("run the command '%s'", cmd)
-	case authgrants.LocalPF, authgrants.RemotePF:
-		intentStr = "TODO intent string for port forwarding"
+		d := m.Intent.AssociatedData.CommandGrantData
+		if !d.IsPattern() {
+			cmd := intentStyle.Render(d.Cmd)
+			intentStr = fmt.Sprintf("run the command '%s'", cmd)
+			break
+		}
+		intentStr = fmt.Sprintf("run commands matching\n    %s", intentStyle.Render(commandPatternString(&d)))
+	case authgrants.LocalPF:
+		d := m.Intent.AssociatedData.LocalPFGrantData
+		addr := intentStyle.Render(pfAddrString(d.Network, d.Address))
+		intentStr = fmt.Sprintf("forward connections to %s", addr)
+	case authgrants.RemotePF:
+		d := m.Intent.AssociatedData.RemotePFGrantData
+		addr := intentStyle.Render(pfAddrString(d.Network, d.Address))
+		intentStr = fmt.Sprintf("listen on %s and forward connections from it", addr)
+	case authgrants.FileRead:
+		d := m.Intent.AssociatedData.FileGrantData
+		intentStr = fmt.Sprintf("download files from %s", intentStyle.Render(d.String()))
+	case authgrants.FileWrite:
+		d := m.Intent.AssociatedData.FileGrantData
+		intentStr = fmt.Sprintf("upload files to %s", intentStyle.Render(d.String()))
+	case authgrants.Subsystem:
+		name := intentStyle.Render(m.Intent.AssociatedData.SubsystemGrantData.Name)
+		intentStr = fmt.Sprintf("start the subsystem %s", name)
 	default:
 		panic(fmt.Sprintf("unexpected authgrants.GrantType: %#v", m.Intent.GrantType))
 	}
 
-	text := fmt.Sprintf("Would you like to\n  allow %s\n  to %s\n  as %s\n  on %s\n  from %s\n  until %s?",
+	usage := usageStyle.Render(m.Intent.UsageString())
+	if m.Intent.Delegable() {
+		usage += "\n  and " + usageStyle.Render("may pass on narrower grants")
+	}
+
+	text := fmt.Sprintf("Would you like to\n  allow %s\n  to %s\n  as %s\n  on %s\n  %s\n  from %s\n  until %s?",
 		delegateSNI,
 		intentStr,
 		targetUser,
 		targetSNI,
+		usage,
 		startTime,
 		endTime,
 	)
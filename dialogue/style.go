@@ -44,6 +44,10 @@ var intentStyle = baseStyle.
 var timeStyle = baseStyle.
 	Foreground(yellow)
 
+var usageStyle = baseStyle.
+	Foreground(orange).
+	Bold(true)
+
 var titleStyle = lipgloss.
 	NewStyle().
 	MarginLeft(2).
@@ -0,0 +1,308 @@
+// Package filetransfer copies single files to and from a Hop server.
+//
+// The client opens a reliable FileTube and sends a request:
+//
+//	op (1 byte) || mode (4 bytes) || size (8 bytes) || path length (2 bytes) || path
+//
+// where op is OpRead or OpWrite, and mode and size describe the file to
+// write. The server replies with
+//
+//	status (1 byte) || message length (1 byte) || message
+//
+// To a read it then sends the file as chunks of a length (4 bytes) followed
+// by that many bytes, ending with an empty chunk. For a write the client sends
+// exactly size bytes. Either way the server ends with a second status, which
+// tells whether the whole file was transferred.
+package filetransfer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Operations
+const (
+	OpRead  = byte(1)
+	OpWrite = byte(2)
+)
+
+const (
+	statusOK     = 0
+	statusFailed = 1
+)
+
+// chunkSize is the most bytes the server sends in a chunk of a read
+const chunkSize = 32 * 1024
+
+// ErrTransferFailed is returned when the server refuses or fails a transfer
+var ErrTransferFailed = errors.New("file transfer failed")
+
+// ErrTooLarge is returned when a file is larger than a transfer allows
+var ErrTooLarge = errors.New("file too large")
+
+// Request asks to read or write a file
+type Request struct {
+	Op   byte
+	Mode os.FileMode // the permission bits of a file to write
+	Size uint64      // the size of a file to write
+	Path string
+	// Root, if set by Server.Authorize, is a directory Path must be opened
+	// beneath. It is not sent.
+	Root string
+}
+
+// writeRequest writes req
+func writeRequest(w io.Writer, req *Request) error {
+	if len(req.Path) > math.MaxUint16 {
+		return fmt.Errorf("path too long")
+	}
+	msg := make([]byte, 15, 15+len(req.Path))
+	msg[0] = req.Op
+	binary.BigEndian.PutUint32(msg[1:], uint32(req.Mode.Perm()))
+	binary.BigEndian.PutUint64(msg[5:], req.Size)
+	binary.BigEndian.PutUint16(msg[13:], uint16(len(req.Path)))
+	_, err := w.Write(append(msg, req.Path...))
+	return err
+}
+
+// readRequest reads a request
+func readRequest(r io.Reader) (*Request, error) {
+	hdr := make([]byte, 15)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	path := make([]byte, binary.BigEndian.Uint16(hdr[13:]))
+	if _, err := io.ReadFull(r, path); err != nil {
+		return nil, err
+	}
+	return &Request{
+		Op:   hdr[0],
+		Mode: os.FileMode(binary.BigEndian.Uint32(hdr[1:])).Perm(),
+		Size: binary.BigEndian.Uint64(hdr[5:]),
+		Path: string(path),
+	}, nil
+}
+
+// writeResponse writes the status of a transfer. A nil err means success.
+func writeResponse(w io.Writer, err error) error {
+	if err == nil {
+		_, err = w.Write([]byte{statusOK, 0})
+		return err
+	}
+	reason := err.Error()
+	if len(reason) > 255 {
+		reason = reason[:255]
+	}
+	_, err = w.Write(append([]byte{statusFailed, byte(len(reason))}, reason...))
+	return err
+}
+
+// readResponse reads the status of a transfer
+func readResponse(r io.Reader) error {
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return err
+	}
+	reason := make([]byte, hdr[1])
+	if _, err := io.ReadFull(r, reason); err != nil {
+		return err
+	}
+	if hdr[0] != statusOK {
+		return fmt.Errorf("%w: %s", ErrTransferFailed, reason)
+	}
+	return nil
+}
+
+// chunkWriter writes everything written to it as chunks
+type chunkWriter struct {
+	w io.Writer
+}
+
+func (c *chunkWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n := min(len(b), chunkSize)
+		hdr := binary.BigEndian.AppendUint32(nil, uint32(n))
+		if _, err := c.w.Write(append(hdr, b[:n]...)); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// end writes the empty chunk that ends a file
+func (c *chunkWriter) end() error {
+	_, err := c.w.Write([]byte{0, 0, 0, 0})
+	return err
+}
+
+// readChunks copies the chunks read from r to w until the empty chunk
+func readChunks(r io.Reader, w io.Writer) (int64, error) {
+	var copied int64
+	hdr := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			return copied, err
+		}
+		n := binary.BigEndian.Uint32(hdr)
+		if n == 0 {
+			return copied, nil
+		}
+		if n > chunkSize {
+			return copied, fmt.Errorf("chunk of %d bytes is too large", n)
+		}
+		m, err := io.CopyN(w, r, int64(n))
+		copied += m
+		if err != nil {
+			return copied, err
+		}
+	}
+}
+
+// Upload writes size bytes from src to the file at path on the server at the
+// other end of rw, with the permission bits of mode
+func Upload(rw io.ReadWriter, path string, mode os.FileMode, size uint64, src io.Reader) error {
+	req := Request{Op: OpWrite, Mode: mode.Perm(), Size: size, Path: path}
+	if err := writeRequest(rw, &req); err != nil {
+		return err
+	}
+	if err := readResponse(rw); err != nil {
+		return err
+	}
+	n, err := io.CopyN(rw, src, int64(size))
+	if err != nil {
+		return fmt.Errorf("sent %d of %d bytes: %w", n, size, err)
+	}
+	return readResponse(rw)
+}
+
+// Download copies the file at path on the server at the other end of rw to
+// dst, and returns how many bytes it copied
+func Download(rw io.ReadWriter, path string, dst io.Writer) (int64, error) {
+	req := Request{Op: OpRead, Path: path}
+	if err := writeRequest(rw, &req); err != nil {
+		return 0, err
+	}
+	if err := readResponse(rw); err != nil {
+		return 0, err
+	}
+	n, err := readChunks(rw, dst)
+	if err != nil {
+		return n, err
+	}
+	return n, readResponse(rw)
+}
+
+// Server serves file transfer requests
+type Server struct {
+	// Authorize, if set, checks a request before it is served, and may
+	// rewrite its path. It returns the largest file a read may return, or 0
+	// for any size.
+	Authorize func(*Request) (uint64, error)
+	// Open opens the file of req for reading
+	Open func(req *Request) (io.ReadCloser, error)
+	// Create writes the file of req with its permission bits, with the
+	// req.Size bytes read from r. It should leave an existing file unchanged
+	// unless r has all of them.
+	Create func(req *Request, r io.Reader) error
+}
+
+// Handle serves the request on rw
+func (s *Server) Handle(rw io.ReadWriter) {
+	req, err := readRequest(rw)
+	if err != nil {
+		logrus.Errorf("filetransfer: error reading request: %s", err)
+		return
+	}
+	var maxSize uint64
+	if s.Authorize != nil {
+		maxSize, err = s.Authorize(req)
+		if err != nil {
+			logrus.Errorf("filetransfer: refusing request for %s: %s", req.Path, err)
+			writeResponse(rw, err)
+			return
+		}
+	}
+	switch req.Op {
+	case OpRead:
+		err = s.read(rw, req, maxSize)
+	case OpWrite:
+		err = s.write(rw, req)
+	default:
+		err = writeResponse(rw, fmt.Errorf("unknown operation %d", req.Op))
+	}
+	if err != nil {
+		logrus.Errorf("filetransfer: %s: %s", req.Path, err)
+	}
+}
+
+// read sends the file of req as chunks, failing if it is larger than maxSize
+func (s *Server) read(rw io.ReadWriter, req *Request, maxSize uint64) error {
+	f, err := s.Open(req)
+	if err != nil {
+		writeResponse(rw, err)
+		return err
+	}
+	defer f.Close()
+	if err := writeResponse(rw, nil); err != nil {
+		return err
+	}
+	cw := &chunkWriter{w: rw}
+	var n int64
+	if maxSize > 0 {
+		n, err = io.Copy(cw, io.LimitReader(f, int64(min(maxSize, math.MaxInt64))))
+		if err == nil {
+			// the file must end here
+			var extra [1]byte
+			if m, _ := io.ReadFull(f, extra[:]); m > 0 {
+				err = fmt.Errorf("%w: larger than %d bytes", ErrTooLarge, maxSize)
+			}
+		}
+	} else {
+		n, err = io.Copy(cw, f)
+	}
+	if endErr := cw.end(); endErr != nil {
+		return endErr
+	}
+	if respErr := writeResponse(rw, err); respErr != nil {
+		return respErr
+	}
+	if err == nil {
+		logrus.Infof("filetransfer: sent %d bytes of %s", n, req.Path)
+	}
+	return err
+}
+
+// write creates the file of req from the bytes the client sends. The client
+// sends all of them before the final status, even if Create fails.
+func (s *Server) write(rw io.ReadWriter, req *Request) error {
+	if req.Size > math.MaxInt64 {
+		return writeResponse(rw, ErrTooLarge)
+	}
+	if err := writeResponse(rw, nil); err != nil {
+		return err
+	}
+	src := &io.LimitedReader{R: rw, N: int64(req.Size)}
+	err := s.Create(req, src)
+	if err == nil && src.N > 0 {
+		err = fmt.Errorf("wrote only %d of %d bytes", int64(req.Size)-src.N, req.Size)
+	}
+	if _, drainErr := io.Copy(io.Discard, src); drainErr != nil {
+		return drainErr
+	}
+	if respErr := writeResponse(rw, err); respErr != nil {
+		return respErr
+	}
+	if err == nil {
+		logrus.Infof("filetransfer: wrote %d bytes to %s", req.Size, req.Path)
+	}
+	return err
+}
@@ -0,0 +1,102 @@
+package filetransfer
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestRequest(t *testing.T) {
+	buf := &bytes.Buffer{}
+	req := Request{Op: OpWrite, Mode: 0o640, Size: 1 << 40, Path: "/srv/releases/app.tar"}
+	assert.NilError(t, writeRequest(buf, &req))
+	got, err := readRequest(buf)
+	assert.NilError(t, err)
+	assert.Equal(t, *got, req)
+	assert.Equal(t, buf.Len(), 0)
+}
+
+// memFiles is an in-memory file system for a Server
+type memFiles struct {
+	files map[string][]byte
+	modes map[string]os.FileMode
+}
+
+func (m *memFiles) server(authorize func(*Request) (uint64, error)) *Server {
+	return &Server{
+		Authorize: authorize,
+		Open: func(req *Request) (io.ReadCloser, error) {
+			b, ok := m.files[req.Path]
+			if !ok {
+				return nil, fs.ErrNotExist
+			}
+			return io.NopCloser(bytes.NewReader(b)), nil
+		},
+		Create: func(req *Request, r io.Reader) error {
+			b, err := io.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			m.files[req.Path] = b
+			m.modes[req.Path] = req.Mode
+			return nil
+		},
+	}
+}
+
+// serve runs s on one end of a pipe and returns the other
+func serve(t *testing.T, s *Server) net.Conn {
+	client, server := net.Pipe()
+	go func() {
+		s.Handle(server)
+		server.Close()
+	}()
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestUploadDownload(t *testing.T) {
+	m := &memFiles{files: map[string][]byte{}, modes: map[string]os.FileMode{}}
+	contents := strings.Repeat("hop", 50000) // several chunks
+
+	err := Upload(serve(t, m.server(nil)), "/srv/app", 0o755, uint64(len(contents)), strings.NewReader(contents))
+	assert.NilError(t, err)
+	assert.Equal(t, string(m.files["/srv/app"]), contents)
+	assert.Equal(t, m.modes["/srv/app"], os.FileMode(0o755))
+
+	out := &bytes.Buffer{}
+	n, err := Download(serve(t, m.server(nil)), "/srv/app", out)
+	assert.NilError(t, err)
+	assert.Equal(t, n, int64(len(contents)))
+	assert.Equal(t, out.String(), contents)
+
+	_, err = Download(serve(t, m.server(nil)), "/srv/missing", out)
+	assert.Assert(t, errors.Is(err, ErrTransferFailed))
+}
+
+func TestAuthorize(t *testing.T) {
+	m := &memFiles{files: map[string][]byte{"/srv/big": []byte("0123456789")}, modes: map[string]os.FileMode{}}
+	deny := func(req *Request) (uint64, error) {
+		return 0, errors.New("no grant")
+	}
+	err := Upload(serve(t, m.server(deny)), "/srv/app", 0o644, 3, strings.NewReader("hop"))
+	assert.Assert(t, errors.Is(err, ErrTransferFailed))
+	assert.ErrorContains(t, err, "no grant")
+	assert.Equal(t, len(m.files), 1)
+
+	limit := func(req *Request) (uint64, error) {
+		return 4, nil
+	}
+	out := &bytes.Buffer{}
+	_, err = Download(serve(t, m.server(limit)), "/srv/big", out)
+	assert.Assert(t, errors.Is(err, ErrTransferFailed))
+	assert.ErrorContains(t, err, "larger than 4 bytes")
+	assert.Equal(t, out.String(), "0123")
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"os"
 	"os/user"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -17,6 +18,7 @@ import (
 	"hop.computer/hop/config"
 	"hop.computer/hop/core"
 	"hop.computer/hop/portforwarding"
+	"hop.computer/hop/tubes"
 )
 
 // ErrMissingInputURL is returned when hoststring is missing
@@ -26,18 +28,24 @@ var ErrMissingInputURL = errors.New("missing [hop://][user@]host[:port]")
 type ClientFlags struct {
 	ConfigPath string
 
-	Cmd     string
-	Address *core.URL
+	Cmd       string
+	Subsystem bool // Cmd names a subsystem of the server
+	Address   *core.URL
 
 	DataTimeout string
+	ProxyJump   string // comma separated jump hosts, overriding the config
 
 	// TODO(dadrian): What are these args?
 	RemoteFwds *portforwarding.Forward // CLI arguments related to remote port forwarding
 	LocalFwds  *portforwarding.Forward // CLI arguments related to local port forwarding
 	udpPFFlag  bool                    // CLI arguments to enable UDP port forwarding
+	FECGroup   int                     // datagrams per FEC parity datagram on UDP forwards, 0 to disable
 	Headless   bool                    // if no cmd desired (just port forwarding)
 	UsePty     bool                    // whether or not to request a remote PTY be allocated
 	Verbose    bool                    // show verbose error messages
+
+	RevokeGrant string           // ID of an authgrant to revoke on the server instead of starting a session
+	FileCopy    *config.FileCopy // a file to transfer instead of starting a session
 }
 
 func mergeAddresses(f *ClientFlags, hc *config.HostConfigOptional) error {
@@ -75,11 +83,31 @@ func mergeClientFlagsAndConfig(f *ClientFlags, cc *config.ClientConfig, dc *conf
 		hc.Cmd = &f.Cmd
 	}
 
+	if f.ProxyJump != "" {
+		hc.ProxyJump = &f.ProxyJump
+	}
+
+	if f.FECGroup != 0 {
+		for _, fwd := range []*portforwarding.Forward{f.LocalFwds, f.RemoteFwds} {
+			if fwd == nil {
+				continue
+			}
+			if !fwd.IsUDP() {
+				return nil, fmt.Errorf("-fec requires -udp port forwarding")
+			}
+			if err := fwd.EnableFEC(tubes.FECConfig{GroupSize: f.FECGroup}); err != nil {
+				return nil, fmt.Errorf("invalid -fec value %d (must be between 1 and 64)", f.FECGroup)
+			}
+		}
+	}
+
 	hc.UsePty = &f.UsePty
 	hc.LocalFwds = f.LocalFwds
 	hc.RemoteFwds = f.RemoteFwds
 
 	clientConfig := hc.Unwrap()
+	clientConfig.FileCopy = f.FileCopy
+	clientConfig.Subsystem = f.Subsystem
 
 	if f.DataTimeout != "" {
 		duration, err := time.ParseDuration(f.DataTimeout)
@@ -128,6 +156,7 @@ func LoadClientConfigFromFlags(f *ClientFlags) (*config.HostConfig, error) {
 // defineClientFlags calls fs.StringVar for Client
 func defineClientFlags(fs *flag.FlagSet, f *ClientFlags) {
 	fs.BoolVar(&f.udpPFFlag, "udp", false, "Enable UDP port forwarding (default: TCP)")
+	fs.IntVar(&f.FECGroup, "fec", 0, "protect UDP port forwarding with a parity datagram after every `n` datagrams, recovering one lost datagram per group (1-64)")
 
 	fs.Func("R", "perform remote port forwarding", func(s string) error {
 		pfNetworkType := portforwarding.PfTCP
@@ -159,11 +188,31 @@ func defineClientFlags(fs *flag.FlagSet, f *ClientFlags) {
 		return nil
 	})
 
+	fs.Func("put", "upload a file, as local:/remote/path, and exit", func(s string) error {
+		i := strings.LastIndex(s, ":")
+		if i < 0 {
+			return fmt.Errorf("expected local:/remote/path")
+		}
+		return f.setFileCopy(&config.FileCopy{Upload: true, Local: s[:i], Remote: s[i+1:]})
+	})
+
+	fs.Func("get", "download a file, as /remote/path:local, and exit", func(s string) error {
+		remote, local, ok := strings.Cut(s, ":")
+		if !ok {
+			return fmt.Errorf("expected /remote/path:local")
+		}
+		return f.setFileCopy(&config.FileCopy{Local: local, Remote: remote})
+	})
+
 	fs.StringVar(&f.ConfigPath, "C", "", "path to client config (uses ~/.hop/config when unspecified)")
 
 	fs.StringVar(&f.Cmd, "c", "", "specific command to execute on remote server")
+	fs.BoolVar(&f.Subsystem, "s", false, "start the subsystem of the remote server named by the command, e.g. sftp")
 	fs.BoolVar(&f.Headless, "N", false, "don't execute a remote command. Useful for just port forwarding.")
 	fs.BoolVar(&f.Verbose, "V", false, "display verbose error messages")
+	fs.StringVar(&f.RevokeGrant, "revoke-grant", "", "revoke the authgrant with this ID on the server and exit")
+
+	fs.StringVar(&f.ProxyJump, "J", "", "connect through jump hosts, separated by commas (\"none\" disables ProxyJump from the config)")
 
 	fs.StringVar(&f.DataTimeout, "datatimeout", "", "Set the client data timeout before closing the session (uses 15 minutes when unspecified). Examples: --datatimeout 10s")
 
@@ -187,6 +236,18 @@ func defineClientFlags(fs *flag.FlagSet, f *ClientFlags) {
 	_ = fs.String("oRequestTTY", "", "")
 }
 
+// setFileCopy sets the file transfer of f. There can only be one.
+func (f *ClientFlags) setFileCopy(c *config.FileCopy) error {
+	if f.FileCopy != nil {
+		return fmt.Errorf("only one of -put or -get may be given")
+	}
+	if c.Local == "" || !filepath.IsAbs(c.Remote) {
+		return fmt.Errorf("expected a local path and an absolute remote path")
+	}
+	f.FileCopy = c
+	return nil
+}
+
 // ParseClientArgs defines and parses the flags from the command line for Client
 func ParseClientArgs(args []string) (*ClientFlags, error) {
 	f := new(ClientFlags)
@@ -226,6 +287,12 @@ func ParseClientArgs(args []string) (*ClientFlags, error) {
 		f.Cmd = strings.Join(fs.Args()[1:], " ")
 	}
 	f.Address = inputURL
+	if f.FileCopy != nil && (f.Cmd != "" || f.Headless || f.RevokeGrant != "") {
+		return nil, fmt.Errorf("-put and -get can not be combined with a command, -N or -revoke-grant")
+	}
+	if f.Subsystem && (f.Cmd == "" || strings.ContainsAny(f.Cmd, " \t")) {
+		return nil, fmt.Errorf("-s needs the name of a subsystem as the command")
+	}
 
 	// Handle pty allocation
 	switch {
@@ -236,7 +303,7 @@ func ParseClientArgs(args []string) (*ClientFlags, error) {
 	case noPty:
 		f.UsePty = false
 	default:
-		f.UsePty = f.Cmd == "" && istty.IsTerminal(os.Stdin.Fd()) && !f.Headless
+		f.UsePty = f.Cmd == "" && istty.IsTerminal(os.Stdin.Fd()) && !f.Headless && f.FileCopy == nil
 	}
 	return f, nil
 }
@@ -0,0 +1,68 @@
+package hopclient
+
+import (
+	"context"
+	"fmt"
+
+	"hop.computer/hop/agent"
+	"hop.computer/hop/authgrants"
+	"hop.computer/hop/certs"
+	"hop.computer/hop/config"
+)
+
+// AgentApprover returns a CheckIntentCallback that sends intents to the
+// approval socket of the hop agent of hc and waits until they are approved or
+// denied there. It is meant for principals that have no terminal to prompt
+// on. delegateHost is the host the delegate client runs on.
+func AgentApprover(hc *config.HostConfig, delegateHost string) (authgrants.CheckIntentCallback, error) {
+	socket := hc.ApprovalSocket
+	if socket == "" {
+		var err error
+		socket, err = agent.DefaultApprovalSocket()
+		if err != nil {
+			return nil, err
+		}
+	}
+	ac := agent.NewApprovalClient(socket)
+	return func(i authgrants.Intent, cert *certs.Certificate) error {
+		req := approvalRequest(&i, delegateHost)
+		if cert != nil && len(cert.IDChunk.Blocks) > 0 {
+			req.Delegate = fmt.Sprintf("%s (%s)", cert.IDChunk.Blocks[0].String(), delegateHost)
+		}
+		d, err := ac.RequestApproval(context.Background(), req)
+		if err != nil {
+			return fmt.Errorf("asking the agent for approval: %w", err)
+		}
+		if !d.Approved {
+			return fmt.Errorf("%w: %s", ErrClientApprovalDenied, d.Reason)
+		}
+		return nil
+	}, nil
+}
+
+// approvalRequest describes i for the agent
+func approvalRequest(i *authgrants.Intent, delegateHost string) *agent.ApprovalRequest {
+	req := &agent.ApprovalRequest{
+		Delegate:  delegateHost,
+		Target:    i.TargetSNI.String(),
+		User:      i.TargetUsername,
+		Grant:     i.GrantType.String(),
+		Usage:     i.UsageString(),
+		Delegable: i.Delegable(),
+		Start:     i.StartTime,
+		Expires:   i.ExpTime,
+	}
+	switch i.GrantType {
+	case authgrants.Command:
+		req.Action = i.AssociatedData.CommandGrantData.String()
+	case authgrants.LocalPF:
+		req.Action = i.AssociatedData.LocalPFGrantData.Address
+	case authgrants.RemotePF:
+		req.Action = i.AssociatedData.RemotePFGrantData.Address
+	case authgrants.FileRead, authgrants.FileWrite:
+		req.Action = i.AssociatedData.FileGrantData.String()
+	case authgrants.Subsystem:
+		req.Action = i.AssociatedData.SubsystemGrantData.Name
+	}
+	return req
+}
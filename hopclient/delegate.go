@@ -1,8 +1,10 @@
 package hopclient
 
 import (
+	"fmt"
 	"net"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -10,8 +12,10 @@ import (
 	"hop.computer/hop/authgrants"
 	"hop.computer/hop/certs"
 	"hop.computer/hop/common"
+	"hop.computer/hop/config"
 	"hop.computer/hop/core"
 	"hop.computer/hop/keys"
+	"hop.computer/hop/portforwarding"
 	"hop.computer/hop/transport"
 )
 
@@ -38,10 +42,17 @@ func (c *HopClient) getAuthorization(vc transport.VerifyConfig) error {
 	c.authenticator = makeAuthenticatorWithGeneratedKeypair(c.hostconfig.HostURL(), vc)
 	// make intent requests
 	irs := []authgrants.Intent{}
+	lifetime := c.hostconfig.AuthgrantLifetime
+	if lifetime <= 0 {
+		lifetime = time.Minute
+	}
 	irTemplate := authgrants.Intent{
-		TargetPort: uint16(c.hostconfig.Port),
-		StartTime:  time.Now(),
-		ExpTime:    time.Now().Add(time.Minute), // TODO(baumanl): add way to customize this
+		TargetPort:  uint16(c.hostconfig.Port),
+		StartTime:   time.Now(),
+		ExpTime:     time.Now().Add(lifetime),
+		MaxUses:     intentMaxUses(c.hostconfig.AuthgrantUses),
+		MinInterval: c.hostconfig.AuthgrantInterval.Truncate(time.Second),
+		Flags:       intentFlags(c.hostconfig),
 		TargetSNI: certs.Name{
 			Type:  certs.TypeDNSName,
 			Label: []byte(c.hostconfig.Hostname),
@@ -49,26 +60,58 @@ func (c *HopClient) getAuthorization(vc transport.VerifyConfig) error {
 		TargetUsername: c.hostconfig.User,
 		DelegateCert:   *c.authenticator.GetLeaf(),
 	}
-	// need shell authgrant?
-	if !c.hostconfig.Headless && c.hostconfig.Cmd == "" {
+	// need file authgrant instead of a session?
+	if c.hostconfig.FileCopy != nil {
+		ir, err := fileIntentRequest(irTemplate, c.hostconfig)
+		if err != nil {
+			return err
+		}
+		irs = append(irs, ir)
+	} else if !c.hostconfig.Headless && c.hostconfig.Cmd == "" {
+		// need shell authgrant?
 		irShell := irTemplate
 		irShell.GrantType = authgrants.Shell
 		irs = append(irs, irShell)
+	} else if c.hostconfig.Subsystem {
+		irSubsystem := irTemplate
+		irSubsystem.GrantType = authgrants.Subsystem
+		irSubsystem.AssociatedData.SubsystemGrantData.Name = c.hostconfig.Cmd
+		irs = append(irs, irSubsystem)
 	} else if c.hostconfig.Cmd != "" {
 		irCmd := irTemplate
 		irCmd.GrantType = authgrants.Command
+		cmdData, err := commandGrantData(c.hostconfig)
+		if err != nil {
+			return err
+		}
 		irCmd.AssociatedData = authgrants.GrantData{
-			CommandGrantData: authgrants.CommandGrantData{
-				Cmd: c.hostconfig.Cmd,
-			},
+			CommandGrantData: cmdData,
 		}
 		irs = append(irs, irCmd)
 	}
+	// need port forwarding authgrant? The client forwards either remotely or
+	// locally, as in Start.
+	if c.hostconfig.RemoteFwds != nil {
+		ir, err := pfIntentRequest(irTemplate, c.hostconfig.RemoteFwds, portforwarding.PfRemote)
+		if err != nil {
+			return err
+		}
+		irs = append(irs, ir)
+	} else if c.hostconfig.LocalFwds != nil {
+		ir, err := pfIntentRequest(irTemplate, c.hostconfig.LocalFwds, portforwarding.PfLocal)
+		if err != nil {
+			return err
+		}
+		irs = append(irs, ir)
+	}
 	// TODO(baumanl): add other intent request types
 
-	// TODO(baumanl): think more about environment variable/test it
-	// connect to delegate proxy --> target
-	val, ok := os.LookupEnv("DP_PROXY")
+	// connect to delegate proxy --> target. The server that started the
+	// delegate names its socket, and the token that identifies the session.
+	val, ok := os.LookupEnv(common.AuthgrantSockEnv)
+	if !ok {
+		val, ok = os.LookupEnv("DP_PROXY")
+	}
 	if !ok {
 		val = common.DefaultAgProxyListenSocket // change to default
 	}
@@ -78,6 +121,14 @@ func (c *HopClient) getAuthorization(vc transport.VerifyConfig) error {
 		return err
 	}
 
+	// without a token the delserver finds the session by the process tree
+	err = authgrants.WriteDelegateToken(os.Getenv(common.AuthgrantTokenEnv), pconn)
+	if err != nil {
+		pconn.Close()
+		logrus.Error("delegate: error sending authgrant token to server")
+		return err
+	}
+
 	// send targetInfo to the delserver
 	err = authgrants.WriteTargetInfo(irTemplate.TargetURL(), pconn)
 	if err != nil {
@@ -87,5 +138,120 @@ func (c *HopClient) getAuthorization(vc transport.VerifyConfig) error {
 	}
 
 	c.delServerConn = pconn
-	return authgrants.StartDelegateInstance(pconn, irs)
+	c.grants, err = authgrants.StartDelegateInstance(pconn, irs)
+	return err
+}
+
+// ChainThrough makes c, which must be a principal, pass on sub-grants of the
+// grants d holds as a delegate instead of asking its own targets. d must be
+// connected to the target with its grants before delegates of c ask for
+// grants. Only delegable grants of d can be passed on, and only narrowed.
+func (c *HopClient) ChainThrough(d *HopClient) error {
+	if !c.hostconfig.IsPrincipal {
+		return fmt.Errorf("can't chain authgrants through a client with IsPrincipal not set")
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.chainVia = d
+	return nil
+}
+
+// parentGrantFor returns a delegable grant held by c that i narrows
+func (c *HopClient) parentGrantFor(i authgrants.Intent) (authgrants.GrantID, bool) {
+	for n := range c.grants {
+		if err := c.grants[n].Attenuates(&i); err == nil {
+			return c.grants[n].ID, true
+		}
+	}
+	return 0, false
+}
+
+// intentMaxUses converts the AuthgrantUses option to the MaxUses of an intent.
+// Negative or too large values request any number of uses.
+func intentMaxUses(uses int) uint16 {
+	if uses < 0 || uses >= authgrants.UnlimitedUses {
+		return authgrants.UnlimitedUses
+	}
+	return uint16(uses)
+}
+
+// commandGrantData returns the command grant a delegate with hc asks for: for
+// Cmd, or for AuthgrantPattern if it is set, which must allow Cmd
+func commandGrantData(hc *config.HostConfig) (authgrants.CommandGrantData, error) {
+	if hc.AuthgrantPattern == "" {
+		return authgrants.CommandGrantData{Cmd: hc.Cmd}, nil
+	}
+	d, err := authgrants.ParseCommandPattern(hc.AuthgrantPattern, hc.AuthgrantFlags)
+	if err != nil {
+		return d, fmt.Errorf("AuthgrantPattern: %w", err)
+	}
+	if _, ok := d.Allows(hc.Cmd); !ok {
+		return d, fmt.Errorf("AuthgrantPattern %q does not allow the command %q", hc.AuthgrantPattern, hc.Cmd)
+	}
+	return d, nil
+}
+
+// fileIntentRequest returns an intent request for the file transfer of hc:
+// for its remote file, or for AuthgrantPath if it is set, which must cover
+// it. Uploads ask for the size and permission bits of the local file.
+func fileIntentRequest(template authgrants.Intent, hc *config.HostConfig) (authgrants.Intent, error) {
+	fc := hc.FileCopy
+	remote := filepath.Clean(fc.Remote)
+	ir := template
+	ir.GrantType = authgrants.FileRead
+	d := authgrants.FileGrantData{Path: remote}
+	if hc.AuthgrantPath != "" {
+		d.Path = hc.AuthgrantPath
+	}
+	if fc.Upload {
+		fi, err := os.Stat(fc.Local)
+		if err != nil {
+			return ir, err
+		}
+		ir.GrantType = authgrants.FileWrite
+		// a MaxSize of 0 would allow any size
+		d.MaxSize = max(uint64(fi.Size()), 1)
+		d.Mode = uint32(fi.Mode().Perm())
+	}
+	if err := d.Validate(); err != nil {
+		return ir, fmt.Errorf("AuthgrantPath: %w", err)
+	}
+	if !d.Allows(remote, d.MaxSize, d.Mode) {
+		return ir, fmt.Errorf("AuthgrantPath %q does not cover %q", hc.AuthgrantPath, remote)
+	}
+	ir.AssociatedData.FileGrantData = d
+	return ir, nil
+}
+
+// intentFlags returns the flags of the intents a delegate with hc requests
+func intentFlags(hc *config.HostConfig) byte {
+	var flags byte
+	if hc.AuthgrantDelegable {
+		flags |= authgrants.FlagDelegable
+	}
+	return flags
+}
+
+// pfIntentRequest returns an intent request for the address the target acts on
+// for fwd
+func pfIntentRequest(template authgrants.Intent, fwd *portforwarding.Forward, pfType int) (authgrants.Intent, error) {
+	network, address, err := portforwarding.FormatAddr(fwd.ServerAddr(pfType))
+	if err != nil {
+		return authgrants.Intent{}, err
+	}
+	ir := template
+	if pfType == portforwarding.PfRemote {
+		ir.GrantType = authgrants.RemotePF
+		ir.AssociatedData.RemotePFGrantData = authgrants.RemotePFGrantData{
+			Network: byte(network),
+			Address: address,
+		}
+	} else {
+		ir.GrantType = authgrants.LocalPF
+		ir.AssociatedData.LocalPFGrantData = authgrants.LocalPFGrantData{
+			Network: byte(network),
+			Address: address,
+		}
+	}
+	return ir, nil
 }
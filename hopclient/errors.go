@@ -21,3 +21,6 @@ var ErrClientUnauthorized = errors.New("client not authorized")
 
 // ErrClientStartingExecTube is returned by client when cmd execution and/or I/O redirection fails
 var ErrClientStartingExecTube = errors.New("failed to start session")
+
+// ErrClientApprovalDenied is returned by client (principal) when the agent did not approve an intent
+var ErrClientApprovalDenied = errors.New("intent not approved by agent")
@@ -0,0 +1,81 @@
+package hopclient
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+
+	"hop.computer/hop/common"
+	"hop.computer/hop/filetransfer"
+)
+
+// CopyFile makes the file transfer of the host config instead of starting a
+// session
+func (c *HopClient) CopyFile() error {
+	fc := c.hostconfig.FileCopy
+	if fc == nil {
+		return fmt.Errorf("no file to copy")
+	}
+	if fc.Upload {
+		return c.Upload(fc.Local, fc.Remote)
+	}
+	return c.Download(fc.Remote, fc.Local)
+}
+
+// Upload copies the local file to the absolute path remote on the server,
+// with the same permission bits
+func (c *HopClient) Upload(local, remote string) error {
+	f, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	tube, err := c.TubeMuxer.CreateReliableTube(common.FileTube)
+	if err != nil {
+		return err
+	}
+	defer tube.Close()
+	err = filetransfer.Upload(tube, filepath.Clean(remote), fi.Mode(), uint64(fi.Size()), f)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("uploaded %d bytes of %s to %s", fi.Size(), local, remote)
+	return nil
+}
+
+// Download copies the file at the absolute path remote on the server to the
+// local file. The local file is only replaced once the whole file arrived.
+func (c *HopClient) Download(remote, local string) error {
+	f, err := os.CreateTemp(filepath.Dir(local), ".hop-download-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	tube, err := c.TubeMuxer.CreateReliableTube(common.FileTube)
+	if err != nil {
+		return err
+	}
+	defer tube.Close()
+	n, err := filetransfer.Download(tube, filepath.Clean(remote), f)
+	if err != nil {
+		return err
+	}
+	if err := f.Chmod(0o644); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), local); err != nil {
+		return err
+	}
+	logrus.Infof("downloaded %d bytes of %s to %s", n, remote, local)
+	return nil
+}
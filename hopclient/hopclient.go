@@ -7,6 +7,8 @@ import (
 	"io/fs"
 	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
 	"sync"
 
 	"github.com/sirupsen/logrus"
@@ -43,13 +45,19 @@ type HopClient struct {
 	// +checklocks:checkIntentLock
 	checkIntent     authgrants.CheckIntentCallback // should only be set if principal
 	checkIntentLock sync.Mutex
-	delServerConn   net.Conn // conn to UDS with delegate server
+	delServerConn   net.Conn             // conn to UDS with delegate server
+	audit           *authgrants.AuditLog // records authgrant decisions as a principal
 
 	TubeMuxer *tubes.Muxer
 	ExecTube  *codex.ExecTube
 
 	hostconfig        *config.HostConfig
 	RawConfigFilePath string
+
+	via *HopClient // jump host the client connects through, if any
+
+	grants   []authgrants.Authgrant // grants held as a delegate
+	chainVia *HopClient             // delegate whose grants intents are sub-grants of, if any
 }
 
 // NewHopClient creates a new client object
@@ -312,9 +320,26 @@ func (c *HopClient) Close() error {
 	// TODO: close all remote and local port forwarding relationships
 	logrus.Info("client waiting in close...")
 	c.wg.Wait()
+
+	if c.via != nil {
+		c.via.Close()
+	}
 	return err
 }
 
+// obfuscationConfig returns the packet obfuscation settings for hc, or nil if
+// obfuscation is disabled. The key is derived from the server's KEM key.
+func obfuscationConfig(hc *config.HostConfig, authenticator core.Authenticator) (*transport.ObfuscationConfig, error) {
+	if !hc.Obfuscate {
+		return nil, nil
+	}
+	key, err := transport.ObfuscationKey(authenticator.GetServerKEMKey())
+	if err != nil {
+		return nil, fmt.Errorf("unable to obfuscate packets: %w", err)
+	}
+	return &transport.ObfuscationConfig{Key: key}, nil
+}
+
 func (c *HopClient) startUnderlying(address string, authenticator core.Authenticator) error {
 	// TODO(dadrian): Update this once the authenticator interface is set.
 	transportConfig := transport.ClientConfig{
@@ -323,21 +348,59 @@ func (c *HopClient) startUnderlying(address string, authenticator core.Authentic
 		Leaf:         authenticator.GetLeaf(),
 		ServerKEMKey: authenticator.GetServerKEMKey(),
 	}
-	var err error
-	var dialer net.Dialer
-	dialer.Timeout = c.hostconfig.HandshakeTimeout
-	c.TransportConn, err = transport.DialWithDialer(&dialer, "udp", address, transportConfig)
-
+	transportConfig.HSTimeout = c.hostconfig.HandshakeTimeout
+	obfuscation, err := obfuscationConfig(c.hostconfig, authenticator)
 	if err != nil {
-		logrus.Errorf("C: error dialing server: %v", err)
+		return err
+	}
+	transportConfig.Obfuscation = obfuscation
+	if c.hostconfig.ProxyURL != "" {
+		transportConfig.Proxy, err = url.Parse(c.hostconfig.ProxyURL)
+		if err != nil {
+			return fmt.Errorf("invalid ProxyURL: %w", err)
+		}
+	}
+
+	// ProxyJump is only for the configured host
+	if c.via == nil && address == c.hostconfig.HostURL().Address() {
+		hosts, err := c.hostconfig.JumpHosts()
+		if err != nil {
+			return err
+		}
+		if len(hosts) > 0 {
+			c.via, err = c.dialJumpHosts(hosts)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if c.via != nil {
+		c.TransportConn, err = dialThrough(c.via, address, transportConfig)
+		if err != nil {
+			logrus.Errorf("C: error dialing server through jump host: %v", err)
+		}
 		return err
 	}
 
-	// TODO(dadrian): This hangs if the server is not available when it starts.
-	// Transport needs to be set with a timeout.
-	err = c.TransportConn.Handshake()
+	// ServerIPv4 and ServerIPv6 take the place of DNS for the configured host,
+	// and FallbackURL is only for that host
+	var serverAddrs []netip.AddrPort
+	var dialer transport.Dialer
+	if address == c.hostconfig.HostURL().Address() {
+		serverAddrs, err = c.hostconfig.ServerAddrs()
+		if err != nil {
+			return err
+		}
+		dialer.FallbackURL = c.hostconfig.FallbackURL
+	}
+
+	if len(serverAddrs) > 0 {
+		c.TransportConn, err = dialer.DialAddrs(context.Background(), serverAddrs, transportConfig)
+	} else {
+		c.TransportConn, err = dialer.DialContext(context.Background(), "udp", address, transportConfig)
+	}
 	if err != nil {
-		logrus.Errorf("C: Issue with handshake: %v", err)
+		logrus.Errorf("C: error dialing server: %v", err)
 		return err
 	}
 	return nil
@@ -384,6 +447,7 @@ func (c *HopClient) startExecTube() error {
 	}
 	execConfig := codex.Config{
 		Cmd:        c.hostconfig.Cmd,
+		Subsystem:  c.hostconfig.Subsystem,
 		UsePty:     c.hostconfig.UsePty,
 		StdinTube:  stdinTube,
 		StdoutTube: stdoutTube,
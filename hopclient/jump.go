@@ -0,0 +1,77 @@
+package hopclient
+
+import (
+	"hop.computer/hop/core"
+	"hop.computer/hop/flags"
+	"hop.computer/hop/jump"
+	"hop.computer/hop/transport"
+)
+
+// SetJumpHost makes the client connect to its server through via, which must
+// already be connected. The transport handshake runs end-to-end with the
+// server over a tube relayed by via. Closing the client also closes via.
+func (c *HopClient) SetJumpHost(via *HopClient) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.via = via
+}
+
+// dialJumpHosts connects to each of hosts in turn, each one through the hosts
+// before it, and returns the client connected to the last. Every jump host is
+// authenticated with the settings from its own [[Hosts]] block.
+func (c *HopClient) dialJumpHosts(hosts []core.URL) (*HopClient, error) {
+	var via *HopClient
+	for _, host := range hosts {
+		cflags := &flags.ClientFlags{
+			ConfigPath: c.RawConfigFilePath,
+			Address:    &host,
+			Headless:   true,
+		}
+		hc, err := flags.LoadClientConfigFromFlags(cflags)
+		if err != nil {
+			if via != nil {
+				via.Close()
+			}
+			return nil, err
+		}
+		// The chain is given by the destination's ProxyJump alone
+		hc.ProxyJump = ""
+
+		jc, err := NewHopClient(hc)
+		if err != nil {
+			if via != nil {
+				via.Close()
+			}
+			return nil, err
+		}
+		jc.Fsystem = c.Fsystem
+		jc.RawConfigFilePath = c.RawConfigFilePath
+		jc.via = via
+		if err := jc.Dial(); err != nil {
+			jc.Close()
+			return nil, err
+		}
+		go jc.HandleTubes()
+		via = jc
+	}
+	return via, nil
+}
+
+// dialThrough runs a transport handshake with the server at address over a
+// tube relayed by via
+func dialThrough(via *HopClient, address string, config transport.ClientConfig) (*transport.Client, error) {
+	tube, err := jump.Open(via.TubeMuxer, address)
+	if err != nil {
+		return nil, err
+	}
+	// The jump host resolves address, and the tube ignores the destination of
+	// each datagram. Packets are bounded by the MaxPayload of the tube instead
+	// of the path MTU.
+	config.DisablePathMTUDiscovery = true
+	client := transport.NewClient(tube, nil, config)
+	if err := client.Handshake(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return client, nil
+}
@@ -44,6 +44,24 @@ func (c *HopClient) SetCheckIntentCallback(f authgrants.CheckIntentCallback) err
 	return nil
 }
 
+// SetAuditLog makes the client record the outcome of the intent requests it
+// handles as a principal to l
+func (c *HopClient) SetAuditLog(l *authgrants.AuditLog) error {
+	if c.hostconfig == nil || !c.hostconfig.IsPrincipal {
+		return fmt.Errorf("can't set audit log for client with IsPrincipal not set")
+	}
+	c.audit = l
+	return nil
+}
+
+// leaf returns the certificate the client authenticates with, if it has one
+func (c *HopClient) leaf() *certs.Certificate {
+	if c.authenticator == nil {
+		return nil
+	}
+	return c.authenticator.GetLeaf()
+}
+
 // allows principal client to keep track of unreliable principal proxy
 // tubes before the reliable has received the tube id
 type ptProxyTubeQueue struct {
@@ -106,6 +124,11 @@ func (c *HopClient) newPrincipalInstanceSetup(delTube *tubes.Reliable, pq *ptPro
 	delete(pq.tubes, tubeID)
 	pq.lock.Unlock()
 
+	if c.chainVia != nil {
+		c.startChainedPrincipal(delTube, proxyTube, ci)
+		return
+	}
+
 	setup := func(url core.URL, verifyCallback authgrants.AdditionalVerifyCallback) (net.Conn, error) {
 		psubclient, err = c.setupTargetClient(url, proxyTube, verifyCallback)
 		if err != nil {
@@ -118,7 +141,7 @@ func (c *HopClient) newPrincipalInstanceSetup(delTube *tubes.Reliable, pq *ptPro
 
 	logrus.Info("starting principal instance")
 
-	authgrants.StartPrincipalInstance(delTube, ci, setup)
+	authgrants.StartPrincipalInstance(delTube, ci, setup, c.audit, c.leaf())
 	delTube.Close()
 
 	if psubclient != nil {
@@ -135,6 +158,36 @@ func (c *HopClient) newPrincipalInstanceSetup(delTube *tubes.Reliable, pq *ptPro
 	}
 }
 
+// startChainedPrincipal answers intent requests from delTube with sub-grants
+// of the grants of c.chainVia, over its connection to the target. The proxy
+// tube to the target is not needed, but is held open until the delegate is
+// done.
+func (c *HopClient) startChainedPrincipal(delTube *tubes.Reliable, proxyTube *tubes.Unreliable, ci authgrants.CheckIntentCallback) {
+	d := c.chainVia
+	var targetConn net.Conn
+	setup := func(url core.URL, verifyCallback authgrants.AdditionalVerifyCallback) (net.Conn, error) {
+		// d already verified the target when it connected
+		if err := verifyCallback(nil); err != nil {
+			return nil, err
+		}
+		tube, err := d.newAuthgrantTube()
+		if err != nil {
+			return nil, err
+		}
+		targetConn = tube
+		return tube, nil
+	}
+
+	logrus.Info("starting chained principal instance")
+
+	authgrants.StartChainedPrincipalInstance(delTube, ci, d.parentGrantFor, setup, c.audit, c.leaf())
+	delTube.Close()
+	if targetConn != nil {
+		targetConn.Close()
+	}
+	proxyTube.Close()
+}
+
 func (c *HopClient) setupTargetClient(targURL core.URL, dt *tubes.Unreliable, verifyCallback authgrants.AdditionalVerifyCallback) (*principalSubclient, error) {
 	psubclient := &principalSubclient{
 		unrelProxyTube: dt,
@@ -181,6 +234,10 @@ func (c *HopClient) setupTargetClient(targURL core.URL, dt *tubes.Unreliable, ve
 	}
 
 	transportConfig.Verify.AddVerifyCallback = transport.AdditionalVerifyCallback(verifyCallback)
+	transportConfig.Obfuscation, err = obfuscationConfig(client.hostconfig, client.authenticator)
+	if err != nil {
+		return psubclient, err
+	}
 
 	client.TransportConn, err = transport.DialNP(client.hostconfig.HostURL().Address(), dt, transportConfig)
 	if err != nil {
@@ -211,3 +268,14 @@ func (c *HopClient) setupTargetClient(targURL core.URL, dt *tubes.Unreliable, ve
 func (c *HopClient) newAuthgrantTube() (*tubes.Reliable, error) {
 	return c.TubeMuxer.CreateReliableTube(common.AuthGrantTube)
 }
+
+// RevokeAuthgrant asks the server to revoke the authgrant with id. The grant
+// must be for the user the client is logged in as.
+func (c *HopClient) RevokeAuthgrant(id authgrants.GrantID) error {
+	tube, err := c.newAuthgrantTube()
+	if err != nil {
+		return err
+	}
+	defer tube.Close()
+	return authgrants.RevokeAuthgrant(tube, id)
+}
@@ -0,0 +1,79 @@
+package hoplb
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"goji.io"
+	"goji.io/pat"
+)
+
+// AdminServer is an http.Handler that reports and changes the state of the
+// backends of a Balancer.
+type AdminServer struct {
+	*goji.Mux
+	b *Balancer
+}
+
+// NewAdminServer creates an AdminServer for b.
+func NewAdminServer(b *Balancer) AdminServer {
+	s := AdminServer{
+		Mux: goji.NewMux(),
+		b:   b,
+	}
+	s.Handle(pat.Get("/backends"), http.HandlerFunc(s.listBackends))
+	s.Handle(pat.Post("/backends/:id/drain"), http.HandlerFunc(s.drain))
+	s.Handle(pat.Post("/backends/:id/undrain"), http.HandlerFunc(s.undrain))
+	s.Handle(pat.Get("/healthz"), http.HandlerFunc(s.healthz))
+	return s
+}
+
+// BackendListResponse is the JSON structure returned by GET /backends.
+type BackendListResponse struct {
+	Backends []BackendStatus `json:"backends"`
+}
+
+func (s *AdminServer) listBackends(w http.ResponseWriter, r *http.Request) {
+	out := BackendListResponse{
+		Backends: s.b.Status(),
+	}
+	err := json.NewEncoder(w).Encode(&out)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+}
+
+func (s *AdminServer) setDraining(w http.ResponseWriter, r *http.Request, draining bool) {
+	id, err := strconv.ParseUint(pat.Param(r, "id"), 10, 8)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	err = s.b.SetDraining(byte(id), draining)
+	if errors.Is(err, ErrUnknownBackend) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *AdminServer) drain(w http.ResponseWriter, r *http.Request) {
+	s.setDraining(w, r, true)
+}
+
+func (s *AdminServer) undrain(w http.ResponseWriter, r *http.Request) {
+	s.setDraining(w, r, false)
+}
+
+func (s *AdminServer) healthz(w http.ResponseWriter, r *http.Request) {
+	for _, st := range s.b.Status() {
+		if st.Healthy && !st.Draining {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusServiceUnavailable)
+}
@@ -0,0 +1,6 @@
+// Package hoplb implements a UDP load balancer for Hop servers that share one
+// address. Handshakes are spread over the healthy backends, and every packet of
+// an established session is sent to the backend whose server ID is embedded in
+// the session ID, even after the client's address changes. The load balancer
+// never decrypts anything.
+package hoplb
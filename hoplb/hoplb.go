@@ -0,0 +1,422 @@
+package hoplb
+
+import (
+	"errors"
+	"fmt"
+	"hash/maphash"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"hop.computer/hop/common"
+	"hop.computer/hop/transport"
+)
+
+// Defaults for Config
+const (
+	DefaultHealthInterval = 5 * time.Second
+	DefaultHealthTimeout  = 2 * time.Second
+	DefaultIdleTimeout    = 5 * time.Minute
+
+	DefaultUnansweredTimeout = 10 * time.Second
+	DefaultMaxFlows          = 1 << 16
+)
+
+// ErrUnknownBackend is returned for a server ID that is not a backend
+var ErrUnknownBackend = errors.New("unknown backend")
+
+// ErrNoBackend is returned when no backend can take a new handshake
+var ErrNoBackend = errors.New("no healthy backend")
+
+// ErrTooManyFlows is returned when a packet would open a flow beyond MaxFlows
+var ErrTooManyFlows = errors.New("too many flows")
+
+// BackendConfig describes a Hop server behind the load balancer
+type BackendConfig struct {
+	ID      byte // the ServerID of the backend, which must not be zero
+	Address string
+}
+
+// Config configures a Balancer
+type Config struct {
+	Backends []BackendConfig
+
+	// ServerIDKey must match the ServerIDKey of the backends
+	ServerIDKey *[transport.ServerIDKeyLen]byte
+
+	// HealthInterval is how often backends are probed. Negative disables
+	// health checks, and every backend is then assumed to be healthy.
+	HealthInterval time.Duration
+	HealthTimeout  time.Duration
+
+	// IdleTimeout is how long a client address keeps its sockets to the
+	// backends after its last packet
+	IdleTimeout time.Duration
+
+	// UnansweredTimeout replaces IdleTimeout for flows the backend has never
+	// replied to, such as those opened by spoofed client addresses
+	UnansweredTimeout time.Duration
+
+	// MaxFlows is the largest number of flows, and so of sockets, the
+	// Balancer opens. Packets that would open more are dropped.
+	MaxFlows int
+}
+
+// backend is a Hop server behind the load balancer
+type backend struct {
+	id   byte
+	addr *net.UDPAddr
+
+	healthy  atomic.Bool
+	draining atomic.Bool
+}
+
+// available reports whether the backend can take new handshakes
+func (b *backend) available() bool {
+	return b.healthy.Load() && !b.draining.Load()
+}
+
+// flowKey identifies the packets from one client address to one backend
+type flowKey struct {
+	client  netip.AddrPort
+	backend byte
+}
+
+// flow relays packets between a client address and a backend over a socket
+// of its own, so that the backend sees each client address as a distinct
+// address, and replies can be sent back to the client
+type flow struct {
+	key      flowKey
+	upstream *net.UDPConn
+	lastUsed atomic.Int64 // unix nanoseconds
+	answered atomic.Bool  // whether the backend has replied
+}
+
+// Balancer forwards datagrams from clients to backends
+type Balancer struct {
+	conn   *net.UDPConn
+	config Config
+
+	backends map[byte]*backend
+	ordered  []*backend // backends in the order of config.Backends
+
+	seed maphash.Seed
+
+	m sync.Mutex
+	// +checklocks:m
+	flows map[flowKey]*flow
+	// +checklocks:m
+	closed bool
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// New returns a Balancer that serves clients on conn
+func New(conn *net.UDPConn, config Config) (*Balancer, error) {
+	if config.HealthInterval == 0 {
+		config.HealthInterval = DefaultHealthInterval
+	}
+	if config.HealthTimeout <= 0 {
+		config.HealthTimeout = DefaultHealthTimeout
+	}
+	if config.IdleTimeout <= 0 {
+		config.IdleTimeout = DefaultIdleTimeout
+	}
+	if config.UnansweredTimeout <= 0 {
+		config.UnansweredTimeout = min(DefaultUnansweredTimeout, config.IdleTimeout)
+	}
+	if config.MaxFlows <= 0 {
+		config.MaxFlows = DefaultMaxFlows
+	}
+	if len(config.Backends) == 0 {
+		return nil, errors.New("no backends")
+	}
+	b := &Balancer{
+		conn:     conn,
+		config:   config,
+		backends: make(map[byte]*backend),
+		seed:     maphash.MakeSeed(),
+		flows:    make(map[flowKey]*flow),
+		done:     make(chan struct{}),
+	}
+	for _, bc := range config.Backends {
+		if bc.ID == 0 {
+			return nil, fmt.Errorf("backend %s: server ID must not be zero", bc.Address)
+		}
+		if _, ok := b.backends[bc.ID]; ok {
+			return nil, fmt.Errorf("duplicate server ID %d", bc.ID)
+		}
+		addr, err := net.ResolveUDPAddr("udp", bc.Address)
+		if err != nil {
+			return nil, fmt.Errorf("backend %d: %w", bc.ID, err)
+		}
+		be := &backend{id: bc.ID, addr: addr}
+		// Backends are assumed to be up until a health check fails
+		be.healthy.Store(true)
+		b.backends[bc.ID] = be
+		b.ordered = append(b.ordered, be)
+	}
+	return b, nil
+}
+
+// Serve forwards datagrams until the Balancer is closed
+func (b *Balancer) Serve() error {
+	b.wg.Add(1)
+	go b.reapFlows()
+	if b.config.HealthInterval > 0 {
+		for _, be := range b.ordered {
+			b.wg.Add(1)
+			go b.checkHealth(be)
+		}
+	}
+
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := b.conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			select {
+			case <-b.done:
+				return nil
+			default:
+				return err
+			}
+		}
+		be, err := b.route(buf[:n], addr)
+		if err != nil {
+			if common.Debug {
+				logrus.Tracef("lb: dropping packet from %s: %s", addr, err)
+			}
+			continue
+		}
+		f, err := b.flow(addr, be)
+		if errors.Is(err, ErrTooManyFlows) {
+			if common.Debug {
+				logrus.Tracef("lb: dropping packet from %s: %s", addr, err)
+			}
+			continue
+		} else if err != nil {
+			logrus.Errorf("lb: unable to open flow from %s to backend %d: %s", addr, be.id, err)
+			continue
+		}
+		f.lastUsed.Store(time.Now().UnixNano())
+		f.upstream.Write(buf[:n])
+	}
+}
+
+// route returns the backend for a datagram from addr. Packets of a session go
+// to the backend in their session ID, and handshakes go to the available
+// backend chosen by rendezvous hashing of the client address.
+func (b *Balancer) route(msg []byte, addr netip.AddrPort) (*backend, error) {
+	id, err := transport.SessionServerID(msg, b.config.ServerIDKey)
+	if err == nil {
+		be, ok := b.backends[id]
+		if !ok {
+			return nil, ErrUnknownBackend
+		}
+		return be, nil
+	}
+	if !errors.Is(err, transport.ErrNoServerID) {
+		return nil, err
+	}
+
+	var best *backend
+	var bestScore uint64
+	key := addr.String()
+	for _, be := range b.ordered {
+		if !be.available() {
+			continue
+		}
+		var h maphash.Hash
+		h.SetSeed(b.seed)
+		h.WriteString(key)
+		h.WriteByte(be.id)
+		if score := h.Sum64(); best == nil || score > bestScore {
+			best, bestScore = be, score
+		}
+	}
+	if best == nil {
+		return nil, ErrNoBackend
+	}
+	return best, nil
+}
+
+// flow returns the flow from client to be, opening it if needed
+func (b *Balancer) flow(client netip.AddrPort, be *backend) (*flow, error) {
+	key := flowKey{client: client, backend: be.id}
+	b.m.Lock()
+	defer b.m.Unlock()
+	if b.closed {
+		return nil, net.ErrClosed
+	}
+	if f, ok := b.flows[key]; ok {
+		return f, nil
+	}
+	if len(b.flows) >= b.config.MaxFlows {
+		return nil, ErrTooManyFlows
+	}
+	upstream, err := net.DialUDP("udp", nil, be.addr)
+	if err != nil {
+		return nil, err
+	}
+	f := &flow{key: key, upstream: upstream}
+	f.lastUsed.Store(time.Now().UnixNano())
+	b.flows[key] = f
+	b.wg.Add(1)
+	go b.relayReplies(f)
+	if common.Debug {
+		logrus.Tracef("lb: opened flow from %s to backend %d", client, be.id)
+	}
+	return f, nil
+}
+
+// relayReplies sends the datagrams from the backend of f to its client until
+// the flow is closed
+func (b *Balancer) relayReplies(f *flow) {
+	defer b.wg.Done()
+	buf := make([]byte, 65535)
+	for {
+		n, err := f.upstream.Read(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// ICMP errors from a backend that is down do not end the flow
+			continue
+		}
+		f.lastUsed.Store(time.Now().UnixNano())
+		f.answered.Store(true)
+		b.conn.WriteToUDPAddrPort(buf[:n], f.key.client)
+	}
+}
+
+// reapFlows closes flows that have been idle for longer than IdleTimeout, or
+// UnansweredTimeout if their backend has never replied
+func (b *Balancer) reapFlows() {
+	defer b.wg.Done()
+	ticker := time.NewTicker(b.config.UnansweredTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.done:
+			return
+		}
+		now := time.Now()
+		cutoff := now.Add(-b.config.IdleTimeout).UnixNano()
+		unansweredCutoff := now.Add(-b.config.UnansweredTimeout).UnixNano()
+		b.m.Lock()
+		for key, f := range b.flows {
+			lastUsed := f.lastUsed.Load()
+			if lastUsed < cutoff || (!f.answered.Load() && lastUsed < unansweredCutoff) {
+				f.upstream.Close()
+				delete(b.flows, key)
+			}
+		}
+		b.m.Unlock()
+	}
+}
+
+// checkHealth probes be every HealthInterval until the Balancer is closed
+func (b *Balancer) checkHealth(be *backend) {
+	defer b.wg.Done()
+	ticker := time.NewTicker(b.config.HealthInterval)
+	defer ticker.Stop()
+	for {
+		err := b.probe(be)
+		if healthy := err == nil; be.healthy.Swap(healthy) != healthy {
+			if healthy {
+				logrus.Infof("lb: backend %d (%s) is healthy", be.id, be.addr)
+			} else {
+				logrus.Warnf("lb: backend %d (%s) is unhealthy: %s", be.id, be.addr, err)
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// probe checks that be answers a Client Hello
+func (b *Balancer) probe(be *backend) error {
+	conn, err := net.DialUDP("udp", nil, be.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return transport.ProbeServer(conn, b.config.HealthTimeout)
+}
+
+// SetDraining stops or resumes sending new handshakes to the backend with id.
+// Established sessions keep reaching a draining backend.
+func (b *Balancer) SetDraining(id byte, draining bool) error {
+	be, ok := b.backends[id]
+	if !ok {
+		return ErrUnknownBackend
+	}
+	if be.draining.Swap(draining) != draining {
+		logrus.Infof("lb: backend %d draining: %t", id, draining)
+	}
+	return nil
+}
+
+// BackendStatus describes the state of a backend
+type BackendStatus struct {
+	ID       byte   `json:"id"`
+	Address  string `json:"address"`
+	Healthy  bool   `json:"healthy"`
+	Draining bool   `json:"draining"`
+	Flows    int    `json:"flows"`
+}
+
+// Status returns the state of every backend
+func (b *Balancer) Status() []BackendStatus {
+	flows := make(map[byte]int)
+	b.m.Lock()
+	for key := range b.flows {
+		flows[key.backend]++
+	}
+	b.m.Unlock()
+
+	out := make([]BackendStatus, 0, len(b.ordered))
+	for _, be := range b.ordered {
+		out = append(out, BackendStatus{
+			ID:       be.id,
+			Address:  be.addr.String(),
+			Healthy:  be.healthy.Load(),
+			Draining: be.draining.Load(),
+			Flows:    flows[be.id],
+		})
+	}
+	return out
+}
+
+// Addr returns the address clients connect to
+func (b *Balancer) Addr() net.Addr {
+	return b.conn.LocalAddr()
+}
+
+// Close stops the Balancer and closes every flow
+func (b *Balancer) Close() error {
+	b.m.Lock()
+	if b.closed {
+		b.m.Unlock()
+		return net.ErrClosed
+	}
+	b.closed = true
+	close(b.done)
+	err := b.conn.Close()
+	for key, f := range b.flows {
+		f.upstream.Close()
+		delete(b.flows, key)
+	}
+	b.m.Unlock()
+	b.wg.Wait()
+	return err
+}
@@ -0,0 +1,250 @@
+package hoplb
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+
+	"hop.computer/hop/certs"
+	"hop.computer/hop/keys"
+	"hop.computer/hop/transport"
+)
+
+var serverIDKey = transport.ServerIDKeyFromSecret([]byte("load balancer test"))
+
+func newBackend(t *testing.T, id byte) (*transport.Server, *transport.VerifyConfig) {
+	keyPair, err := keys.ReadDHKeyFromPEMFile("../transport/testdata/leaf-key.pem")
+	assert.NilError(t, err)
+	certificate, err := certs.ReadCertificatePEMFile("../transport/testdata/leaf.pem")
+	assert.NilError(t, err)
+	intermediate, err := certs.ReadCertificatePEMFile("../transport/testdata/intermediate.pem")
+	assert.NilError(t, err)
+	root, err := certs.ReadCertificatePEMFile("../transport/testdata/root.pem")
+	assert.NilError(t, err)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	s, err := transport.NewServer(pc.(*net.UDPConn), transport.ServerConfig{
+		KeyPair:          keyPair,
+		Certificate:      certificate,
+		Intermediate:     intermediate,
+		HandshakeTimeout: 5 * time.Second,
+		ServerID:         id,
+		ServerIDKey:      serverIDKey,
+	})
+	assert.NilError(t, err)
+	go s.Serve()
+	t.Cleanup(func() { s.Close() })
+
+	verify := transport.VerifyConfig{
+		Store:       certs.Store{},
+		CurrentTime: certificate.IssuedAt.Add(time.Second),
+	}
+	verify.Store.AddCertificate(root)
+	return s, &verify
+}
+
+func newBalancer(t *testing.T, config Config) *Balancer {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NilError(t, err)
+	b, err := New(conn, config)
+	assert.NilError(t, err)
+	go b.Serve()
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+func newClientConfig(t *testing.T, verify *transport.VerifyConfig) transport.ClientConfig {
+	kp := keys.GenerateNewX25519KeyPair()
+	leaf, err := certs.SelfSignLeaf(&certs.Identity{PublicKey: kp.Public})
+	assert.NilError(t, err)
+	return transport.ClientConfig{
+		Verify:    *verify,
+		Exchanger: kp,
+		Leaf:      leaf,
+		HSTimeout: 5 * time.Second,
+	}
+}
+
+// dialAndEcho dials a session through b, and checks that it was accepted by
+// want and carries data in both directions
+func dialAndEcho(t *testing.T, b *Balancer, config transport.ClientConfig, want *transport.Server) {
+	c, err := transport.Dial("udp", b.Addr().String(), config)
+	assert.NilError(t, err)
+	defer c.Close()
+	h, err := want.AcceptTimeout(time.Second)
+	assert.NilError(t, err)
+	defer h.Close()
+
+	_, err = c.Write([]byte("ping"))
+	assert.NilError(t, err)
+	buf := make([]byte, 64)
+	h.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := h.ReadMsg(buf)
+	assert.NilError(t, err)
+	assert.Equal(t, string(buf[:n]), "ping")
+
+	err = h.WriteMsg([]byte("pong"))
+	assert.NilError(t, err)
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	n, err = c.ReadMsg(buf)
+	assert.NilError(t, err)
+	assert.Equal(t, string(buf[:n]), "pong")
+}
+
+func TestBalancer(t *testing.T) {
+	one, verify := newBackend(t, 1)
+	two, _ := newBackend(t, 2)
+	b := newBalancer(t, Config{
+		Backends: []BackendConfig{
+			{ID: 1, Address: one.Addr().String()},
+			{ID: 2, Address: two.Addr().String()},
+		},
+		ServerIDKey:    serverIDKey,
+		HealthInterval: -1,
+	})
+	config := newClientConfig(t, verify)
+
+	// New sessions avoid draining backends, and each session stays with the
+	// backend that accepted it
+	assert.NilError(t, b.SetDraining(1, true))
+	for i := 0; i < 3; i++ {
+		dialAndEcho(t, b, config, two)
+	}
+	assert.NilError(t, b.SetDraining(1, false))
+	assert.NilError(t, b.SetDraining(2, true))
+	for i := 0; i < 3; i++ {
+		dialAndEcho(t, b, config, one)
+	}
+
+	// With every backend draining there is nowhere to send a handshake
+	assert.NilError(t, b.SetDraining(1, true))
+	config.HSTimeout = 200 * time.Millisecond
+	_, err := transport.Dial("udp", b.Addr().String(), config)
+	assert.Assert(t, err != nil)
+
+	assert.Equal(t, b.SetDraining(3, true), ErrUnknownBackend)
+}
+
+func TestBalancerHealthCheck(t *testing.T) {
+	up, _ := newBackend(t, 1)
+	down, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	defer down.Close()
+	b := newBalancer(t, Config{
+		Backends: []BackendConfig{
+			{ID: 1, Address: up.Addr().String()},
+			{ID: 2, Address: down.LocalAddr().String()},
+		},
+		HealthInterval: 20 * time.Millisecond,
+		HealthTimeout:  50 * time.Millisecond,
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status := b.Status()
+		if status[0].Healthy && !status[1].Healthy {
+			break
+		}
+		assert.Assert(t, time.Now().Before(deadline), "backend 2 is still healthy")
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitForFlows waits until b has n flows
+func waitForFlows(t *testing.T, b *Balancer, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for b.Status()[0].Flows != n {
+		assert.Assert(t, time.Now().Before(deadline), "%d flows, expected %d", b.Status()[0].Flows, n)
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBalancerFlowLimits(t *testing.T) {
+	// The backend only answers packets that ask for it
+	backend, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NilError(t, err)
+	defer backend.Close()
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, addr, err := backend.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if string(buf[:n]) == "\xffanswer" {
+				backend.WriteToUDP(buf[:n], addr)
+			}
+		}
+	}()
+	b := newBalancer(t, Config{
+		Backends:          []BackendConfig{{ID: 1, Address: backend.LocalAddr().String()}},
+		HealthInterval:    -1,
+		UnansweredTimeout: 100 * time.Millisecond,
+		MaxFlows:          2,
+	})
+
+	clients := make([]*net.UDPConn, 3)
+	for i := range clients {
+		clients[i], err = net.DialUDP("udp", nil, b.Addr().(*net.UDPAddr))
+		assert.NilError(t, err)
+		defer clients[i].Close()
+	}
+	_, err = clients[0].Write([]byte("\xffanswer"))
+	assert.NilError(t, err)
+	buf := make([]byte, 64)
+	clients[0].SetReadDeadline(time.Now().Add(time.Second))
+	_, err = clients[0].Read(buf)
+	assert.NilError(t, err)
+	_, err = clients[1].Write([]byte("\xffsilent"))
+	assert.NilError(t, err)
+	waitForFlows(t, b, 2)
+
+	// A third client address cannot open a flow
+	_, err = clients[2].Write([]byte("\xffsilent"))
+	assert.NilError(t, err)
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, b.Status()[0].Flows, 2)
+
+	// The flow the backend never answered is closed first, making room
+	waitForFlows(t, b, 1)
+	_, err = clients[2].Write([]byte("\xffsilent"))
+	assert.NilError(t, err)
+	waitForFlows(t, b, 2)
+}
+
+func TestAdminServer(t *testing.T) {
+	b := newBalancer(t, Config{
+		Backends:       []BackendConfig{{ID: 4, Address: "127.0.0.1:1"}},
+		HealthInterval: -1,
+	})
+	s := httptest.NewServer(NewAdminServer(b))
+	defer s.Close()
+
+	post := func(path string) int {
+		resp, err := http.Post(s.URL+path, "", nil)
+		assert.NilError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	get := func(path string) int {
+		resp, err := http.Get(s.URL + path)
+		assert.NilError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, get("/healthz"), http.StatusOK)
+	assert.Equal(t, post("/backends/4/drain"), http.StatusNoContent)
+	assert.Equal(t, b.Status()[0].Draining, true)
+	assert.Equal(t, get("/healthz"), http.StatusServiceUnavailable)
+	assert.Equal(t, post("/backends/4/undrain"), http.StatusNoContent)
+	assert.Equal(t, b.Status()[0].Draining, false)
+	assert.Equal(t, post("/backends/5/drain"), http.StatusNotFound)
+	assert.Equal(t, post("/backends/300/drain"), http.StatusBadRequest)
+	assert.Equal(t, get("/backends"), http.StatusOK)
+}
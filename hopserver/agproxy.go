@@ -2,6 +2,8 @@ package hopserver
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"net"
 	"os"
@@ -12,6 +14,7 @@ import (
 
 	"hop.computer/hop/authgrants"
 	"hop.computer/hop/common"
+	"hop.computer/hop/core"
 	"hop.computer/hop/proxy"
 	"hop.computer/hop/tubes"
 
@@ -29,8 +32,10 @@ import (
 //   - listen on a unix socket for Delegate hop clients
 //   - maintain a mapping of Delegate hop clients to Principal hop client sessions
 //   - proxy all authgrant messages between the Delegate and Principal
-//   - ensure that processes connecting to unix socket are legitimate descendants
-//     of the hop server [implemented for linux, TODO others]
+//   - identify the session a delegate was started from by the token the
+//     session handed it in its environment [implemented]
+//   - optionally also ensure that processes connecting to unix socket are
+//     legitimate descendants of the hop server [implemented for linux, TODO others]
 
 // 	Responsibilities [status] (2: Principal <--> Target proxy):
 // 	- run a proxy between the Principal (unreliable tube) and Target
@@ -46,15 +51,23 @@ type agProxy struct {
 	address string // unix socket to listen on.
 
 	// +checklocks:principalLock
-	principals    map[int32]sessID
+	principals map[int32]sessID
+	// +checklocks:principalLock
+	tokens        map[string]sessID // the session each delegate token belongs to
 	principalLock sync.Mutex
 
+	// requireDescendant makes delegates that present a token also be
+	// descendants of a process of the session the token belongs to
+	requireDescendant bool
+
 	listener  net.Listener
 	running   bool
 	runningCV sync.Cond
 
 	proxyWG      sync.WaitGroup
 	getPrincipal GetPrincipal
+
+	audit *authgrants.AuditLog
 }
 
 type agpInstance struct {
@@ -137,26 +150,30 @@ func (p *agProxy) checkAndProxy(c net.Conn) {
 	defer c.Close()
 	logrus.Debug("AG Proxy: just accepted a new connection")
 	// Verify that the client is a legit descendent and get principal sess
-	principalID, e := p.checkCredentials(c)
+	principalID, targetURL, e := p.checkCredentials(c)
 	if e != nil {
 		logrus.Errorf("AG Proxy: error checking credentials: %v", e)
+		p.record(nil, nil, authgrants.AuditDenied, fmt.Sprintf("checking credentials: %s", e))
 		return
 	}
 	principalSess, ok := p.getPrincipal(principalID)
 	if !ok {
 		logrus.Error("AG Proxy: principal session not found.")
+		p.record(nil, nil, authgrants.AuditDenied, "principal session not found")
 		return
 	}
 	logrus.Debug("AG Proxy: found the principal session")
 
 	if principalSess.transportConn.IsClosed() {
 		logrus.Error("AG Proxy: connection with principal is closed or closing")
+		p.record(principalSess, nil, authgrants.AuditFailed, "connection with principal is closed")
 		return
 	}
 	// connect to principal (reliable)
 	principalConn, err := principalSess.newAuthGrantTube()
 	if err != nil {
 		logrus.Errorf("AG Proxy: error connecting to principal: %v", err)
+		p.record(principalSess, nil, authgrants.AuditFailed, fmt.Sprintf("connecting to principal: %s", err))
 		return
 	}
 	logrus.Infof("AG Proxy: connected to principal")
@@ -166,15 +183,20 @@ func (p *agProxy) checkAndProxy(c net.Conn) {
 	unreliableProxyTube, err := principalSess.newUnreliablePrincipalProxyTube()
 	if err != nil {
 		logrus.Errorf("AG Proxy: error making unreliable proxy tube with principal: %v", err)
+		p.record(principalSess, nil, authgrants.AuditFailed, fmt.Sprintf("connecting to principal: %s", err))
 		return
 	}
 	logrus.Infof("AG Proxy: got unreliable proxy tube to principal")
 	defer unreliableProxyTube.Close()
 
-	// read Target Info and get udp conn to target
-	targetURL, err := authgrants.ReadTargetInfo(c)
-	if err != nil {
-		return
+	// read Target Info, unless an older client sent it already, and get udp
+	// conn to target
+	if targetURL == nil {
+		targetURL, err = authgrants.ReadTargetInfo(c)
+		if err != nil {
+			p.record(principalSess, nil, authgrants.AuditFailed, fmt.Sprintf("reading target: %s", err))
+			return
+		}
 	}
 
 	ti := authgrants.TargetInfo{
@@ -184,11 +206,14 @@ func (p *agProxy) checkAndProxy(c net.Conn) {
 	tconn, err := ti.ConnectToTarget()
 	if err != nil {
 		logrus.Error("AG Proxy: error connecting to target")
+		p.record(principalSess, targetURL, authgrants.AuditFailed, fmt.Sprintf("connecting to target: %s", err))
 		return
 	}
 	logrus.Infof("AG Proxy: successfully connected to target")
 	defer tconn.Close()
 
+	p.record(principalSess, targetURL, authgrants.AuditAllowed, "")
+
 	conns := &agpInstance{
 		dconn:     c,
 		pconn:     principalConn,
@@ -199,6 +224,28 @@ func (p *agProxy) checkAndProxy(c net.Conn) {
 	p.proxy(conns)
 }
 
+// record adds a record of proxying a delegate to the principal of sess, for
+// an authgrant on target, to the audit log. sess and target are nil if they
+// are not known yet.
+func (p *agProxy) record(sess *hopSession, target *core.URL, outcome, reason string) {
+	if p.audit == nil {
+		return
+	}
+	r := authgrants.AuditRecord{
+		Role:    authgrants.AuditDelegateServer,
+		Event:   authgrants.AuditProxy,
+		Outcome: outcome,
+		Reason:  reason,
+	}
+	if sess != nil {
+		r.SetPrincipal(sess.transportConn.FetchClientLeaf())
+	}
+	if target != nil {
+		r.Target = target.String()
+	}
+	p.audit.Record(r)
+}
+
 // proxy is used by Server to forward INTENT_REQUESTS from a Client -> Principal and responses from Principal -> Client
 // Checks hop client process is a descendent of the hop server and conducts authgrant request with the appropriate principal
 func (p *agProxy) proxy(conns *agpInstance) {
@@ -263,9 +310,61 @@ func (p *agProxy) proxy(conns *agpInstance) {
 	}
 }
 
-// verifies that client is a descendent of a process started by the principal
-// and returns its corresponding principal session
-func (p *agProxy) checkCredentials(c net.Conn) (sessID, error) {
+// newToken returns a new delegate token for the principal session id
+func (p *agProxy) newToken(id sessID) string {
+	var b [32]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err.Error())
+	}
+	token := hex.EncodeToString(b[:])
+	p.principalLock.Lock()
+	defer p.principalLock.Unlock()
+	p.tokens[token] = id
+	return token
+}
+
+// forgetToken stops accepting token
+func (p *agProxy) forgetToken(token string) {
+	p.principalLock.Lock()
+	defer p.principalLock.Unlock()
+	delete(p.tokens, token)
+}
+
+// checkCredentials reads the token the client presents and returns the
+// principal session it belongs to. Clients without a token, and all clients if
+// requireDescendant is set, must be descendants of a process started by the
+// session. Older clients send their target URL instead of a token, and it is
+// returned too.
+func (p *agProxy) checkCredentials(c net.Conn) (sessID, *core.URL, error) {
+	token, targetURL, err := authgrants.ReadDelegateToken(c)
+	if err != nil {
+		return 0, nil, err
+	}
+	if token == "" {
+		id, err := p.checkAncestor(c)
+		return id, targetURL, err
+	}
+	p.principalLock.Lock()
+	id, ok := p.tokens[token]
+	p.principalLock.Unlock()
+	if !ok {
+		return 0, nil, fmt.Errorf("unknown authgrant token")
+	}
+	if p.requireDescendant {
+		ancestorID, err := p.checkAncestor(c)
+		if err != nil {
+			return 0, nil, err
+		}
+		if ancestorID != id {
+			return 0, nil, fmt.Errorf("token belongs to a different session than the process")
+		}
+	}
+	return id, nil, nil
+}
+
+// checkAncestor verifies that client is a descendent of a process started by
+// the principal and returns its corresponding principal session
+func (p *agProxy) checkAncestor(c net.Conn) (sessID, error) {
 	// cPID is PID of client process that connected to socket
 	cPID, err := readCreds(c)
 	if err != nil {
@@ -76,3 +76,38 @@ func TestProxySimpleDenial(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+func TestCheckCredentialsToken(t *testing.T) {
+	p := &agProxy{
+		principals: make(map[int32]sessID),
+		tokens:     make(map[string]sessID),
+	}
+	token := p.newToken(7)
+
+	check := func(token string) (sessID, error) {
+		c, server := net.Pipe()
+		defer c.Close()
+		defer server.Close()
+		go authgrants.WriteDelegateToken(token, c)
+		id, targetURL, err := p.checkCredentials(server)
+		assert.Assert(t, targetURL == nil)
+		return id, err
+	}
+
+	id, err := check(token)
+	assert.NilError(t, err)
+	assert.Equal(t, id, sessID(7))
+
+	_, err = check("not a token")
+	assert.ErrorContains(t, err, "unknown authgrant token")
+
+	// the process of a pipe can not be checked
+	p.requireDescendant = true
+	_, err = check(token)
+	assert.Assert(t, err != nil)
+	p.requireDescendant = false
+
+	p.forgetToken(token)
+	_, err = check(token)
+	assert.ErrorContains(t, err, "unknown authgrant token")
+}
@@ -0,0 +1,163 @@
+package hopserver
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// FileHelperCommand is the first argument hopd runs itself with to read or
+// write a file as the user of a session:
+//
+//	hopd file-helper read root path
+//	hopd file-helper write root path mode size
+//
+// If root is not empty, path is opened beneath it without following any
+// symlinks, so that nothing the user changes after a transfer is authorized
+// can lead it out of root.
+const FileHelperCommand = "file-helper"
+
+// RunFileHelper runs the file helper and exits if args ask for it. Programs
+// that serve file transfers call it before doing anything else.
+func RunFileHelper(args []string) {
+	if len(args) < 2 || args[1] != FileHelperCommand {
+		return
+	}
+	if err := fileHelper(args[2:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// fileHelper serves the file helper arguments that follow FileHelperCommand
+func fileHelper(args []string) error {
+	switch {
+	case len(args) == 3 && args[0] == "read":
+		return helperRead(args[1], args[2], os.Stdout)
+	case len(args) == 5 && args[0] == "write":
+		mode, err := strconv.ParseUint(args[3], 8, 32)
+		if err != nil {
+			return fmt.Errorf("invalid mode %q", args[3])
+		}
+		size, err := strconv.ParseInt(args[4], 10, 64)
+		if err != nil || size < 0 {
+			return fmt.Errorf("invalid size %q", args[4])
+		}
+		return helperWrite(args[1], args[2], os.FileMode(mode).Perm(), size, os.Stdin)
+	default:
+		return errors.New("usage: file-helper read root path | write root path mode size")
+	}
+}
+
+// helperRead copies the file at path, beneath root if it is set, to w
+func helperRead(root, path string, w io.Writer) error {
+	dir, base, err := openParent(root, path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	flags := unix.O_RDONLY | unix.O_CLOEXEC
+	if root != "" {
+		flags |= unix.O_NOFOLLOW
+	}
+	fd, err := unix.Openat(int(dir.Fd()), base, flags, 0)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	f := os.NewFile(uintptr(fd), path)
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// helperWrite replaces the file at path, beneath root if it is set, with size
+// bytes read from r, and gives it mode. The bytes go to a new file next to it
+// first, so the file is only replaced once all of them have been written.
+func helperWrite(root, path string, mode os.FileMode, size int64, r io.Reader) error {
+	dir, base, err := openParent(root, path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	dirfd := int(dir.Fd())
+	tmp := fmt.Sprintf(".%s.hop-%d", base, os.Getpid())
+	fd, err := unix.Openat(dirfd, tmp, unix.O_WRONLY|unix.O_CREAT|unix.O_EXCL|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0o600)
+	if err != nil {
+		return &os.PathError{Op: "create", Path: path, Err: err}
+	}
+	f := os.NewFile(uintptr(fd), tmp)
+	n, err := io.Copy(f, io.LimitReader(r, size))
+	if err == nil && n < size {
+		err = fmt.Errorf("upload ended after %d of %d bytes", n, size)
+	}
+	if err == nil {
+		err = f.Chmod(mode)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = unix.Renameat(dirfd, tmp, dirfd, base)
+	}
+	if err != nil {
+		unix.Unlinkat(dirfd, tmp, 0)
+		return fmt.Errorf("writing %s: %w", path, err)
+	}
+	return nil
+}
+
+// openParent opens the directory path is in, and returns it with the last
+// element of path. If root is set, path must be under it, and the directory is
+// opened beneath root without following symlinks.
+func openParent(root, path string) (*os.File, string, error) {
+	if !filepath.IsAbs(path) || filepath.Clean(path) != path || path == "/" {
+		return nil, "", fmt.Errorf("%q is not a clean absolute path to a file", path)
+	}
+	parent, base := filepath.Split(path)
+	if root == "" {
+		dir, err := os.Open(parent)
+		return dir, base, err
+	}
+	rel, err := filepath.Rel(root, filepath.Clean(parent))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return nil, "", fmt.Errorf("%s is not under %s", path, root)
+	}
+	dir, err := os.Open(root)
+	if err != nil {
+		return nil, "", err
+	}
+	defer dir.Close()
+	fd, err := openDirBeneath(int(dir.Fd()), rel)
+	if err != nil {
+		return nil, "", &os.PathError{Op: "open", Path: filepath.Clean(parent), Err: err}
+	}
+	return os.NewFile(uintptr(fd), filepath.Clean(parent)), base, nil
+}
+
+// walkDirBeneath opens the directory at rel beneath dirfd one element at a
+// time, refusing symlinks
+func walkDirBeneath(dirfd int, rel string) (int, error) {
+	fd, err := unix.Openat(dirfd, ".", unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil || rel == "." {
+		return fd, err
+	}
+	for _, elem := range strings.Split(rel, "/") {
+		next, err := unix.Openat(fd, elem, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		unix.Close(fd)
+		if err != nil {
+			return -1, err
+		}
+		fd = next
+	}
+	return fd, nil
+}
@@ -0,0 +1,20 @@
+package hopserver
+
+import (
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// openDirBeneath opens the directory at rel beneath dirfd without following
+// symlinks. Kernels without openat2 walk rel instead.
+func openDirBeneath(dirfd int, rel string) (int, error) {
+	fd, err := unix.Openat2(dirfd, rel, &unix.OpenHow{
+		Flags:   unix.O_RDONLY | unix.O_DIRECTORY | unix.O_CLOEXEC,
+		Resolve: unix.RESOLVE_BENEATH | unix.RESOLVE_NO_SYMLINKS,
+	})
+	if errors.Is(err, unix.ENOSYS) {
+		return walkDirBeneath(dirfd, rel)
+	}
+	return fd, err
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package hopserver
+
+// openDirBeneath opens the directory at rel beneath dirfd without following
+// symlinks
+func openDirBeneath(dirfd int, rel string) (int, error) {
+	return walkDirBeneath(dirfd, rel)
+}
@@ -0,0 +1,73 @@
+package hopserver
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestFileHelperBeneath(t *testing.T) {
+	dir := t.TempDir()
+	releases := filepath.Join(dir, "releases")
+	assert.NilError(t, os.MkdirAll(filepath.Join(releases, "v1"), 0o755))
+	assert.NilError(t, os.WriteFile(filepath.Join(dir, "secret"), []byte("secret"), 0o600))
+	assert.NilError(t, os.Symlink(dir, filepath.Join(releases, "up")))
+	assert.NilError(t, os.Symlink(filepath.Join(dir, "secret"), filepath.Join(releases, "secret")))
+
+	err := helperWrite(releases, filepath.Join(releases, "v1", "app.tar"), 0o640, 5, strings.NewReader("hello"))
+	assert.NilError(t, err)
+	var out bytes.Buffer
+	assert.NilError(t, helperRead(releases, filepath.Join(releases, "v1", "app.tar"), &out))
+	assert.Equal(t, out.String(), "hello")
+	fi, err := os.Stat(filepath.Join(releases, "v1", "app.tar"))
+	assert.NilError(t, err)
+	assert.Equal(t, fi.Mode().Perm(), os.FileMode(0o640))
+
+	// Symlinks beneath the root are not followed
+	for _, path := range []string{
+		filepath.Join(releases, "up", "secret"),
+		filepath.Join(releases, "secret"),
+		filepath.Join(dir, "secret"),
+	} {
+		assert.Assert(t, helperRead(releases, path, &out) != nil, path)
+	}
+	for _, path := range []string{
+		filepath.Join(releases, "up", "secret"),
+		filepath.Join(dir, "secret"),
+	} {
+		assert.Assert(t, helperWrite(releases, path, 0o600, 1, strings.NewReader("x")) != nil, path)
+	}
+	// Writing a symlink replaces the link, not the file it points to
+	err = helperWrite(releases, filepath.Join(releases, "secret"), 0o600, 1, strings.NewReader("x"))
+	assert.NilError(t, err)
+	fi, err = os.Lstat(filepath.Join(releases, "secret"))
+	assert.NilError(t, err)
+	assert.Assert(t, fi.Mode().IsRegular())
+	got, err := os.ReadFile(filepath.Join(dir, "secret"))
+	assert.NilError(t, err)
+	assert.Equal(t, string(got), "secret")
+
+	// Without a root the user may follow symlinks
+	out.Reset()
+	assert.NilError(t, helperRead("", filepath.Join(releases, "up", "secret"), &out))
+	assert.Equal(t, out.String(), "secret")
+}
+
+func TestFileHelperShortUpload(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.tar")
+	assert.NilError(t, os.WriteFile(path, []byte("old"), 0o644))
+
+	err := helperWrite(dir, path, 0o644, 10, strings.NewReader("new"))
+	assert.ErrorContains(t, err, "3 of 10 bytes")
+	got, err := os.ReadFile(path)
+	assert.NilError(t, err)
+	assert.Equal(t, string(got), "old")
+	entries, err := os.ReadDir(dir)
+	assert.NilError(t, err)
+	assert.Equal(t, len(entries), 1)
+}
@@ -0,0 +1,173 @@
+package hopserver
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+
+	"hop.computer/hop/authgrants"
+	"hop.computer/hop/filetransfer"
+	"hop.computer/hop/pkg/thunks"
+	"hop.computer/hop/tubes"
+)
+
+// handleFile serves a file transfer on ch. Files are read and written by the
+// file helper running as the user of the session, so a transfer can only
+// reach files the user can.
+func (sess *hopSession) handleFile(ch *tubes.Reliable) {
+	defer ch.Close()
+	s := filetransfer.Server{
+		Open:   sess.openFile,
+		Create: sess.createFile,
+	}
+	if sess.usingAuthGrant {
+		s.Authorize = sess.checkFile
+	}
+	s.Handle(ch)
+}
+
+// checkFile checks that the session has an unexpired file grant for req, and
+// uses it. It sets the root of req to the directory the grant covers, so that
+// the file is opened beneath it. It returns the largest file the grant allows
+// reading.
+func (sess *hopSession) checkFile(req *filetransfer.Request) (uint64, error) {
+	logrus.Infof("target: received request to transfer %s", req.Path)
+	grantType := authgrants.FileRead
+	if req.Op == filetransfer.OpWrite {
+		grantType = authgrants.FileWrite
+	}
+	if !filepath.IsAbs(req.Path) || filepath.Clean(req.Path) != req.Path {
+		return 0, fmt.Errorf("%q is not a clean absolute path", req.Path)
+	}
+	ag, err := sess.useAuthGrant(fmt.Sprintf("%s: %s", grantType, req.Path), func(ag *authgrants.Authgrant) bool {
+		return ag.GrantType == grantType &&
+			ag.AssociatedData.FileGrantData.Allows(req.Path, req.Size, uint32(req.Mode.Perm()))
+	})
+	if err != nil {
+		return 0, fmt.Errorf("no auth grant for %s of %s: %w", grantType, req.Path, err)
+	}
+	d := &ag.AssociatedData.FileGrantData
+	req.Root = d.Path
+	if req.Path == d.Path {
+		req.Root = filepath.Dir(d.Path)
+	}
+	return d.MaxSize, nil
+}
+
+// userCommand returns a command that runs as the user of the session, in
+// their home directory
+func (sess *hopSession) userCommand(name string, args ...string) (*exec.Cmd, error) {
+	user, err := thunks.LookupUser(sess.user)
+	if err != nil {
+		return nil, errors.New("could not find entry for user " + sess.user)
+	}
+	c := exec.Command(name, args...)
+	c.Env = []string{
+		"USER=" + user.Username(),
+		"LOGNAME=" + user.Username(),
+		"HOME=" + user.Homedir(),
+	}
+	c.Dir = user.Homedir()
+	c.SysProcAttr = &syscall.SysProcAttr{}
+	c.SysProcAttr.Credential = &syscall.Credential{
+		Uid:    uint32(user.Uid()),
+		Gid:    uint32(user.Gid()),
+		Groups: getGroups(user.Uid()),
+	}
+	return c, nil
+}
+
+// fileHelper returns a command that runs the file helper of hopd as the user
+// of the session
+func (sess *hopSession) fileHelper(args ...string) (*exec.Cmd, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	return sess.userCommand(self, append([]string{FileHelperCommand}, args...)...)
+}
+
+// openFile reads the file of req as the user of the session
+func (sess *hopSession) openFile(req *filetransfer.Request) (io.ReadCloser, error) {
+	c, err := sess.fileHelper("read", req.Root, req.Path)
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := c.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	r := &cmdReader{ReadCloser: stdout, cmd: c}
+	c.Stderr = &r.stderr
+	if err := thunks.StartCmd(c); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// createFile writes the file of req as the user of the session. The file is
+// only replaced once the whole upload has been written.
+func (sess *hopSession) createFile(req *filetransfer.Request, r io.Reader) error {
+	c, err := sess.fileHelper("write", req.Root, req.Path,
+		fmt.Sprintf("%o", req.Mode.Perm()), strconv.FormatUint(req.Size, 10))
+	if err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	c.Stdin = r
+	c.Stderr = &stderr
+	if err := thunks.StartCmd(c); err != nil {
+		return err
+	}
+	if err := c.Wait(); err != nil {
+		return cmdError(err, &stderr)
+	}
+	return nil
+}
+
+// cmdReader reads the output of a command. It errors instead of returning
+// io.EOF if the command fails.
+type cmdReader struct {
+	io.ReadCloser
+	cmd    *exec.Cmd
+	stderr bytes.Buffer
+	done   bool
+}
+
+func (r *cmdReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	if errors.Is(err, io.EOF) && !r.done {
+		r.done = true
+		if werr := r.cmd.Wait(); werr != nil {
+			return n, cmdError(werr, &r.stderr)
+		}
+	}
+	return n, err
+}
+
+// Close stops the command if it has not finished
+func (r *cmdReader) Close() error {
+	if !r.done {
+		r.done = true
+		r.cmd.Process.Kill()
+		r.cmd.Wait()
+	}
+	return nil
+}
+
+// cmdError describes a failed command by what it printed, if anything
+func cmdError(err error, stderr *bytes.Buffer) error {
+	if msg := strings.TrimSpace(stderr.String()); msg != "" {
+		return errors.New(msg)
+	}
+	return err
+}
@@ -0,0 +1,139 @@
+package hopserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"goji.io"
+	"goji.io/pat"
+
+	"hop.computer/hop/authgrants"
+)
+
+// GrantAdminServer is an http.Handler that lists and revokes the outstanding
+// authgrants of a HopServer. hopd serves it on the AuthgrantAdminSocket.
+type GrantAdminServer struct {
+	*goji.Mux
+	s *HopServer
+}
+
+// NewGrantAdminServer creates a GrantAdminServer for s.
+func NewGrantAdminServer(s *HopServer) GrantAdminServer {
+	a := GrantAdminServer{
+		Mux: goji.NewMux(),
+		s:   s,
+	}
+	a.Handle(pat.Get("/grants"), http.HandlerFunc(a.listGrants))
+	a.Handle(pat.Delete("/grants/:id"), http.HandlerFunc(a.revokeGrant))
+	return a
+}
+
+// GrantListResponse is the JSON structure returned by GET /grants.
+type GrantListResponse struct {
+	Grants []GrantDescription `json:"grants"`
+}
+
+// GrantDescription is a JSON structure describing a single authgrant.
+type GrantDescription struct {
+	ID       authgrants.GrantID `json:"id"`
+	User     string             `json:"user"`
+	Type     string             `json:"type"`
+	Start    time.Time          `json:"start"`
+	Expires  time.Time          `json:"expires"`
+	Delegate string             `json:"delegate"`         // the delegate public key
+	Uses     uint16             `json:"uses"`             // how many times the grant was used
+	Limits   string             `json:"limits"`           // e.g. "up to 10 times, at most once every 1m0s"
+	Parent   authgrants.GrantID `json:"parent,omitempty"` // the grant this is a sub-grant of
+	Command  string             `json:"command,omitempty"`
+	Address  string             `json:"address,omitempty"`
+}
+
+func describeGrant(ag *authgrants.Authgrant) GrantDescription {
+	d := GrantDescription{
+		ID:       ag.ID,
+		User:     ag.User,
+		Type:     ag.GrantType.String(),
+		Start:    ag.StartTime,
+		Expires:  ag.ExpTime,
+		Delegate: ag.DelegateCert.PublicKey.String(),
+		Uses:     ag.Uses,
+		Limits:   ag.UsageString(),
+		Parent:   ag.Parent,
+	}
+	switch ag.GrantType {
+	case authgrants.Command:
+		d.Command = ag.AssociatedData.CommandGrantData.String()
+	case authgrants.LocalPF:
+		d.Address = ag.AssociatedData.LocalPFGrantData.Address
+	case authgrants.RemotePF:
+		d.Address = ag.AssociatedData.RemotePFGrantData.Address
+	}
+	return d
+}
+
+// listGrants serves the grants of the user in the user query parameter, or
+// of every user if it is not set
+func (a *GrantAdminServer) listGrants(w http.ResponseWriter, r *http.Request) {
+	out := GrantListResponse{
+		Grants: []GrantDescription{}, // non-null empty list
+	}
+	for _, ag := range a.s.agMap.List(r.URL.Query().Get("user")) {
+		out.Grants = append(out.Grants, describeGrant(&ag))
+	}
+	sort.Slice(out.Grants, func(i, j int) bool {
+		return out.Grants[i].Expires.Before(out.Grants[j].Expires)
+	})
+	err := json.NewEncoder(w).Encode(&out)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+}
+
+// revokeGrant revokes a grant. If the user query parameter is set, the grant
+// must be for that user.
+func (a *GrantAdminServer) revokeGrant(w http.ResponseWriter, r *http.Request) {
+	id, err := authgrants.ParseGrantID(pat.Param(r, "id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	_, err = a.s.RevokeAuthGrant(id, r.URL.Query().Get("user"))
+	if errors.Is(err, authgrants.ErrNoAuthgrant) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logrus.Errorf("authgrant admin: error revoking %s: %s", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// startGrantAdmin serves the authgrant admin API on a unix socket at path
+// that only the user running hopd can connect to
+func (s *HopServer) startGrantAdmin(path string) error {
+	if err := os.RemoveAll(path); err != nil {
+		return fmt.Errorf("authgrant admin: error removing %s: %s", path, err)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("authgrant admin: unix socket listen error: %s", err)
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		l.Close()
+		return fmt.Errorf("authgrant admin: error setting permissions of %s: %s", path, err)
+	}
+	s.grantAdmin = l
+	logrus.Info("authgrant admin: listening on unix socket: ", path)
+	go http.Serve(l, NewGrantAdminServer(s))
+	return nil
+}
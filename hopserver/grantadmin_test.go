@@ -0,0 +1,51 @@
+package hopserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+
+	"hop.computer/hop/authgrants"
+	"hop.computer/hop/portforwarding"
+)
+
+func TestGrantAdminServer(t *testing.T) {
+	later := time.Now().Add(time.Hour)
+	sess := testGrantSession(t,
+		pfGrant(authgrants.LocalPF, portforwarding.PfTCP, "127.0.0.1:8080", later),
+		pfGrant(authgrants.RemotePF, portforwarding.PfTCP, "127.0.0.1:8081", later.Add(time.Minute)),
+	)
+	a := NewGrantAdminServer(sess.server)
+
+	list := func(query string) GrantListResponse {
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/grants"+query, nil))
+		assert.Equal(t, w.Code, http.StatusOK)
+		var out GrantListResponse
+		assert.NilError(t, json.NewDecoder(w.Body).Decode(&out))
+		return out
+	}
+	revoke := func(target string) int {
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, target, nil))
+		return w.Code
+	}
+
+	grants := list("").Grants
+	assert.Equal(t, len(grants), 2)
+	assert.Equal(t, grants[0].User, "user")
+	assert.Equal(t, grants[0].Type, "localpf")
+	assert.Equal(t, grants[0].Address, "127.0.0.1:8080")
+	assert.Equal(t, len(list("?user=other").Grants), 0)
+
+	id := grants[0].ID.String()
+	assert.Equal(t, revoke("/grants/nothex"), http.StatusBadRequest)
+	assert.Equal(t, revoke("/grants/"+id+"?user=other"), http.StatusNotFound)
+	assert.Equal(t, revoke("/grants/"+id+"?user=user"), http.StatusNoContent)
+	assert.Equal(t, revoke("/grants/"+id), http.StatusNotFound)
+	assert.Equal(t, len(list("?user=user").Grants), 1)
+}
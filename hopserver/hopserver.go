@@ -34,7 +34,9 @@ type HopServer struct {
 	m sync.Mutex
 
 	// Target server state
-	agMap *authgrants.AuthgrantMapSync
+	agMap      *authgrants.AuthgrantMapSync
+	grantAdmin net.Listener
+	audit      *authgrants.AuditLog // records authgrant decisions, if set
 
 	// Delegate proxy server state
 	dpProxy *agProxy
@@ -52,6 +54,10 @@ type HopServer struct {
 	Server   *transport.Server
 	keyStore *authkeys.SyncAuthKeySet
 	authsock net.Listener //nolint TODO(hosono) add linting back
+
+	// StreamServer, if set, serves clients that connect over TCP or
+	// WebSockets because their networks block UDP
+	StreamServer *transport.Server
 }
 
 // TODO(baumanl): Think about how NewHopServerExt and NewHopServer and actual
@@ -71,9 +77,12 @@ func NewHopServerExt(underlying *transport.Server, config *config.ServerConfig,
 		dpProxy: &agProxy{
 			address:       agproxyUnixSocket,
 			principals:    make(map[int32]sessID),
+			tokens:        make(map[string]sessID),
 			principalLock: sync.Mutex{},
 			runningCV:     sync.Cond{L: &sync.Mutex{}},
 			proxyWG:       sync.WaitGroup{},
+
+			requireDescendant: config.AgProxyRequireDescendant,
 		},
 
 		sessions:      make(map[sessID]*hopSession),
@@ -92,6 +101,28 @@ func NewHopServerExt(underlying *transport.Server, config *config.ServerConfig,
 	} else {
 		server.keyStore = authkeys.NewSyncAuthKeySet()
 	}
+
+	if config.EnableAuthgrants && config.AuthgrantStore != "" {
+		agMap, err := authgrants.OpenAuthgrantMapSync(config.AuthgrantStore)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open authgrant store: %w", err)
+		}
+		server.agMap = agMap
+		// delegates of grants from before a restart can still log in
+		for _, ag := range agMap.List("") {
+			server.keyStore.AddKey(ag.DelegateCert.PublicKey)
+		}
+	}
+
+	if config.EnableAuthgrants && config.AuthgrantAuditLog != "" {
+		audit, err := authgrants.OpenAuditLog(config.AuthgrantAuditLog, config.AuthgrantAuditChain)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open authgrant audit log: %w", err)
+		}
+		server.audit = audit
+		server.agMap.SetAuditLog(audit)
+		server.dpProxy.audit = audit
+	}
 	return server, nil
 }
 
@@ -104,12 +135,14 @@ func NewHopServer(sc *config.ServerConfig) (*HopServer, error) {
 		logrus.Fatalf("unable to parse virtual hosts: %s", err)
 	}
 
-	pktConn, err := net.ListenPacket("udp", sc.ListenAddress)
+	conns, err := listenConns(sc)
 	if err != nil {
-		logrus.Fatalf("unable to open socket for address %s: %s", sc.ListenAddress, err)
+		logrus.Fatalf("unable to open sockets: %s", err)
+	}
+	streams, err := listenStreams(sc)
+	if err != nil {
+		logrus.Fatalf("unable to open stream listeners: %s", err)
 	}
-	udpConn := pktConn.(*net.UDPConn)
-	logrus.Infof("listening at %s", udpConn.LocalAddr())
 
 	getCert := func(info transport.ClientHandshakeInfo) (*transport.Certificate, error) {
 		if h := vhosts.Match(string(info.ServerName.Label)); h != nil {
@@ -151,6 +184,35 @@ func NewHopServer(sc *config.ServerConfig) (*HopServer, error) {
 		GetCertList:          getAllowedCerts,
 		HiddenModeVHostNames: sc.HiddenModeVHostNames,
 		IsHidden:             isHiddenActivated,
+		CookieSecret:         sc.CookieSecret,
+		CookieRotation:       sc.CookieRotation,
+		ServerID:             sc.ServerID,
+		HandshakeLimits: transport.HandshakeLimits{
+			Rate:             sc.HandshakeRateLimit,
+			Burst:            sc.HandshakeRateBurst,
+			MaxConcurrent:    sc.MaxConcurrentHandshakes,
+			PuzzleThreshold:  sc.HandshakePuzzleThreshold,
+			PuzzleDifficulty: sc.HandshakePuzzleDifficulty,
+		},
+	}
+
+	if sc.ServerIDSecret != nil {
+		tconf.ServerIDKey = transport.ServerIDKeyFromSecret(sc.ServerIDSecret)
+	}
+
+	if sc.Obfuscate {
+		if sc.KEMKey == nil {
+			return nil, errors.New("obfuscation requires a KEMKey")
+		}
+		key, err := transport.ObfuscationKey(&sc.KEMKey.Public)
+		if err != nil {
+			return nil, err
+		}
+		tconf.Obfuscation = &transport.ObfuscationConfig{
+			Key:        key,
+			MaxPadding: sc.ObfuscationPadding,
+			Jitter:     sc.ObfuscationJitter,
+		}
 	}
 
 	// serverConfig options inform verify config settings
@@ -209,18 +271,32 @@ func NewHopServer(sc *config.ServerConfig) (*HopServer, error) {
 		}
 	}
 
-	underlying, err := transport.NewServer(udpConn, tconf)
+	underlying, err := transport.NewMultiServer(conns, tconf)
 	if err != nil {
 		logrus.Fatalf("unable to open transport server: %s", err)
 	}
 
-	return NewHopServerExt(underlying, sc, tconf.ClientVerify.AuthKeys)
+	server, err := NewHopServerExt(underlying, sc, tconf.ClientVerify.AuthKeys)
+	if err != nil {
+		return nil, err
+	}
+	if len(streams) > 0 {
+		server.StreamServer, err = transport.NewMultiServer(streams, tconf)
+		if err != nil {
+			logrus.Fatalf("unable to open stream transport server: %s", err)
+		}
+	}
+	return server, nil
 }
 
 // Serve listens for incoming hop connection requests and starts
 // corresponding agproxy on unix socket
 func (s *HopServer) Serve() {
 	go s.Server.Serve() // start transport layer server
+	if s.StreamServer != nil {
+		go s.StreamServer.Serve()
+		go s.acceptStreams()
+	}
 	logrus.Info("hop server starting")
 
 	// start dpproxy
@@ -235,6 +311,12 @@ func (s *HopServer) Serve() {
 		logrus.Error("issue starting dpproxy server")
 	}
 
+	if s.config.EnableAuthgrants && s.config.AuthgrantAdminSocket != "" {
+		if err := s.startGrantAdmin(s.config.AuthgrantAdminSocket); err != nil {
+			logrus.Error(err)
+		}
+	}
+
 	for {
 		serverConn, err := s.Server.AcceptTimeout(30 * time.Minute)
 		// io.EOF indicates the server was closed, which is ok
@@ -248,6 +330,18 @@ func (s *HopServer) Serve() {
 	}
 }
 
+// acceptStreams starts a session for each client of the stream server until it
+// is closed
+func (s *HopServer) acceptStreams() {
+	for {
+		serverConn, err := s.StreamServer.Accept()
+		if err != nil {
+			return
+		}
+		go s.newSession(serverConn)
+	}
+}
+
 // newSession Starts a new hop session
 func (s *HopServer) newSession(serverConn *transport.Handle) {
 	muxerConfig := tubes.Config{
@@ -285,6 +379,21 @@ func (s *HopServer) ListenAddress() net.Addr {
 	return s.Server.Addr()
 }
 
+// ListenAddresses returns the addresses of every socket the transport server
+// listens on.
+func (s *HopServer) ListenAddresses() []net.Addr {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.Server == nil {
+		return nil
+	}
+	addrs := s.Server.Addrs()
+	if s.StreamServer != nil {
+		addrs = append(addrs, s.StreamServer.Addrs()...)
+	}
+	return addrs
+}
+
 // Close stops the underlying connection and cleans up all resources
 // TODO(hosono) this is a very rough sketch of what this method needs to do
 func (s *HopServer) Close() error {
@@ -302,36 +411,54 @@ func (s *HopServer) Close() error {
 	}
 	wg.Wait()
 	s.dpProxy.stop()
+	if s.grantAdmin != nil {
+		s.grantAdmin.Close()
+	}
+	s.audit.Close()
+	if s.StreamServer != nil {
+		s.StreamServer.Close()
+	}
 	return s.Server.Close()
 }
 
 func (s *HopServer) AddAuthGrant(intent *authgrants.Intent) error {
+	_, err := s.addAuthGrant(intent, nil)
+	return err
+}
+
+// addAuthGrant adds an authgrant for intent issued by the principal with key
+// principal, if known, and returns its ID
+func (s *HopServer) addAuthGrant(intent *authgrants.Intent, principal *keys.DHPublicKey) (authgrants.GrantID, error) {
 	// TODO(hosono) should authgrants be disabled by default?
 	// Can we give the server more fine-grained control over what intents it allows?
 	if !s.config.EnableAuthgrants {
 		logrus.Warn("Tried to add authgrant, but authgrants are not enabled")
-		return fmt.Errorf("authgrants not enabled")
+		return 0, fmt.Errorf("authgrants not enabled")
 	}
 	if intent == nil {
 		logrus.Error("intent is nil")
-		return fmt.Errorf("intent is nil")
+		return 0, fmt.Errorf("intent is nil")
 	}
 
 	if s.agMap == nil {
-		return fmt.Errorf("agmap is nil")
+		return 0, fmt.Errorf("agmap is nil")
 	}
 
 	if s.keyStore == nil {
-		return fmt.Errorf("keystore is nil")
+		return 0, fmt.Errorf("keystore is nil")
 	}
 
 	// add authorization grant to server mappings
-	s.agMap.AddAuthGrant(intent, authgrants.PrincipalID(NoSession))
+	ag, err := s.agMap.AddAuthGrant(intent, authgrants.PrincipalID(NoSession), principal)
+	if err != nil {
+		// the grant is still usable until hopd restarts
+		logrus.Errorf("target: unable to save authgrant %s: %s", ag.ID, err)
+	}
 
 	// add delegate key from cert to transport server authorized key pool
 	s.keyStore.AddKey(intent.DelegateCert.PublicKey)
 
-	return nil
+	return ag.ID, nil
 }
 
 // AuthorizeKey returns nil if the publicKey is in the authorized_keys file for
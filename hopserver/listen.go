@@ -0,0 +1,151 @@
+package hopserver
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+
+	"hop.computer/hop/config"
+	"hop.computer/hop/transport"
+)
+
+// The first file descriptor passed by systemd socket activation. See
+// sd_listen_fds(3).
+const listenFDsStart = 3
+
+var errNotUDP = errors.New("not a UDP socket")
+
+// listenAddresses returns the addresses hopd listens on when it is not socket
+// activated
+func listenAddresses(sc *config.ServerConfig) []string {
+	var addrs []string
+	if sc.ListenAddress != "" || len(sc.ListenAddresses) == 0 {
+		addrs = append(addrs, sc.ListenAddress)
+	}
+	return append(addrs, sc.ListenAddresses...)
+}
+
+// udpNetwork returns the network to listen on address with. IP literals get a
+// socket of their own family, so that the IPv4 and IPv6 wildcard addresses can
+// be listened on together.
+func udpNetwork(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return "udp"
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return "udp"
+	}
+	if ip.Unmap().Is4() {
+		return "udp4"
+	}
+	return "udp6"
+}
+
+// listen opens shards UDP sockets for each address. Several sockets for an
+// address share it with SO_REUSEPORT.
+func listen(addresses []string, shards int) ([]transport.UDPLike, error) {
+	var conns []transport.UDPLike
+	for _, address := range addresses {
+		group, err := transport.ListenReusePort(udpNetwork(address), address, max(shards, 1))
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return nil, fmt.Errorf("unable to open socket for address %s: %w", address, err)
+		}
+		conns = append(conns, group...)
+	}
+	return conns, nil
+}
+
+// activationConns returns the UDP sockets passed in by systemd socket
+// activation, or nil if the process was not socket activated.
+func activationConns() ([]transport.UDPLike, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	// The sockets are not passed on to child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	var conns []transport.UDPLike
+	for fd := listenFDsStart; fd < listenFDsStart+n; fd++ {
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		pktConn, err := net.FilePacketConn(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket activation fd %d: %w", fd, err)
+		}
+		udpConn, ok := pktConn.(*net.UDPConn)
+		if !ok {
+			pktConn.Close()
+			return nil, fmt.Errorf("socket activation fd %d: %w", fd, errNotUDP)
+		}
+		conns = append(conns, udpConn)
+	}
+	return conns, nil
+}
+
+// listenConns returns the UDP sockets hopd serves: the socket activated
+// sockets if there are any, or a socket for each configured listen address.
+func listenConns(sc *config.ServerConfig) ([]transport.UDPLike, error) {
+	conns, err := activationConns()
+	if err != nil {
+		return nil, err
+	}
+	if len(conns) > 0 {
+		logrus.Infof("using %d sockets from socket activation", len(conns))
+	} else if conns, err = listen(listenAddresses(sc), sc.ReceiveShards); err != nil {
+		return nil, err
+	}
+	for _, c := range conns {
+		logrus.Infof("listening at %s", c.LocalAddr())
+	}
+	return conns, nil
+}
+
+// listenStreams returns the stream listeners for clients that cannot use UDP.
+// They are served by a transport server of their own, so that they do not
+// count towards the SO_REUSEPORT groups session IDs are steered by, and their
+// clients' addresses cannot collide with those of UDP clients.
+func listenStreams(sc *config.ServerConfig) ([]transport.UDPLike, error) {
+	var streams []transport.UDPLike
+	if sc.TCPListenAddress != "" {
+		l, err := transport.ListenStream("tcp", sc.TCPListenAddress)
+		if err != nil {
+			return nil, fmt.Errorf("unable to listen for TCP at %s: %w", sc.TCPListenAddress, err)
+		}
+		streams = append(streams, l)
+	}
+	if sc.WebSocketListenAddress != "" {
+		path := sc.WebSocketPath
+		if path == "" {
+			path = transport.DefaultWebSocketPath
+		}
+		l, err := transport.ListenWebSocket("tcp", sc.WebSocketListenAddress, path)
+		if err != nil {
+			for _, s := range streams {
+				s.Close()
+			}
+			return nil, fmt.Errorf("unable to listen for WebSockets at %s: %w", sc.WebSocketListenAddress, err)
+		}
+		streams = append(streams, l)
+	}
+	for _, s := range streams {
+		logrus.Infof("listening for streams at %s", s.LocalAddr())
+	}
+	return streams, nil
+}
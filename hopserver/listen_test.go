@@ -0,0 +1,83 @@
+package hopserver
+
+import (
+	"net"
+	"runtime"
+	"testing"
+
+	"gotest.tools/assert"
+
+	"hop.computer/hop/config"
+)
+
+func TestUDPNetwork(t *testing.T) {
+	assert.Equal(t, udpNetwork("0.0.0.0:77"), "udp4")
+	assert.Equal(t, udpNetwork("[::]:77"), "udp6")
+	assert.Equal(t, udpNetwork("[::ffff:10.0.0.1]:77"), "udp4")
+	assert.Equal(t, udpNetwork("example.com:77"), "udp")
+	assert.Equal(t, udpNetwork(":77"), "udp")
+	assert.Equal(t, udpNetwork(""), "udp")
+}
+
+func TestListenAddresses(t *testing.T) {
+	assert.DeepEqual(t, listenAddresses(&config.ServerConfig{}), []string{""})
+	assert.DeepEqual(t, listenAddresses(&config.ServerConfig{ListenAddress: ":77"}), []string{":77"})
+	assert.DeepEqual(t, listenAddresses(&config.ServerConfig{
+		ListenAddresses: []string{"10.0.0.1:77", "[2001:db8::1]:77"},
+	}), []string{"10.0.0.1:77", "[2001:db8::1]:77"})
+	assert.DeepEqual(t, listenAddresses(&config.ServerConfig{
+		ListenAddress:   ":77",
+		ListenAddresses: []string{"10.0.0.1:77"},
+	}), []string{":77", "10.0.0.1:77"})
+}
+
+func TestListen(t *testing.T) {
+	addrs := []string{"127.0.0.1:0"}
+	if c, err := net.ListenPacket("udp6", "[::1]:0"); err == nil {
+		c.Close()
+		addrs = append(addrs, "[::1]:0")
+	}
+	conns, err := listen(addrs, 0)
+	assert.NilError(t, err)
+	assert.Equal(t, len(conns), len(addrs))
+	for _, c := range conns {
+		c.Close()
+	}
+
+	if runtime.GOOS == "linux" {
+		conns, err = listen(addrs, 4)
+		assert.NilError(t, err)
+		assert.Equal(t, len(conns), 4*len(addrs))
+		assert.Equal(t, conns[0].LocalAddr().String(), conns[3].LocalAddr().String())
+		for _, c := range conns {
+			c.Close()
+		}
+	}
+
+	// A failure closes the sockets that were already opened
+	_, err = listen([]string{"127.0.0.1:0", "256.0.0.1:0"}, 0)
+	assert.ErrorContains(t, err, "256.0.0.1:0")
+}
+
+func TestListenStreams(t *testing.T) {
+	streams, err := listenStreams(&config.ServerConfig{})
+	assert.NilError(t, err)
+	assert.Equal(t, len(streams), 0)
+
+	streams, err = listenStreams(&config.ServerConfig{
+		TCPListenAddress:       "127.0.0.1:0",
+		WebSocketListenAddress: "127.0.0.1:0",
+	})
+	assert.NilError(t, err)
+	assert.Equal(t, len(streams), 2)
+	for _, s := range streams {
+		assert.Equal(t, s.LocalAddr().Network(), "tcp")
+		s.Close()
+	}
+
+	_, err = listenStreams(&config.ServerConfig{
+		TCPListenAddress:       "127.0.0.1:0",
+		WebSocketListenAddress: "256.0.0.1:0",
+	})
+	assert.ErrorContains(t, err, "256.0.0.1:0")
+}
@@ -2,11 +2,13 @@ package hopserver
 
 import (
 	"errors"
+	"fmt"
 	"net"
 	"os"
 	"os/exec"
 	"os/user"
 	"strconv"
+	"sync"
 	"syscall"
 
 	"github.com/creack/pty"
@@ -15,6 +17,8 @@ import (
 	"hop.computer/hop/authgrants"
 	"hop.computer/hop/codex"
 	"hop.computer/hop/common"
+	"hop.computer/hop/jump"
+	"hop.computer/hop/pkg/glob"
 	"hop.computer/hop/pkg/thunks"
 	"hop.computer/hop/portforwarding"
 	"hop.computer/hop/transport"
@@ -42,10 +46,19 @@ type hopSession struct {
 	// We use a channel (with size 1) to avoid reading window sizes before we've created the pty
 	pty chan *os.File
 
-	usingAuthGrant    bool // true if client authenticated with authgrant
+	usingAuthGrant bool // true if client authenticated with authgrant
+
+	// agToken is handed to processes of the session in their environment, and
+	// tells the agproxy which principal a delegate among them belongs to
+	agToken string
+
+	actionsLock sync.Mutex
+	// +checklocks:actionsLock
 	authorizedActions []authgrants.Authgrant
 
 	forward portforwarding.Forward
+
+	jumpTubes jump.TubeQueue // unreliable tubes waiting for their jump request
 }
 
 func (sess *hopSession) checkAuthorization() bool {
@@ -78,7 +91,9 @@ func (sess *hopSession) checkAuthorization() bool {
 				return false
 			}
 			sess.usingAuthGrant = true
+			sess.actionsLock.Lock()
 			sess.authorizedActions = actions
+			sess.actionsLock.Unlock()
 		} else {
 			logrus.Errorf("rejecting key for %q: %s", username, err)
 			return false
@@ -101,6 +116,10 @@ func (sess *hopSession) start() {
 		return
 		//TODO(baumanl): Check closing behavior. how to end session completely
 	}
+	// sessions authorized by an authgrant are not principals
+	if !sess.usingAuthGrant {
+		sess.agToken = sess.server.dpProxy.newToken(sess.ID)
+	}
 
 	// start accepting incoming tubes
 	logrus.Info("STARTING TUBE LOOP")
@@ -116,7 +135,7 @@ func (sess *hopSession) start() {
 		if r, ok := tube.(*tubes.Reliable); ok {
 			switch tube.Type() {
 			case common.ExecTube:
-				if len(sess.authorizedActions) == 1 && sess.authorizedActions[0].GrantType == authgrants.Acme {
+				if sess.acmeOnly() {
 					// TODO Do Acme Stuff
 				} else {
 					t2, err := sess.tubeMuxer.Accept()
@@ -135,6 +154,10 @@ func (sess *hopSession) start() {
 				go sess.handlePF(r)
 			case common.WinSizeTube:
 				go sess.startSizeTube(r)
+			case common.JumpTube:
+				go sess.handleJump(r)
+			case common.FileTube:
+				go sess.handleFile(r)
 			default:
 				tube.Close() // Close unrecognized tube types
 			}
@@ -143,6 +166,12 @@ func (sess *hopSession) start() {
 			switch tube.Type() {
 			case common.PFTube:
 				go sess.handlePF(u)
+			case common.JumpTube:
+				if sess.jumpAllowed() {
+					sess.jumpTubes.Add(u)
+				} else {
+					u.Close()
+				}
 			default:
 				tube.Close() // Close unrecognized tube types
 			}
@@ -160,6 +189,9 @@ func (sess *hopSession) start() {
 // TODO(baumanl): look closely at closing behavior
 func (sess *hopSession) close() error {
 	sess.tubeMuxer.Stop()
+	if sess.agToken != "" {
+		sess.server.dpProxy.forgetToken(sess.agToken)
+	}
 
 	// remove from server session map
 	sess.server.sessionLock.Lock()
@@ -181,7 +213,7 @@ func (sess *hopSession) handleAgc(tube *tubes.Reliable) {
 	} else {
 		logrus.Info("target: starting target instance")
 		cert := sess.transportConn.FetchClientLeaf()
-		authgrants.StartTargetInstance(tube, cert, sess.checkIntent, sess.server.AddAuthGrant)
+		authgrants.StartTargetInstance(tube, cert, sess.checkIntent, sess.addAuthGrant, sess.revokeAuthGrant, sess.addSubGrant)
 	}
 }
 
@@ -217,21 +249,39 @@ func (sess *hopSession) startCodex(t1, t2 *tubes.Reliable) {
 		stdinTube = t2
 		stdoutTube = t1
 	}
-	cmd, termEnv, shell, size, _ := codex.GetCmd(stdinTube)
+	req, _ := codex.GetCmd(stdinTube)
+	cmd, termEnv, shell, size := req.Cmd, req.Term, req.UsePty, req.Size
 	principalSess := sess.ID
+	var argv []string // run without a shell if set
+	if req.Subsystem {
+		argv = sess.server.config.Subsystems[cmd]
+		if argv == nil || shell {
+			codex.SendFailure(stdoutTube, fmt.Errorf("no subsystem %q", cmd))
+			return
+		}
+	}
 	// if using an authgrant, check that the cmd is authorized
-	if sess.usingAuthGrant {
-		principalID, err := sess.checkCmd(cmd, shell)
+	if sess.usingAuthGrant && req.Subsystem {
+		principalID, err := sess.checkSubsystem(cmd)
+		if err != nil {
+			codex.SendFailure(stdoutTube, err)
+			return
+		}
+		principalSess = principalID
+	} else if sess.usingAuthGrant {
+		principalID, args, err := sess.checkCmd(cmd, shell)
 		if err != nil {
 			codex.SendFailure(stdoutTube, err)
 			return
 		}
 		principalSess = principalID
+		argv = args
 	}
 
 	logrus.WithFields(logrus.Fields{
-		"command": cmd,
-		"shell":   shell,
+		"command":   cmd,
+		"shell":     shell,
+		"subsystem": req.Subsystem,
 	}).Info("starting code execution")
 	var err error
 	user, err := thunks.LookupUser(sess.user)
@@ -250,12 +300,23 @@ func (sess *hopSession) startCodex(t1, t2 *tubes.Reliable) {
 		"HOME=" + user.Homedir(),
 		"TERM=" + termEnv,
 	}
+	if sess.agToken != "" {
+		env = append(env,
+			common.AuthgrantSockEnv+"="+sess.server.dpProxy.address,
+			common.AuthgrantTokenEnv+"="+sess.agToken,
+		)
+	}
 	var c *exec.Cmd
 	if cmd == "" {
-		//login(1) starts default shell for user and changes all privileges and environment variables
-		c = exec.Command("login", "-f", sess.user)
+		//login(1) starts default shell for user and changes all privileges and environment variables.
+		//-p keeps the environment set here, so that delegates can reach the agproxy
+		c = exec.Command("login", "-p", "-f", sess.user)
 	} else {
-		c = exec.Command(user.Shell(), "-c", cmd)
+		if argv != nil {
+			c = exec.Command(argv[0], argv[1:]...)
+		} else {
+			c = exec.Command(user.Shell(), "-c", cmd)
+		}
 		c.Dir = user.Homedir()
 		c.SysProcAttr = &syscall.SysProcAttr{}
 		c.SysProcAttr.Credential = &syscall.Credential{
@@ -331,9 +392,41 @@ func (sess *hopSession) newAuthGrantTube() (*tubes.Reliable, error) {
 func (sess *hopSession) startPF(ch *tubes.Reliable) {
 	// TODO find a way of selecting a remote forwarding
 	// or a local forwarding
-	portforwarding.StartPFServer(ch, &sess.forward, sess.tubeMuxer)
+	var authorize func(net.Addr, int) error
+	if sess.usingAuthGrant {
+		authorize = sess.checkPF
+	}
+	portforwarding.StartPFServer(ch, &sess.forward, sess.tubeMuxer, authorize)
 }
 
 func (sess *hopSession) handlePF(ch tubes.Tube) {
 	portforwarding.HandlePF(ch, &sess.forward)
 }
+
+// jumpAllowed reports whether the session may use this server as a jump host.
+// Sessions authorized by an authgrant are limited to the granted action.
+func (sess *hopSession) jumpAllowed() bool {
+	return sess.server.config.EnableJump && !sess.usingAuthGrant
+}
+
+// jumpDestinationAllowed reports whether the session may jump to address
+func (sess *hopSession) jumpDestinationAllowed(address string) bool {
+	destinations := sess.server.config.JumpDestinations
+	if len(destinations) == 0 {
+		return true
+	}
+	for _, pattern := range destinations {
+		if address != "" && glob.Glob(pattern, address) {
+			return true
+		}
+	}
+	return false
+}
+
+func (sess *hopSession) handleJump(ch *tubes.Reliable) {
+	if !sess.jumpAllowed() {
+		jump.Deny(ch, "jump hosts disabled")
+		return
+	}
+	jump.Handle(ch, &sess.jumpTubes, sess.jumpDestinationAllowed)
+}
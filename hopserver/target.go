@@ -1,7 +1,10 @@
 package hopserver
 
 import (
+	"errors"
 	"fmt"
+	"net"
+	"path/filepath"
 	"slices"
 	"time"
 
@@ -11,6 +14,7 @@ import (
 	"hop.computer/hop/certs"
 	"hop.computer/hop/keys"
 	"hop.computer/hop/pkg/thunks"
+	"hop.computer/hop/portforwarding"
 )
 
 // Target server: a hop server that a delegate hop client
@@ -18,31 +22,94 @@ import (
 // principal hop client.
 // Responsibilities [status]:
 // - receive and approve / deny "Intent Communication" messages from principals [implemented]
-// - maintain a mapping of current authgrants [implemented, removing expired still TODO]
+// - maintain a mapping of current authgrants [implemented]
 // - keep server authkey store up to date (add / remove)
 // - conducting user authorization with authgrants
 // - checking all client actions if authorized using an authgrant and updating
 //   authorized actions accordingly
 
+// AuthorizeKeyAuthGrant returns the unexpired authgrants for user:publicKey.
+// The grants stay outstanding until they are used with UseAuthGrant, are
+// revoked or expire.
 func (s *HopServer) AuthorizeKeyAuthGrant(user string, publicKey keys.DHPublicKey) ([]authgrants.Authgrant, error) {
 	if s.config.EnableAuthgrants {
-		ags, err := s.agMap.RemoveAuthgrants(user, publicKey)
-		if err == nil {
-			// remove from transport layer key set
-			s.keyStore.RemoveKey(publicKey)
-		}
-		return ags, err
+		return s.agMap.Authgrants(user, publicKey)
 	}
 	return []authgrants.Authgrant{}, fmt.Errorf("auth grants not enabled")
 }
 
-// checkIntent looks at details of Intent Request and ensures they follow its policies
-// func (sess *hopSession) checkIntent(tube *tubes.Reliable) (authgrants.MessageData, bool) {
+// UseAuthGrant records a use of ag, and returns the updated grant. It errors
+// if ag was used up, revoked or expired, or if it is used again too soon. The
+// delegate key of ag stops being accepted once it has no authgrants left.
+func (s *HopServer) UseAuthGrant(ag authgrants.Authgrant) (authgrants.Authgrant, error) {
+	used, err := s.agMap.UseAuthgrant(ag.ID, ag.User)
+	if err != nil {
+		return used, err
+	}
+	if used.UsedUp() {
+		s.forgetUnusedKey(ag.DelegateCert.PublicKey)
+	}
+	return used, nil
+}
+
+// RevokeAuthGrant revokes the authgrant with id and its sub-grants. If user is
+// not empty, the grant must be for user.
+func (s *HopServer) RevokeAuthGrant(id authgrants.GrantID, user string) ([]authgrants.Authgrant, error) {
+	removed, err := s.agMap.RemoveAuthgrant(id, user)
+	if err != nil {
+		return nil, err
+	}
+	for _, ag := range removed {
+		logrus.Infof("target: revoked authgrant %s for user %s", ag.ID, ag.User)
+		s.forgetUnusedKey(ag.DelegateCert.PublicKey)
+	}
+	return removed, nil
+}
+
+// forgetUnusedKey removes key from the transport key set if it has no
+// outstanding authgrants
+func (s *HopServer) forgetUnusedKey(key keys.DHPublicKey) {
+	if !s.agMap.HasKey(key) {
+		s.keyStore.RemoveKey(key)
+	}
+}
+
+// checkIntent looks at details of Intent Request and ensures they follow its
+// policies. Sessions authorized by an authgrant may only ask for sub-grants.
 func (sess *hopSession) checkIntent(intent authgrants.Intent, principalCert *certs.Certificate) error {
+	err := fmt.Errorf("sessions authorized by an authgrant may only request sub-grants")
+	if !sess.usingAuthGrant {
+		err = sess.validateIntent(&intent)
+	}
+	if err != nil {
+		sess.recordDeniedIntent(&intent, 0, err)
+	}
+	return err
+}
+
+// recordDeniedIntent adds the denial of an intent from the principal of the
+// session to the audit log. Approved intents are recorded as their grants are
+// added.
+func (sess *hopSession) recordDeniedIntent(intent *authgrants.Intent, parent authgrants.GrantID, err error) {
+	if sess.server.audit == nil {
+		return
+	}
+	r := authgrants.IntentAuditRecord(authgrants.AuditTarget, authgrants.AuditIntent, intent)
+	r.Outcome, r.Reason, r.Parent = authgrants.AuditDenied, err.Error(), parent
+	r.SetPrincipal(sess.transportConn.FetchClientLeaf())
+	sess.server.audit.Record(r)
+}
+
+// validateIntent checks that the intent is for the user of the session, is
+// not expired and is well formed
+func (sess *hopSession) validateIntent(intent *authgrants.Intent) error {
 	// check that requested time is valid
 	if intent.ExpTime.Before(time.Now()) {
 		return fmt.Errorf("invalid expiration time")
 	}
+	if !intent.StartTime.Before(intent.ExpTime) {
+		return fmt.Errorf("start time not before expiration time")
+	}
 
 	// TODO(baumanl): check target SNI matches the current hostname of this server? necessary?
 
@@ -63,35 +130,227 @@ func (sess *hopSession) checkIntent(intent authgrants.Intent, principalCert *cer
 	case authgrants.Shell:
 		// TODO(baumanl)
 	case authgrants.Command:
-		// TODO
-	case authgrants.LocalPF:
-		// TODO
-	case authgrants.RemotePF:
-		// TODO
+		if err := intent.AssociatedData.CommandGrantData.Validate(); err != nil {
+			return fmt.Errorf("invalid command grant: %w", err)
+		}
+	case authgrants.LocalPF, authgrants.RemotePF:
+		if _, err := pfGrantAddr(intent.GrantType, intent.AssociatedData); err != nil {
+			return fmt.Errorf("invalid port forwarding grant: %w", err)
+		}
+	case authgrants.FileRead, authgrants.FileWrite:
+		if err := intent.AssociatedData.FileGrantData.Validate(); err != nil {
+			return fmt.Errorf("invalid file grant: %w", err)
+		}
+	case authgrants.Subsystem:
+		if _, ok := sess.server.config.Subsystems[intent.AssociatedData.SubsystemGrantData.Name]; !ok {
+			return fmt.Errorf("no subsystem %q", intent.AssociatedData.SubsystemGrantData.Name)
+		}
 	default:
 		return fmt.Errorf(authgrants.UnrecognizedGrantType)
 	}
 	return nil
 }
 
+// addAuthGrant adds a grant for an intent the principal of the session
+// approved
+func (sess *hopSession) addAuthGrant(intent *authgrants.Intent) (authgrants.GrantID, error) {
+	principal := sess.transportConn.FetchClientLeaf().PublicKey
+	id, err := sess.server.addAuthGrant(intent, &principal)
+	if err != nil {
+		sess.recordDeniedIntent(intent, 0, err)
+	}
+	return id, err
+}
+
+// addSubGrant adds a sub-grant of parent for intent. The client of the session
+// must be the delegate of parent.
+func (sess *hopSession) addSubGrant(parent authgrants.GrantID, intent *authgrants.Intent) (authgrants.GrantID, error) {
+	if err := sess.validateIntent(intent); err != nil {
+		sess.recordDeniedIntent(intent, parent, err)
+		return 0, err
+	}
+	issuer := sess.transportConn.FetchClientLeaf().PublicKey
+	ag, err := sess.server.agMap.AddSubAuthgrant(parent, issuer, intent)
+	if err != nil && ag.ID == 0 {
+		sess.recordDeniedIntent(intent, parent, err)
+		return 0, err
+	}
+	if err != nil {
+		// the grant is still usable until hopd restarts
+		logrus.Errorf("target: unable to save authgrant %s: %s", ag.ID, err)
+	}
+	logrus.Infof("target: added sub-grant %s of %s for user %s", ag.ID, parent, ag.User)
+	sess.server.keyStore.AddKey(intent.DelegateCert.PublicKey)
+	return ag.ID, nil
+}
+
+// revokeAuthGrant revokes a grant for the user of the session. Sessions
+// authorized by an authgrant may not revoke grants.
+func (sess *hopSession) revokeAuthGrant(id authgrants.GrantID) error {
+	if sess.usingAuthGrant {
+		return fmt.Errorf("sessions authorized by an authgrant may not revoke authgrants")
+	}
+	_, err := sess.server.RevokeAuthGrant(id, sess.user)
+	return err
+}
+
 // TODO(baumanl): rewrite this/think about best way to generalize to all grant types
-// checks if the session has an auth grant to perform cmd
-func (sess *hopSession) checkCmd(cmd string, shell bool) (sessID, error) {
+// checks if the session has an auth grant to perform cmd. If the grant allows
+// cmd by argument patterns, it returns the arguments to run without a shell.
+func (sess *hopSession) checkCmd(cmd string, shell bool) (sessID, []string, error) {
 	logrus.Info("target: received request to perform: ", cmd)
-	for i, ag := range sess.authorizedActions {
-		if thunks.TimeNow().Before(ag.ExpTime) {
-			if !shell && ag.GrantType == authgrants.Command {
-				if ag.AssociatedData.CommandGrantData.Cmd == cmd {
-					// remove from authorized actions and return
-					sess.authorizedActions = slices.Delete(sess.authorizedActions, i, i+1)
-					return sessID(ag.PrincipalID), nil
-				}
-			}
-			if shell && ag.GrantType == authgrants.Shell {
-				sess.authorizedActions = slices.Delete(sess.authorizedActions, i, i+1)
-				return sessID(ag.PrincipalID), nil
-			}
-		}
-	}
-	return 0, fmt.Errorf("no auth grant for cmd: %s", cmd)
+	var argv []string
+	ag, err := sess.useAuthGrant("cmd: "+cmd, func(ag *authgrants.Authgrant) bool {
+		if shell {
+			return ag.GrantType == authgrants.Shell
+		}
+		if ag.GrantType != authgrants.Command {
+			return false
+		}
+		var ok bool
+		argv, ok = ag.AssociatedData.CommandGrantData.Allows(cmd)
+		return ok
+	})
+	if err != nil {
+		return 0, nil, fmt.Errorf("no auth grant for cmd: %s: %w", cmd, err)
+	}
+	return sessID(ag.PrincipalID), argv, nil
+}
+
+// checkSubsystem checks that the session has an unexpired subsystem grant for
+// name, and uses it. It returns the session of the principal of the grant.
+func (sess *hopSession) checkSubsystem(name string) (sessID, error) {
+	logrus.Info("target: received request to start subsystem: ", name)
+	ag, err := sess.useAuthGrant("subsystem: "+name, func(ag *authgrants.Authgrant) bool {
+		return ag.GrantType == authgrants.Subsystem && ag.AssociatedData.SubsystemGrantData.Name == name
+	})
+	if err != nil {
+		return 0, fmt.Errorf("no auth grant for subsystem: %s: %w", name, err)
+	}
+	return sessID(ag.PrincipalID), nil
+}
+
+// useAuthGrant uses the first unexpired authorized action of the session that
+// matches, and forgets actions that are used up or revoked. Whether request
+// was allowed is recorded to the audit log.
+func (sess *hopSession) useAuthGrant(request string, match func(*authgrants.Authgrant) bool) (authgrants.Authgrant, error) {
+	used, err := sess.useMatchingAuthGrant(match)
+	if sess.server.audit == nil {
+		return used, err
+	}
+	r := authgrants.GrantAuditRecord(authgrants.AuditTarget, authgrants.AuditGrantUse, &used)
+	r.Outcome = authgrants.AuditAllowed
+	if err != nil {
+		r = authgrants.AuditRecord{
+			Role:    authgrants.AuditTarget,
+			Event:   authgrants.AuditGrantUse,
+			Outcome: authgrants.AuditDenied,
+			Reason:  err.Error(),
+			User:    sess.user,
+		}
+		r.SetDelegate(sess.transportConn.FetchClientLeaf())
+	}
+	r.Request = request
+	sess.server.audit.Record(r)
+	return used, err
+}
+
+// useMatchingAuthGrant does the work of useAuthGrant
+func (sess *hopSession) useMatchingAuthGrant(match func(*authgrants.Authgrant) bool) (authgrants.Authgrant, error) {
+	sess.actionsLock.Lock()
+	defer sess.actionsLock.Unlock()
+	err := authgrants.ErrNoAuthgrant
+	for i := 0; i < len(sess.authorizedActions); i++ {
+		ag := sess.authorizedActions[i]
+		now := thunks.TimeNow()
+		if !now.Before(ag.ExpTime) || !match(&ag) {
+			continue
+		}
+		if now.Before(ag.StartTime) {
+			err = authgrants.ErrAuthgrantNotStarted
+			continue
+		}
+		var used authgrants.Authgrant
+		used, err = sess.server.UseAuthGrant(ag)
+		if errors.Is(err, authgrants.ErrNoAuthgrant) {
+			sess.authorizedActions = slices.Delete(sess.authorizedActions, i, i+1)
+			i--
+			continue
+		}
+		if err != nil {
+			// try other matching grants that may not be rate limited
+			continue
+		}
+		if used.UsedUp() {
+			sess.authorizedActions = slices.Delete(sess.authorizedActions, i, i+1)
+		} else {
+			sess.authorizedActions[i] = used
+		}
+		return used, nil
+	}
+	return authgrants.Authgrant{}, err
+}
+
+// acmeOnly reports whether the only authorized action of the session is an
+// ACME grant
+func (sess *hopSession) acmeOnly() bool {
+	sess.actionsLock.Lock()
+	defer sess.actionsLock.Unlock()
+	return len(sess.authorizedActions) == 1 && sess.authorizedActions[0].GrantType == authgrants.Acme
+}
+
+// pfGrantAddr returns the address covered by a port forwarding grant. TCP and
+// UDP grants must name an IP address and a port, and unix socket grants an
+// absolute path, so that a grant matches exactly one address.
+func pfGrantAddr(grantType authgrants.GrantType, data authgrants.GrantData) (net.Addr, error) {
+	var network byte
+	var address string
+	switch grantType {
+	case authgrants.LocalPF:
+		network, address = data.LocalPFGrantData.Network, data.LocalPFGrantData.Address
+	case authgrants.RemotePF:
+		network, address = data.RemotePFGrantData.Network, data.RemotePFGrantData.Address
+	default:
+		return nil, errors.New("not a port forwarding grant")
+	}
+	addr, err := portforwarding.ParseAddr(portforwarding.NetType(network), address)
+	if err != nil {
+		return nil, err
+	}
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		if a.IP == nil || a.Port == 0 {
+			return nil, fmt.Errorf("%q is not an IP address and port", address)
+		}
+	case *net.UDPAddr:
+		if a.IP == nil || a.Port == 0 {
+			return nil, fmt.Errorf("%q is not an IP address and port", address)
+		}
+	case *net.UnixAddr:
+		if !filepath.IsAbs(a.Name) {
+			return nil, fmt.Errorf("%q is not an absolute path", address)
+		}
+	}
+	return addr, nil
+}
+
+// checkPF checks that the session has an unexpired auth grant for a forward
+// of fwdType to or from addr, and uses it
+func (sess *hopSession) checkPF(addr net.Addr, fwdType int) error {
+	grantType := authgrants.LocalPF
+	if fwdType == portforwarding.PfRemote {
+		grantType = authgrants.RemotePF
+	}
+	logrus.Infof("target: received request to forward %s %s", addr.Network(), addr)
+	_, err := sess.useAuthGrant(fmt.Sprintf("forward: %s %s", addr.Network(), addr), func(ag *authgrants.Authgrant) bool {
+		if ag.GrantType != grantType {
+			return false
+		}
+		granted, err := pfGrantAddr(ag.GrantType, ag.AssociatedData)
+		return err == nil && granted.Network() == addr.Network() && granted.String() == addr.String()
+	})
+	if err != nil {
+		return fmt.Errorf("no auth grant for forward: %s %s: %w", addr.Network(), addr, err)
+	}
+	return nil
 }
@@ -0,0 +1,285 @@
+package hopserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+
+	"hop.computer/hop/authgrants"
+	"hop.computer/hop/authkeys"
+	"hop.computer/hop/filetransfer"
+	"hop.computer/hop/portforwarding"
+)
+
+func pfGrant(grantType authgrants.GrantType, network byte, address string, exp time.Time) authgrants.Authgrant {
+	ag := authgrants.Authgrant{
+		GrantType: grantType,
+		ExpTime:   exp,
+	}
+	ag.AssociatedData.LocalPFGrantData = authgrants.LocalPFGrantData{Network: network, Address: address}
+	ag.AssociatedData.RemotePFGrantData = authgrants.RemotePFGrantData{Network: network, Address: address}
+	return ag
+}
+
+func TestPFGrantAddr(t *testing.T) {
+	for _, tc := range []struct {
+		network byte
+		address string
+		valid   bool
+	}{
+		{portforwarding.PfTCP, "127.0.0.1:8080", true},
+		{portforwarding.PfUDP, "[::1]:53", true},
+		{portforwarding.PfUNIX, "/run/app.sock", true},
+		{portforwarding.PfTCP, "localhost:8080", false},
+		{portforwarding.PfTCP, "127.0.0.1:0", false},
+		{portforwarding.PfTCP, "127.0.0.1", false},
+		{portforwarding.PfUNIX, "app.sock", false},
+		{9, "127.0.0.1:8080", false},
+	} {
+		ag := pfGrant(authgrants.LocalPF, tc.network, tc.address, time.Time{})
+		_, err := pfGrantAddr(ag.GrantType, ag.AssociatedData)
+		assert.Equal(t, err == nil, tc.valid, "%d %s: %v", tc.network, tc.address, err)
+	}
+}
+
+// testGrantSession returns a session of a server with an outstanding
+// authgrant for each of ags, authorized to use them
+func testGrantSession(t *testing.T, ags ...authgrants.Authgrant) *hopSession {
+	s := &HopServer{
+		agMap:    authgrants.NewAuthgrantMapSync(),
+		keyStore: authkeys.NewSyncAuthKeySet(),
+	}
+	sess := &hopSession{server: s, user: "user", usingAuthGrant: true}
+	for _, ag := range ags {
+		intent := authgrants.Intent{
+			GrantType:      ag.GrantType,
+			StartTime:      ag.StartTime,
+			ExpTime:        ag.ExpTime,
+			MaxUses:        ag.MaxUses,
+			MinInterval:    ag.MinInterval,
+			TargetUsername: "user",
+			AssociatedData: ag.AssociatedData,
+		}
+		added, err := s.agMap.AddAuthGrant(&intent, 0, nil)
+		assert.NilError(t, err)
+		sess.authorizedActions = append(sess.authorizedActions, added)
+	}
+	return sess
+}
+
+func TestCheckPF(t *testing.T) {
+	later := time.Now().Add(time.Hour)
+	sess := testGrantSession(t,
+		pfGrant(authgrants.LocalPF, portforwarding.PfTCP, "127.0.0.1:8080", later),
+		pfGrant(authgrants.RemotePF, portforwarding.PfUNIX, "/run/app.sock", later),
+		pfGrant(authgrants.LocalPF, portforwarding.PfTCP, "127.0.0.1:9090", time.Now().Add(-time.Hour)),
+	)
+	tcp := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8080}
+
+	// The grant type, network and address must all match
+	assert.Assert(t, sess.checkPF(tcp, portforwarding.PfRemote) != nil)
+	assert.Assert(t, sess.checkPF(&net.UDPAddr{IP: tcp.IP, Port: tcp.Port}, portforwarding.PfLocal) != nil)
+	assert.Assert(t, sess.checkPF(&net.TCPAddr{IP: tcp.IP, Port: 8081}, portforwarding.PfLocal) != nil)
+	assert.NilError(t, sess.checkPF(tcp, portforwarding.PfLocal))
+
+	// Grants are used up
+	assert.Assert(t, sess.checkPF(tcp, portforwarding.PfLocal) != nil)
+
+	assert.NilError(t, sess.checkPF(&net.UnixAddr{Name: "/run/app.sock", Net: "unix"}, portforwarding.PfRemote))
+
+	// Expired grants do not count
+	assert.Assert(t, sess.checkPF(&net.TCPAddr{IP: tcp.IP, Port: 9090}, portforwarding.PfLocal) != nil)
+}
+
+func TestUsedAndRevokedGrants(t *testing.T) {
+	later := time.Now().Add(time.Hour)
+	sess := testGrantSession(t,
+		pfGrant(authgrants.LocalPF, portforwarding.PfTCP, "127.0.0.1:8080", later),
+		pfGrant(authgrants.LocalPF, portforwarding.PfTCP, "127.0.0.1:8081", later),
+	)
+	other := testGrantSession(t)
+	other.server = sess.server
+	sess.actionsLock.Lock()
+	used, revoked := sess.authorizedActions[0], sess.authorizedActions[1]
+	sess.actionsLock.Unlock()
+	other.actionsLock.Lock()
+	other.authorizedActions = []authgrants.Authgrant{used}
+	other.actionsLock.Unlock()
+
+	// A grant used by one session is gone for every other session
+	assert.NilError(t, sess.checkPF(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8080}, portforwarding.PfLocal))
+	assert.Assert(t, other.checkPF(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8080}, portforwarding.PfLocal) != nil)
+	assert.Equal(t, len(sess.server.agMap.List("user")), 1)
+
+	// Sessions authorized by an authgrant cannot revoke grants
+	assert.Assert(t, sess.revokeAuthGrant(revoked.ID) != nil)
+	other.usingAuthGrant = false
+	assert.NilError(t, other.revokeAuthGrant(revoked.ID))
+	assert.Assert(t, sess.checkPF(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8081}, portforwarding.PfLocal) != nil)
+	assert.Equal(t, len(sess.server.agMap.List("")), 0)
+}
+
+func TestCheckCmdUses(t *testing.T) {
+	batch := authgrants.Authgrant{
+		GrantType:   authgrants.Command,
+		ExpTime:     time.Now().Add(time.Hour),
+		MaxUses:     2,
+		MinInterval: time.Hour,
+	}
+	batch.AssociatedData.CommandGrantData.Cmd = "backup"
+	unlimited := batch
+	unlimited.AssociatedData.CommandGrantData.Cmd = "status"
+	unlimited.MaxUses = authgrants.UnlimitedUses
+	unlimited.MinInterval = 0
+	sess := testGrantSession(t, batch, unlimited)
+
+	_, _, err := sess.checkCmd("backup", false)
+	assert.NilError(t, err)
+	// The second use is too soon
+	_, _, err = sess.checkCmd("backup", false)
+	assert.Assert(t, errors.Is(err, authgrants.ErrAuthgrantRateLimited))
+
+	for range 5 {
+		_, _, err = sess.checkCmd("status", false)
+		assert.NilError(t, err)
+	}
+	_, _, err = sess.checkCmd("status", true)
+	assert.Assert(t, err != nil)
+	assert.Equal(t, len(sess.server.agMap.List("user")), 2)
+}
+
+func TestCheckSubsystem(t *testing.T) {
+	sftp := authgrants.Authgrant{
+		GrantType: authgrants.Subsystem,
+		ExpTime:   time.Now().Add(time.Hour),
+		MaxUses:   1,
+	}
+	sftp.AssociatedData.SubsystemGrantData.Name = "sftp"
+	shell := sftp
+	shell.GrantType = authgrants.Shell
+	sess := testGrantSession(t, sftp, shell)
+
+	_, err := sess.checkSubsystem("backup")
+	assert.Assert(t, err != nil)
+	_, err = sess.checkSubsystem("sftp")
+	assert.NilError(t, err)
+	// A shell grant does not start subsystems
+	_, err = sess.checkSubsystem("sftp")
+	assert.Assert(t, err != nil)
+}
+
+func TestCheckCmdBeforeStart(t *testing.T) {
+	later := authgrants.Authgrant{
+		GrantType: authgrants.Command,
+		StartTime: time.Now().Add(time.Hour),
+		ExpTime:   time.Now().Add(2 * time.Hour),
+		MaxUses:   authgrants.UnlimitedUses,
+	}
+	later.AssociatedData.CommandGrantData.Cmd = "backup"
+	sess := testGrantSession(t, later)
+
+	_, _, err := sess.checkCmd("backup", false)
+	assert.Assert(t, errors.Is(err, authgrants.ErrAuthgrantNotStarted))
+	_, err = sess.server.agMap.UseAuthgrant(sess.authorizedActions[0].ID, "user")
+	assert.Assert(t, errors.Is(err, authgrants.ErrAuthgrantNotStarted))
+	assert.Equal(t, len(sess.authorizedActions), 1)
+}
+
+func TestGrantUseAudit(t *testing.T) {
+	status := authgrants.Authgrant{
+		GrantType: authgrants.Command,
+		ExpTime:   time.Now().Add(time.Hour),
+		MaxUses:   authgrants.UnlimitedUses,
+	}
+	status.AssociatedData.CommandGrantData.Cmd = "status"
+	sess := testGrantSession(t, status)
+	audit := &bytes.Buffer{}
+	sess.server.audit = authgrants.NewAuditLog(audit, false)
+
+	_, _, err := sess.checkCmd("status", false)
+	assert.NilError(t, err)
+	var r authgrants.AuditRecord
+	assert.NilError(t, json.Unmarshal(audit.Bytes(), &r))
+	assert.Equal(t, r.Event, authgrants.AuditGrantUse)
+	assert.Equal(t, r.Outcome, authgrants.AuditAllowed)
+	assert.Equal(t, r.Request, "cmd: status")
+	assert.Equal(t, r.GrantID, sess.authorizedActions[0].ID)
+	assert.Equal(t, r.Uses, uint16(1))
+}
+
+func TestCheckIntentGrantSession(t *testing.T) {
+	sess := testGrantSession(t)
+	intent := authgrants.Intent{
+		GrantType:      authgrants.Shell,
+		ExpTime:        time.Now().Add(time.Hour),
+		TargetUsername: "user",
+	}
+	// Delegates may only pass on sub-grants of their own grants
+	assert.ErrorContains(t, sess.checkIntent(intent, nil), "sub-grants")
+}
+
+func TestCheckCmdPattern(t *testing.T) {
+	restart := authgrants.Authgrant{
+		GrantType: authgrants.Command,
+		ExpTime:   time.Now().Add(time.Hour),
+		MaxUses:   authgrants.UnlimitedUses,
+	}
+	var err error
+	restart.AssociatedData.CommandGrantData, err = authgrants.ParseCommandPattern("systemctl restart app-*", []string{"--no-block"})
+	assert.NilError(t, err)
+	sess := testGrantSession(t, restart)
+
+	_, argv, err := sess.checkCmd("systemctl --no-block restart 'app-web'", false)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, argv, []string{"systemctl", "--no-block", "restart", "app-web"})
+
+	for _, cmd := range []string{
+		"systemctl restart app-web; reboot",
+		"systemctl restart $(reboot)",
+		"systemctl restart db",
+		"systemctl restart app-web app-db",
+		"systemctl --force restart app-web",
+	} {
+		_, _, err = sess.checkCmd(cmd, false)
+		assert.Assert(t, err != nil, cmd)
+	}
+}
+
+func TestCheckFile(t *testing.T) {
+	dir := t.TempDir()
+	releases := filepath.Join(dir, "releases")
+	assert.NilError(t, os.Mkdir(releases, 0o755))
+	assert.NilError(t, os.Symlink(dir, filepath.Join(releases, "up")))
+	upload := authgrants.Authgrant{
+		GrantType: authgrants.FileWrite,
+		ExpTime:   time.Now().Add(time.Hour),
+		MaxUses:   authgrants.UnlimitedUses,
+	}
+	upload.AssociatedData.FileGrantData = authgrants.FileGrantData{Path: releases, MaxSize: 100, Mode: 0o644}
+	sess := testGrantSession(t, upload)
+
+	req := filetransfer.Request{Op: filetransfer.OpWrite, Path: filepath.Join(releases, "app.tar"), Size: 100, Mode: 0o640}
+	_, err := sess.checkFile(&req)
+	assert.NilError(t, err)
+	assert.Equal(t, req.Root, releases)
+
+	for _, req := range []filetransfer.Request{
+		{Op: filetransfer.OpRead, Path: filepath.Join(releases, "app.tar")},
+		{Op: filetransfer.OpWrite, Path: filepath.Join(releases, "app.tar"), Size: 101, Mode: 0o644},
+		{Op: filetransfer.OpWrite, Path: filepath.Join(releases, "app.tar"), Size: 1, Mode: 0o755},
+		{Op: filetransfer.OpWrite, Path: filepath.Join(dir, "app.tar"), Size: 1},
+		{Op: filetransfer.OpWrite, Path: releases + "/../app.tar", Size: 1},
+		{Op: filetransfer.OpWrite, Path: releases + "-old/app.tar", Size: 1},
+		{Op: filetransfer.OpWrite, Path: "app.tar", Size: 1},
+	} {
+		_, err := sess.checkFile(&req)
+		assert.Assert(t, err != nil, "%d %s %d %o", req.Op, req.Path, req.Size, req.Mode)
+	}
+}
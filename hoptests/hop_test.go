@@ -2,11 +2,13 @@ package hoptests
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"net"
 	"net/http"
 	"os"
 	"path"
+	"path/filepath"
 	"strconv"
 	"sync"
 	"testing"
@@ -23,13 +25,21 @@ import (
 	"hop.computer/hop/common"
 	"hop.computer/hop/config"
 	"hop.computer/hop/core"
+	"hop.computer/hop/filetransfer"
 	"hop.computer/hop/hopclient"
 	"hop.computer/hop/hopserver"
+	"hop.computer/hop/jump"
 	"hop.computer/hop/keys"
 	"hop.computer/hop/pkg/thunks"
 	"hop.computer/hop/transport"
 )
 
+// TestMain lets servers in the tests run this binary as their file helper
+func TestMain(m *testing.M) {
+	hopserver.RunFileHelper(os.Args)
+	os.Exit(m.Run())
+}
+
 type TestAgent struct {
 	Data *agent.Data // map string (keypath) -> keys
 
@@ -55,6 +65,7 @@ type TestServer struct {
 
 	UDPConn    *net.UDPConn
 	Transport  *transport.Server
+	Streams    *transport.Server // optional server for TCP and WebSocket clients
 	Server     *hopserver.HopServer
 	ServerName string
 }
@@ -167,6 +178,7 @@ func (s *TestServer) StartHopServer(t *testing.T) {
 	}
 	assert.NilError(t, err)
 	logrus.Infof("Hop Server running on address: %s", s.Server.ListenAddress().String())
+	s.Server.StreamServer = s.Streams
 
 	for user, file := range s.AuthorizedKeyFiles {
 		path := "home/" + user + "/.hop/authorized_keys"
@@ -320,6 +332,42 @@ func TestHopClientExtAuth(t *testing.T) {
 	})
 }
 
+func TestHopClientStreamFallback(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	logrus.SetLevel(logrus.TraceLevel)
+	thunks.SetUpTest()
+	s := NewTestServer(t)
+	c := NewTestClient(t, s, "username")
+	s.AddClientToAuthorizedKeys(t, c)
+
+	tcp, err := transport.ListenStream("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	s.Streams, err = transport.NewMultiServer([]transport.UDPLike{tcp}, transport.ServerConfig{
+		Certificate:      s.Leaf,
+		Intermediate:     s.Intermediate,
+		KeyPair:          s.LeafKeyPair,
+		HandshakeTimeout: time.Second,
+	})
+	assert.NilError(t, err)
+	s.StartTransport(t)
+	s.StartHopServer(t)
+	assert.Equal(t, len(s.Server.ListenAddresses()), 2)
+
+	// Nothing answers over UDP, so the client falls back to TCP
+	blackHole, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NilError(t, err)
+	defer blackHole.Close()
+	c.Config.Hostname = "127.0.0.1"
+	c.Config.Port = blackHole.LocalAddr().(*net.UDPAddr).Port
+	c.Config.FallbackURL = "tcp://" + tcp.LocalAddr().String()
+	c.Config.HandshakeTimeout = 500 * time.Millisecond
+	c.StartClient(t)
+
+	assert.NilError(t, c.Client.Close())
+	assert.NilError(t, s.Server.Close())
+}
+
 func TestHopClientInMemAuth(t *testing.T) {
 	defer goleak.VerifyNone(t)
 
@@ -482,6 +530,43 @@ func TestStartCmd(t *testing.T) {
 	})
 }
 
+func TestSubsystem(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	logrus.SetLevel(logrus.TraceLevel)
+	thunks.SetUpTest()
+
+	s := NewTestServer(t)
+	c := NewTestClient(t, s, "username")
+	s.AddClientToAuthorizedKeys(t, c)
+	s.Config.Subsystems = map[string][]string{"upper": {"tr", "a-z", "A-Z"}}
+	s.StartTransport(t)
+	s.StartHopServer(t)
+	c.Authenticator = s.ChainAuthenticator(t, c.KeyPair)
+
+	// The command names the subsystem, and is not run itself
+	c.AddCmd("upper")
+	c.Config.Subsystem = true
+	output := &bytes.Buffer{}
+	c.Config.Output = output
+	c.Config.Input = bytes.NewBufferString("hello from hop tests")
+	c.StartClient(t)
+	err := c.Client.Start()
+	assert.NilError(t, err)
+	err = c.Client.Close()
+	assert.NilError(t, err)
+	assert.Equal(t, output.String(), "HELLO FROM HOP TESTS")
+
+	c.AddCmd("tr")
+	c.StartClient(t)
+	err = c.Client.Start()
+	assert.Assert(t, err != nil)
+	c.Client.Close()
+
+	err = s.Server.Close()
+	assert.NilError(t, err)
+}
+
 func TestSelfAuthGrant(t *testing.T) {
 	// defer goleak.VerifyNone(t)
 	logrus.SetLevel(logrus.TraceLevel)
@@ -562,3 +647,119 @@ func TestSelfAuthGrant(t *testing.T) {
 	logrus.Info(outString)
 	assert.Equal(t, outString, testString)
 }
+
+func TestJumpHost(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	logrus.SetLevel(logrus.TraceLevel)
+	thunks.SetUpTest()
+
+	bastion := NewTestServer(t)
+	target := NewTestServer(t)
+	jc := NewTestClient(t, bastion, "username")
+	c := NewTestClient(t, target, "username")
+
+	bastion.AddClientToAuthorizedKeys(t, jc)
+	target.AddClientToAuthorizedKeys(t, c)
+	bastion.Config.EnableJump = true
+	bastion.Config.JumpDestinations = []string{c.Remote}
+
+	bastion.StartTransport(t)
+	bastion.StartHopServer(t)
+	target.StartTransport(t)
+	target.StartHopServer(t)
+
+	jc.Authenticator = bastion.ChainAuthenticator(t, jc.KeyPair)
+	c.Authenticator = target.ChainAuthenticator(t, c.KeyPair)
+	jc.StartClient(t)
+
+	// The handshake with the target runs over a tube relayed by the bastion
+	var err error
+	c.Client, err = hopclient.NewHopClient(c.Config)
+	assert.NilError(t, err)
+	c.Client.SetJumpHost(jc.Client)
+	err = c.Client.DialExternalAuthenticator(c.Remote, c.Authenticator)
+	assert.NilError(t, err)
+
+	// Messages larger than a packet are split to fit the relayed tube
+	dir := t.TempDir()
+	contents := bytes.Repeat([]byte("Hello through the jump host!\n"), 2000)
+	local := filepath.Join(dir, "local")
+	assert.NilError(t, os.WriteFile(local, contents, 0o600))
+	remote := filepath.Join(dir, "remote")
+	assert.NilError(t, c.Client.Upload(local, remote))
+	back := filepath.Join(dir, "back")
+	assert.NilError(t, c.Client.Download(remote, back))
+	got, err := os.ReadFile(back)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, got, contents)
+
+	// Closing the client closes the jump host as well
+	err = c.Client.Close()
+	assert.NilError(t, err)
+
+	// A server refuses to relay to other destinations, or with jump hosts
+	// disabled
+	for _, disable := range []func(){
+		func() { bastion.Config.JumpDestinations = []string{"10.0.0.*:77"} },
+		func() { bastion.Config.EnableJump = false },
+	} {
+		disable()
+		jc.StartClient(t)
+		c.Client, err = hopclient.NewHopClient(c.Config)
+		assert.NilError(t, err)
+		c.Client.SetJumpHost(jc.Client)
+		err = c.Client.DialExternalAuthenticator(c.Remote, c.Authenticator)
+		assert.Assert(t, errors.Is(err, jump.ErrJumpFailed))
+		err = c.Client.Close()
+		assert.NilError(t, err)
+	}
+
+	err = bastion.Server.Close()
+	assert.NilError(t, err)
+	err = target.Server.Close()
+	assert.NilError(t, err)
+}
+
+func TestFileCopy(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	logrus.SetLevel(logrus.TraceLevel)
+	thunks.SetUpTest()
+
+	s := NewTestServer(t)
+	c := NewTestClient(t, s, "username")
+	s.AddClientToAuthorizedKeys(t, c)
+	s.StartTransport(t)
+	s.StartHopServer(t)
+	c.Authenticator = s.ChainAuthenticator(t, c.KeyPair)
+	c.StartClient(t)
+
+	dir := t.TempDir()
+	contents := bytes.Repeat([]byte("Hello from hop tests!\n"), 10000)
+	local := filepath.Join(dir, "local")
+	assert.NilError(t, os.WriteFile(local, contents, 0o640))
+
+	remote := filepath.Join(dir, "remote")
+	assert.NilError(t, c.Client.Upload(local, remote))
+	got, err := os.ReadFile(remote)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, got, contents)
+	fi, err := os.Stat(remote)
+	assert.NilError(t, err)
+	assert.Equal(t, fi.Mode().Perm(), os.FileMode(0o640))
+
+	back := filepath.Join(dir, "back")
+	assert.NilError(t, c.Client.Download(remote, back))
+	got, err = os.ReadFile(back)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, got, contents)
+
+	err = c.Client.Download(filepath.Join(dir, "missing"), back)
+	assert.Assert(t, errors.Is(err, filetransfer.ErrTransferFailed))
+
+	err = c.Client.Close()
+	assert.NilError(t, err)
+	err = s.Server.Close()
+	assert.NilError(t, err)
+}
@@ -0,0 +1,244 @@
+// Package jump lets a client reach a Hop server through a chain of other Hop
+// servers, called jump hosts.
+//
+// To jump through a server, the client opens an unreliable JumpTube and a
+// reliable JumpTube. It sends a request over the reliable tube with the ID of
+// the unreliable tube and the address of the next hop:
+//
+//	tube ID (1 byte) || address length (1 byte) || address
+//
+// The server dials the address over UDP and relays datagrams between the
+// unreliable tube and the UDP socket. It then replies with
+//
+//	status (1 byte) || message length (1 byte) || message
+//
+// The client runs its transport handshake with the next hop over the
+// unreliable tube, so the jump host only ever relays ciphertext.
+package jump
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"hop.computer/hop/common"
+	"hop.computer/hop/proxy"
+	"hop.computer/hop/tubes"
+)
+
+const (
+	statusOK     = 0
+	statusFailed = 1
+)
+
+// tubeTimeout is how long the server waits for the unreliable tube named in a
+// request to arrive
+const tubeTimeout = 10 * time.Second
+
+// ErrAddressTooLong is returned when the address of the next hop does not fit
+// in a request
+var ErrAddressTooLong = errors.New("jump address too long")
+
+// ErrJumpFailed is returned when the jump host does not connect to the next hop
+var ErrJumpFailed = errors.New("jump host refused connection")
+
+// writeRequest writes a request to connect tube id to address
+func writeRequest(w io.Writer, id byte, address string) error {
+	if len(address) > 255 {
+		return ErrAddressTooLong
+	}
+	msg := append([]byte{id, byte(len(address))}, address...)
+	_, err := w.Write(msg)
+	return err
+}
+
+// readRequest reads the tube ID and address of a request
+func readRequest(r io.Reader) (byte, string, error) {
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return 0, "", err
+	}
+	address := make([]byte, hdr[1])
+	if _, err := io.ReadFull(r, address); err != nil {
+		return 0, "", err
+	}
+	return hdr[0], string(address), nil
+}
+
+// writeResponse writes the result of a request. A nil err means the jump
+// host is relaying to the next hop.
+func writeResponse(w io.Writer, err error) error {
+	if err == nil {
+		_, err = w.Write([]byte{statusOK, 0})
+		return err
+	}
+	reason := err.Error()
+	if len(reason) > 255 {
+		reason = reason[:255]
+	}
+	_, err = w.Write(append([]byte{statusFailed, byte(len(reason))}, reason...))
+	return err
+}
+
+// readResponse reads the result of a request
+func readResponse(r io.Reader) error {
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return err
+	}
+	reason := make([]byte, hdr[1])
+	if _, err := io.ReadFull(r, reason); err != nil {
+		return err
+	}
+	if hdr[0] != statusOK {
+		return fmt.Errorf("%w: %s", ErrJumpFailed, reason)
+	}
+	return nil
+}
+
+// Open asks the server on the other end of muxer to relay to address. It
+// returns the unreliable tube that carries datagrams to and from address.
+func Open(muxer *tubes.Muxer, address string) (*tubes.Unreliable, error) {
+	data, err := muxer.CreateUnreliableTube(common.JumpTube)
+	if err != nil {
+		return nil, err
+	}
+	ch, err := muxer.CreateReliableTube(common.JumpTube)
+	if err != nil {
+		data.Close()
+		return nil, err
+	}
+	defer ch.Close()
+
+	err = writeRequest(ch, data.GetID(), address)
+	if err == nil {
+		err = readResponse(ch)
+	}
+	if err != nil {
+		data.Close()
+		return nil, err
+	}
+	return data, nil
+}
+
+// TubeQueue holds the unreliable JumpTubes accepted by a server until the
+// request naming them arrives. The zero value is ready to use.
+type TubeQueue struct {
+	m sync.Mutex
+	// +checklocks:m
+	tubes map[byte]chan *tubes.Unreliable
+}
+
+// slotLocked returns the channel that the tube with id is delivered on
+// +checklocks:q.m
+func (q *TubeQueue) slotLocked(id byte) chan *tubes.Unreliable {
+	if q.tubes == nil {
+		q.tubes = make(map[byte]chan *tubes.Unreliable)
+	}
+	slot, ok := q.tubes[id]
+	if !ok {
+		slot = make(chan *tubes.Unreliable, 1)
+		q.tubes[id] = slot
+	}
+	return slot
+}
+
+// Add queues u for the request that names it
+func (q *TubeQueue) Add(u *tubes.Unreliable) {
+	q.m.Lock()
+	defer q.m.Unlock()
+	select {
+	case q.slotLocked(u.GetID()) <- u:
+	default:
+		// A tube with the same ID is already waiting
+		u.Close()
+	}
+}
+
+// wait returns the tube with id, waiting up to timeout for it to be added
+func (q *TubeQueue) wait(id byte, timeout time.Duration) (*tubes.Unreliable, bool) {
+	q.m.Lock()
+	slot := q.slotLocked(id)
+	q.m.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	var u *tubes.Unreliable
+	select {
+	case u = <-slot:
+	case <-timer.C:
+	}
+
+	q.m.Lock()
+	if q.tubes[id] == slot {
+		delete(q.tubes, id)
+	}
+	q.m.Unlock()
+	return u, u != nil
+}
+
+// Deny refuses the request on ch with reason
+func Deny(ch *tubes.Reliable, reason string) {
+	defer ch.Close()
+	if _, _, err := readRequest(ch); err != nil {
+		return
+	}
+	writeResponse(ch, errors.New(reason))
+}
+
+// Handle serves the request on ch. The unreliable tube named by the request is
+// taken from q, and its datagrams are relayed to and from the requested
+// address until either side closes. Addresses that allowed rejects are
+// refused.
+func Handle(ch *tubes.Reliable, q *TubeQueue, allowed func(address string) bool) {
+	defer ch.Close()
+	id, address, err := readRequest(ch)
+	if err != nil {
+		logrus.Errorf("jump: error reading request: %s", err)
+		return
+	}
+	if !allowed(address) {
+		logrus.Errorf("jump: refusing to relay to %s", address)
+		writeResponse(ch, errors.New("destination not allowed"))
+		// the tube is still coming, and must not be left in q
+		if data, ok := q.wait(id, tubeTimeout); ok {
+			data.Close()
+		}
+		return
+	}
+	data, ok := q.wait(id, tubeTimeout)
+	if !ok {
+		logrus.Errorf("jump: tube %d for %s never arrived", id, address)
+		writeResponse(ch, errors.New("missing tube"))
+		return
+	}
+
+	raddr, err := net.ResolveUDPAddr("udp", address)
+	var conn *net.UDPConn
+	if err == nil {
+		conn, err = net.DialUDP("udp", nil, raddr)
+	}
+	if err != nil {
+		logrus.Errorf("jump: unable to reach %s: %s", address, err)
+		writeResponse(ch, err)
+		data.Close()
+		return
+	}
+	if err := writeResponse(ch, nil); err != nil {
+		conn.Close()
+		data.Close()
+		return
+	}
+
+	logrus.Infof("jump: relaying tube %d to %s", id, address)
+	wg := proxy.UnreliableProxy(conn, data)
+	go func() {
+		wg.Wait()
+		logrus.Infof("jump: stopped relaying to %s", address)
+	}()
+}
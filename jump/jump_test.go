@@ -0,0 +1,47 @@
+package jump
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestRequest(t *testing.T) {
+	buf := &bytes.Buffer{}
+	assert.NilError(t, writeRequest(buf, 7, "[2001:db8::1]:77"))
+	id, address, err := readRequest(buf)
+	assert.NilError(t, err)
+	assert.Equal(t, id, byte(7))
+	assert.Equal(t, address, "[2001:db8::1]:77")
+
+	err = writeRequest(buf, 7, strings.Repeat("a", 256))
+	assert.Equal(t, err, ErrAddressTooLong)
+}
+
+func TestResponse(t *testing.T) {
+	buf := &bytes.Buffer{}
+	assert.NilError(t, writeResponse(buf, nil))
+	assert.NilError(t, readResponse(buf))
+
+	assert.NilError(t, writeResponse(buf, errors.New("no route to host")))
+	err := readResponse(buf)
+	assert.Assert(t, errors.Is(err, ErrJumpFailed))
+	assert.ErrorContains(t, err, "no route to host")
+
+	// Long reasons are truncated to fit
+	assert.NilError(t, writeResponse(buf, errors.New(strings.Repeat("x", 300))))
+	assert.Assert(t, errors.Is(readResponse(buf), ErrJumpFailed))
+	assert.Equal(t, buf.Len(), 0)
+}
+
+func TestTubeQueueTimeout(t *testing.T) {
+	var q TubeQueue
+	_, ok := q.wait(3, 0)
+	assert.Assert(t, !ok)
+	q.m.Lock()
+	assert.Equal(t, len(q.tubes), 0)
+	q.m.Unlock()
+}
@@ -5,6 +5,8 @@ import (
 	"encoding/binary"
 	"net"
 	"testing"
+
+	"hop.computer/hop/tubes"
 )
 
 func TestReadPacket(t *testing.T) {
@@ -13,6 +15,7 @@ func TestReadPacket(t *testing.T) {
 		input           []byte
 		expectedAddr    net.Addr
 		expectedFwdType byte
+		expectedFEC     tubes.FECConfig
 		expectErr       bool
 	}{
 		{
@@ -39,6 +42,33 @@ func TestReadPacket(t *testing.T) {
 			expectedFwdType: PfLocal,
 			expectErr:       false,
 		},
+		{
+			name: "UDP address with FEC",
+			input: func() []byte {
+				ipPort := "127.0.0.1:53"
+				addrLen := make([]byte, 2)
+				binary.BigEndian.PutUint16(addrLen, uint16(len(ipPort)))
+				b := append([]byte{byte(PfUDP), PfLocal | pfFECFlag}, append(addrLen, []byte(ipPort)...)...)
+				return append(b, 8)
+			}(),
+			expectedAddr:    &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53},
+			expectedFwdType: PfLocal,
+			expectedFEC:     tubes.FECConfig{GroupSize: 8},
+			expectErr:       false,
+		},
+		{
+			name: "Error: Invalid FEC group size",
+			input: func() []byte {
+				ipPort := "127.0.0.1:53"
+				addrLen := make([]byte, 2)
+				binary.BigEndian.PutUint16(addrLen, uint16(len(ipPort)))
+				b := append([]byte{byte(PfUDP), PfLocal | pfFECFlag}, append(addrLen, []byte(ipPort)...)...)
+				return append(b, 0)
+			}(),
+			expectedAddr:    nil,
+			expectedFwdType: 0,
+			expectErr:       true,
+		},
 		{
 			name: "Valid UNIX address",
 			input: func() []byte {
@@ -68,7 +98,7 @@ func TestReadPacket(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			r := bytes.NewReader(tt.input)
-			addr, fwdType, err := readPacket(r)
+			addr, fwdType, fec, err := readPacket(r)
 
 			if tt.expectErr {
 				if err == nil {
@@ -89,6 +119,10 @@ func TestReadPacket(t *testing.T) {
 			if fwdType != tt.expectedFwdType {
 				t.Errorf("expected forward type %v, got %v", tt.expectedFwdType, fwdType)
 			}
+
+			if fec != tt.expectedFEC {
+				t.Errorf("expected FEC config %+v, got %+v", tt.expectedFEC, fec)
+			}
 		})
 	}
 }
@@ -98,6 +132,7 @@ func TestToBytes(t *testing.T) {
 		name      string
 		inputAddr net.Addr
 		fwdType   int
+		fec       tubes.FECConfig
 		expected  []byte
 	}{
 		{
@@ -122,6 +157,19 @@ func TestToBytes(t *testing.T) {
 				return append([]byte{byte(PfUDP), PfLocal}, append(addrLen, []byte(ipPort)...)...)
 			}(),
 		},
+		{
+			name:      "UDP Address with FEC",
+			inputAddr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53},
+			fwdType:   PfRemote,
+			fec:       tubes.FECConfig{GroupSize: 4},
+			expected: func() []byte {
+				ipPort := "127.0.0.1:53"
+				addrLen := make([]byte, 2)
+				binary.BigEndian.PutUint16(addrLen, uint16(len(ipPort)))
+				b := append([]byte{byte(PfUDP), PfRemote | pfFECFlag}, append(addrLen, []byte(ipPort)...)...)
+				return append(b, 4)
+			}(),
+		},
 		{
 			name:      "UNIX Address",
 			inputAddr: &net.UnixAddr{Name: "/tmp/unix.sock", Net: "unix"},
@@ -137,7 +185,7 @@ func TestToBytes(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := toBytes(tt.inputAddr, tt.fwdType)
+			got := toBytes(tt.inputAddr, tt.fwdType, tt.fec)
 			if !bytes.Equal(got, tt.expected) {
 				t.Errorf("expected %v, got %v", tt.expected, got)
 			}
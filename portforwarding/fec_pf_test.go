@@ -0,0 +1,149 @@
+package portforwarding
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gotest.tools/assert"
+
+	"hop.computer/hop/common"
+	"hop.computer/hop/tubes"
+)
+
+// lossyMsgConn is a MsgConn over UDP that drops every dropEvery-th packet it
+// writes while lossy is set
+type lossyMsgConn struct {
+	*net.UDPConn
+	dropEvery int
+	lossy     atomic.Bool
+	written   atomic.Int64
+}
+
+func (c *lossyMsgConn) ReadMsg(b []byte) (int, error) {
+	n, _, _, _, err := c.ReadMsgUDP(b, nil)
+	return n, err
+}
+
+func (c *lossyMsgConn) WriteMsg(b []byte) error {
+	if c.lossy.Load() && c.written.Add(1)%int64(c.dropEvery) == 0 {
+		return nil
+	}
+	_, _, err := c.WriteMsgUDP(b, nil, nil)
+	return err
+}
+
+func (c *lossyMsgConn) MaxPayload() int {
+	return 1200
+}
+
+// TestUDPForwardFEC tests:
+// Scenario: A local UDP forward with FEC runs over a link that loses one
+// packet in every seven, to a UDP echo server
+// Expected behavior: Every datagram and its echo is delivered, and the server
+// rebuilds lost datagrams from parity datagrams
+func TestUDPForwardFEC(t *testing.T) {
+	logrus.SetLevel(logrus.InfoLevel)
+
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NilError(t, err)
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(buf[:n], addr)
+		}
+	}()
+
+	// Find a free port for the forward to listen on
+	free, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NilError(t, err)
+	listenAddr := free.LocalAddr().(*net.UDPAddr)
+	free.Close()
+
+	serverUDP, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NilError(t, err)
+	clientUDP, err := net.DialUDP("udp", nil, serverUDP.LocalAddr().(*net.UDPAddr))
+	assert.NilError(t, err)
+	serverUDP.Close()
+	serverUDP, err = net.DialUDP("udp", serverUDP.LocalAddr().(*net.UDPAddr), clientUDP.LocalAddr().(*net.UDPAddr))
+	assert.NilError(t, err)
+	clientConn := &lossyMsgConn{UDPConn: clientUDP, dropEvery: 7}
+	serverConn := &lossyMsgConn{UDPConn: serverUDP, dropEvery: 7}
+
+	config := &tubes.Config{Timeout: 5 * time.Second, Log: logrus.WithField("test", t.Name())}
+	clientMuxer := tubes.Client(clientConn, config)
+	serverMuxer := tubes.Server(serverConn, config)
+	defer func() {
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			clientMuxer.Stop()
+		}()
+		serverMuxer.Stop()
+		wg.Wait()
+	}()
+
+	// The server side of the session
+	var serverForward Forward
+	pfTubes := make(chan *tubes.Unreliable, 1)
+	go func() {
+		for {
+			tube, err := serverMuxer.Accept()
+			if err != nil {
+				return
+			}
+			switch tube.Type() {
+			case common.PFControlTube:
+				go StartPFServer(tube.(*tubes.Reliable), &serverForward, serverMuxer, nil)
+			case common.PFTube:
+				pfTubes <- tube.(*tubes.Unreliable)
+				go HandlePF(tube, &serverForward)
+			}
+		}
+	}()
+
+	forward, err := ParseForward(fmt.Sprintf("%d:%s", listenAddr.Port, echo.LocalAddr()), PfUDP)
+	assert.NilError(t, err)
+	assert.NilError(t, forward.EnableFEC(tubes.FECConfig{GroupSize: 4}))
+	StartPFClient(forward, clientMuxer, PfLocal)
+	serverTube := <-pfTubes
+
+	clientConn.lossy.Store(true)
+	serverConn.lossy.Store(true)
+
+	local, err := net.DialUDP("udp", nil, listenAddr)
+	assert.NilError(t, err)
+	defer local.Close()
+
+	const count = 40
+	for i := 0; i < count; i++ {
+		_, err := local.Write([]byte(fmt.Sprintf("datagram %d", i)))
+		assert.NilError(t, err)
+	}
+
+	received := make(map[string]bool)
+	buf := make([]byte, 1500)
+	for len(received) < count {
+		local.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, err := local.Read(buf)
+		if err != nil {
+			break
+		}
+		received[string(buf[:n])] = true
+	}
+	assert.Equal(t, len(received), count)
+
+	stats := serverTube.FECStats()
+	assert.Assert(t, stats.Recovered > 0)
+	assert.Assert(t, stats.ParitySent > 0)
+}
@@ -8,6 +8,7 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"sync"
 
 	"hop.computer/hop/common"
 	"hop.computer/hop/proxy"
@@ -29,6 +30,29 @@ type NetType byte
 type Forward struct {
 	listen  net.Addr
 	connect net.Addr
+	fec     tubes.FECConfig
+}
+
+// pfFECFlag is set in the forward type of a forward whose UDP tubes use
+// forward error correction. The FEC group size follows the address.
+const pfFECFlag = 0x80
+
+// EnableFEC protects the UDP traffic of f with forward error correction. Both
+// peers send a parity datagram after every config.GroupSize datagrams, which
+// lets the other side rebuild any one datagram of the group that was lost.
+func (f *Forward) EnableFEC(config tubes.FECConfig) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	f.fec = config
+	return nil
+}
+
+// IsUDP returns whether f forwards UDP traffic
+func (f *Forward) IsUDP() bool {
+	_, listenUDP := f.listen.(*net.UDPAddr)
+	_, connectUDP := f.connect.(*net.UDPAddr)
+	return listenUDP || connectUDP
 }
 
 const (
@@ -37,77 +61,108 @@ const (
 )
 
 // readPacket parse the addresses sent from the client and convert them to net.Addr objects
-func readPacket(r io.Reader) (net.Addr, byte, error) {
+func readPacket(r io.Reader) (net.Addr, byte, tubes.FECConfig, error) {
+	var fec tubes.FECConfig
 	b := make([]byte, 2)
 	_, err := io.ReadFull(r, b)
 	if err != nil {
-		return nil, 0, err
+		return nil, 0, fec, err
 	}
 
 	netType := NetType(b[0])
-	fwdType := b[1]
+	fwdType := b[1] &^ pfFECFlag
 
 	var addrLen uint16
 	err = binary.Read(r, binary.BigEndian, &addrLen)
 	if err != nil {
-		return nil, 0, err
+		return nil, 0, fec, err
 	}
 
 	addrBytes := make([]byte, addrLen)
 	_, err = io.ReadFull(r, addrBytes)
 	if err != nil {
-		return nil, 0, err
+		return nil, 0, fec, err
 	}
 
-	addrStr := string(addrBytes)
+	addr, err := ParseAddr(netType, string(addrBytes))
+	if err != nil {
+		return nil, 0, fec, err
+	}
 
-	var addr net.Addr
+	if b[1]&pfFECFlag != 0 {
+		var groupSize [1]byte
+		if _, err := io.ReadFull(r, groupSize[:]); err != nil {
+			return nil, 0, fec, err
+		}
+		fec.GroupSize = int(groupSize[0])
+		if err := fec.Validate(); err != nil {
+			return nil, 0, fec, err
+		}
+	}
+
+	return addr, fwdType, fec, nil
+}
+
+// ParseAddr converts an address sent by the client to a net.Addr
+func ParseAddr(netType NetType, addrStr string) (net.Addr, error) {
 	switch netType {
 	case PfTCP:
 		host, portStr, err := net.SplitHostPort(addrStr)
 		if err != nil {
-			return nil, 0, fmt.Errorf("invalid TCP address: %s", addrStr)
+			return nil, fmt.Errorf("invalid TCP address: %s", addrStr)
 		}
 		port, _ := strconv.Atoi(portStr)
-		addr = &net.TCPAddr{IP: net.ParseIP(host), Port: port}
+		return &net.TCPAddr{IP: net.ParseIP(host), Port: port}, nil
 
 	case PfUDP:
 		host, portStr, err := net.SplitHostPort(addrStr)
 		if err != nil {
-			return nil, 0, fmt.Errorf("invalid UDP address: %s", addrStr)
+			return nil, fmt.Errorf("invalid UDP address: %s", addrStr)
 		}
 		port, _ := strconv.Atoi(portStr)
-		addr = &net.UDPAddr{IP: net.ParseIP(host), Port: port}
+		return &net.UDPAddr{IP: net.ParseIP(host), Port: port}, nil
 
 	case PfUNIX:
-		addr = &net.UnixAddr{Name: addrStr, Net: "unix"}
+		return &net.UnixAddr{Name: addrStr, Net: "unix"}, nil
 
 	default:
-		return nil, 0, fmt.Errorf("unknown network type: %d", netType)
+		return nil, fmt.Errorf("unknown network type: %d", netType)
 	}
-
-	return addr, fwdType, nil
 }
 
-// toBytes writes the PF information to send them to the server
-func toBytes(f net.Addr, fwdType int) []byte {
-	var netType byte
-	var addrStr string
-
+// FormatAddr returns the network type and address string of f, as they are
+// sent to the server
+func FormatAddr(f net.Addr) (NetType, string, error) {
 	switch addr := f.(type) {
 	case *net.TCPAddr:
-		netType = byte(PfTCP)
-		addrStr = net.JoinHostPort(addr.IP.String(), strconv.Itoa(addr.Port))
+		return PfTCP, net.JoinHostPort(addr.IP.String(), strconv.Itoa(addr.Port)), nil
 
 	case *net.UDPAddr:
-		netType = byte(PfUDP)
-		addrStr = net.JoinHostPort(addr.IP.String(), strconv.Itoa(addr.Port))
+		return PfUDP, net.JoinHostPort(addr.IP.String(), strconv.Itoa(addr.Port)), nil
 
 	case *net.UnixAddr:
-		netType = byte(PfUNIX)
-		addrStr = addr.Name
+		return PfUNIX, addr.Name, nil
 
 	default:
+		return 0, "", fmt.Errorf("unknown address type: %T", f)
+	}
+}
+
+// ServerAddr returns the address the server acts on for a forward of pfType:
+// the address it connects to for local forwarding, or the address it listens
+// on for remote forwarding.
+func (f *Forward) ServerAddr(pfType int) net.Addr {
+	if pfType == PfRemote {
+		return f.listen
+	}
+	return f.connect
+}
+
+// toBytes writes the PF information to send them to the server. fec is only
+// sent if its GroupSize is set.
+func toBytes(f net.Addr, fwdType int, fec tubes.FECConfig) []byte {
+	netType, addrStr, err := FormatAddr(f)
+	if err != nil {
 		logrus.Error("Unknown address type")
 		return nil
 	}
@@ -115,19 +170,28 @@ func toBytes(f net.Addr, fwdType int) []byte {
 	addrLen := make([]byte, 2)
 	binary.BigEndian.PutUint16(addrLen, uint16(len(addrStr)))
 
+	if fec.GroupSize > 0 {
+		fwdType |= pfFECFlag
+	}
+
 	var res []byte
-	res = append(res, netType)
+	res = append(res, byte(netType))
 	res = append(res, byte(fwdType))
 	res = append(res, addrLen...)
 	res = append(res, []byte(addrStr)...)
+	if fec.GroupSize > 0 {
+		res = append(res, byte(fec.GroupSize))
+	}
 	return res
 }
 
 // StartPFServer handles the PFControlTube and starts the appropriate PF
 // based on the client's PF information sent through the common.PFControlTube.
-func StartPFServer(ch *tubes.Reliable, forward *Forward, muxer *tubes.Muxer) {
+// If authorize is not nil, the forward is refused unless authorize returns nil
+// for its address and type.
+func StartPFServer(ch *tubes.Reliable, forward *Forward, muxer *tubes.Muxer, authorize func(addr net.Addr, fwdType int) error) {
 
-	addr, fwdType, err := readPacket(ch)
+	addr, fwdType, fec, err := readPacket(ch)
 
 	if err != nil {
 		ch.Write([]byte{failure})
@@ -135,6 +199,15 @@ func StartPFServer(ch *tubes.Reliable, forward *Forward, muxer *tubes.Muxer) {
 		return
 	}
 
+	if authorize != nil {
+		if err := authorize(addr, int(fwdType)); err != nil {
+			logrus.Errorf("PF: refusing forward of %v: %v", addr, err)
+			ch.Write([]byte{failure})
+			ch.Close()
+			return
+		}
+	}
+
 	switch fwdType {
 	case PfLocal:
 		// This Dial is for creating a communication between the hop server(/client)
@@ -151,6 +224,7 @@ func StartPFServer(ch *tubes.Reliable, forward *Forward, muxer *tubes.Muxer) {
 		throwawayConn.Close()
 
 		forward.connect = addr
+		forward.fec = fec
 
 		ch.Write([]byte{success})
 
@@ -159,7 +233,7 @@ func StartPFServer(ch *tubes.Reliable, forward *Forward, muxer *tubes.Muxer) {
 
 		ch.Write([]byte{success})
 
-		setupListenerAndForward(muxer, addr)
+		setupListenerAndForward(muxer, addr, fec)
 	default:
 		logrus.Errorf("PF: closing porfforwarding session, bad fwdType %v", fwdType)
 		ch.Write([]byte{failure})
@@ -175,7 +249,8 @@ func StartPFServer(ch *tubes.Reliable, forward *Forward, muxer *tubes.Muxer) {
 // - For UDP connections, it ensures the use of an unreliable tube.
 //
 // The PFTube and established connections are automatically closed
-// within proxy.ReliableProxy or proxy.UnreliableProxy
+// within proxy.ReliableProxy or proxy.UnreliableProxy. Half-closes of TCP and
+// Unix socket connections are propagated through reliable tubes.
 func HandlePF(ch tubes.Tube, forward *Forward) {
 	addr := forward.connect
 
@@ -216,10 +291,16 @@ func HandlePF(ch tubes.Tube, forward *Forward) {
 				return
 			}
 
+			if !enableFEC(unreliableTube, forward.fec) {
+				conn.Close()
+				return
+			}
+
 			wg := proxy.UnreliableProxy(conn, unreliableTube)
 			go func() {
 				wg.Wait()
 				logrus.Infof("PF: Closing UDP connection")
+				logFECStats(unreliableTube, forward.fec)
 			}()
 		} else {
 			logrus.Error("PF: UDP connection are operated only over unreliable tubes")
@@ -241,8 +322,9 @@ func HandlePF(ch tubes.Tube, forward *Forward) {
 //   - Unix Sockets: Listen the configured Unix socket and forwards connections
 //     through a reliable proxy tube.
 //
-// This method is called by the client if PF is Local and the server if PF is remote
-func setupListenerAndForward(muxer *tubes.Muxer, addr net.Addr) {
+// This method is called by the client if PF is Local and the server if PF is
+// remote. fec applies to the UDP tube if its GroupSize is set.
+func setupListenerAndForward(muxer *tubes.Muxer, addr net.Addr, fec tubes.FECConfig) {
 	switch addr := addr.(type) {
 	case *net.UDPAddr:
 		listener, err := net.ListenUDP(addr.Network(), addr)
@@ -253,9 +335,18 @@ func setupListenerAndForward(muxer *tubes.Muxer, addr net.Addr) {
 		proxyTube, err := muxer.CreateUnreliableTube(common.PFTube)
 		if err != nil {
 			logrus.Errorf("PF: error creating proxy tube: %v", err)
+			listener.Close()
 			return
 		}
-		go proxy.UnreliableProxy(listener, proxyTube)
+		if !enableFEC(proxyTube, fec) {
+			listener.Close()
+			return
+		}
+		wg := proxy.UnreliableProxy(&udpListener{UDPConn: listener}, proxyTube)
+		go func() {
+			wg.Wait()
+			logFECStats(proxyTube, fec)
+		}()
 
 	case *net.TCPAddr:
 		listener, err := net.ListenTCP(addr.Network(), addr)
@@ -338,7 +429,7 @@ func StartPFClient(forward *Forward, muxer *tubes.Muxer, pfType int) {
 		addr = forward.listen
 	}
 
-	byteAddr := toBytes(addr, pfType)
+	byteAddr := toBytes(addr, pfType, forward.fec)
 	_, err = pfControlTube.Write(byteAddr)
 	if err != nil {
 		logrus.Errorf("PF: Can't write in the PF control tube. %v", err)
@@ -355,7 +446,7 @@ func StartPFClient(forward *Forward, muxer *tubes.Muxer, pfType int) {
 	}
 
 	if pfType == PfLocal {
-		setupListenerAndForward(muxer, forward.listen)
+		setupListenerAndForward(muxer, forward.listen, forward.fec)
 
 	} else if pfType == PfRemote {
 		throwawayConn, err := net.Dial(forward.listen.Network(), forward.listen.String())
@@ -370,6 +461,63 @@ func StartPFClient(forward *Forward, muxer *tubes.Muxer, pfType int) {
 	}
 }
 
+// udpListener sends the datagrams written to it to the last address it received
+// a datagram from, so that replies coming back through a UDP forward reach the
+// local application
+type udpListener struct {
+	*net.UDPConn
+
+	m    sync.Mutex
+	peer *net.UDPAddr
+}
+
+// ReadMsgUDP implements transport.UDPLike and remembers the sender
+func (l *udpListener) ReadMsgUDP(b, oob []byte) (n, oobn, flags int, addr *net.UDPAddr, err error) {
+	n, oobn, flags, addr, err = l.UDPConn.ReadMsgUDP(b, oob)
+	if err == nil {
+		l.m.Lock()
+		l.peer = addr
+		l.m.Unlock()
+	}
+	return
+}
+
+// WriteMsgUDP implements transport.UDPLike. addr is ignored in favor of the
+// last sender. Datagrams written before anything was received are dropped.
+func (l *udpListener) WriteMsgUDP(b, oob []byte, _ *net.UDPAddr) (n, oobn int, err error) {
+	l.m.Lock()
+	peer := l.peer
+	l.m.Unlock()
+	if peer == nil {
+		return len(b), len(oob), nil
+	}
+	return l.UDPConn.WriteMsgUDP(b, oob, peer)
+}
+
+// enableFEC turns on fec for u if its GroupSize is set. On failure, u is
+// closed and false is returned.
+func enableFEC(u *tubes.Unreliable, fec tubes.FECConfig) bool {
+	if fec.GroupSize == 0 {
+		return true
+	}
+	if err := u.EnableFEC(fec); err != nil {
+		logrus.Errorf("PF: can't enable FEC: %v", err)
+		u.Close()
+		return false
+	}
+	return true
+}
+
+// logFECStats logs how much loss FEC recovered on u once it is closed
+func logFECStats(u *tubes.Unreliable, fec tubes.FECConfig) {
+	if fec.GroupSize == 0 {
+		return
+	}
+	stats := u.FECStats()
+	logrus.Infof("PF: FEC sent %d parity datagrams, received %d, recovered %d lost datagrams, %d unrecoverable",
+		stats.ParitySent, stats.ParityReceived, stats.Recovered, stats.Unrecovered)
+}
+
 // ErrInvalidPFArgs is returned when there is a problem parsing argument
 var ErrInvalidPFArgs = errors.New("PF: Error parsing argument")
 
@@ -4,25 +4,47 @@ import (
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 
 	"github.com/sirupsen/logrus"
 )
 
-func reliableProxyOneSide(a net.Conn, b net.Conn, wg *sync.WaitGroup) {
+// closeWriter is implemented by connections that support half-close, such as
+// *net.TCPConn, *net.UnixConn, and *tubes.Reliable.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+func reliableProxyOneSide(a net.Conn, b net.Conn, wg *sync.WaitGroup, running *atomic.Int32) {
 	defer wg.Done()
 	w, err := io.Copy(a, b)
+	last := running.Add(-1) == 0
+
+	// When b closes its writing side cleanly, pass the half-close on to a so
+	// that the other direction can keep going. Otherwise, or once both
+	// directions are done, close both connections.
+	if cw, ok := a.(closeWriter); ok && err == nil && !last {
+		if cwErr := cw.CloseWrite(); cwErr == nil {
+			logrus.Infof("reliable proxy: wrote %v bytes from %v to %v. Closed writing to %v", w, b.LocalAddr().String(), a.LocalAddr().String(), a.LocalAddr().String())
+			return
+		}
+	}
 	a.Close()
 	b.Close()
 	logrus.Infof("reliable proxy: wrote %v bytes from %v to %v. Ended with err: %v", w, b.LocalAddr().String(), a.LocalAddr().String(), err)
 }
 
 // ReliableProxy starts proxying two reliable connections. Will stop on
-// error.
+// error. If one connection closes its writing side and the other supports
+// CloseWrite, the half-close is propagated and the opposite direction keeps
+// running until it finishes too.
 func ReliableProxy(a net.Conn, b net.Conn) *sync.WaitGroup {
 	logrus.Infof("reliable proxy: starting proxy between %v and %v.", a.LocalAddr().String(), b.LocalAddr().String())
 	wg := &sync.WaitGroup{}
 	wg.Add(2)
-	go reliableProxyOneSide(a, b, wg)
-	go reliableProxyOneSide(b, a, wg)
+	running := &atomic.Int32{}
+	running.Store(2)
+	go reliableProxyOneSide(a, b, wg, running)
+	go reliableProxyOneSide(b, a, wg, running)
 	return wg
 }
@@ -110,3 +110,60 @@ func TestReliableOneClose(t *testing.T) {
 		<-c
 	}
 }
+
+// tcpPair returns both ends of a loopback TCP connection
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NilError(t, err)
+	defer l.Close()
+
+	accepted := make(chan *net.TCPConn)
+	go func() {
+		c, err := l.AcceptTCP()
+		assert.Check(t, err)
+		accepted <- c
+	}()
+	dialed, err := net.DialTCP("tcp", nil, l.Addr().(*net.TCPAddr))
+	assert.NilError(t, err)
+	return dialed, <-accepted
+}
+
+func TestReliableHalfClose(t *testing.T) {
+	clientA, serverA := tcpPair(t)
+	clientB, serverB := tcpPair(t)
+
+	request := "request"
+	response := "response"
+
+	// proxy clientA <--> clientB
+	wg := ReliableProxy(serverA, serverB)
+
+	// clientA sends a request and shuts down writing, like rsync or git do
+	_, err := clientA.Write([]byte(request))
+	assert.NilError(t, err)
+	assert.NilError(t, clientA.CloseWrite())
+
+	// clientB sees the whole request followed by EOF, and still responds
+	got, err := io.ReadAll(clientB)
+	assert.NilError(t, err)
+	assert.Equal(t, string(got), request)
+	_, err = clientB.Write([]byte(response))
+	assert.NilError(t, err)
+	assert.NilError(t, clientB.Close())
+
+	got, err = io.ReadAll(clientA)
+	assert.NilError(t, err)
+	assert.Equal(t, string(got), response)
+	assert.NilError(t, clientA.Close())
+
+	c := make(chan struct{})
+	go func() {
+		defer close(c)
+		wg.Wait()
+	}()
+	select {
+	case <-c:
+	case <-time.After(time.Second * 3):
+		t.Fatal("Timed out waiting for wait group")
+	}
+}
@@ -0,0 +1,76 @@
+package transport
+
+import (
+	"net"
+
+	"github.com/sirupsen/logrus"
+)
+
+// packetBatchSize is the largest number of datagrams read or written by a
+// single batched system call.
+const packetBatchSize = 32
+
+// datagram is a single packet read from or written to a batchConn.
+type datagram struct {
+	b    []byte
+	addr *net.UDPAddr
+}
+
+// batchConn reads and writes several datagrams at a time. On Linux, a
+// *net.UDPConn uses recvmmsg and sendmmsg, along with UDP GRO and GSO when the
+// kernel supports them. Any other UDPLike falls back to one datagram per call.
+type batchConn interface {
+	// readBatch blocks until at least one datagram is available. The returned
+	// datagrams are only valid until the next call to readBatch, which must not
+	// be called concurrently.
+	readBatch() ([]datagram, error)
+
+	// writeBatch writes each datagram in order. It is safe for concurrent use.
+	writeBatch(pkts []datagram) error
+}
+
+// newBatchConn returns a batchConn for conn. When gro is true, the socket may
+// be configured to coalesce received datagrams, so every read from conn must
+// then go through the returned batchConn.
+func newBatchConn(conn UDPLike, gro bool) batchConn {
+	if udpConn, ok := conn.(*net.UDPConn); ok {
+		bc, err := newMmsgConn(udpConn, gro)
+		if err == nil {
+			return bc
+		}
+		logrus.Debugf("transport: batched I/O unavailable, using single datagrams: %s", err)
+	}
+	return &singleConn{conn: conn}
+}
+
+// singleConn is the portable batchConn, which reads and writes one datagram
+// per system call.
+type singleConn struct {
+	conn UDPLike
+
+	buf []byte
+	out [1]datagram
+}
+
+var _ batchConn = &singleConn{}
+
+func (c *singleConn) readBatch() ([]datagram, error) {
+	if c.buf == nil {
+		c.buf = make([]byte, 65535)
+	}
+	n, _, _, addr, err := c.conn.ReadMsgUDP(c.buf, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.out[0] = datagram{b: c.buf[:n], addr: addr}
+	return c.out[:], nil
+}
+
+func (c *singleConn) writeBatch(pkts []datagram) error {
+	for _, pkt := range pkts {
+		if _, _, err := c.conn.WriteMsgUDP(pkt.b, nil, pkt.addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
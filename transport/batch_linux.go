@@ -0,0 +1,402 @@
+//go:build linux
+
+package transport
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// mmsghdr matches struct mmsghdr from <sys/socket.h>. Go pads the struct to
+// the alignment of unix.Msghdr, as C does.
+type mmsghdr struct {
+	hdr unix.Msghdr
+	n   uint32
+}
+
+const (
+	// The kernel accepts at most this many segments in one GSO send
+	udpMaxSegments = 64
+
+	// The largest UDP payload of a GSO send, which must fit in one IP packet
+	gsoMaxBytes = 65535 - 8 - 40
+
+	// The length of a receive buffer when GRO is enabled, which can hold a
+	// full coalesced packet
+	groBufferLen = 65535
+)
+
+var (
+	groCmsgSpace = unix.CmsgSpace(4)
+	gsoCmsgSpace = unix.CmsgSpace(2)
+)
+
+// mmsgConn implements batchConn on Linux with recvmmsg and sendmmsg. With GRO,
+// the kernel may coalesce consecutive datagrams of the same size from one
+// sender into a single read, which is split back apart here. With GSO, runs
+// of equally sized datagrams to the same destination are written as a single
+// segmented send.
+type mmsgConn struct {
+	rc syscall.RawConn
+
+	// family is the address family of the socket, AF_INET or AF_INET6
+	family int
+	gro    bool
+	gso    atomic.Bool
+
+	// Read state, allocated by the first readBatch
+	rmsgs  []mmsghdr
+	riovs  []unix.Iovec
+	rnames []unix.RawSockaddrInet6
+	roob   []byte
+	rbufs  [][]byte
+	out    []datagram
+
+	wm sync.Mutex
+
+	// +checklocks:wm
+	wmsgs []mmsghdr
+	// +checklocks:wm
+	wiovs []unix.Iovec
+	// +checklocks:wm
+	wnames []unix.RawSockaddrInet6
+	// +checklocks:wm
+	woob []byte
+	// +checklocks:wm
+	wcounts []int
+}
+
+var _ batchConn = &mmsgConn{}
+
+func newMmsgConn(conn *net.UDPConn, gro bool) (batchConn, error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	c := &mmsgConn{rc: rc}
+	var sockErr error
+	err = rc.Control(func(fd uintptr) {
+		c.family, sockErr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_DOMAIN)
+		if sockErr != nil {
+			return
+		}
+		if gro {
+			c.gro = unix.SetsockoptInt(int(fd), unix.IPPROTO_UDP, unix.UDP_GRO, 1) == nil
+		}
+		_, gsoErr := unix.GetsockoptInt(int(fd), unix.IPPROTO_UDP, unix.UDP_SEGMENT)
+		c.gso.Store(gsoErr == nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sockErr != nil {
+		return nil, sockErr
+	}
+	if c.family != unix.AF_INET && c.family != unix.AF_INET6 {
+		return nil, errors.New("unsupported address family")
+	}
+
+	c.wmsgs = make([]mmsghdr, packetBatchSize)
+	c.wiovs = make([]unix.Iovec, 2*udpMaxSegments)
+	c.wnames = make([]unix.RawSockaddrInet6, packetBatchSize)
+	c.woob = make([]byte, packetBatchSize*gsoCmsgSpace)
+	c.wcounts = make([]int, packetBatchSize)
+	return c, nil
+}
+
+func (c *mmsgConn) initRead() {
+	c.rmsgs = make([]mmsghdr, packetBatchSize)
+	c.riovs = make([]unix.Iovec, packetBatchSize)
+	c.rnames = make([]unix.RawSockaddrInet6, packetBatchSize)
+	c.rbufs = make([][]byte, packetBatchSize)
+	if c.gro {
+		c.roob = make([]byte, packetBatchSize*groCmsgSpace)
+	}
+	for i := range c.rmsgs {
+		c.rbufs[i] = make([]byte, groBufferLen)
+		c.riovs[i].Base = &c.rbufs[i][0]
+		c.riovs[i].SetLen(len(c.rbufs[i]))
+		h := &c.rmsgs[i].hdr
+		h.Name = (*byte)(unsafe.Pointer(&c.rnames[i]))
+		h.Iov = &c.riovs[i]
+		h.SetIovlen(1)
+		if c.gro {
+			h.Control = &c.roob[i*groCmsgSpace]
+		}
+	}
+}
+
+func (c *mmsgConn) readBatch() ([]datagram, error) {
+	if c.rmsgs == nil {
+		c.initRead()
+	}
+	// The kernel overwrites the name and control lengths
+	for i := range c.rmsgs {
+		h := &c.rmsgs[i].hdr
+		h.Namelen = unix.SizeofSockaddrInet6
+		if c.gro {
+			h.SetControllen(groCmsgSpace)
+		}
+		h.Flags = 0
+	}
+
+	var n int
+	var errno syscall.Errno
+	err := c.rc.Read(func(fd uintptr) bool {
+		var r uintptr
+		for {
+			r, _, errno = unix.Syscall6(unix.SYS_RECVMMSG, fd, uintptr(unsafe.Pointer(&c.rmsgs[0])), uintptr(len(c.rmsgs)), 0, 0, 0)
+			if errno != unix.EINTR {
+				break
+			}
+		}
+		if errno == unix.EAGAIN {
+			return false
+		}
+		n = int(r)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if errno != 0 {
+		return nil, os.NewSyscallError("recvmmsg", errno)
+	}
+
+	c.out = c.out[:0]
+	for i := 0; i < n; i++ {
+		m := &c.rmsgs[i]
+		addr := sockaddrToUDPAddr(&c.rnames[i])
+		b := c.rbufs[i][:m.n]
+		segment := len(b)
+		if c.gro {
+			oob := c.roob[i*groCmsgSpace : i*groCmsgSpace+int(m.hdr.Controllen)]
+			if size := groSegmentSize(oob); size > 0 {
+				segment = size
+			}
+		}
+		for len(b) > segment {
+			c.out = append(c.out, datagram{b: b[:segment], addr: addr})
+			b = b[segment:]
+		}
+		c.out = append(c.out, datagram{b: b, addr: addr})
+	}
+	return c.out, nil
+}
+
+// groSegmentSize returns the segment size of a coalesced read from its control
+// messages, or 0 if the read was not coalesced.
+func groSegmentSize(oob []byte) int {
+	for len(oob) >= unix.SizeofCmsghdr {
+		h := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+		length := int(h.Len)
+		if length < unix.CmsgLen(0) || length > len(oob) {
+			return 0
+		}
+		if h.Level == unix.IPPROTO_UDP && h.Type == unix.UDP_GRO && length >= unix.CmsgLen(4) {
+			return int(binary.NativeEndian.Uint32(oob[unix.CmsgLen(0):]))
+		}
+		next := unix.CmsgSpace(length - unix.CmsgLen(0))
+		if next > len(oob) {
+			return 0
+		}
+		oob = oob[next:]
+	}
+	return 0
+}
+
+func (c *mmsgConn) writeBatch(pkts []datagram) error {
+	c.wm.Lock()
+	defer c.wm.Unlock()
+
+	for len(pkts) > 0 {
+		gso := c.gso.Load()
+		n, err := c.writeSomeLocked(pkts, gso)
+		if err != nil && gso && (errors.Is(err, unix.EIO) || errors.Is(err, unix.EINVAL)) {
+			// The device or kernel rejected the segmented send
+			logrus.Debugf("transport: disabling UDP GSO: %s", err)
+			c.gso.Store(false)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		pkts = pkts[n:]
+	}
+	return nil
+}
+
+// writeSomeLocked writes at least one datagram from the start of pkts and
+// returns how many were written.
+//
+// +checklocks:c.wm
+func (c *mmsgConn) writeSomeLocked(pkts []datagram, gso bool) (int, error) {
+	msgs := 0
+	iovs := 0
+	for i := 0; i < len(pkts) && msgs < len(c.wmsgs) && iovs < len(c.wiovs); {
+		// Group a run of datagrams to the same destination. Every segment but the
+		// last must have the same size.
+		first := pkts[i]
+		count := 1
+		total := len(first.b)
+		if gso && len(first.b) > 0 {
+			for j := i + 1; j < len(pkts) && count < udpMaxSegments && iovs+count < len(c.wiovs); j++ {
+				next := pkts[j]
+				if len(next.b) == 0 || len(next.b) > len(first.b) || total+len(next.b) > gsoMaxBytes || !EqualUDPAddress(next.addr, first.addr) {
+					break
+				}
+				count++
+				total += len(next.b)
+				if len(next.b) < len(first.b) {
+					break
+				}
+			}
+		}
+
+		nameLen, err := c.putSockaddr(&c.wnames[msgs], first.addr)
+		if err != nil {
+			if msgs > 0 {
+				// Write what came before, and fail on the next call
+				break
+			}
+			return 0, err
+		}
+
+		m := &c.wmsgs[msgs]
+		m.hdr = unix.Msghdr{
+			Name:    (*byte)(unsafe.Pointer(&c.wnames[msgs])),
+			Namelen: nameLen,
+			Iov:     &c.wiovs[iovs],
+		}
+		m.hdr.SetIovlen(count)
+		for k := 0; k < count; k++ {
+			b := pkts[i+k].b
+			iov := &c.wiovs[iovs+k]
+			iov.Base = nil
+			if len(b) > 0 {
+				iov.Base = &b[0]
+			}
+			iov.SetLen(len(b))
+		}
+		if count > 1 {
+			oob := c.woob[msgs*gsoCmsgSpace : (msgs+1)*gsoCmsgSpace]
+			h := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+			h.Level = unix.IPPROTO_UDP
+			h.Type = unix.UDP_SEGMENT
+			h.SetLen(unix.CmsgLen(2))
+			binary.NativeEndian.PutUint16(oob[unix.CmsgLen(0):], uint16(len(first.b)))
+			m.hdr.Control = &oob[0]
+			m.hdr.SetControllen(gsoCmsgSpace)
+		}
+
+		c.wcounts[msgs] = count
+		msgs++
+		iovs += count
+		i += count
+	}
+
+	var sent int
+	var errno syscall.Errno
+	err := c.rc.Write(func(fd uintptr) bool {
+		var r uintptr
+		for {
+			r, _, errno = unix.Syscall6(unix.SYS_SENDMMSG, fd, uintptr(unsafe.Pointer(&c.wmsgs[0])), uintptr(msgs), 0, 0, 0)
+			if errno != unix.EINTR {
+				break
+			}
+		}
+		if errno == unix.EAGAIN {
+			return false
+		}
+		sent = int(r)
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	if errno != 0 {
+		return 0, os.NewSyscallError("sendmmsg", errno)
+	}
+
+	written := 0
+	for _, count := range c.wcounts[:sent] {
+		written += count
+	}
+	return written, nil
+}
+
+// putSockaddr encodes addr for the socket's address family and returns its
+// length.
+func (c *mmsgConn) putSockaddr(sa *unix.RawSockaddrInet6, addr *net.UDPAddr) (uint32, error) {
+	if addr == nil {
+		return 0, errors.New("missing destination address")
+	}
+	port := (*[2]byte)(unsafe.Pointer(&sa.Port))
+	if c.family == unix.AF_INET {
+		ip := addr.IP.To4()
+		if ip == nil {
+			return 0, &net.AddrError{Err: "non-IPv4 address", Addr: addr.String()}
+		}
+		sa4 := (*unix.RawSockaddrInet4)(unsafe.Pointer(sa))
+		*sa4 = unix.RawSockaddrInet4{Family: unix.AF_INET}
+		port = (*[2]byte)(unsafe.Pointer(&sa4.Port))
+		binary.BigEndian.PutUint16(port[:], uint16(addr.Port))
+		copy(sa4.Addr[:], ip)
+		return unix.SizeofSockaddrInet4, nil
+	}
+	ip := addr.IP.To16()
+	if ip == nil {
+		return 0, &net.AddrError{Err: "invalid IP address", Addr: addr.String()}
+	}
+	*sa = unix.RawSockaddrInet6{Family: unix.AF_INET6}
+	binary.BigEndian.PutUint16(port[:], uint16(addr.Port))
+	copy(sa.Addr[:], ip)
+	if addr.Zone != "" {
+		sa.Scope_id = zoneToScopeID(addr.Zone)
+	}
+	return unix.SizeofSockaddrInet6, nil
+}
+
+// sockaddrToUDPAddr decodes a socket address filled in by the kernel
+func sockaddrToUDPAddr(sa *unix.RawSockaddrInet6) *net.UDPAddr {
+	switch sa.Family {
+	case unix.AF_INET:
+		sa4 := (*unix.RawSockaddrInet4)(unsafe.Pointer(sa))
+		port := (*[2]byte)(unsafe.Pointer(&sa4.Port))
+		ip := make(net.IP, net.IPv4len)
+		copy(ip, sa4.Addr[:])
+		return &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(port[:]))}
+	case unix.AF_INET6:
+		port := (*[2]byte)(unsafe.Pointer(&sa.Port))
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, sa.Addr[:])
+		addr := &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(port[:]))}
+		if sa.Scope_id != 0 {
+			addr.Zone = strconv.FormatUint(uint64(sa.Scope_id), 10)
+		}
+		return addr
+	}
+	return nil
+}
+
+// zoneToScopeID converts an IPv6 zone, either an interface name or index, to
+// a scope ID.
+func zoneToScopeID(zone string) uint32 {
+	if id, err := strconv.ParseUint(zone, 10, 32); err == nil {
+		return uint32(id)
+	}
+	if ifi, err := net.InterfaceByName(zone); err == nil {
+		return uint32(ifi.Index)
+	}
+	return 0
+}
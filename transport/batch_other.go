@@ -0,0 +1,14 @@
+//go:build !linux
+
+package transport
+
+import (
+	"errors"
+	"net"
+)
+
+// newMmsgConn always fails on this platform, so newBatchConn falls back to
+// single datagrams.
+func newMmsgConn(conn *net.UDPConn, gro bool) (batchConn, error) {
+	return nil, errors.New("recvmmsg and sendmmsg are only supported on linux")
+}
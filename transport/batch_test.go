@@ -0,0 +1,135 @@
+package transport
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func newBatchTestConns(t *testing.T) (*net.UDPConn, *net.UDPConn) {
+	a, err := net.ListenPacket("udp", "localhost:0")
+	assert.NilError(t, err)
+	b, err := net.ListenPacket("udp", "localhost:0")
+	assert.NilError(t, err)
+	b.(*net.UDPConn).SetReadBuffer(1 << 20)
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return a.(*net.UDPConn), b.(*net.UDPConn)
+}
+
+// batchTestPackets returns runs of equally sized packets, which can be sent
+// with GSO, broken up by packets of other sizes
+func batchTestPackets(dst *net.UDPAddr) []datagram {
+	var pkts []datagram
+	for i := 0; i < 100; i++ {
+		size := 1000
+		switch {
+		case i%20 == 19:
+			size = 10
+		case i%50 == 49:
+			size = 1500
+		}
+		b := bytes.Repeat([]byte{byte(i)}, size)
+		copy(b, fmt.Sprintf("%d", i))
+		pkts = append(pkts, datagram{b: b, addr: dst})
+	}
+	return pkts
+}
+
+func testBatchRoundTrip(t *testing.T, writer, reader batchConn, readConn *net.UDPConn, dst *net.UDPAddr) {
+	pkts := batchTestPackets(dst)
+
+	// Read concurrently so that the socket buffer does not overflow
+	readConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	done := make(chan error)
+	var got [][]byte
+	go func() {
+		for len(got) < len(pkts) {
+			batch, err := reader.readBatch()
+			if err != nil {
+				done <- err
+				return
+			}
+			for _, pkt := range batch {
+				got = append(got, append([]byte(nil), pkt.b...))
+			}
+		}
+		done <- nil
+	}()
+	for i := 0; i < len(pkts); i += 10 {
+		assert.NilError(t, writer.writeBatch(pkts[i:i+10]))
+		// Give the reader a chance to keep up
+		time.Sleep(time.Millisecond)
+	}
+	assert.NilError(t, <-done)
+	for i := range pkts {
+		assert.Assert(t, bytes.Equal(got[i], pkts[i].b), "packet %d differs", i)
+	}
+}
+
+func TestBatchConn(t *testing.T) {
+	w, r := newBatchTestConns(t)
+	dst := r.LocalAddr().(*net.UDPAddr)
+	testBatchRoundTrip(t, newBatchConn(w, false), newBatchConn(r, true), r, dst)
+}
+
+func TestBatchConnFallback(t *testing.T) {
+	w, r := newBatchTestConns(t)
+	dst := r.LocalAddr().(*net.UDPAddr)
+	testBatchRoundTrip(t, &singleConn{conn: w}, &singleConn{conn: r}, r, dst)
+
+	// The batched path interoperates with plain reads and writes
+	w, r = newBatchTestConns(t)
+	dst = r.LocalAddr().(*net.UDPAddr)
+	testBatchRoundTrip(t, newBatchConn(w, false), &singleConn{conn: r}, r, dst)
+}
+
+func TestHandleWriteMsgs(t *testing.T) {
+	c, s := newClientAndServerForBench(t)
+	defer s.Close()
+	defer c.Close()
+	h, err := s.AcceptTimeout(time.Second)
+	assert.NilError(t, err)
+
+	msgs := make([][]byte, 50)
+	for i := range msgs {
+		msgs[i] = []byte(fmt.Sprintf("message %d", i))
+	}
+	assert.NilError(t, h.WriteMsgs(msgs))
+
+	buf := make([]byte, 1024)
+	for _, msg := range msgs {
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := c.ReadMsg(buf)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, buf[:n], msg)
+	}
+
+	assert.Equal(t, h.WriteMsgs([][]byte{make([]byte, MaxPlaintextSize+1)}), ErrBufOverflow)
+
+	// Clients write batches too
+	assert.NilError(t, c.WriteMsgs(msgs))
+	for _, msg := range msgs {
+		h.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := h.ReadMsg(buf)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, buf[:n], msg)
+	}
+}
+
+func TestBufferPool(t *testing.T) {
+	for _, n := range []int{0, 100, 2048, 2049, MaxTotalPacketSize} {
+		b := getBuffer(n)
+		assert.Equal(t, len(b), n)
+		putBuffer(b)
+	}
+	b := getBuffer(MaxTotalPacketSize + 1)
+	assert.Equal(t, len(b), MaxTotalPacketSize+1)
+	putBuffer(b)
+}
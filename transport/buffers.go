@@ -0,0 +1,47 @@
+package transport
+
+import (
+	"sync"
+)
+
+// Decrypted packets wait in a Handle's receive queue until they are read, which
+// holds up to thousands of packets per session. Pooled buffers are therefore
+// grouped into size classes, so that a queue full of small packets does not
+// pin a MaxTotalPacketSize buffer for each of them.
+var bufferClasses = [...]int{2048, 16384, MaxTotalPacketSize}
+
+var bufferPools [len(bufferClasses)]sync.Pool
+
+func init() {
+	for i := range bufferPools {
+		size := bufferClasses[i]
+		bufferPools[i].New = func() any {
+			b := make([]byte, size)
+			return &b
+		}
+	}
+}
+
+// getBuffer returns a buffer of length n. Buffers larger than the largest
+// size class are allocated and never pooled.
+func getBuffer(n int) []byte {
+	for i, size := range bufferClasses {
+		if n <= size {
+			b := bufferPools[i].Get().(*[]byte)
+			return (*b)[:n]
+		}
+	}
+	return make([]byte, n)
+}
+
+// putBuffer returns a buffer from getBuffer to its pool. The caller must not
+// use b afterwards. Buffers that did not come from getBuffer are ignored.
+func putBuffer(b []byte) {
+	for i, size := range bufferClasses {
+		if cap(b) == size {
+			b = b[:size]
+			bufferPools[i].Put(&b)
+			return
+		}
+	}
+}
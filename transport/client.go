@@ -198,6 +198,8 @@ func (c *Client) clientHandshakeLocked() error {
 	c.ss.readKey = &c.ss.serverToClientKey
 	c.ss.writeKey = &c.ss.clientToServerKey
 
+	pathMTU := c.hs.pathMTU && !c.config.DisablePathMTUDiscovery
+
 	// Ensuring that the HandshakeState isn't inadvertently reused
 	c.hs = nil
 	c.dialAddr = nil
@@ -212,12 +214,18 @@ func (c *Client) clientHandshakeLocked() error {
 	// we should have a DialContext.
 	c.underlyingConn.SetReadDeadline(time.Time{})
 	c.ss.handle = newHandleForSession(c.underlyingConn, c.ss, c.config.Leaf, c.config.maxBufferedPackets())
+	// The client's own read loop reads from the socket, so GRO stays off
+	c.ss.batch = newBatchConn(c.underlyingConn, false)
 	c.wg.Add(1)
 	if !c.state.CompareAndSwap(clientStateHandshaking, clientStateOpen) {
 		c.wg.Done()
 		return io.EOF
 	}
 	go c.listen()
+	if pathMTU {
+		c.ss.handle.enablePathMTUDiscovery()
+		c.ss.handle.startPathMTUDiscovery()
+	}
 
 	return nil
 }
@@ -453,6 +461,15 @@ func (c *Client) listen() {
 			if c.state.Load() != clientStateOpen {
 				continue
 			}
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				// A stream carrier was closed by the server. No more packets
+				// will arrive, so close the session.
+				logrus.Errorf("client: connection to server closed: %s", err)
+				c.ss.m.Lock()
+				c.ss.closeLocked()
+				c.ss.m.Unlock()
+				return
+			}
 			logrus.Errorf("client: error reading packet %s", err)
 			continue
 		}
@@ -478,10 +495,12 @@ func (c *Client) handleSessionMessage(addr *net.UDPAddr, msg []byte) error {
 		return nil
 	}
 
-	// TODO(dadrian): Can we avoid this allocation?
-	plaintext := make([]byte, PlaintextLen(len(msg)))
+	// Transport messages are returned to the pool once they have been read from
+	// the Handle. Control messages are handled before returning.
+	plaintext := getBuffer(max(PlaintextLen(len(msg)), 0))
 	_, mt, err := c.ss.readPacketLocked(plaintext, msg, c.ss.readKey)
 	if err != nil {
+		putBuffer(plaintext)
 		return err
 	}
 	if common.Debug {
@@ -495,18 +514,25 @@ func (c *Client) handleSessionMessage(addr *net.UDPAddr, msg []byte) error {
 			break
 		default:
 			logrus.Warnf("session %x: recv queue full, dropping packet", sessionID)
+			putBuffer(plaintext)
 		}
 	case MessageTypeControl:
-		if err := c.ss.handleControlLocked(plaintext); err != nil {
+		err := c.ss.handleControlLocked(plaintext)
+		putBuffer(plaintext)
+		if err != nil {
 			return err
 		}
 	default:
 		// Close the connection on an unknown message type
+		putBuffer(plaintext)
 		c.ss.closeLocked()
 		return ErrInvalidMessage
 	}
 
 	if !EqualUDPAddress(c.ss.remoteAddr, addr) {
+		if c.ss.remoteAddr != nil && addr != nil && c.ss.handle.pmtu != nil {
+			c.ss.handle.pmtu.migrate()
+		}
 		c.ss.remoteAddr = addr
 	}
 	return nil
@@ -530,6 +556,24 @@ func (c *Client) WriteMsg(b []byte) error {
 	return c.ss.handle.WriteMsg(b)
 }
 
+// WriteMsgs implements BatchMsgWriter. Like WriteMsg, a successful return means
+// the underlying transport accepted every message.
+func (c *Client) WriteMsgs(msgs [][]byte) error {
+	if err := c.Handshake(); err != nil {
+		return err
+	}
+	return c.ss.handle.WriteMsgs(msgs)
+}
+
+// MaxPayload implements MsgConn. Before the handshake completes, it returns the
+// payload of a BasePacketSize packet.
+func (c *Client) MaxPayload() int {
+	if c.state.Load() != clientStateOpen {
+		return BasePacketSize - SessionOverhead - packetExpansion(c.underlyingConn)
+	}
+	return c.ss.handle.MaxPayload()
+}
+
 // ReadMsg reads a single message. If b is too short to hold the message, it is
 // buffered and ErrBufOverflow is returned.
 func (c *Client) ReadMsg(b []byte) (n int, err error) {
@@ -646,6 +690,9 @@ closing:
 // NewClient returns a Client configured as specified, using the underlying UDP
 // connection. The Client has not yet completed a handshake.
 func NewClient(conn UDPLike, server *net.UDPAddr, config ClientConfig) *Client {
+	if config.Obfuscation != nil {
+		conn = NewObfuscatedConn(conn, *config.Obfuscation)
+	}
 	c := &Client{
 		underlyingConn: conn,
 		dialAddr:       server,
@@ -122,8 +122,23 @@ type ControlMessage byte
 // ControlMessage constants for each control message
 const (
 	ControlMessageClose ControlMessage = 0x01
+
+	// ControlMessagePMTUProbe is a padded path MTU discovery probe. It is
+	// followed by the two-byte size of the whole probe packet.
+	ControlMessagePMTUProbe ControlMessage = 0x02
+
+	// ControlMessagePMTUAck acknowledges a ControlMessagePMTUProbe. It is
+	// followed by the two-byte size of the acknowledged probe packet.
+	ControlMessagePMTUAck ControlMessage = 0x03
 )
 
+// serverFlagPathMTU is set in the second header byte of a Server Auth or Server
+// Response Hidden when the server supports path MTU discovery. Clients only
+// probe servers that set it, and servers only probe clients that have sent a
+// probe of their own, so neither side probes a peer that has disabled path MTU
+// discovery.
+const serverFlagPathMTU byte = 0x01
+
 // states that a Handle or Client can be in. Most of them are needed to handle closing
 // most of these names are taken from the RFC 793 (TCP) for familiarity
 type connState uint32
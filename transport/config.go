@@ -1,6 +1,7 @@
 package transport
 
 import (
+	"net/url"
 	"time"
 
 	"hop.computer/hop/authkeys"
@@ -59,6 +60,20 @@ type ClientConfig struct {
 
 	// ServerKEMKey is the ML-KEM public static key used in the hidden mode handshake
 	ServerKEMKey *keys.KEMPublicKey
+
+	// DisablePathMTUDiscovery turns off probing for the largest packet size
+	// supported by the path to the server.
+	DisablePathMTUDiscovery bool
+
+	// Obfuscation, if set, disguises the client's datagrams. The server must
+	// use the same obfuscation key.
+	Obfuscation *ObfuscationConfig
+
+	// Proxy, if set, is the proxy the client reaches the server through. A
+	// socks5 proxy relays datagrams with UDP ASSOCIATE. An http or https proxy
+	// tunnels a stream to the server's StreamListener with CONNECT. Credentials
+	// for the proxy are taken from the URL.
+	Proxy *url.URL
 }
 
 func (c *ClientConfig) maxBufferedPackets() int {
@@ -114,6 +129,33 @@ type ServerConfig struct {
 
 	HiddenModeVHostNames []string
 	IsHidden             bool // if HiddenModeVHostNames length > 0, server discards discoverable mode HS
+
+	// DisablePathMTUDiscovery turns off probing for the largest packet size
+	// supported by the path to each client.
+	DisablePathMTUDiscovery bool
+
+	// HandshakeLimits protects the server against floods of handshake
+	// messages.
+	HandshakeLimits HandshakeLimits
+
+	// Obfuscation, if set, disguises the datagrams on every socket of the
+	// server. Clients must use the same obfuscation key.
+	Obfuscation *ObfuscationConfig
+
+	// CookieSecret, if set, derives the keys that handshake cookies are
+	// encrypted with, so that servers sharing the secret accept each other's
+	// cookies, including across restarts. It must be at least
+	// MinCookieSecretLen bytes. CookieRotation is how often the keys rotate,
+	// DefaultCookieRotation if zero.
+	CookieSecret   []byte
+	CookieRotation time.Duration
+
+	// ServerID, if nonzero, is embedded in the session IDs the server assigns,
+	// so that a load balancer can route the packets of each session to it.
+	// ServerIDKey, if set, encrypts the server ID, and the load balancer needs
+	// the same key.
+	ServerID    byte
+	ServerIDKey *[ServerIDKeyLen]byte
 }
 
 func (c *ServerConfig) maxPendingConnections() int {
@@ -0,0 +1,127 @@
+package transport
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// Cookie keys. The server encrypts its handshake state into the cookie in the
+// Server Hello, so that it holds no state for a client until the Client Ack.
+// The keys rotate every rotation period, and cookies encrypted with the
+// previous key are still accepted, so a rotation never fails a handshake in
+// flight.
+//
+// By default the keys are random and only held in memory. If the server has a
+// cookie secret, the key for each period is derived from the secret and the
+// period number instead. Servers sharing a secret then use the same keys at the
+// same time, so they accept each other's cookies, and a restarted server still
+// accepts the cookies it issued before the restart. Servers sharing a secret
+// need synchronized clocks.
+
+// DefaultCookieRotation is how often cookie keys rotate when
+// ServerConfig.CookieRotation is zero
+const DefaultCookieRotation = 2 * time.Minute
+
+// MinCookieSecretLen is the length of the shortest cookie secret
+const MinCookieSecretLen = 32
+
+// ErrShortCookieSecret is returned when a cookie secret is too short to derive
+// keys from
+var ErrShortCookieSecret = errors.New("cookie secret must be at least 32 bytes")
+
+// cookieKeys holds the key that new cookies are encrypted with, and the key
+// before it
+type cookieKeys struct {
+	secret   []byte
+	rotation time.Duration
+
+	period            int64
+	current, previous [KeyLen]byte
+}
+
+// newCookieKeys returns the cookie keys for the period containing now. If
+// secret is nil, the keys are random.
+func newCookieKeys(secret []byte, rotation time.Duration, now time.Time) (cookieKeys, error) {
+	if secret != nil && len(secret) < MinCookieSecretLen {
+		return cookieKeys{}, ErrShortCookieSecret
+	}
+	if rotation <= 0 {
+		rotation = DefaultCookieRotation
+	}
+	k := cookieKeys{
+		secret:   secret,
+		rotation: rotation,
+		period:   now.UnixNano() / int64(rotation),
+	}
+	k.current = k.key(k.period)
+	k.previous = k.key(k.period - 1)
+	return k, nil
+}
+
+// deriveCookieKey returns the cookie key for period
+func deriveCookieKey(secret []byte, period int64) [KeyLen]byte {
+	var p [8]byte
+	binary.BigEndian.PutUint64(p[:], uint64(period))
+	h := sha256.New()
+	h.Write([]byte("hop cookie key v1"))
+	h.Write(secret)
+	h.Write(p[:])
+	var key [KeyLen]byte
+	copy(key[:], h.Sum(nil))
+	return key
+}
+
+// key returns a key for period, derived from the secret if there is one
+func (k *cookieKeys) key(period int64) [KeyLen]byte {
+	if k.secret != nil {
+		return deriveCookieKey(k.secret, period)
+	}
+	var key [KeyLen]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		panic(err.Error())
+	}
+	return key
+}
+
+// update rotates the keys if now is in a later period than the current key
+func (k *cookieKeys) update(now time.Time) {
+	period := now.UnixNano() / int64(k.rotation)
+	switch {
+	case period <= k.period:
+		return
+	case period == k.period+1:
+		k.previous = k.current
+	default:
+		k.previous = k.key(period - 1)
+	}
+	k.current = k.key(period)
+	k.period = period
+}
+
+// cookieKeyLocked returns the key to encrypt new cookies with
+// +checklocks:s.cookieLock
+func (s *Server) cookieKeyLocked() [KeyLen]byte {
+	s.cookies.update(time.Now())
+	return s.cookies.current
+}
+
+// openCookieLocked decrypts cookie for hs with the current or the previous
+// cookie key. hs.cookieKey is left set to the key that worked.
+// +checklocks:s.cookieLock
+func (s *Server) openCookieLocked(hs *HandshakeState, cookie []byte) (int, *[]byte, error) {
+	s.cookies.update(time.Now())
+	var err error
+	for _, key := range [...][KeyLen]byte{s.cookies.current, s.cookies.previous} {
+		hs.cookieKey = key
+		var n int
+		var k *[]byte
+		n, k, err = hs.decryptCookie(cookie)
+		if err == nil {
+			return n, k, nil
+		}
+	}
+	return 0, nil, err
+}
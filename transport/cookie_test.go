@@ -0,0 +1,111 @@
+package transport
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestCookieKeys(t *testing.T) {
+	secret := bytes.Repeat([]byte{1}, MinCookieSecretLen)
+	start := time.Unix(1000, 0)
+	a, err := newCookieKeys(secret, time.Minute, start)
+	assert.NilError(t, err)
+	b, err := newCookieKeys(secret, time.Minute, start.Add(10*time.Second))
+	assert.NilError(t, err)
+	assert.Equal(t, a.current, b.current)
+	assert.Equal(t, a.previous, b.previous)
+	assert.Assert(t, a.current != a.previous)
+
+	// The current key becomes the previous key for one period
+	current := a.current
+	a.update(start.Add(time.Minute))
+	assert.Equal(t, a.previous, current)
+	b.update(start.Add(3 * time.Minute))
+	a.update(start.Add(3 * time.Minute))
+	assert.Equal(t, a.current, b.current)
+	assert.Equal(t, a.previous, b.previous)
+
+	// Keys never go backwards
+	current = a.current
+	a.update(start)
+	assert.Equal(t, a.current, current)
+
+	// Random keys are not shared, and rotate the same way
+	r, err := newCookieKeys(nil, time.Minute, start)
+	assert.NilError(t, err)
+	assert.Assert(t, r.current != a.current && r.current != r.previous)
+	current = r.current
+	r.update(start.Add(time.Minute))
+	assert.Equal(t, r.previous, current)
+
+	_, err = newCookieKeys([]byte("short"), time.Minute, start)
+	assert.Equal(t, err, ErrShortCookieSecret)
+}
+
+// newSplitHandshakeRelay returns the address of a relay that sends Client
+// Hellos to a and every other message to b, like a load balancer that moved the
+// client between servers partway through the handshake. Both servers see the
+// client at the same address.
+func newSplitHandshakeRelay(t *testing.T, a, b net.Addr) net.Addr {
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NilError(t, err)
+	t.Cleanup(func() { relay.Close() })
+	go func() {
+		var client *net.UDPAddr
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := relay.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			switch {
+			case addr.String() == a.String() || addr.String() == b.String():
+				if client != nil {
+					relay.WriteToUDP(buf[:n], client)
+				}
+			case n > 0 && MessageType(buf[0]) == MessageTypeClientHello:
+				client = addr
+				relay.WriteTo(buf[:n], a)
+			default:
+				client = addr
+				relay.WriteTo(buf[:n], b)
+			}
+		}
+	}()
+	return relay.LocalAddr()
+}
+
+func TestCookieSecretSharedAcrossServers(t *testing.T) {
+	newServer := func(secret []byte) *Server {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		assert.NilError(t, err)
+		serverConfig, _ := newTestServerConfig(t)
+		serverConfig.CookieSecret = secret
+		s, err := NewServer(pc.(*net.UDPConn), *serverConfig)
+		assert.NilError(t, err)
+		go s.Serve()
+		t.Cleanup(func() { s.Close() })
+		return s
+	}
+	_, verifyConfig := newTestServerConfig(t)
+	_, _, clientConfig := newClientAuthAndConfig(t, verifyConfig)
+	clientConfig.HSTimeout = time.Second
+
+	// Servers sharing a secret accept each other's cookies
+	secret := bytes.Repeat([]byte{7}, MinCookieSecretLen)
+	a, b := newServer(secret), newServer(secret)
+	c, err := Dial("udp", newSplitHandshakeRelay(t, a.Addr(), b.Addr()).String(), *clientConfig)
+	assert.NilError(t, err)
+	c.Close()
+	_, err = b.AcceptTimeout(time.Second)
+	assert.NilError(t, err)
+
+	// Servers with random keys do not
+	a, b = newServer(nil), newServer(nil)
+	_, err = Dial("udp", newSplitHandshakeRelay(t, a.Addr(), b.Addr()).String(), *clientConfig)
+	assert.Assert(t, err != nil)
+}
@@ -0,0 +1,379 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultAttemptDelay is how long a Dialer waits for a handshake to complete
+// before it starts one with the next address, as recommended by RFC 8305.
+const DefaultAttemptDelay = 250 * time.Millisecond
+
+// Dialer dials every address of a host, racing handshakes in the style of
+// Happy Eyeballs (RFC 8305). Handshakes start AttemptDelay apart, or as soon as
+// the previous one fails, and the first to complete wins.
+type Dialer struct {
+	// AttemptDelay is the time between starting handshakes with successive
+	// addresses. If zero, DefaultAttemptDelay is used.
+	AttemptDelay time.Duration
+
+	// Resolver looks up host names. If nil, net.DefaultResolver is used.
+	Resolver *net.Resolver
+
+	// FallbackURL, if set, is dialed with DialStream when every UDP handshake
+	// fails with a network error such as a timeout, as happens on networks that
+	// block UDP.
+	FallbackURL string
+
+	// TLSConfig is used for wss fallback URLs. If nil, the server certificate
+	// is verified against the system roots.
+	TLSConfig *tls.Config
+}
+
+// DialAttemptError is the error from a handshake with a single address
+type DialAttemptError struct {
+	Addr netip.AddrPort
+	Err  error
+}
+
+func (e *DialAttemptError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Addr, e.Err)
+}
+
+func (e *DialAttemptError) Unwrap() error {
+	return e.Err
+}
+
+// DialError is returned by a Dialer when the handshake with every address
+// fails.
+type DialError struct {
+	Attempts []*DialAttemptError
+}
+
+func (e *DialError) Error() string {
+	msgs := make([]string, 0, len(e.Attempts))
+	for _, a := range e.Attempts {
+		msgs = append(msgs, a.Error())
+	}
+	return "unable to handshake with any address: " + strings.Join(msgs, "; ")
+}
+
+func (e *DialError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Attempts))
+	for _, a := range e.Attempts {
+		errs = append(errs, a)
+	}
+	return errs
+}
+
+// ErrNoAddresses is returned when there are no addresses to dial
+var ErrNoAddresses = errors.New("no addresses to dial")
+
+func (d *Dialer) resolver() *net.Resolver {
+	if d.Resolver != nil {
+		return d.Resolver
+	}
+	return net.DefaultResolver
+}
+
+func (d *Dialer) attemptDelay() time.Duration {
+	if d.AttemptDelay != 0 {
+		return d.AttemptDelay
+	}
+	return DefaultAttemptDelay
+}
+
+// DialContext resolves every address of the host in address and handshakes
+// with them. The network must be "udp", "udp4" or "udp6". The returned Client
+// has completed its handshake.
+func (d *Dialer) DialContext(ctx context.Context, network, address string, config ClientConfig) (*Client, error) {
+	if err := checkProxy(config.Proxy); err != nil {
+		return nil, err
+	}
+	if config.Proxy != nil && !isSOCKS5Proxy(config.Proxy) {
+		// HTTP proxies cannot relay UDP, and resolve the host themselves
+		return d.dialStream(ctx, d.streamURL(address), config)
+	}
+	addrs, err := d.resolve(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return d.DialAddrs(ctx, addrs, config)
+}
+
+// resolve returns the addresses of the host in address, ordered for dialing
+func (d *Dialer) resolve(ctx context.Context, network, address string) ([]netip.AddrPort, error) {
+	var ipNetwork string
+	switch network {
+	case "udp":
+		ipNetwork = "ip"
+	case "udp4":
+		ipNetwork = "ip4"
+	case "udp6":
+		ipNetwork = "ip6"
+	default:
+		return nil, ErrUDPOnly
+	}
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := d.resolver().LookupPort(ctx, udp, portString)
+	if err != nil {
+		return nil, err
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return []netip.AddrPort{netip.AddrPortFrom(ip.Unmap(), uint16(port))}, nil
+	}
+	if host == "" {
+		// As with net.Dial, an empty host is the local system
+		var ips []netip.Addr
+		if network != "udp6" {
+			ips = append(ips, netip.AddrFrom4([4]byte{127, 0, 0, 1}))
+		}
+		if network != "udp4" {
+			ips = append(ips, netip.IPv6Loopback())
+		}
+		return interleaveFamilies(ips, uint16(port)), nil
+	}
+	ips, err := d.resolver().LookupNetIP(ctx, ipNetwork, host)
+	if err != nil {
+		return nil, err
+	}
+	return interleaveFamilies(ips, uint16(port)), nil
+}
+
+// interleaveFamilies orders ips for dialing as in RFC 8305 section 4,
+// alternating between address families and starting with the family of the
+// first address.
+func interleaveFamilies(ips []netip.Addr, port uint16) []netip.AddrPort {
+	var first, second []netip.AddrPort
+	for _, ip := range ips {
+		ip = ip.Unmap()
+		addr := netip.AddrPortFrom(ip, port)
+		if len(first) == 0 || first[0].Addr().Is4() == ip.Is4() {
+			first = append(first, addr)
+		} else {
+			second = append(second, addr)
+		}
+	}
+	out := make([]netip.AddrPort, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			out = append(out, first[i])
+		}
+		if i < len(second) {
+			out = append(out, second[i])
+		}
+	}
+	return out
+}
+
+// dialAttempt is the result of a handshake with addrs[i]
+type dialAttempt struct {
+	i   int
+	c   *Client
+	err error
+}
+
+// DialAddrs handshakes with each of addrs in order, racing the handshakes as
+// described on Dialer. The handshake timeout in config applies to each
+// handshake, and the deadline of ctx to all of them. If no handshake completes
+// and FallbackURL is set, DialAddrs falls back to a stream.
+func (d *Dialer) DialAddrs(ctx context.Context, addrs []netip.AddrPort, config ClientConfig) (*Client, error) {
+	if err := checkProxy(config.Proxy); err != nil {
+		return nil, err
+	}
+	if config.Proxy != nil && !isSOCKS5Proxy(config.Proxy) {
+		if len(addrs) == 0 {
+			return nil, ErrNoAddresses
+		}
+		return d.dialStream(ctx, d.streamURL(addrs[0].String()), config)
+	}
+	c, err := d.dialUDP(ctx, addrs, config)
+	if err == nil || d.FallbackURL == "" || !udpUnreachable(err) {
+		return c, err
+	}
+	logrus.Infof("client: unable to reach server over UDP, falling back to %s", d.FallbackURL)
+	c, fallbackErr := d.dialStream(ctx, d.FallbackURL, config)
+	if fallbackErr != nil {
+		return nil, fmt.Errorf("%w; fallback to %s: %w", err, d.FallbackURL, fallbackErr)
+	}
+	return c, nil
+}
+
+// udpUnreachable reports whether err from dialUDP means the server could not be
+// reached over UDP at all, rather than that a handshake was rejected
+func udpUnreachable(err error) bool {
+	var dialErr *DialError
+	if !errors.As(err, &dialErr) {
+		return false
+	}
+	for _, attempt := range dialErr.Attempts {
+		var netErr net.Error
+		if !errors.As(attempt.Err, &netErr) && !errors.Is(attempt.Err, os.ErrDeadlineExceeded) {
+			return false
+		}
+	}
+	return true
+}
+
+// withContextDeadline returns config with its handshake deadline no later than
+// the deadline of ctx
+func withContextDeadline(ctx context.Context, config ClientConfig) ClientConfig {
+	if deadline, ok := ctx.Deadline(); ok && (config.HSDeadline.IsZero() || deadline.Before(config.HSDeadline)) {
+		config.HSDeadline = deadline
+	}
+	return config
+}
+
+// dialUDP races UDP handshakes with addrs
+func (d *Dialer) dialUDP(ctx context.Context, addrs []netip.AddrPort, config ClientConfig) (*Client, error) {
+	if len(addrs) == 0 {
+		return nil, ErrNoAddresses
+	}
+	config = withContextDeadline(ctx, config)
+
+	results := make(chan dialAttempt, len(addrs))
+	clients := make([]*Client, 0, len(addrs))
+	var attemptErrs []*DialAttemptError
+	next := 0
+	pending := 0
+	timer := time.NewTimer(d.attemptDelay())
+	defer timer.Stop()
+
+	// startNext starts a handshake with the next address that a socket can be
+	// opened for
+	startNext := func() {
+		for ; next < len(addrs); next++ {
+			c, err := newClientForAddr(ctx, addrs[next], config)
+			if err != nil {
+				attemptErrs = append(attemptErrs, &DialAttemptError{Addr: addrs[next], Err: err})
+				continue
+			}
+			logrus.Debugf("client: starting handshake with %s", addrs[next])
+			clients = append(clients, c)
+			pending++
+			go func(i int) {
+				results <- dialAttempt{i: i, c: c, err: c.Handshake()}
+			}(next)
+			next++
+			timer.Reset(d.attemptDelay())
+			return
+		}
+	}
+	closeOthers := func(winner *Client) {
+		for _, c := range clients {
+			if c != winner {
+				c.Close()
+			}
+		}
+	}
+
+	startNext()
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			startNext()
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				closeOthers(r.c)
+				return r.c, nil
+			}
+			logrus.Debugf("client: handshake with %s failed: %s", addrs[r.i], r.err)
+			attemptErrs = append(attemptErrs, &DialAttemptError{Addr: addrs[r.i], Err: r.err})
+			startNext()
+		case <-ctx.Done():
+			closeOthers(nil)
+			return nil, ctx.Err()
+		}
+	}
+	closeOthers(nil)
+	return nil, &DialError{Attempts: attemptErrs}
+}
+
+// newClientForAddr opens a socket and returns a Client that will handshake with
+// addr over it. With a SOCKS5 proxy, the socket relays through the proxy.
+func newClientForAddr(ctx context.Context, addr netip.AddrPort, config ClientConfig) (*Client, error) {
+	if config.Proxy != nil {
+		var nd net.Dialer
+		conn, err := dialSOCKS5UDP(ctx, &nd, config.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		return NewClient(conn, net.UDPAddrFromAddrPort(addr), config), nil
+	}
+	inner, err := net.ListenPacket(udp, ":0")
+	if err != nil {
+		return nil, err
+	}
+	if !config.DisablePathMTUDiscovery {
+		if err := SetDontFragment(inner.(*net.UDPConn)); err != nil {
+			inner.Close()
+			return nil, err
+		}
+	}
+	return NewClient(inner.(*net.UDPConn), net.UDPAddrFromAddrPort(addr), config), nil
+}
+
+// DialStream connects to the StreamListener at rawURL and handshakes over it.
+// The scheme of rawURL is tcp for a TCP stream, e.g. tcp://example.com:77, or
+// ws or wss for a WebSocket.
+func DialStream(ctx context.Context, rawURL string, config ClientConfig) (*Client, error) {
+	var d Dialer
+	return d.dialStream(ctx, rawURL, config)
+}
+
+func (d *Dialer) dialStream(ctx context.Context, rawURL string, config ClientConfig) (*Client, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkProxy(config.Proxy); err != nil {
+		return nil, err
+	}
+	var conn net.Conn
+	switch u.Scheme {
+	case "tcp":
+		var nd net.Dialer
+		conn, err = dialProxyStream(ctx, &nd, config.Proxy, u.Host)
+	case "ws", "wss":
+		conn, err = dialWebSocket(ctx, rawURL, d.TLSConfig, config.Proxy)
+	default:
+		return nil, fmt.Errorf("unsupported stream scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Streams do not fragment datagrams, so there is no path MTU to discover
+	config = withContextDeadline(ctx, config)
+	config.DisablePathMTUDiscovery = true
+	c := NewClient(NewStreamConn(conn), streamAddr(conn.RemoteAddr()), config)
+	if err := c.Handshake(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// streamURL returns the URL of the stream to dial for the server at address
+// when UDP cannot be used: FallbackURL if it is set, or otherwise TCP to the
+// same address.
+func (d *Dialer) streamURL(address string) string {
+	if d.FallbackURL != "" {
+		return d.FallbackURL
+	}
+	return "tcp://" + address
+}
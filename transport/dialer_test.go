@@ -0,0 +1,114 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestInterleaveFamilies(t *testing.T) {
+	ips := []netip.Addr{
+		netip.MustParseAddr("2001:db8::1"),
+		netip.MustParseAddr("2001:db8::2"),
+		netip.MustParseAddr("2001:db8::3"),
+		netip.MustParseAddr("192.0.2.1"),
+		netip.MustParseAddr("::ffff:192.0.2.2"),
+	}
+	var got []string
+	for _, a := range interleaveFamilies(ips, 77) {
+		got = append(got, a.String())
+	}
+	assert.DeepEqual(t, got, []string{
+		"[2001:db8::1]:77",
+		"192.0.2.1:77",
+		"[2001:db8::2]:77",
+		"192.0.2.2:77",
+		"[2001:db8::3]:77",
+	})
+}
+
+// newBlackHole returns the address of a socket that never answers
+func newBlackHole(t *testing.T) netip.AddrPort {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	t.Cleanup(func() { pc.Close() })
+	return pc.LocalAddr().(*net.UDPAddr).AddrPort()
+}
+
+func newDialerTestServer(t *testing.T) (*Server, *ClientConfig) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	serverConfig, verifyConfig := newTestServerConfig(t)
+	s, err := NewServer(pc.(*net.UDPConn), *serverConfig)
+	assert.NilError(t, err)
+	go s.Serve()
+	t.Cleanup(func() { s.Close() })
+	_, _, clientConfig := newClientAuthAndConfig(t, verifyConfig)
+	clientConfig.HSTimeout = 5 * time.Second
+	return s, clientConfig
+}
+
+func TestDialerSkipsDeadAddress(t *testing.T) {
+	s, clientConfig := newDialerTestServer(t)
+	server := s.Addr().(*net.UDPAddr).AddrPort()
+
+	d := Dialer{AttemptDelay: 50 * time.Millisecond}
+	start := time.Now()
+	c, err := d.DialAddrs(context.Background(), []netip.AddrPort{newBlackHole(t), newBlackHole(t), server}, *clientConfig)
+	assert.NilError(t, err)
+	defer c.Close()
+	assert.Assert(t, time.Since(start) < clientConfig.HSTimeout)
+
+	h, err := s.AcceptTimeout(time.Second)
+	assert.NilError(t, err)
+	assert.NilError(t, c.WriteMsg([]byte("hello")))
+	buf := make([]byte, 100)
+	h.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := h.ReadMsg(buf)
+	assert.NilError(t, err)
+	assert.Equal(t, string(buf[:n]), "hello")
+}
+
+func TestDialerHostname(t *testing.T) {
+	s, clientConfig := newDialerTestServer(t)
+	_, port, err := net.SplitHostPort(s.Addr().String())
+	assert.NilError(t, err)
+
+	// localhost may also resolve to ::1, which the server does not listen on
+	d := Dialer{AttemptDelay: 50 * time.Millisecond}
+	c, err := d.DialContext(context.Background(), "udp", net.JoinHostPort("localhost", port), *clientConfig)
+	assert.NilError(t, err)
+	c.Close()
+
+	// An empty host is the local system
+	c, err = d.DialContext(context.Background(), "udp", net.JoinHostPort("", port), *clientConfig)
+	assert.NilError(t, err)
+	c.Close()
+
+	_, err = d.DialContext(context.Background(), "tcp", net.JoinHostPort("localhost", port), *clientConfig)
+	assert.Equal(t, err, ErrUDPOnly)
+}
+
+func TestDialerAllFail(t *testing.T) {
+	_, clientConfig := newDialerTestServer(t)
+	clientConfig.HSTimeout = 200 * time.Millisecond
+	addrs := []netip.AddrPort{newBlackHole(t), newBlackHole(t)}
+
+	d := Dialer{AttemptDelay: 50 * time.Millisecond}
+	_, err := d.DialAddrs(context.Background(), addrs, *clientConfig)
+	var dialErr *DialError
+	assert.Assert(t, errors.As(err, &dialErr))
+	assert.Equal(t, len(dialErr.Attempts), 2)
+	for _, a := range dialErr.Attempts {
+		assert.Assert(t, a.Addr == addrs[0] || a.Addr == addrs[1])
+		assert.Assert(t, a.Err != nil)
+	}
+
+	_, err = d.DialAddrs(context.Background(), nil, *clientConfig)
+	assert.Equal(t, err, ErrNoAddresses)
+}
@@ -22,10 +22,8 @@ func (s *Server) ReplayDuplexFromCookie(cookie, clientEphemeral []byte, clientAd
 	out.dh = new(dhState)
 	copy(out.dh.remoteEphemeral[:], clientEphemeral)
 	out.remoteAddr = clientAddr
-	out.cookieKey = s.cookieKey
-
 	// Pull the private key out of the cookie
-	n, _, err := out.decryptCookie(cookie)
+	n, _, err := s.openCookieLocked(out, cookie)
 	if err != nil {
 		logrus.Errorf("unable to decrypt cookie: %s", err)
 		return nil, err
@@ -0,0 +1,328 @@
+package transport
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Handshake flood protection. The stateless cookie keeps spoofed sources from
+// creating handshake state, but every handshake message still costs the server
+// KEM, DH or signature operations. The Server limits the rate of handshake
+// messages from each source prefix, caps the number of handshakes in progress,
+// and, when the overall rate of handshake messages is high, requires clients to
+// solve a puzzle before it replays their cookie.
+//
+// Puzzles only apply to discoverable handshakes. The server sets the puzzle
+// difficulty in the Server Hello header, and the client echoes it in the Client
+// Ack header and appends a PuzzleNonceLen nonce after the Client Ack MAC. A
+// solution is a nonce such that SHA-256(cookie || nonce) starts with at least
+// difficulty zero bits. Hidden mode servers never answer unauthenticated
+// messages, so they rely on the rate limits alone.
+
+// Default handshake limits, used when a HandshakeLimits field is zero
+const (
+	DefaultHandshakeRate             = 50
+	DefaultHandshakeBurst            = 100
+	DefaultHandshakeIPv4PrefixLen    = 24
+	DefaultHandshakeIPv6PrefixLen    = 48
+	DefaultMaxConcurrentHandshakes   = 4096
+	DefaultHandshakePuzzleThreshold  = 1000
+	DefaultHandshakePuzzleDifficulty = 16
+)
+
+// PuzzleNonceLen is the length of a puzzle solution appended to a Client Ack
+const PuzzleNonceLen = 8
+
+// MaxPuzzleDifficulty is the hardest puzzle a client will attempt to solve
+const MaxPuzzleDifficulty = 24
+
+// Once the server requires puzzles, it keeps requiring them for this long after
+// the load drops, so that it does not flap between modes.
+const puzzleHoldDown = 10 * time.Second
+
+// The largest number of source prefixes tracked individually. Sources beyond
+// this share a single rate limit.
+const maxTrackedPrefixes = 1 << 16
+
+// errHandshakeDropped is returned for handshake messages dropped by flood
+// protection. It is counted rather than logged.
+var errHandshakeDropped = errors.New("handshake message dropped by flood protection")
+
+// HandshakeLimits configures how a Server protects itself from floods of
+// handshake messages. Zero values use the defaults, and negative values
+// disable the corresponding limit.
+type HandshakeLimits struct {
+	// Rate is the sustained number of handshake messages per second accepted
+	// from each source prefix.
+	Rate float64
+
+	// Burst is the number of handshake messages a source prefix can send
+	// before it is limited to Rate.
+	Burst int
+
+	// IPv4PrefixLen and IPv6PrefixLen are the lengths of the source prefixes
+	// that share a rate limit.
+	IPv4PrefixLen int
+	IPv6PrefixLen int
+
+	// MaxConcurrent is the largest number of handshakes in progress. New
+	// handshakes are dropped until others finish or time out.
+	MaxConcurrent int
+
+	// PuzzleThreshold is the number of handshake messages per second, across
+	// all sources, above which clients must solve a puzzle. Puzzles are also
+	// required while more than half of MaxConcurrent handshakes are in
+	// progress.
+	PuzzleThreshold int
+
+	// PuzzleDifficulty is the number of leading zero bits a puzzle solution
+	// needs. Each additional bit doubles the expected work for clients.
+	PuzzleDifficulty int
+}
+
+// withDefaults returns l with zero values replaced by defaults
+func (l HandshakeLimits) withDefaults() HandshakeLimits {
+	if l.Rate == 0 {
+		l.Rate = DefaultHandshakeRate
+	}
+	if l.Burst == 0 {
+		l.Burst = DefaultHandshakeBurst
+	}
+	if l.IPv4PrefixLen == 0 {
+		l.IPv4PrefixLen = DefaultHandshakeIPv4PrefixLen
+	}
+	if l.IPv6PrefixLen == 0 {
+		l.IPv6PrefixLen = DefaultHandshakeIPv6PrefixLen
+	}
+	if l.MaxConcurrent == 0 {
+		l.MaxConcurrent = DefaultMaxConcurrentHandshakes
+	}
+	if l.PuzzleThreshold == 0 {
+		l.PuzzleThreshold = DefaultHandshakePuzzleThreshold
+	}
+	if l.PuzzleDifficulty == 0 {
+		l.PuzzleDifficulty = DefaultHandshakePuzzleDifficulty
+	}
+	l.IPv4PrefixLen = min(max(l.IPv4PrefixLen, 0), 32)
+	l.IPv6PrefixLen = min(max(l.IPv6PrefixLen, 0), 128)
+	l.PuzzleDifficulty = min(l.PuzzleDifficulty, MaxPuzzleDifficulty)
+	return l
+}
+
+// HandshakeStats counts handshake messages dropped by flood protection
+type HandshakeStats struct {
+	// RateLimited is the number of messages dropped by per-source rate limits
+	RateLimited uint64
+	// OverCapacity is the number of new handshakes dropped because too many
+	// were already in progress
+	OverCapacity uint64
+	// PuzzleRejected is the number of Client Acks dropped for a missing or
+	// invalid puzzle solution
+	PuzzleRejected uint64
+	// PuzzleRequired reports whether the server currently requires puzzles
+	PuzzleRequired bool
+}
+
+// tokenBucket allows rate events per second, with bursts of up to burst events
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(now time.Time, burst int) *tokenBucket {
+	return &tokenBucket{tokens: float64(burst), last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time, rate float64, burst int) {
+	b.tokens = min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+}
+
+func (b *tokenBucket) take(now time.Time, rate float64, burst int) bool {
+	b.refill(now, rate, burst)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// handshakeGuard implements flood protection for a Server
+type handshakeGuard struct {
+	limits HandshakeLimits
+	now    func() time.Time
+
+	m sync.Mutex
+
+	// +checklocks:m
+	buckets map[netip.Prefix]*tokenBucket
+	// +checklocks:m
+	overflow *tokenBucket
+	// +checklocks:m
+	windowStart time.Time
+	// +checklocks:m
+	windowCount int
+	// +checklocks:m
+	loadedUntil time.Time
+
+	rateLimited    atomic.Uint64
+	overCapacity   atomic.Uint64
+	puzzleRejected atomic.Uint64
+}
+
+func newHandshakeGuard(limits HandshakeLimits) *handshakeGuard {
+	return &handshakeGuard{
+		limits:  limits.withDefaults(),
+		now:     time.Now,
+		buckets: make(map[netip.Prefix]*tokenBucket),
+	}
+}
+
+// sourcePrefix returns the prefix of addr that shares a rate limit
+func (g *handshakeGuard) sourcePrefix(addr *net.UDPAddr) netip.Prefix {
+	ip, ok := netip.AddrFromSlice(addr.IP)
+	if !ok {
+		return netip.Prefix{}
+	}
+	ip = ip.Unmap()
+	bits := g.limits.IPv6PrefixLen
+	if ip.Is4() {
+		bits = g.limits.IPv4PrefixLen
+	}
+	prefix, _ := ip.Prefix(bits)
+	return prefix
+}
+
+// allow records a handshake message from addr and reports whether it is within
+// the rate limit of its source prefix.
+func (g *handshakeGuard) allow(addr *net.UDPAddr) bool {
+	now := g.now()
+	g.m.Lock()
+	defer g.m.Unlock()
+
+	// Measure the overall rate of handshake messages in one second windows
+	if now.Sub(g.windowStart) >= time.Second {
+		if g.limits.PuzzleThreshold > 0 && g.windowCount > g.limits.PuzzleThreshold {
+			if !now.Before(g.loadedUntil) {
+				logrus.Warnf("server: received %d handshake messages in the last second, requiring puzzles", g.windowCount)
+			}
+			g.loadedUntil = now.Add(puzzleHoldDown)
+		}
+		g.windowStart = now
+		g.windowCount = 0
+	}
+	g.windowCount++
+
+	if g.limits.Rate < 0 || addr == nil {
+		return true
+	}
+	bucket := g.bucketLocked(now, g.sourcePrefix(addr))
+	if !bucket.take(now, g.limits.Rate, g.limits.Burst) {
+		g.rateLimited.Add(1)
+		return false
+	}
+	return true
+}
+
+// bucketLocked returns the token bucket for prefix.
+//
+// +checklocks:g.m
+func (g *handshakeGuard) bucketLocked(now time.Time, prefix netip.Prefix) *tokenBucket {
+	if b, ok := g.buckets[prefix]; ok {
+		return b
+	}
+	if len(g.buckets) >= maxTrackedPrefixes {
+		// Forget prefixes whose buckets have refilled, since a new bucket would
+		// be identical
+		for p, b := range g.buckets {
+			b.refill(now, g.limits.Rate, g.limits.Burst)
+			if b.tokens >= float64(g.limits.Burst) {
+				delete(g.buckets, p)
+			}
+		}
+	}
+	if len(g.buckets) >= maxTrackedPrefixes {
+		if g.overflow == nil {
+			g.overflow = newTokenBucket(now, g.limits.Burst)
+		}
+		return g.overflow
+	}
+	b := newTokenBucket(now, g.limits.Burst)
+	g.buckets[prefix] = b
+	return b
+}
+
+// admit reports whether a new handshake can start while inProgress handshakes
+// are in progress.
+func (g *handshakeGuard) admit(inProgress int) bool {
+	if g.limits.MaxConcurrent > 0 && inProgress >= g.limits.MaxConcurrent {
+		g.overCapacity.Add(1)
+		return false
+	}
+	return true
+}
+
+// puzzleDifficulty returns the difficulty of the puzzle clients currently need
+// to solve, or 0 if none is required.
+func (g *handshakeGuard) puzzleDifficulty(inProgress int) int {
+	if g.limits.PuzzleThreshold < 0 || g.limits.PuzzleDifficulty <= 0 {
+		return 0
+	}
+	if g.limits.MaxConcurrent > 0 && inProgress > g.limits.MaxConcurrent/2 {
+		return g.limits.PuzzleDifficulty
+	}
+	now := g.now()
+	g.m.Lock()
+	defer g.m.Unlock()
+	if now.Before(g.loadedUntil) {
+		return g.limits.PuzzleDifficulty
+	}
+	return 0
+}
+
+func (g *handshakeGuard) stats(inProgress int) HandshakeStats {
+	return HandshakeStats{
+		RateLimited:    g.rateLimited.Load(),
+		OverCapacity:   g.overCapacity.Load(),
+		PuzzleRejected: g.puzzleRejected.Load(),
+		PuzzleRequired: g.puzzleDifficulty(inProgress) > 0,
+	}
+}
+
+// puzzleSolved reports whether nonce solves the puzzle for cookie
+func puzzleSolved(cookie, nonce []byte, difficulty int) bool {
+	h := sha256.New()
+	h.Write(cookie)
+	h.Write(nonce)
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+	zeros := 0
+	for i := 0; i < len(sum); i += 8 {
+		word := binary.BigEndian.Uint64(sum[i:])
+		zeros += bits.LeadingZeros64(word)
+		if word != 0 {
+			break
+		}
+	}
+	return zeros >= difficulty
+}
+
+// solvePuzzle returns a nonce that solves the puzzle for cookie
+func solvePuzzle(cookie []byte, difficulty int) [PuzzleNonceLen]byte {
+	var nonce [PuzzleNonceLen]byte
+	for i := uint64(0); ; i++ {
+		binary.BigEndian.PutUint64(nonce[:], i)
+		if puzzleSolved(cookie, nonce[:], difficulty) {
+			return nonce
+		}
+	}
+}
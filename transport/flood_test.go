@@ -0,0 +1,159 @@
+package transport
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+// newTestGuard returns a handshakeGuard with a clock controlled by the test
+func newTestGuard(limits HandshakeLimits) (*handshakeGuard, *time.Time) {
+	g := newHandshakeGuard(limits)
+	now := time.Unix(1700000000, 0)
+	g.now = func() time.Time { return now }
+	return g, &now
+}
+
+func udpAddr(s string) *net.UDPAddr {
+	return net.UDPAddrFromAddrPort(netip.MustParseAddrPort(s))
+}
+
+func TestHandshakeRateLimit(t *testing.T) {
+	g, now := newTestGuard(HandshakeLimits{Rate: 2, Burst: 3})
+	a := udpAddr("192.0.2.1:1000")
+
+	for i := 0; i < 3; i++ {
+		assert.Assert(t, g.allow(a))
+	}
+	assert.Assert(t, !g.allow(a))
+
+	// Sources in the same prefix share the limit, other prefixes do not
+	assert.Assert(t, !g.allow(udpAddr("192.0.2.200:1000")))
+	assert.Assert(t, g.allow(udpAddr("192.0.3.1:1000")))
+	assert.Equal(t, g.stats(0).RateLimited, uint64(2))
+
+	// Tokens refill at Rate
+	*now = now.Add(500 * time.Millisecond)
+	assert.Assert(t, g.allow(a))
+	assert.Assert(t, !g.allow(a))
+}
+
+func TestHandshakeRateLimitIPv6(t *testing.T) {
+	g, _ := newTestGuard(HandshakeLimits{Rate: 1, Burst: 1})
+	assert.Assert(t, g.allow(udpAddr("[2001:db8:1::1]:1000")))
+	assert.Assert(t, !g.allow(udpAddr("[2001:db8:1:ffff::1]:1000")))
+	assert.Assert(t, g.allow(udpAddr("[2001:db8:2::1]:1000")))
+
+	// IPv4-mapped addresses are limited with their IPv4 prefix
+	assert.Assert(t, g.allow(udpAddr("[::ffff:192.0.2.1]:1000")))
+	assert.Assert(t, !g.allow(udpAddr("192.0.2.2:1000")))
+}
+
+func TestHandshakeRateLimitDisabled(t *testing.T) {
+	g, _ := newTestGuard(HandshakeLimits{Rate: -1})
+	a := udpAddr("192.0.2.1:1000")
+	for i := 0; i < 1000; i++ {
+		assert.Assert(t, g.allow(a))
+	}
+}
+
+func TestHandshakeConcurrencyCap(t *testing.T) {
+	g, _ := newTestGuard(HandshakeLimits{MaxConcurrent: 10, PuzzleThreshold: -1})
+	assert.Assert(t, g.admit(9))
+	assert.Assert(t, !g.admit(10))
+	assert.Equal(t, g.stats(10).OverCapacity, uint64(1))
+}
+
+func TestHandshakePuzzleMode(t *testing.T) {
+	g, now := newTestGuard(HandshakeLimits{Rate: -1, PuzzleThreshold: 5, PuzzleDifficulty: 8, MaxConcurrent: 10})
+	a := udpAddr("192.0.2.1:1000")
+	assert.Equal(t, g.puzzleDifficulty(0), 0)
+
+	// Too many messages in one second turns on puzzles when the window ends
+	for i := 0; i < 6; i++ {
+		g.allow(a)
+	}
+	*now = now.Add(time.Second)
+	g.allow(a)
+	assert.Equal(t, g.puzzleDifficulty(0), 8)
+	assert.Assert(t, g.stats(0).PuzzleRequired)
+
+	// Puzzles stay on for the hold down period after the load drops
+	*now = now.Add(puzzleHoldDown - time.Millisecond)
+	g.allow(a)
+	assert.Equal(t, g.puzzleDifficulty(0), 8)
+	*now = now.Add(time.Millisecond)
+	assert.Equal(t, g.puzzleDifficulty(0), 0)
+
+	// Many handshakes in progress also requires puzzles
+	assert.Equal(t, g.puzzleDifficulty(6), 8)
+}
+
+func TestPuzzle(t *testing.T) {
+	cookie := []byte("cookie")
+	for _, difficulty := range []int{1, 8, 12} {
+		nonce := solvePuzzle(cookie, difficulty)
+		assert.Assert(t, puzzleSolved(cookie, nonce[:], difficulty))
+	}
+	nonce := solvePuzzle(cookie, 12)
+	assert.Assert(t, !puzzleSolved([]byte("other cookie"), nonce[:], 12))
+}
+
+func TestHandshakeWithPuzzle(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "localhost:0")
+	assert.NilError(t, err)
+	sc, vc := newTestServerConfig(t)
+	sc.HandshakeLimits = HandshakeLimits{PuzzleDifficulty: 12}
+	s, err := NewServer(pc.(*net.UDPConn), *sc)
+	assert.NilError(t, err)
+	go s.Serve()
+	defer s.Close()
+
+	// Put the server under load
+	s.guard.m.Lock()
+	s.guard.loadedUntil = time.Now().Add(time.Hour)
+	s.guard.m.Unlock()
+	assert.Assert(t, s.HandshakeStats().PuzzleRequired)
+
+	_, _, cc := newClientAuthAndConfig(t, vc)
+	c, err := Dial("udp", s.Addr().String(), *cc)
+	assert.NilError(t, err)
+	defer c.Close()
+	// The server drops Client Acks without a solution, so the handshake proves
+	// that the client solved the puzzle
+	assert.Equal(t, s.HandshakeStats().PuzzleRejected, uint64(0))
+
+	h, err := s.AcceptTimeout(time.Second)
+	assert.NilError(t, err)
+	assert.NilError(t, c.WriteMsg([]byte("hello")))
+	buf := make([]byte, 100)
+	h.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := h.ReadMsg(buf)
+	assert.NilError(t, err)
+	assert.Equal(t, string(buf[:n]), "hello")
+}
+
+func TestHandshakeRateLimited(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "localhost:0")
+	assert.NilError(t, err)
+	sc, vc := newTestServerConfig(t)
+	// Enough for a single handshake
+	sc.HandshakeLimits = HandshakeLimits{Rate: 0.001, Burst: 3}
+	s, err := NewServer(pc.(*net.UDPConn), *sc)
+	assert.NilError(t, err)
+	go s.Serve()
+	defer s.Close()
+
+	_, _, cc := newClientAuthAndConfig(t, vc)
+	c, err := Dial("udp", s.Addr().String(), *cc)
+	assert.NilError(t, err)
+	defer c.Close()
+
+	cc.HSTimeout = 200 * time.Millisecond
+	_, err = Dial("udp", s.Addr().String(), *cc)
+	assert.Assert(t, err != nil)
+	assert.Assert(t, s.HandshakeStats().RateLimited > 0)
+}
@@ -1,6 +1,7 @@
 package transport
 
 import (
+	"context"
 	"errors"
 	"net"
 )
@@ -13,31 +14,11 @@ var _ net.Conn = &Client{}
 // ErrUDPOnly is returned when non-UDP connections are attempted or used.
 var ErrUDPOnly = errors.New("portal requires UDP transport")
 
-// Dial matches the interface of net.Dial
+// Dial matches the interface of net.Dial. It handshakes with every address of
+// the host, as described on Dialer.
 func Dial(network, address string, config ClientConfig) (*Client, error) {
-	if network != udp {
-		return nil, ErrUDPOnly
-	}
-
-	inner, err := net.ListenPacket(udp, ":0")
-	if err != nil {
-		return nil, err
-	}
-
-	raddr, err := net.ResolveUDPAddr(udp, address)
-	if err != nil {
-		return nil, err
-	}
-
-	c, err := NewClient(inner.(*net.UDPConn), raddr, config), nil
-	if err != nil {
-		return nil, err
-	}
-	err = c.Handshake()
-	if err != nil {
-		return nil, err
-	}
-	return c, nil
+	var d Dialer
+	return d.DialContext(context.Background(), network, address, config)
 }
 
 // DialNP is similar to Dial, but using a reliable tube as an underlying conn for the Client
@@ -50,27 +31,43 @@ func DialNP(address string, tube UDPLike, config ClientConfig) (*Client, error)
 	return NewClient(tube, dst, config), nil
 }
 
-// DialWithDialer is similar to Dial, but uses options specified in a net.Dialer
+// DialWithDialer is similar to Dial, but uses options specified in a net.Dialer.
+// If config has a Proxy, the Client reaches address through it.
 // TODO(hosono) Do we need a DialNPWithDialer()??
 func DialWithDialer(dialer *net.Dialer, network, address string, config ClientConfig) (*Client, error) {
 	if network != udp {
 		return nil, ErrUDPOnly
 	}
+	if config.Proxy != nil {
+		return dialWithProxy(dialer, address, config)
+	}
 
+	// The dialer only resolves address. The client uses a socket of its own.
 	inner, err := dialer.Dial(udp, address)
 	if err != nil {
 		return nil, err
 	}
+	raddr := inner.RemoteAddr().(*net.UDPAddr)
+	inner.Close()
 
-	raddr := inner.RemoteAddr()
-	if udpListener, err := net.ListenPacket("udp", ":0"); err == nil {
-		inner = udpListener.(*net.UDPConn)
-	} else {
+	udpListener, err := net.ListenPacket("udp", ":0")
+	if err != nil {
 		return nil, err
 	}
+	conn := udpListener.(*net.UDPConn)
+	if !config.DisablePathMTUDiscovery {
+		if err := SetDontFragment(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
 
-	// If dialer has set a timeout, deadline, or keep alive, use those
-	// Options set in dialer will override those in config
+	return NewClient(conn, raddr, applyDialerOptions(dialer, config)), nil
+}
+
+// applyDialerOptions returns config with the timeout, deadline and keep alive
+// of dialer. Options set in dialer override those in config.
+func applyDialerOptions(dialer *net.Dialer, config ClientConfig) ClientConfig {
 	if dialer.Timeout != 0 {
 		config.HSTimeout = dialer.Timeout
 	}
@@ -82,6 +79,40 @@ func DialWithDialer(dialer *net.Dialer, network, address string, config ClientCo
 	if dialer.KeepAlive != 0 {
 		config.KeepAlive = dialer.KeepAlive
 	}
+	return config
+}
+
+// dialWithProxy is DialWithDialer through config.Proxy. With an HTTP proxy, the
+// Client carries its datagrams over a CONNECT tunnel to the server's TCP
+// StreamListener at address.
+func dialWithProxy(dialer *net.Dialer, address string, config ClientConfig) (*Client, error) {
+	if err := checkProxy(config.Proxy); err != nil {
+		return nil, err
+	}
+	config = applyDialerOptions(dialer, config)
+	ctx := context.Background()
+	if !config.HSDeadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, config.HSDeadline)
+		defer cancel()
+	}
+
+	if isSOCKS5Proxy(config.Proxy) {
+		raddr, err := net.ResolveUDPAddr(udp, address)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := dialSOCKS5UDP(ctx, dialer, config.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		return NewClient(conn, raddr, config), nil
+	}
 
-	return NewClient(inner.(*net.UDPConn), raddr.(*net.UDPAddr), config), nil
+	stream, err := dialProxyStream(ctx, dialer, config.Proxy, address)
+	if err != nil {
+		return nil, err
+	}
+	config.DisablePathMTUDiscovery = true
+	return NewClient(NewStreamConn(stream), streamAddr(stream.RemoteAddr()), config), nil
 }
@@ -7,6 +7,8 @@ import (
 	"sync"
 	"time"
 
+	"github.com/sirupsen/logrus"
+
 	"hop.computer/hop/certs"
 	"hop.computer/hop/common"
 )
@@ -16,7 +18,6 @@ type Handle struct {
 	readLock  sync.Mutex
 	writeLock sync.Mutex
 
-	underlying UDPLike // outgoing socket-like
 	// recv contains decrypted messages accepted by the Client or Server receive
 	// loop but not yet returned to this Handle's reader.
 	recv *common.DeadlineChan[[]byte]
@@ -27,6 +28,9 @@ type Handle struct {
 	// Constant after initialization
 	clientLeaf *certs.Certificate
 	ss         *SessionState
+
+	// pmtu is nil when path MTU discovery is disabled
+	pmtu *pathMTU
 }
 
 var _ MsgReader = &Handle{}
@@ -36,9 +40,9 @@ var _ MsgConn = &Handle{}
 var _ net.Conn = &Handle{}
 
 func newHandleForSession(underlying UDPLike, ss *SessionState, leaf *certs.Certificate, packetBufLen int) *Handle {
+	ss.conn = underlying
 	return &Handle{
 		recv:       common.NewDeadlineChan[[]byte](packetBufLen),
-		underlying: underlying,
 		ss:         ss,
 		clientLeaf: leaf,
 	}
@@ -76,6 +80,9 @@ func (c *Handle) ReadMsg(b []byte) (int, error) {
 		return 0, err
 	}
 
+	// Messages are copied out, so their buffer can go back to the pool
+	defer putBuffer(msg)
+
 	// If the input is long enough, just copy into it
 	if len(b) >= len(msg) {
 		copy(b, msg)
@@ -111,6 +118,9 @@ func (c *Handle) Read(b []byte) (int, error) {
 		return 0, err
 	}
 
+	// Messages are copied out, so their buffer can go back to the pool
+	defer putBuffer(msg)
+
 	// Copy as much data as possible into the output data
 	n := copy(b, msg)
 	if n == len(msg) {
@@ -121,6 +131,63 @@ func (c *Handle) Read(b []byte) (int, error) {
 	return n, err
 }
 
+// MaxPayload implements MsgConn. It returns the largest message that fits in a
+// single packet on the path to the peer. When path MTU discovery is enabled,
+// this starts at BasePacketSize and grows as larger packets are confirmed.
+// Packets must also fit the carrier of the session, if it limits them, after
+// it has added its own bytes.
+func (c *Handle) MaxPayload() int {
+	c.ss.m.Lock()
+	conn := c.ss.conn
+	c.ss.m.Unlock()
+	n := MaxPlaintextSize
+	if c.pmtu != nil {
+		n = c.pmtu.packetSize() - SessionOverhead - packetExpansion(conn)
+	}
+	if l, ok := conn.(payloadLimiter); ok {
+		n = min(n, l.MaxPayload()-SessionOverhead)
+	}
+	return n
+}
+
+// enablePathMTUDiscovery sets up path MTU discovery state. Until probing
+// starts, MaxPayload reflects BasePacketSize.
+func (c *Handle) enablePathMTUDiscovery() {
+	c.pmtu = newPathMTU()
+}
+
+// startPathMTUDiscovery starts probing the path to the peer, if it has not
+// already started. Probing stops when the session closes.
+func (c *Handle) startPathMTUDiscovery() {
+	c.pmtu.startOnce.Do(func() {
+		go c.pmtu.run(c.sendPMTUProbe)
+	})
+}
+
+// sendPMTUProbe writes a single probe packet of the given size, including the
+// bytes the carrier adds to it. Unlike regular writes, an error does not close
+// the session since oversized probes are expected to fail.
+func (c *Handle) sendPMTUProbe(size int) error {
+	c.ss.m.Lock()
+	overhead := SessionOverhead + packetExpansion(c.ss.conn)
+	c.ss.m.Unlock()
+	if size-overhead < pmtuControlLen {
+		return ErrBufOverflow
+	}
+	b := make([]byte, size-overhead)
+	n := writePMTUProbe(b, size, overhead)
+	return c.sendNoClose(MessageTypeControl, b[:n])
+}
+
+// sendPMTUAck acknowledges a probe of the given size.
+func (c *Handle) sendPMTUAck(size int) {
+	var b [pmtuControlLen]byte
+	n := writePMTUAck(b[:], size)
+	if err := c.sendNoClose(MessageTypeControl, b[:n]); err != nil && err != io.EOF {
+		logrus.Debugf("pmtud: unable to acknowledge probe of %d bytes: %s", size, err)
+	}
+}
+
 // WriteMsg writes b as a single packet. A successful return means the configured
 // UDPLike transport accepted it, not that the peer received it. If b is too
 // long, WriteMsg returns ErrBufOverlow.
@@ -131,6 +198,63 @@ func (c *Handle) WriteMsg(b []byte) error {
 	return c.send(MessageTypeTransport, b)
 }
 
+// WriteMsgs writes each message in msgs as its own packet, in order. Where the
+// platform supports it, the packets are sent with a single system call. Like
+// WriteMsg, a successful return means the transport accepted every packet.
+func (c *Handle) WriteMsgs(msgs [][]byte) error {
+	for _, b := range msgs {
+		if len(b) > MaxPlaintextSize {
+			return ErrBufOverflow
+		}
+	}
+	err := c.writeBatch(msgs)
+	if err != nil && err != io.EOF {
+		go c.Close()
+	}
+	return err
+}
+
+// writeBatch seals msgs and writes them to the session's socket
+func (c *Handle) writeBatch(msgs [][]byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	pkts := make([]datagram, 0, len(msgs))
+	defer func() {
+		for _, pkt := range pkts {
+			putBuffer(pkt.b)
+		}
+	}()
+
+	c.ss.m.Lock()
+	if c.ss.handleState == closed {
+		c.ss.m.Unlock()
+		return io.EOF
+	}
+	for _, b := range msgs {
+		buf := getBuffer(SessionOverhead + len(b))
+		pkt, err := c.ss.sealPacketLocked(buf[:0], MessageTypeTransport, b, c.ss.writeKey)
+		if err != nil {
+			putBuffer(buf)
+			c.ss.m.Unlock()
+			return err
+		}
+		pkts = append(pkts, datagram{b: pkt, addr: c.ss.remoteAddr})
+	}
+	conn, batch := c.ss.conn, c.ss.batch
+	c.ss.m.Unlock()
+
+	if batch != nil {
+		return batch.writeBatch(pkts)
+	}
+	for _, pkt := range pkts {
+		if _, _, err := conn.WriteMsgUDP(pkt.b, nil, pkt.addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Write implements io.Writer. It splits b into transport packets and returns
 // after the configured UDPLike transport accepts each packet; it does not wait
 // for peer receipt.
@@ -159,6 +283,16 @@ func (c *Handle) Write(buf []byte) (int, error) {
 }
 
 func (c *Handle) send(msgType MessageType, b []byte) error {
+	err := c.sendNoClose(msgType, b)
+	if err != nil && err != io.EOF && err != io.ErrShortWrite {
+		go c.Close()
+	}
+	return err
+}
+
+// sendNoClose seals and writes a single packet. Unlike send, it leaves the
+// session open when sealing or writing fails.
+func (c *Handle) sendNoClose(msgType MessageType, b []byte) error {
 	// Preserve packet write order without holding the session lock during
 	// socket I/O. Close only needs the session lock, so a blocked write cannot
 	// prevent it from completing.
@@ -170,17 +304,18 @@ func (c *Handle) send(msgType MessageType, b []byte) error {
 		c.ss.m.Unlock()
 		return io.EOF
 	}
-	pkt, err := c.ss.sealPacketLocked(msgType, b, c.ss.writeKey)
+	buf := getBuffer(SessionOverhead + len(b))
+	defer putBuffer(buf)
+	pkt, err := c.ss.sealPacketLocked(buf[:0], msgType, b, c.ss.writeKey)
 	remoteAddr := c.ss.remoteAddr
+	conn := c.ss.conn
 	c.ss.m.Unlock()
 	if err != nil {
-		go c.Close()
 		return err
 	}
 
-	written, _, err := c.underlying.WriteMsgUDP(pkt, nil, remoteAddr)
+	written, _, err := conn.WriteMsgUDP(pkt, nil, remoteAddr)
 	if err != nil {
-		go c.Close()
 		return err
 	}
 	if written != len(pkt) {
@@ -203,14 +338,21 @@ func (c *Handle) FetchClientLeaf() *certs.Certificate {
 	return c.clientLeaf
 }
 
-// LocalAddr implements net.Conn.
+// LocalAddr implements net.Conn. On a Server with several sockets, it is the
+// address of the socket the peer last sent from.
 func (c *Handle) LocalAddr() net.Addr {
-	return c.underlying.LocalAddr()
+	c.ss.m.Lock()
+	conn := c.ss.conn
+	c.ss.m.Unlock()
+	return conn.LocalAddr()
 }
 
 // RemoteAddr implements net.Conn.
 func (c *Handle) RemoteAddr() net.Addr {
-	return c.underlying.RemoteAddr()
+	c.ss.m.Lock()
+	conn := c.ss.conn
+	c.ss.m.Unlock()
+	return conn.RemoteAddr()
 }
 
 // SetDeadline sets a deadline at which future operations will stop.
@@ -55,6 +55,18 @@ type HandshakeState struct {
 	cookieKey [KeyLen]byte // server only
 
 	cookie []byte // client only
+
+	// puzzleDifficulty is the difficulty of the puzzle the server requires the
+	// client to solve before it replays the cookie, or 0 for no puzzle
+	puzzleDifficulty int
+
+	// pathMTU is set on the client when the server supports path MTU
+	// discovery
+	pathMTU bool
+
+	// socket is the server socket the handshake arrived on. It is only used by
+	// the server.
+	socket *serverSocket
 }
 
 type dhState struct {
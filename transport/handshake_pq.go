@@ -97,7 +97,7 @@ func writePQServerHello(hs *HandshakeState, b []byte) (int, error) {
 
 	// Header
 	b[0] = byte(MessageTypeServerHello)
-	b[1] = 0
+	b[1] = byte(hs.puzzleDifficulty) // Puzzle difficulty
 	b[2] = 0
 	b[3] = 0
 	hs.duplex.Absorb(b[:HeaderLen])
@@ -144,9 +144,10 @@ func readPQServerHello(hs *HandshakeState, b []byte) (int, error) {
 	if MessageType(b[0]) != MessageTypeServerHello {
 		return 0, ErrUnexpectedMessage
 	}
-	if b[1] != 0 || b[2] != 0 || b[3] != 0 {
+	if b[1] > MaxPuzzleDifficulty || b[2] != 0 || b[3] != 0 {
 		return 0, ErrInvalidMessage
 	}
+	hs.puzzleDifficulty = int(b[1])
 	hs.duplex.Absorb(b[:HeaderLen])
 	b = b[HeaderLen:]
 
@@ -177,13 +178,16 @@ func readPQServerHello(hs *HandshakeState, b []byte) (int, error) {
 
 func (hs *HandshakeState) writePQClientAck(b []byte) (int, error) {
 	length := HeaderLen + DHLen + KemKeyLen + PQCookieLen + SNILen + MacLen
+	if hs.puzzleDifficulty > 0 {
+		length += PuzzleNonceLen
+	}
 	if len(b) < length {
 		return 0, ErrBufOverflow
 	}
 
 	// Header
 	b[0] = byte(MessageTypeClientAck)
-	b[1] = 0
+	b[1] = byte(hs.puzzleDifficulty) // Puzzle difficulty
 	b[2] = 0
 	b[3] = 0
 	hs.duplex.Absorb(b[:HeaderLen])
@@ -222,6 +226,13 @@ func (hs *HandshakeState) writePQClientAck(b []byte) (int, error) {
 	// Mac
 	hs.duplex.Squeeze(b[:MacLen])
 	logrus.Debugf("client: PQ client ack mac: %x", b[:MacLen])
+	b = b[MacLen:]
+
+	// Puzzle solution
+	if hs.puzzleDifficulty > 0 {
+		nonce := solvePuzzle(hs.cookie, hs.puzzleDifficulty)
+		copy(b, nonce[:])
+	}
 
 	return length, nil
 }
@@ -237,9 +248,16 @@ func (s *Server) readPQClientAck(b []byte, addr *net.UDPAddr) (int, *HandshakeSt
 	}
 
 	// Header
-	if b[1] != 0 || b[2] != 0 || b[3] != 0 {
+	if b[1] > MaxPuzzleDifficulty || b[2] != 0 || b[3] != 0 {
 		return 0, nil, ErrUnexpectedMessage
 	}
+	difficulty := int(b[1])
+	if difficulty > 0 {
+		length += PuzzleNonceLen
+		if len(b) < length {
+			return 0, nil, ErrBufUnderflow
+		}
+	}
 	header := b[:HeaderLen]
 	b = b[HeaderLen:]
 
@@ -259,7 +277,22 @@ func (s *Server) readPQClientAck(b []byte, addr *net.UDPAddr) (int, *HandshakeSt
 	cookie := b[:PQCookieLen]
 	b = b[PQCookieLen:]
 
-	hs, err := s.ReplayPQDuplexFromCookie(cookie, *kemRemoteEphemeral, addr)
+	// Check the puzzle solution before doing any work for the cookie. The
+	// difficulty is authenticated by the MAC, since it is part of the replayed
+	// Server Hello header.
+	if difficulty < s.requiredPuzzleDifficulty() {
+		s.guard.puzzleRejected.Add(1)
+		return 0, nil, errHandshakeDropped
+	}
+	if difficulty > 0 {
+		nonce := b[SNILen+MacLen : SNILen+MacLen+PuzzleNonceLen]
+		if !puzzleSolved(cookie, nonce, difficulty) {
+			s.guard.puzzleRejected.Add(1)
+			return 0, nil, errHandshakeDropped
+		}
+	}
+
+	hs, err := s.replayPQDuplexFromCookie(cookie, *kemRemoteEphemeral, addr, difficulty)
 	if err != nil {
 		return 0, nil, err
 	}
@@ -301,6 +334,15 @@ func (s *Server) readPQClientAck(b []byte, addr *net.UDPAddr) (int, *HandshakeSt
 	return length, hs, err
 }
 
+// handshakeFlags returns the flags the server sets in a Server Auth or Server
+// Response Hidden
+func (s *Server) handshakeFlags() byte {
+	if s.config.DisablePathMTUDiscovery {
+		return 0
+	}
+	return serverFlagPathMTU
+}
+
 func (s *Server) writePQServerAuth(b []byte, hs *HandshakeState) (int, error) {
 
 	c, err := s.config.GetCertificate(ClientHandshakeInfo{
@@ -317,7 +359,7 @@ func (s *Server) writePQServerAuth(b []byte, hs *HandshakeState) (int, error) {
 	x := b
 	pos := 0
 	x[0] = byte(MessageTypeServerAuth)
-	x[1] = 0
+	x[1] = s.handshakeFlags()
 	x[2] = byte(encCertLen >> 8)
 	x[3] = byte(encCertLen)
 
@@ -392,9 +434,10 @@ func (hs *HandshakeState) readPQServerAuth(b []byte) (int, error) {
 	if mt := MessageType(b[0]); mt != MessageTypeServerAuth {
 		return 0, ErrUnexpectedMessage
 	}
-	if b[1] != 0 {
+	if b[1]&^serverFlagPathMTU != 0 {
 		return 0, ErrInvalidMessage
 	}
+	hs.pathMTU = b[1]&serverFlagPathMTU != 0
 	encryptedCertLen := (int(b[2]) << 8) + int(b[3])
 	logrus.Debugf("client: got encrypted cert length %d", encryptedCertLen)
 	fullLength := minLength + encryptedCertLen
@@ -630,6 +673,12 @@ func (s *Server) readPQClientAuth(b []byte, addr *net.UDPAddr) (int, *HandshakeS
 // equivalent after the server sent the Server Hello message. The returned
 // duplex has not yet processed the Client Ack as in ReplayDuplexFromCookie.
 func (s *Server) ReplayPQDuplexFromCookie(cookie []byte, clientKemEphemeral keys.KEMPublicKey, clientAddr *net.UDPAddr) (*HandshakeState, error) {
+	return s.replayPQDuplexFromCookie(cookie, clientKemEphemeral, clientAddr, 0)
+}
+
+// replayPQDuplexFromCookie is ReplayPQDuplexFromCookie for a Server Hello that
+// required a puzzle of the given difficulty.
+func (s *Server) replayPQDuplexFromCookie(cookie []byte, clientKemEphemeral keys.KEMPublicKey, clientAddr *net.UDPAddr, difficulty int) (*HandshakeState, error) {
 	s.cookieLock.Lock()
 	defer s.cookieLock.Unlock()
 
@@ -640,10 +689,8 @@ func (s *Server) ReplayPQDuplexFromCookie(cookie []byte, clientKemEphemeral keys
 
 	out.kem.remoteEphemeral = clientKemEphemeral
 	out.remoteAddr = clientAddr
-	out.cookieKey = s.cookieKey
-
 	// Pull the shared secret out of the cookie
-	n, k, err := out.decryptCookie(cookie)
+	n, k, err := s.openCookieLocked(out, cookie)
 	if err != nil {
 		logrus.Errorf("unable to decrypt cookie: %s", err)
 		return nil, err
@@ -667,7 +714,7 @@ func (s *Server) ReplayPQDuplexFromCookie(cookie []byte, clientKemEphemeral keys
 	logrus.Debugf("server: regen ch mac: %x", out.macBuf[:])
 
 	// Replay Server Hello
-	out.duplex.Absorb([]byte{byte(MessageTypeServerHello), 0, 0, 0})
+	out.duplex.Absorb([]byte{byte(MessageTypeServerHello), byte(difficulty), 0, 0})
 	out.duplex.Absorb(*k) // KEM ciphertext
 	out.duplex.Absorb(cookie)
 	out.duplex.Squeeze(out.macBuf[:])
@@ -945,7 +992,7 @@ func (s *Server) writePQServerResponseHidden(hs *HandshakeState, b []byte) (int,
 
 	// Header
 	b[0] = byte(MessageTypeServerResponseHidden)
-	b[1] = 0
+	b[1] = s.handshakeFlags()
 	b[2] = byte(encCertLen >> 8)
 	b[3] = byte(encCertLen)
 	hs.duplex.Absorb(b[:HeaderLen])
@@ -1019,9 +1066,10 @@ func (hs *HandshakeState) readPQServerResponseHidden(b []byte) (int, error) {
 	if mt := MessageType(b[0]); mt != MessageTypeServerResponseHidden {
 		return 0, ErrUnexpectedMessage
 	}
-	if b[1] != 0 {
+	if b[1]&^serverFlagPathMTU != 0 {
 		return 0, ErrInvalidMessage
 	}
+	hs.pathMTU = b[1]&serverFlagPathMTU != 0
 	encryptedCertLen := (int(b[2]) << 8) + int(b[3])
 	logrus.Debugf("client: got encrypted cert length %d", encryptedCertLen)
 	fullLength := minLength + encryptedCertLen
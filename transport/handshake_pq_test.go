@@ -56,11 +56,11 @@ func TestPQNoiseXXHandshake(t *testing.T) {
 	serverHs.dh.ephemeral.Generate()
 
 	serverHs.remoteAddr = raddr
-	serverHs.cookieKey = server.cookieKey
+	serverHs.cookieKey = server.cookies.current
 	client.hs.remoteAddr = raddr
 	client.hs.certVerify = &client.config.Verify
 
-	server.createSessionFromHandshakeLocked(serverHs)
+	server.createSessionFromHandshake(serverHs)
 
 	assert.Check(t, cmp.Equal(nil, err))
 
@@ -108,7 +108,7 @@ func TestPQNoiseXXHandshake(t *testing.T) {
 	err = client.hs.deriveFinalKeys(&client.ss.clientToServerKey, &client.ss.serverToClientKey)
 	assert.NilError(t, err)
 
-	serverSs := server.fetchSessionLocked(serverHs.sessionID)
+	serverSs := server.fetchSession(serverHs.sessionID)
 	err = serverHs.deriveFinalKeys(&serverSs.clientToServerKey, &serverSs.serverToClientKey)
 	assert.NilError(t, err)
 
@@ -159,12 +159,12 @@ func TestPQNoiseIKHandshake(t *testing.T) {
 	serverHs.dh.static = server.config.KeyPair
 
 	serverHs.remoteAddr = raddr
-	serverHs.cookieKey = server.cookieKey
+	serverHs.cookieKey = server.cookies.current
 	serverHs.sni = certs.RawStringName("testing")
 	client.hs.remoteAddr = raddr
 	client.hs.certVerify = &client.config.Verify
 
-	server.createSessionFromHandshakeLocked(serverHs)
+	server.createSessionFromHandshake(serverHs)
 	server.setHandshakeState(raddr, serverHs)
 
 	assert.Check(t, cmp.Equal(nil, err))
@@ -186,7 +186,7 @@ func TestPQNoiseIKHandshake(t *testing.T) {
 	err = client.hs.deriveFinalKeys(&client.ss.clientToServerKey, &client.ss.serverToClientKey)
 	assert.NilError(t, err)
 
-	serverSs := server.fetchSessionLocked(serverHs.sessionID)
+	serverSs := server.fetchSession(serverHs.sessionID)
 	err = serverHs.deriveFinalKeys(&serverSs.clientToServerKey, &serverSs.serverToClientKey)
 	assert.NilError(t, err)
 
@@ -14,11 +14,45 @@ type MsgWriter interface {
 	WriteMsg(b []byte) error
 }
 
+// BatchMsgWriter is implemented by message-oriented connections that can write
+// several messages at once, each as its own packet, more cheaply than one at a
+// time.
+type BatchMsgWriter interface {
+	WriteMsgs(msgs [][]byte) error
+}
+
 // MsgConn models message-oriented connections.
 type MsgConn interface {
 	MsgReader
 	MsgWriter
 	net.Conn
+
+	// MaxPayload returns the size of the largest message that is expected to
+	// reach the peer in a single packet. It can change over the lifetime of
+	// the connection.
+	MaxPayload() int
+}
+
+// payloadLimiter is implemented by carriers of transport packets that limit
+// their size, such as tubes relayed by a jump host. MaxPayload is the largest
+// packet they carry.
+type payloadLimiter interface {
+	MaxPayload() int
+}
+
+// packetExpander is implemented by carriers that add bytes to every transport
+// packet they send, such as obfuscation. PacketExpansion is the most bytes
+// they add to a packet.
+type packetExpander interface {
+	PacketExpansion() int
+}
+
+// packetExpansion returns the most bytes conn adds to a packet
+func packetExpansion(conn UDPLike) int {
+	if e, ok := conn.(packetExpander); ok {
+		return e.PacketExpansion()
+	}
+	return 0
 }
 
 // Client implements MsgConn
@@ -27,6 +61,12 @@ var _ MsgConn = &Client{}
 // Handle implements MsgConn
 var _ MsgConn = &Handle{}
 
+// Client and Handle write batches of messages
+var (
+	_ BatchMsgWriter = &Client{}
+	_ BatchMsgWriter = &Handle{}
+)
+
 // UDPMsgConn is an implementations of MsgConn backed by a single UDP socket.
 type UDPMsgConn struct {
 	net.UDPConn
@@ -43,6 +83,12 @@ func (c *UDPMsgConn) WriteMsg(b []byte) (err error) {
 	return
 }
 
+// MaxPayload implements the MsgConn interface. A UDPMsgConn does not perform
+// path MTU discovery, so it relies on IP fragmentation for large messages.
+func (c *UDPMsgConn) MaxPayload() int {
+	return MaxPlaintextSize
+}
+
 // ReadMsg implements the MsgConn interface
 func (c *UDPMsgConn) ReadMsg(b []byte) (n int, err error) {
 	n, _, _, _, err = c.ReadMsgUDP(b, nil)
@@ -0,0 +1,201 @@
+package transport
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	mathRand "math/rand/v2"
+	"net"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/chacha20"
+
+	"hop.computer/hop/common"
+	"hop.computer/hop/keys"
+)
+
+// Packet obfuscation. Hidden mode hides the identity of a server, but Hop
+// packets are still easy to recognize from their message type byte and fixed
+// handshake sizes. An obfuscated connection encapsulates every datagram as
+//
+//	nonce || XChaCha20(key, nonce) XOR (length || packet || padding)
+//
+// so that datagrams look like random bytes of random length. The key is shared
+// by the server and its clients, and is usually derived from the server's
+// hidden mode KEM public key. Obfuscation is not encryption: Hop packets are
+// already authenticated and encrypted, and anyone with the server's public key
+// can remove the obfuscation.
+
+// ObfuscationOverhead is the number of bytes obfuscation adds to each datagram,
+// not including padding
+const ObfuscationOverhead = chacha20.NonceSizeX + 2
+
+// DefaultObfuscationPadding is the default largest number of padding bytes
+// added to each datagram
+const DefaultObfuscationPadding = 128
+
+// ObfuscationConfig configures packet obfuscation for a Client or Server. The
+// client and server must use the same Key.
+type ObfuscationConfig struct {
+	// Key is the shared obfuscation key. ObfuscationKey derives it from the
+	// server's hidden mode KEM public key.
+	Key [chacha20.KeySize]byte
+
+	// MaxPadding is the largest number of random bytes added to a datagram.
+	// Each datagram is padded by a uniformly random amount up to MaxPadding.
+	// Zero uses DefaultObfuscationPadding, and a negative value disables
+	// padding.
+	MaxPadding int
+
+	// Jitter is the largest random delay added before sending a datagram. Zero
+	// sends datagrams immediately. Delayed datagrams can be reordered.
+	Jitter time.Duration
+}
+
+func (c *ObfuscationConfig) maxPadding() int {
+	if c.MaxPadding == 0 {
+		return DefaultObfuscationPadding
+	}
+	return max(c.MaxPadding, 0)
+}
+
+// ObfuscationKey derives an obfuscation key from a server's hidden mode KEM
+// public key
+func ObfuscationKey(pub *keys.KEMPublicKey) ([chacha20.KeySize]byte, error) {
+	var key [chacha20.KeySize]byte
+	if pub == nil || *pub == nil {
+		return key, errors.New("obfuscation requires a KEM public key")
+	}
+	b, err := (*pub).MarshalBinary()
+	if err != nil {
+		return key, err
+	}
+	h := sha256.New()
+	h.Write([]byte("hop packet obfuscation v1"))
+	h.Write(b)
+	h.Sum(key[:0])
+	return key, nil
+}
+
+// obfuscatedConn obfuscates the datagrams written to and read from a UDPLike
+type obfuscatedConn struct {
+	UDPLike
+	config ObfuscationConfig
+}
+
+var _ UDPLike = &obfuscatedConn{}
+
+// NewObfuscatedConn returns a UDPLike that obfuscates the datagrams sent over
+// conn. Datagrams that cannot be deobfuscated are dropped.
+func NewObfuscatedConn(conn UDPLike, config ObfuscationConfig) UDPLike {
+	return &obfuscatedConn{UDPLike: conn, config: config}
+}
+
+// PacketExpansion returns the most bytes obfuscation adds to a datagram
+func (c *obfuscatedConn) PacketExpansion() int {
+	return ObfuscationOverhead + c.config.maxPadding()
+}
+
+// MaxPayload returns the largest datagram that fits in the underlying
+// connection once obfuscated and fully padded
+func (c *obfuscatedConn) MaxPayload() int {
+	if l, ok := c.UDPLike.(payloadLimiter); ok {
+		return l.MaxPayload() - c.PacketExpansion()
+	}
+	return MaxTotalPacketSize - c.PacketExpansion()
+}
+
+// randomUpTo returns a uniformly random integer in [0, n]. Padding lengths and
+// delays do not need to be unpredictable, only varied.
+func randomUpTo(n int64) int64 {
+	if n <= 0 {
+		return 0
+	}
+	return mathRand.Int64N(n + 1)
+}
+
+func (c *obfuscatedConn) xor(nonce, b []byte) {
+	s, err := chacha20.NewUnauthenticatedCipher(c.config.Key[:], nonce)
+	if err != nil {
+		panic(err.Error())
+	}
+	s.XORKeyStream(b, b)
+}
+
+// WriteMsgUDP implements UDPLike
+func (c *obfuscatedConn) WriteMsgUDP(b, oob []byte, addr *net.UDPAddr) (n, oobn int, err error) {
+	if len(b) > MaxTotalPacketSize-ObfuscationOverhead {
+		return 0, 0, ErrBufOverflow
+	}
+	padding := int(randomUpTo(int64(min(c.config.maxPadding(), MaxTotalPacketSize-ObfuscationOverhead-len(b)))))
+	pkt := getBuffer(ObfuscationOverhead + len(b) + padding)
+	nonce := pkt[:chacha20.NonceSizeX]
+	if _, err := rand.Read(nonce); err != nil {
+		putBuffer(pkt)
+		return 0, 0, err
+	}
+	body := pkt[chacha20.NonceSizeX:]
+	binary.BigEndian.PutUint16(body, uint16(len(b)))
+	copy(body[2:], b)
+	// The padding is encrypted, so it does not need to be random
+	clear(body[2+len(b):])
+	c.xor(nonce, body)
+
+	if c.config.Jitter > 0 {
+		delay := time.Duration(randomUpTo(int64(c.config.Jitter)))
+		oob = append([]byte(nil), oob...)
+		time.AfterFunc(delay, func() {
+			defer putBuffer(pkt)
+			if _, _, err := c.UDPLike.WriteMsgUDP(pkt, oob, addr); err != nil {
+				logrus.Debugf("obfuscation: delayed write failed: %s", err)
+			}
+		})
+		return len(b), len(oob), nil
+	}
+	defer putBuffer(pkt)
+	if _, oobn, err = c.UDPLike.WriteMsgUDP(pkt, oob, addr); err != nil {
+		return 0, oobn, err
+	}
+	return len(b), oobn, nil
+}
+
+// ReadMsgUDP implements UDPLike
+func (c *obfuscatedConn) ReadMsgUDP(b, oob []byte) (n, oobn, flags int, addr *net.UDPAddr, err error) {
+	buf := getBuffer(MaxTotalPacketSize)
+	defer putBuffer(buf)
+	for {
+		var read int
+		read, oobn, flags, addr, err = c.UDPLike.ReadMsgUDP(buf, oob)
+		if err != nil {
+			return 0, oobn, flags, addr, err
+		}
+		if read < ObfuscationOverhead {
+			continue
+		}
+		nonce, body := buf[:chacha20.NonceSizeX], buf[chacha20.NonceSizeX:read]
+		c.xor(nonce, body)
+		length := int(binary.BigEndian.Uint16(body))
+		if length > len(body)-2 {
+			if common.Debug {
+				logrus.Tracef("obfuscation: dropping invalid datagram from %s", addr)
+			}
+			continue
+		}
+		n = copy(b, body[2:2+length])
+		return n, oobn, flags, addr, nil
+	}
+}
+
+// Write implements net.Conn for connected sockets
+func (c *obfuscatedConn) Write(b []byte) (int, error) {
+	n, _, err := c.WriteMsgUDP(b, nil, nil)
+	return n, err
+}
+
+// Read implements net.Conn
+func (c *obfuscatedConn) Read(b []byte) (int, error) {
+	n, _, _, _, err := c.ReadMsgUDP(b, nil)
+	return n, err
+}
@@ -0,0 +1,148 @@
+package transport
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+
+	"hop.computer/hop/keys"
+)
+
+func newObfuscationTestKey(t *testing.T) [32]byte {
+	kp, err := keys.GenerateKEMKeyPair(rand.Reader)
+	assert.NilError(t, err)
+	key, err := ObfuscationKey(&kp.Public)
+	assert.NilError(t, err)
+	return key
+}
+
+func TestObfuscatedConn(t *testing.T) {
+	w, r := newBatchTestConns(t)
+	dst := r.LocalAddr().(*net.UDPAddr)
+	config := ObfuscationConfig{Key: newObfuscationTestKey(t)}
+	ow := NewObfuscatedConn(w, config)
+	or := NewObfuscatedConn(r, config)
+
+	r.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, MaxTotalPacketSize)
+	for _, size := range []int{0, 1, 100, 1500, MaxTotalPacketSize - ObfuscationOverhead} {
+		msg := bytes.Repeat([]byte{byte(MessageTypeTransport)}, size)
+		n, _, err := ow.WriteMsgUDP(msg, nil, dst)
+		assert.NilError(t, err)
+		assert.Equal(t, n, size)
+		n, _, _, addr, err := or.ReadMsgUDP(buf, nil)
+		assert.NilError(t, err)
+		assert.Assert(t, bytes.Equal(buf[:n], msg), "size %d", size)
+		assert.Equal(t, addr.String(), w.LocalAddr().String())
+	}
+	_, _, err := ow.WriteMsgUDP(make([]byte, MaxTotalPacketSize), nil, dst)
+	assert.Equal(t, err, ErrBufOverflow)
+
+	// On the wire, datagrams have random lengths and do not contain the packet
+	msg := bytes.Repeat([]byte{byte(MessageTypeTransport)}, 32)
+	lengths := make(map[int]bool)
+	for i := 0; i < 20; i++ {
+		_, _, err := ow.WriteMsgUDP(msg, nil, dst)
+		assert.NilError(t, err)
+		n, _, _, _, err := r.ReadMsgUDP(buf, nil)
+		assert.NilError(t, err)
+		assert.Assert(t, n >= len(msg)+ObfuscationOverhead)
+		assert.Assert(t, n <= len(msg)+ObfuscationOverhead+DefaultObfuscationPadding)
+		assert.Assert(t, !bytes.Contains(buf[:n], msg))
+		lengths[n] = true
+	}
+	assert.Assert(t, len(lengths) > 1)
+}
+
+func TestObfuscatedConnDropsInvalid(t *testing.T) {
+	w, r := newBatchTestConns(t)
+	dst := r.LocalAddr().(*net.UDPAddr)
+	or := NewObfuscatedConn(r, ObfuscationConfig{Key: newObfuscationTestKey(t)})
+	other := NewObfuscatedConn(w, ObfuscationConfig{Key: newObfuscationTestKey(t), MaxPadding: -1})
+
+	// Plain packets, short packets and packets with another key are dropped
+	_, err := w.WriteToUDP([]byte{byte(MessageTypeClientHello), 1, 2, 3}, dst)
+	assert.NilError(t, err)
+	_, _, err = other.WriteMsgUDP([]byte("0123456789"), nil, dst)
+	assert.NilError(t, err)
+	r.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, _, _, _, err = or.ReadMsgUDP(make([]byte, 100), nil)
+	assert.Assert(t, err != nil)
+	assert.Assert(t, err.(net.Error).Timeout())
+}
+
+func TestObfuscatedHandshake(t *testing.T) {
+	key := newObfuscationTestKey(t)
+	pc, err := net.ListenPacket("udp", "localhost:0")
+	assert.NilError(t, err)
+	serverConfig, verifyConfig := newTestServerConfig(t)
+	serverConfig.Obfuscation = &ObfuscationConfig{Key: key, Jitter: 5 * time.Millisecond}
+	s, err := NewServer(pc.(*net.UDPConn), *serverConfig)
+	assert.NilError(t, err)
+	go s.Serve()
+	defer s.Close()
+
+	_, _, clientConfig := newClientAuthAndConfig(t, verifyConfig)
+	clientConfig.Obfuscation = &ObfuscationConfig{Key: key, Jitter: 5 * time.Millisecond}
+	c, err := Dial("udp", s.Addr().String(), *clientConfig)
+	assert.NilError(t, err)
+	defer c.Close()
+	h, err := s.AcceptTimeout(time.Second)
+	assert.NilError(t, err)
+	assert.NilError(t, c.WriteMsg([]byte("hello")))
+	buf := make([]byte, 100)
+	h.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := h.ReadMsg(buf)
+	assert.NilError(t, err)
+	assert.Equal(t, string(buf[:n]), "hello")
+
+	// Clients without the key cannot reach the server
+	clientConfig.Obfuscation = nil
+	clientConfig.HSTimeout = 200 * time.Millisecond
+	_, err = Dial("udp", s.Addr().String(), *clientConfig)
+	assert.Assert(t, err != nil)
+}
+
+func TestObfuscatedMaxPayload(t *testing.T) {
+	key := newObfuscationTestKey(t)
+	pc, err := net.ListenPacket("udp", "localhost:0")
+	assert.NilError(t, err)
+	serverConfig, verifyConfig := newTestServerConfig(t)
+	serverConfig.Obfuscation = &ObfuscationConfig{Key: key}
+	s, err := NewServer(pc.(*net.UDPConn), *serverConfig)
+	assert.NilError(t, err)
+	go s.Serve()
+	defer s.Close()
+
+	_, _, clientConfig := newClientAuthAndConfig(t, verifyConfig)
+	clientConfig.Obfuscation = &ObfuscationConfig{Key: key}
+	c, err := Dial("udp", s.Addr().String(), *clientConfig)
+	assert.NilError(t, err)
+	defer c.Close()
+
+	// A fully padded message of MaxPayload fits in a BasePacketSize datagram
+	expansion := SessionOverhead + ObfuscationOverhead + DefaultObfuscationPadding
+	assert.Equal(t, c.MaxPayload(), BasePacketSize-expansion)
+
+	h, err := s.AcceptTimeout(time.Second)
+	assert.NilError(t, err)
+	deadline := time.Now().Add(10 * time.Second)
+	for c.MaxPayload() <= BasePacketSize-expansion && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Assert(t, c.MaxPayload() > BasePacketSize-expansion)
+	assert.Assert(t, c.MaxPayload() <= MaxTotalPacketSize-expansion)
+
+	msg := make([]byte, c.MaxPayload())
+	msg[len(msg)-1] = 0xff
+	assert.NilError(t, c.WriteMsg(msg))
+	buf := make([]byte, 65535)
+	h.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := h.ReadMsg(buf)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, buf[:n], msg)
+}
@@ -0,0 +1,231 @@
+package transport
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Datagram packetization layer path MTU discovery (DPLPMTUD), following RFC
+// 8899. Each side of a session probes the path in its sending direction with
+// padded control messages. A probe is confirmed when the peer acknowledges it,
+// and the largest confirmed size bounds the size of transport messages.
+//
+// All sizes count the bytes of a whole transport message, which is the UDP
+// payload.
+const (
+	// BasePacketSize is the packet size every path is assumed to support
+	// (BASE_PLPMTU). It matches the minimum datagram size of QUIC.
+	BasePacketSize = 1200
+
+	// MaxProbePacketSize is the largest packet size that will be probed
+	// (MAX_PLPMTU).
+	MaxProbePacketSize = MaxTotalPacketSize
+
+	// SessionOverhead is the number of bytes a transport message adds to its
+	// plaintext.
+	SessionOverhead = HeaderLen + SessionIDLen + CounterLen + TagLen
+
+	// The number of unacknowledged probes of one size before that size is
+	// considered too large (MAX_PROBES)
+	pmtuMaxProbes = 3
+
+	// How long to wait before searching for a larger size again (PMTU_RAISE_TIMER)
+	pmtuRaiseInterval = 10 * time.Minute
+
+	// How long to wait for a probe acknowledgement (PROBE_TIMER)
+	pmtuProbeTimeout = time.Second
+
+	// The search stops once the bounds are this close together
+	pmtuSearchGranularity = 16
+
+	// The length of the control message type and the probe size
+	pmtuControlLen = 3
+)
+
+// pathMTU tracks the path MTU discovery state of a single session.
+type pathMTU struct {
+	m sync.Mutex
+
+	// The largest confirmed packet size
+	// +checklocks:m
+	current int
+
+	// How long to wait for a probe acknowledgement
+	probeTimeout time.Duration
+
+	// acked receives the sizes of acknowledged probes
+	acked chan int
+	// migrated is signaled when the peer changes address
+	migrated chan struct{}
+	// done is closed when the session closes
+	done      chan struct{}
+	stopOnce  sync.Once
+	startOnce sync.Once
+}
+
+func newPathMTU() *pathMTU {
+	return &pathMTU{
+		current:      BasePacketSize,
+		probeTimeout: pmtuProbeTimeout,
+		acked:        make(chan int, 1),
+		migrated:     make(chan struct{}, 1),
+		done:         make(chan struct{}),
+	}
+}
+
+// packetSize returns the largest confirmed packet size
+func (p *pathMTU) packetSize() int {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.current
+}
+
+func (p *pathMTU) setPacketSize(size int) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.current = size
+}
+
+// ack records the acknowledgement of a probe. It does not block.
+func (p *pathMTU) ack(size int) {
+	select {
+	case p.acked <- size:
+	default:
+	}
+}
+
+// migrate requests that the current packet size be validated on the new path.
+// It does not block.
+func (p *pathMTU) migrate() {
+	select {
+	case p.migrated <- struct{}{}:
+	default:
+	}
+}
+
+func (p *pathMTU) stop() {
+	p.stopOnce.Do(func() { close(p.done) })
+}
+
+// The outcome of probing a single packet size
+type probeResult int
+
+const (
+	probeLost probeResult = iota
+	probeConfirmed
+	probeMigrated
+	probeStopped
+)
+
+// probe sends up to pmtuMaxProbes probes of the given size and waits for one
+// of them to be acknowledged.
+func (p *pathMTU) probe(size int, sendProbe func(size int) error) probeResult {
+	timer := time.NewTimer(p.probeTimeout)
+	defer timer.Stop()
+
+	for probes := 0; probes < pmtuMaxProbes; probes++ {
+		if err := sendProbe(size); err != nil {
+			logrus.Debugf("pmtud: unable to send probe of %d bytes: %s", size, err)
+			return probeLost
+		}
+		timer.Reset(p.probeTimeout)
+		for waiting := true; waiting; {
+			select {
+			case acked := <-p.acked:
+				// Acknowledgements of earlier probes are ignored
+				if acked == size {
+					return probeConfirmed
+				}
+			case <-timer.C:
+				waiting = false
+			case <-p.migrated:
+				return probeMigrated
+			case <-p.done:
+				return probeStopped
+			}
+		}
+	}
+	return probeLost
+}
+
+// run searches for the largest packet size supported by the path until stop is
+// called. sendProbe writes a single probe packet of the given size. A write
+// error counts as a lost probe.
+func (p *pathMTU) run(sendProbe func(size int) error) {
+	low := p.packetSize()
+	high := MaxProbePacketSize
+	validating := false
+
+	raiseTimer := time.NewTimer(pmtuRaiseInterval)
+	defer raiseTimer.Stop()
+
+	for {
+		// Pick the next size to probe, or wait if the search is complete.
+		var size int
+		switch {
+		case validating:
+			size = low
+		case high-low >= pmtuSearchGranularity:
+			size = (low + high + 1) / 2
+		default:
+			select {
+			case <-raiseTimer.C:
+				high = MaxProbePacketSize
+			case <-p.migrated:
+				validating = low > BasePacketSize
+			case <-p.done:
+				return
+			}
+			raiseTimer.Reset(pmtuRaiseInterval)
+			continue
+		}
+
+		result := p.probe(size, sendProbe)
+		switch {
+		case result == probeStopped:
+			return
+		case result == probeMigrated:
+			validating = low > BasePacketSize
+		case result == probeConfirmed && validating:
+			// The new path supports the current size, keep searching upwards
+			validating = false
+			high = MaxProbePacketSize
+		case result == probeConfirmed:
+			low = size
+			p.setPacketSize(size)
+			logrus.Debugf("pmtud: confirmed packet size %d", size)
+		case validating:
+			// The new path does not support the current size. Fall back to
+			// the base size and search below the previous size.
+			validating = false
+			low = BasePacketSize
+			high = size - 1
+			p.setPacketSize(BasePacketSize)
+			logrus.Debugf("pmtud: packet size %d not supported after migration", size)
+		default:
+			high = size - 1
+		}
+	}
+}
+
+// writePMTUProbe writes the plaintext of a probe control message of the given
+// total packet size into b, and returns its length. overhead is the number of
+// bytes added to the plaintext on its way to the wire.
+func writePMTUProbe(b []byte, size, overhead int) int {
+	n := size - overhead
+	b[0] = byte(ControlMessagePMTUProbe)
+	binary.BigEndian.PutUint16(b[1:pmtuControlLen], uint16(size))
+	clear(b[pmtuControlLen:n])
+	return n
+}
+
+// writePMTUAck writes the plaintext of the acknowledgement of a probe of the
+// given size into b, and returns its length.
+func writePMTUAck(b []byte, size int) int {
+	b[0] = byte(ControlMessagePMTUAck)
+	binary.BigEndian.PutUint16(b[1:pmtuControlLen], uint16(size))
+	return pmtuControlLen
+}
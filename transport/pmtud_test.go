@@ -0,0 +1,160 @@
+package transport
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+// simulatedPath acknowledges probes no larger than its MTU
+type simulatedPath struct {
+	mtu atomic.Int64
+	p   *pathMTU
+}
+
+func (s *simulatedPath) sendProbe(size int) error {
+	if int64(size) <= s.mtu.Load() {
+		go s.p.ack(size)
+	}
+	return nil
+}
+
+const testProbeTimeout = 10 * time.Millisecond
+
+func newTestPath(mtu int) *simulatedPath {
+	path := &simulatedPath{p: newPathMTU()}
+	path.p.probeTimeout = testProbeTimeout
+	path.mtu.Store(int64(mtu))
+	return path
+}
+
+func waitForPacketSize(t *testing.T, p *pathMTU, low, high int) {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		size := p.packetSize()
+		if size >= low && size <= high {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("packet size %d did not converge to [%d, %d]", p.packetSize(), low, high)
+}
+
+func TestPathMTUSearch(t *testing.T) {
+	path := newTestPath(1500)
+	p := path.p
+	go p.run(path.sendProbe)
+	defer p.stop()
+
+	waitForPacketSize(t, p, 1500-pmtuSearchGranularity, 1500)
+}
+
+func TestPathMTUMigration(t *testing.T) {
+	path := newTestPath(9000)
+	p := path.p
+	go p.run(path.sendProbe)
+	defer p.stop()
+
+	waitForPacketSize(t, p, 9000-pmtuSearchGranularity, 9000)
+
+	// The new path has a smaller MTU, so the current size fails validation
+	path.mtu.Store(1400)
+	p.migrate()
+	waitForPacketSize(t, p, 1400-pmtuSearchGranularity, 1400)
+
+	// The new path supports the current size, which is kept
+	p.migrate()
+	time.Sleep(10 * testProbeTimeout)
+	waitForPacketSize(t, p, 1400-pmtuSearchGranularity, 1400)
+}
+
+func TestPathMTUUnreachable(t *testing.T) {
+	path := newTestPath(0)
+	p := path.p
+	go p.run(path.sendProbe)
+
+	time.Sleep(20 * testProbeTimeout)
+	p.stop()
+	assert.Equal(t, p.packetSize(), BasePacketSize)
+}
+
+func TestPathMTUDiscovery(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "localhost:0")
+	assert.NilError(t, err)
+	sc, vc := newTestServerConfig(t)
+	s, err := NewServer(pc.(*net.UDPConn), *sc)
+	assert.NilError(t, err)
+	go s.Serve()
+	defer s.Close()
+
+	_, _, cc := newClientAuthAndConfig(t, vc)
+	c, err := Dial("udp", s.Addr().String(), *cc)
+	assert.NilError(t, err)
+	defer c.Close()
+	assert.Equal(t, c.MaxPayload(), BasePacketSize-SessionOverhead)
+
+	h, err := s.AcceptTimeout(time.Second)
+	assert.NilError(t, err)
+
+	// Loopback interfaces support packets much larger than the base size
+	deadline := time.Now().Add(10 * time.Second)
+	for c.MaxPayload() <= BasePacketSize-SessionOverhead && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Assert(t, c.MaxPayload() > BasePacketSize-SessionOverhead)
+
+	// A message of the discovered size is delivered in one piece
+	msg := make([]byte, c.MaxPayload())
+	msg[len(msg)-1] = 0xff
+	assert.NilError(t, c.WriteMsg(msg))
+
+	buf := make([]byte, 65535)
+	h.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := h.ReadMsg(buf)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, buf[:n], msg)
+}
+
+func TestPathMTUNegotiation(t *testing.T) {
+	for _, tc := range []struct {
+		name                         string
+		disableServer, disableClient bool
+		serverPayload                int
+	}{
+		{name: "server disabled", disableServer: true, serverPayload: MaxPlaintextSize},
+		// The server does not know the path, so it keeps to the base size
+		{name: "client disabled", disableClient: true, serverPayload: BasePacketSize - SessionOverhead},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pc, err := net.ListenPacket("udp", "localhost:0")
+			assert.NilError(t, err)
+			sc, vc := newTestServerConfig(t)
+			sc.DisablePathMTUDiscovery = tc.disableServer
+			s, err := NewServer(pc.(*net.UDPConn), *sc)
+			assert.NilError(t, err)
+			go s.Serve()
+			defer s.Close()
+
+			_, _, cc := newClientAuthAndConfig(t, vc)
+			cc.DisablePathMTUDiscovery = tc.disableClient
+			c, err := Dial("udp", s.Addr().String(), *cc)
+			assert.NilError(t, err)
+			defer c.Close()
+			h, err := s.AcceptTimeout(time.Second)
+			assert.NilError(t, err)
+
+			// Neither side probes
+			assert.NilError(t, c.WriteMsg([]byte("hello")))
+			buf := make([]byte, 100)
+			h.SetReadDeadline(time.Now().Add(time.Second))
+			_, err = h.ReadMsg(buf)
+			assert.NilError(t, err)
+			time.Sleep(100 * time.Millisecond)
+			assert.Equal(t, c.MaxPayload(), MaxPlaintextSize)
+			assert.Equal(t, h.MaxPayload(), tc.serverPayload)
+		})
+	}
+}
@@ -0,0 +1,383 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Client proxies. A Client can reach its server through a SOCKS5 proxy, which
+// relays its datagrams with UDP ASSOCIATE (RFC 1928), or through an HTTP proxy,
+// which tunnels a stream to a StreamListener with CONNECT. Proxies only carry
+// packets: the Hop handshake still authenticates the server end to end.
+
+// SOCKS5 protocol constants from RFC 1928 and RFC 1929
+const (
+	socks5Version      = 0x05
+	socks5AuthNone     = 0x00
+	socks5AuthPassword = 0x02
+	socks5PasswordVer  = 0x01
+	socks5CmdConnect   = 0x01
+	socks5CmdAssociate = 0x03
+	socks5AtypIPv4     = 0x01
+	socks5AtypDomain   = 0x03
+	socks5AtypIPv6     = 0x04
+	socks5ReplySuccess = 0x00
+)
+
+// ErrProxy is returned when a proxy refuses a request
+var ErrProxy = errors.New("proxy error")
+
+// ErrUnsupportedProxy is returned for proxy URLs with an unknown scheme
+var ErrUnsupportedProxy = errors.New("unsupported proxy scheme")
+
+// isSOCKS5Proxy reports whether proxy relays UDP
+func isSOCKS5Proxy(proxy *url.URL) bool {
+	return proxy.Scheme == "socks5" || proxy.Scheme == "socks5h"
+}
+
+// checkProxy returns an error if proxy is not a supported proxy URL
+func checkProxy(proxy *url.URL) error {
+	if proxy == nil {
+		return nil
+	}
+	switch proxy.Scheme {
+	case "socks5", "socks5h", "http", "https":
+		return nil
+	}
+	return fmt.Errorf("%w %q", ErrUnsupportedProxy, proxy.Scheme)
+}
+
+// proxyAddress returns the host:port of proxy, with the default port for its
+// scheme if it has none
+func proxyAddress(proxy *url.URL) string {
+	if proxy.Port() != "" {
+		return proxy.Host
+	}
+	port := "1080"
+	switch proxy.Scheme {
+	case "http":
+		port = "80"
+	case "https":
+		port = "443"
+	}
+	return net.JoinHostPort(proxy.Hostname(), port)
+}
+
+// dialProxyStream opens a TCP stream to address through proxy. A nil proxy
+// dials address directly.
+func dialProxyStream(ctx context.Context, nd *net.Dialer, proxy *url.URL, address string) (net.Conn, error) {
+	if proxy == nil {
+		return nd.DialContext(ctx, "tcp", address)
+	}
+	if err := checkProxy(proxy); err != nil {
+		return nil, err
+	}
+	conn, err := nd.DialContext(ctx, "tcp", proxyAddress(proxy))
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if isSOCKS5Proxy(proxy) {
+		_, err = socks5Request(conn, proxy, socks5CmdConnect, address)
+	} else {
+		conn, err = httpConnect(ctx, conn, proxy, address)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// httpConnect asks the HTTP proxy on conn to tunnel to address
+func httpConnect(ctx context.Context, conn net.Conn, proxy *url.URL, address string) (net.Conn, error) {
+	if proxy.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxy.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return conn, err
+		}
+		conn = tlsConn
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		return conn, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return conn, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return conn, fmt.Errorf("%w: CONNECT %s: %s", ErrProxy, address, resp.Status)
+	}
+	if br.Buffered() > 0 {
+		return conn, fmt.Errorf("%w: CONNECT %s: unexpected data after response", ErrProxy, address)
+	}
+	return conn, nil
+}
+
+// socks5Authenticate negotiates an authentication method with the SOCKS5 proxy
+// on conn, using the username and password in proxy if there are any
+func socks5Authenticate(conn net.Conn, proxy *url.URL) error {
+	method := byte(socks5AuthNone)
+	if proxy.User != nil {
+		method = socks5AuthPassword
+	}
+	if _, err := conn.Write([]byte{socks5Version, 1, method}); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != socks5Version || reply[1] != method {
+		return fmt.Errorf("%w: no acceptable SOCKS5 authentication method", ErrProxy)
+	}
+	if method == socks5AuthNone {
+		return nil
+	}
+
+	username := proxy.User.Username()
+	password, _ := proxy.User.Password()
+	if len(username) > 255 || len(password) > 255 {
+		return fmt.Errorf("%w: SOCKS5 username or password too long", ErrProxy)
+	}
+	msg := []byte{socks5PasswordVer, byte(len(username))}
+	msg = append(msg, username...)
+	msg = append(msg, byte(len(password)))
+	msg = append(msg, password...)
+	if _, err := conn.Write(msg); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[1] != 0 {
+		return fmt.Errorf("%w: SOCKS5 authentication failed", ErrProxy)
+	}
+	return nil
+}
+
+// appendSOCKS5Addr appends address in SOCKS5 ATYP || ADDR || PORT form
+func appendSOCKS5Addr(b []byte, address string) ([]byte, error) {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portString)
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		if ip = ip.Unmap(); ip.Is4() {
+			b = append(b, socks5AtypIPv4)
+		} else {
+			b = append(b, socks5AtypIPv6)
+		}
+		b = append(b, ip.AsSlice()...)
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("host name %q too long", host)
+		}
+		b = append(b, socks5AtypDomain, byte(len(host)))
+		b = append(b, host...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+}
+
+// readSOCKS5Addr reads an address in SOCKS5 ATYP || ADDR || PORT form from r
+func readSOCKS5Addr(r io.Reader) (netip.AddrPort, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return netip.AddrPort{}, err
+	}
+	var addr []byte
+	switch atyp[0] {
+	case socks5AtypIPv4:
+		addr = make([]byte, 4+2)
+	case socks5AtypIPv6:
+		addr = make([]byte, 16+2)
+	case socks5AtypDomain:
+		// Bound addresses are not expected to be names, but they must be read
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return netip.AddrPort{}, err
+		}
+		if _, err := io.ReadFull(r, make([]byte, int(n[0])+2)); err != nil {
+			return netip.AddrPort{}, err
+		}
+		return netip.AddrPort{}, nil
+	default:
+		return netip.AddrPort{}, fmt.Errorf("%w: invalid SOCKS5 address type %d", ErrProxy, atyp[0])
+	}
+	if _, err := io.ReadFull(r, addr); err != nil {
+		return netip.AddrPort{}, err
+	}
+	ip, _ := netip.AddrFromSlice(addr[:len(addr)-2])
+	return netip.AddrPortFrom(ip.Unmap(), binary.BigEndian.Uint16(addr[len(addr)-2:])), nil
+}
+
+// socks5Request authenticates with the SOCKS5 proxy on conn and sends it a
+// request. It returns the bound address from the proxy's reply.
+func socks5Request(conn net.Conn, proxy *url.URL, cmd byte, address string) (netip.AddrPort, error) {
+	if err := socks5Authenticate(conn, proxy); err != nil {
+		return netip.AddrPort{}, err
+	}
+	req, err := appendSOCKS5Addr([]byte{socks5Version, cmd, 0}, address)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	if _, err := conn.Write(req); err != nil {
+		return netip.AddrPort{}, err
+	}
+	var reply [3]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return netip.AddrPort{}, err
+	}
+	if reply[0] != socks5Version {
+		return netip.AddrPort{}, fmt.Errorf("%w: invalid SOCKS5 reply", ErrProxy)
+	}
+	if reply[1] != socks5ReplySuccess {
+		return netip.AddrPort{}, fmt.Errorf("%w: SOCKS5 request failed with code %d", ErrProxy, reply[1])
+	}
+	return readSOCKS5Addr(conn)
+}
+
+// socks5UDPConn relays the datagrams of a Client through a SOCKS5 proxy. The
+// association lasts as long as the control connection to the proxy.
+type socks5UDPConn struct {
+	*net.UDPConn
+	control net.Conn
+}
+
+var _ UDPLike = &socks5UDPConn{}
+
+// dialSOCKS5UDP asks the SOCKS5 proxy to relay UDP datagrams and returns a
+// UDPLike that sends datagrams through the relay
+func dialSOCKS5UDP(ctx context.Context, nd *net.Dialer, proxy *url.URL) (UDPLike, error) {
+	control, err := nd.DialContext(ctx, "tcp", proxyAddress(proxy))
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		control.SetDeadline(deadline)
+	}
+	// The client address is not known before the socket is opened, so it is
+	// left unspecified
+	relay, err := socks5Request(control, proxy, socks5CmdAssociate, "0.0.0.0:0")
+	if err != nil {
+		control.Close()
+		return nil, err
+	}
+	control.SetDeadline(time.Time{})
+	if !relay.IsValid() || relay.Addr().IsUnspecified() {
+		// The relay is on the proxy itself
+		proxyIP := control.RemoteAddr().(*net.TCPAddr).AddrPort().Addr()
+		relay = netip.AddrPortFrom(proxyIP.Unmap(), relay.Port())
+	}
+	udpConn, err := net.DialUDP(udp, nil, net.UDPAddrFromAddrPort(relay))
+	if err != nil {
+		control.Close()
+		return nil, err
+	}
+	logrus.Debugf("proxy: relaying UDP through %s", relay)
+
+	c := &socks5UDPConn{UDPConn: udpConn, control: control}
+	go func() {
+		// The proxy ends the association by closing the control connection
+		io.Copy(io.Discard, control)
+		udpConn.Close()
+	}()
+	return c, nil
+}
+
+// WriteMsgUDP implements UDPLike. The datagram is relayed to addr.
+func (c *socks5UDPConn) WriteMsgUDP(b, oob []byte, addr *net.UDPAddr) (n, oobn int, err error) {
+	if addr == nil {
+		return 0, 0, errors.New("SOCKS5 relay requires a destination address")
+	}
+	// RSV || FRAG || ATYP || DST.ADDR || DST.PORT
+	var hdrBuf [3 + 1 + 16 + 2]byte
+	hdr, err := appendSOCKS5Addr(hdrBuf[:3], addr.AddrPort().String())
+	if err != nil {
+		return 0, 0, err
+	}
+	pkt := getBuffer(len(hdr) + len(b))
+	defer putBuffer(pkt)
+	copy(pkt, hdr)
+	copy(pkt[len(hdr):], b)
+	if _, err := c.UDPConn.Write(pkt); err != nil {
+		return 0, 0, err
+	}
+	return len(b), 0, nil
+}
+
+// ReadMsgUDP implements UDPLike. The address of a datagram is the address it
+// was relayed from.
+func (c *socks5UDPConn) ReadMsgUDP(b, oob []byte) (n, oobn, flags int, addr *net.UDPAddr, err error) {
+	buf := getBuffer(65535)
+	defer putBuffer(buf)
+	for {
+		read, err := c.UDPConn.Read(buf)
+		if err != nil {
+			return 0, 0, 0, nil, err
+		}
+		// Fragmented datagrams are not supported and are dropped
+		if read < 3 || buf[2] != 0 {
+			continue
+		}
+		r := bytes.NewReader(buf[3:read])
+		src, err := readSOCKS5Addr(r)
+		if err != nil || !src.IsValid() {
+			continue
+		}
+		n = copy(b, buf[read-r.Len():read])
+		return n, 0, 0, net.UDPAddrFromAddrPort(src), nil
+	}
+}
+
+// Write implements net.Conn. A relayed socket has no default destination.
+func (c *socks5UDPConn) Write(b []byte) (int, error) {
+	return 0, errors.New("SOCKS5 relay requires a destination address")
+}
+
+// Read implements net.Conn
+func (c *socks5UDPConn) Read(b []byte) (int, error) {
+	n, _, _, _, err := c.ReadMsgUDP(b, nil)
+	return n, err
+}
+
+// Close ends the association and closes the socket
+func (c *socks5UDPConn) Close() error {
+	c.control.Close()
+	return c.UDPConn.Close()
+}
@@ -0,0 +1,257 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+// testSOCKS5Proxy is a SOCKS5 proxy that supports CONNECT and UDP ASSOCIATE
+// with username and password authentication
+type testSOCKS5Proxy struct {
+	ln                 net.Listener
+	username, password string
+}
+
+func newTestSOCKS5Proxy(t *testing.T, username, password string) *testSOCKS5Proxy {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	p := &testSOCKS5Proxy{ln: ln, username: username, password: password}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(conn)
+		}
+	}()
+	return p
+}
+
+func (p *testSOCKS5Proxy) url() *url.URL {
+	return &url.URL{Scheme: "socks5", Host: p.ln.Addr().String(), User: url.UserPassword(p.username, p.password)}
+}
+
+func (p *testSOCKS5Proxy) serve(conn net.Conn) {
+	defer conn.Close()
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		return
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn, methods); err != nil || !bytes.Contains(methods, []byte{socks5AuthPassword}) {
+		return
+	}
+	conn.Write([]byte{socks5Version, socks5AuthPassword})
+
+	// Username and password
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		return
+	}
+	username := make([]byte, hdr[1])
+	io.ReadFull(conn, username)
+	io.ReadFull(conn, hdr[:1])
+	password := make([]byte, hdr[0])
+	io.ReadFull(conn, password)
+	if string(username) != p.username || string(password) != p.password {
+		conn.Write([]byte{socks5PasswordVer, 1})
+		return
+	}
+	conn.Write([]byte{socks5PasswordVer, 0})
+
+	req := make([]byte, 3)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return
+	}
+	dst, err := readSOCKS5Addr(conn)
+	if err != nil {
+		return
+	}
+	switch req[1] {
+	case socks5CmdConnect:
+		upstream, err := net.Dial("tcp", dst.String())
+		if err != nil {
+			conn.Write([]byte{socks5Version, 5, 0, socks5AtypIPv4, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer upstream.Close()
+		conn.Write([]byte{socks5Version, socks5ReplySuccess, 0, socks5AtypIPv4, 0, 0, 0, 0, 0, 0})
+		go io.Copy(upstream, conn)
+		io.Copy(conn, upstream)
+	case socks5CmdAssociate:
+		relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			return
+		}
+		defer relay.Close()
+		reply, _ := appendSOCKS5Addr([]byte{socks5Version, socks5ReplySuccess, 0}, relay.LocalAddr().String())
+		conn.Write(reply)
+		go p.relay(relay)
+		io.Copy(io.Discard, conn)
+	}
+}
+
+// relay forwards datagrams between the client and the servers it sends to
+func (p *testSOCKS5Proxy) relay(relay *net.UDPConn) {
+	var client netip.AddrPort
+	buf := make([]byte, 65535)
+	for {
+		n, src, err := relay.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return
+		}
+		if !client.IsValid() || src == client {
+			client = src
+			r := bytes.NewReader(buf[3:n])
+			dst, err := readSOCKS5Addr(r)
+			if err != nil {
+				continue
+			}
+			relay.WriteToUDPAddrPort(buf[n-r.Len():n], dst)
+			continue
+		}
+		pkt, _ := appendSOCKS5Addr([]byte{0, 0, 0}, src.String())
+		relay.WriteToUDPAddrPort(append(pkt, buf[:n]...), client)
+	}
+}
+
+// newTestHTTPProxy returns the URL of an HTTP proxy that supports CONNECT with
+// basic authentication
+func newTestHTTPProxy(t *testing.T, username, password string) *url.URL {
+	expected := "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Header.Get("Proxy-Authorization") != expected {
+			http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+			return
+		}
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			upstream.Close()
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go func() {
+			io.Copy(upstream, conn)
+			upstream.Close()
+		}()
+		io.Copy(conn, upstream)
+		conn.Close()
+	}))
+	t.Cleanup(s.Close)
+	u, err := url.Parse(s.URL)
+	assert.NilError(t, err)
+	u.User = url.UserPassword(username, password)
+	return u
+}
+
+// checkProxiedClient handshakes c and exchanges messages with the server
+func checkProxiedClient(t *testing.T, s *Server, c *Client) {
+	assert.NilError(t, c.Handshake())
+	h, err := s.AcceptTimeout(time.Second)
+	assert.NilError(t, err)
+	assert.NilError(t, c.WriteMsg([]byte("hello")))
+	buf := make([]byte, 100)
+	h.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := h.ReadMsg(buf)
+	assert.NilError(t, err)
+	assert.Equal(t, string(buf[:n]), "hello")
+	assert.NilError(t, h.WriteMsg([]byte("world")))
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	n, err = c.ReadMsg(buf)
+	assert.NilError(t, err)
+	assert.Equal(t, string(buf[:n]), "world")
+}
+
+func TestSOCKS5Proxy(t *testing.T) {
+	s, clientConfig := newDialerTestServer(t)
+	proxy := newTestSOCKS5Proxy(t, "user", "secret")
+	clientConfig.Proxy = proxy.url()
+
+	c, err := DialWithDialer(&net.Dialer{}, "udp", s.Addr().String(), *clientConfig)
+	assert.NilError(t, err)
+	checkProxiedClient(t, s, c)
+	c.Close()
+
+	var d Dialer
+	c, err = d.DialAddrs(context.Background(), []netip.AddrPort{s.Addr().(*net.UDPAddr).AddrPort()}, *clientConfig)
+	assert.NilError(t, err)
+	checkProxiedClient(t, s, c)
+	c.Close()
+
+	clientConfig.Proxy.User = url.UserPassword("user", "wrong")
+	_, err = DialWithDialer(&net.Dialer{}, "udp", s.Addr().String(), *clientConfig)
+	assert.Assert(t, errors.Is(err, ErrProxy))
+}
+
+func TestHTTPProxy(t *testing.T) {
+	tcp, err := ListenStream("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	ws, err := ListenWebSocket("tcp", "127.0.0.1:0", DefaultWebSocketPath)
+	assert.NilError(t, err)
+	serverConfig, verifyConfig := newTestServerConfig(t)
+	s, err := NewMultiServer([]UDPLike{tcp, ws}, *serverConfig)
+	assert.NilError(t, err)
+	go s.Serve()
+	defer s.Close()
+	_, _, clientConfig := newClientAuthAndConfig(t, verifyConfig)
+	clientConfig.HSTimeout = 5 * time.Second
+	clientConfig.Proxy = newTestHTTPProxy(t, "user", "secret")
+
+	c, err := DialWithDialer(&net.Dialer{}, "udp", tcp.LocalAddr().String(), *clientConfig)
+	assert.NilError(t, err)
+	checkProxiedClient(t, s, c)
+	c.Close()
+
+	// The fallback URL is dialed through the proxy without trying UDP
+	d := Dialer{FallbackURL: "ws://" + ws.LocalAddr().String() + DefaultWebSocketPath}
+	c, err = d.DialContext(context.Background(), "udp", "127.0.0.1:1", *clientConfig)
+	assert.NilError(t, err)
+	checkProxiedClient(t, s, c)
+	c.Close()
+
+	clientConfig.Proxy.User = url.UserPassword("user", "wrong")
+	_, err = DialWithDialer(&net.Dialer{}, "udp", tcp.LocalAddr().String(), *clientConfig)
+	assert.Assert(t, errors.Is(err, ErrProxy))
+
+	clientConfig.Proxy = &url.URL{Scheme: "ftp", Host: "127.0.0.1:21"}
+	_, err = DialWithDialer(&net.Dialer{}, "udp", tcp.LocalAddr().String(), *clientConfig)
+	assert.Assert(t, errors.Is(err, ErrUnsupportedProxy))
+}
+
+func TestSOCKS5Addr(t *testing.T) {
+	for _, address := range []string{"192.0.2.1:77", "[2001:db8::1]:77"} {
+		b, err := appendSOCKS5Addr(nil, address)
+		assert.NilError(t, err)
+		addr, err := readSOCKS5Addr(bytes.NewReader(b))
+		assert.NilError(t, err)
+		assert.Equal(t, addr.String(), address)
+	}
+	b, err := appendSOCKS5Addr(nil, "example.com:77")
+	assert.NilError(t, err)
+	assert.Equal(t, b[0], byte(socks5AtypDomain))
+	assert.Equal(t, int(b[1]), len("example.com"))
+	assert.Equal(t, binary.BigEndian.Uint16(b[len(b)-2:]), uint16(77))
+}
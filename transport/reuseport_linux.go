@@ -0,0 +1,103 @@
+//go:build linux
+
+package transport
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// ListenReusePort opens n UDP sockets bound to the same address with
+// SO_REUSEPORT, for a Server with a receive loop per socket. The kernel
+// spreads handshakes over the sockets by a hash of their addresses, and a BPF
+// program steers session packets to the socket of the shard encoded in their
+// session ID, so they still reach the right receive loop after NAT rebinding.
+func ListenReusePort(network, address string, n int) ([]UDPLike, error) {
+	if n < 1 || n > MaxShards {
+		return nil, fmt.Errorf("number of sockets must be between 1 and %d", MaxShards)
+	}
+	lc := net.ListenConfig{
+		Control: func(network, address string, rc syscall.RawConn) error {
+			var sockErr error
+			err := rc.Control(func(fd uintptr) {
+				sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+
+	conns := make([]UDPLike, 0, n)
+	closeAll := func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}
+	for i := 0; i < n; i++ {
+		pc, err := lc.ListenPacket(context.Background(), network, address)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		udpConn := pc.(*net.UDPConn)
+		conns = append(conns, udpConn)
+		if i > 0 {
+			continue
+		}
+		// The other sockets join the group on the port the first was given
+		address = udpConn.LocalAddr().String()
+		if n > 1 {
+			if err := attachSteeringProgram(udpConn, n); err != nil {
+				closeAll()
+				return nil, fmt.Errorf("unable to attach reuseport program: %w", err)
+			}
+		}
+	}
+	return conns, nil
+}
+
+// steeringProgram returns a classic BPF program that selects the socket for a
+// packet out of a reuseport group of n sockets. Session packets go to the
+// socket of the shard in their session ID. The program returns an invalid
+// index for other packets, so the kernel falls back to its hash.
+func steeringProgram(n int) []unix.SockFilter {
+	return []unix.SockFilter{
+		// A = message type
+		{Code: unix.BPF_LD | unix.BPF_B | unix.BPF_ABS, K: 0},
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 1, K: uint32(MessageTypeTransport)},
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jf: 3, K: uint32(MessageTypeControl)},
+		// A = shardForSession(sessionID, n)
+		{Code: unix.BPF_LD | unix.BPF_B | unix.BPF_ABS, K: HeaderLen},
+		{Code: unix.BPF_ALU | unix.BPF_MOD | unix.BPF_K, K: uint32(n)},
+		{Code: unix.BPF_RET | unix.BPF_A},
+		{Code: unix.BPF_RET | unix.BPF_K, K: 0xffffffff},
+	}
+}
+
+// attachSteeringProgram attaches steeringProgram to the reuseport group of
+// conn
+func attachSteeringProgram(conn *net.UDPConn, n int) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	prog := steeringProgram(n)
+	fprog := unix.SockFprog{
+		Len:    uint16(len(prog)),
+		Filter: &prog[0],
+	}
+	var sockErr error
+	err = rc.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptSockFprog(int(fd), unix.SOL_SOCKET, unix.SO_ATTACH_REUSEPORT_CBPF, &fprog)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+
+package transport
+
+import (
+	"errors"
+	"net"
+)
+
+// ListenReusePort opens a single UDP socket bound to address. Several sockets
+// with SO_REUSEPORT steering are only supported on linux.
+func ListenReusePort(network, address string, n int) ([]UDPLike, error) {
+	if n != 1 {
+		return nil, errors.New("SO_REUSEPORT sharding is only supported on linux")
+	}
+	pc, err := net.ListenPacket(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return []UDPLike{pc.(*net.UDPConn)}, nil
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"crypto/rand"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"sync"
@@ -31,19 +32,22 @@ const (
 //
 // To run, call Serve.
 type Server struct {
-	m sync.RWMutex
-
 	lifecycleMu sync.Mutex
 
-	udpConn UDPLike
+	// sockets are the sockets the server receives packets on. Sessions reply
+	// from the socket their peer last sent to.
+	sockets []*serverSocket
 	config  ServerConfig
 
-	state atomic.Uint32
+	// shards hold handshake and session state. There is one per socket.
+	shards []*serverShard
+	// inProgress counts the handshakes in all shards
+	inProgress atomic.Int64
 
-	// +checklocks:m
-	handshakes map[string]*HandshakeState
-	// +checklocks:m
-	sessions map[SessionID]*SessionState
+	// guard limits handshake messages to protect against floods
+	guard *handshakeGuard
+
+	state atomic.Uint32
 
 	// pendingConnections contains established Handles published by the Serve
 	// receive loop but not yet returned by Accept. Close stops that producer
@@ -51,10 +55,8 @@ type Server struct {
 	pendingConnections chan *Handle
 
 	// +checklocks:cookieLock
-	cookieKey  [KeyLen]byte
+	cookies    cookieKeys
 	cookieLock sync.Mutex
-	// stopCookieRotate is closed once by the shutdown owner.
-	stopCookieRotate chan struct{}
 
 	wg sync.WaitGroup
 	// closeDone closes after all workers and session receive queues stop and
@@ -64,33 +66,32 @@ type Server struct {
 }
 
 func (s *Server) setHandshakeState(remoteAddr *net.UDPAddr, hs *HandshakeState) bool {
-	s.m.Lock()
-	defer s.m.Unlock()
+	sh := s.handshakeShard(remoteAddr)
+	sh.hsMu.Lock()
+	defer sh.hsMu.Unlock()
 	key := AddressHashKey(remoteAddr)
-	_, exists := s.handshakes[key]
+	_, exists := sh.handshakes[key]
 	if exists {
 		return false
 	}
-	s.handshakes[key] = hs
+	sh.handshakes[key] = hs
+	s.inProgress.Add(1)
 	hs.remoteAddr = remoteAddr
 
-	s.createSessionFromHandshakeLocked(hs)
+	s.createSessionFromHandshake(hs)
 
 	// Delete handshake if the connection times out
 	// TODO(dadrian)[2023-09-09]: Is there a race condition here? Should we be
 	// selecting over two channels---one that gets a message after the handshake
 	// finishes, and one after a timeout instead?
 	time.AfterFunc(s.config.HandshakeTimeout, func() {
-		s.m.Lock()
-		defer s.m.Unlock()
-		hs := s.fetchHandshakeStateLocked(remoteAddr)
+		sh.hsMu.Lock()
+		defer sh.hsMu.Unlock()
+		hs := s.fetchHandshakeStateLocked(sh, remoteAddr)
 		if hs != nil {
 			logrus.Errorf("Connection to %s timed out during handshake", remoteAddr)
-			s.stopTrackingHandshakeStateLocked(remoteAddr)
-			ss := s.fetchSessionLocked(hs.sessionID)
-			if ss != nil {
-				s.stopTrackingSessionLocked(ss.sessionID)
-			}
+			s.stopTrackingHandshakeStateLocked(sh, remoteAddr)
+			s.stopTrackingSession(hs.sessionID)
 		} else {
 			logrus.Debugf("Connection to %s did not time out", remoteAddr)
 		}
@@ -99,68 +100,104 @@ func (s *Server) setHandshakeState(remoteAddr *net.UDPAddr, hs *HandshakeState)
 }
 
 func (s *Server) fetchHandshakeState(remoteAddr *net.UDPAddr) *HandshakeState {
-	s.m.RLock()
-	defer s.m.RUnlock()
-	return s.fetchHandshakeStateLocked(remoteAddr)
+	sh := s.handshakeShard(remoteAddr)
+	sh.hsMu.RLock()
+	defer sh.hsMu.RUnlock()
+	return s.fetchHandshakeStateLocked(sh, remoteAddr)
 }
 
-// +checklocksread:s.m
-func (s *Server) fetchHandshakeStateLocked(remoteAddr *net.UDPAddr) *HandshakeState {
+// +checklocksread:sh.hsMu
+func (s *Server) fetchHandshakeStateLocked(sh *serverShard, remoteAddr *net.UDPAddr) *HandshakeState {
 	key := AddressHashKey(remoteAddr)
-	return s.handshakes[key]
+	return sh.handshakes[key]
 }
 
-// TODO(hosono) fix lint error
-// nolint
-func (s *Server) stopTrackingHandhshakeState(remoteAddr *net.UDPAddr) {
-	s.m.Lock()
-	defer s.m.Unlock()
-	s.stopTrackingHandshakeStateLocked(remoteAddr)
+// +checklocks:sh.hsMu
+func (s *Server) stopTrackingHandshakeStateLocked(sh *serverShard, remoteAddr *net.UDPAddr) {
+	key := AddressHashKey(remoteAddr)
+	if _, ok := sh.handshakes[key]; ok {
+		delete(sh.handshakes, key)
+		s.inProgress.Add(-1)
+	}
 }
 
-// +checklocks:s.m
-func (s *Server) stopTrackingHandshakeStateLocked(remoteAddr *net.UDPAddr) {
-	key := AddressHashKey(remoteAddr)
-	delete(s.handshakes, key)
+// handshakesInProgress returns the number of handshakes that have passed the
+// cookie check and not yet finished
+func (s *Server) handshakesInProgress() int {
+	return int(s.inProgress.Load())
+}
+
+// requiredPuzzleDifficulty returns the difficulty of the puzzle that clients
+// must currently solve, or 0 if none is required
+func (s *Server) requiredPuzzleDifficulty() int {
+	if s.config.IsHidden {
+		return 0
+	}
+	return s.guard.puzzleDifficulty(s.handshakesInProgress())
+}
+
+// HandshakeStats returns counters for handshake messages dropped by flood
+// protection.
+func (s *Server) HandshakeStats() HandshakeStats {
+	return s.guard.stats(s.handshakesInProgress())
 }
 
 func (s *Server) fetchSession(sessionID SessionID) *SessionState {
-	s.m.RLock()
-	defer s.m.RUnlock()
-	return s.fetchSessionLocked(sessionID)
+	sh := s.sessionShard(sessionID)
+	sh.sessMu.RLock()
+	defer sh.sessMu.RUnlock()
+	return sh.sessions[sessionID]
 }
 
-// +checklocksread:s.m
-func (s *Server) fetchSessionLocked(sessionID SessionID) *SessionState {
-	return s.sessions[sessionID]
+func (s *Server) stopTrackingSession(sessionID SessionID) {
+	sh := s.sessionShard(sessionID)
+	sh.sessMu.Lock()
+	defer sh.sessMu.Unlock()
+	delete(sh.sessions, sessionID)
 }
 
-// +checklocks:s.m
-func (s *Server) stopTrackingSessionLocked(sessionID SessionID) {
-	delete(s.sessions, sessionID)
+// serverSocket is a socket served by a Server
+type serverSocket struct {
+	conn UDPLike
+	// batch reads from conn in Serve, and is shared by Handles for batched
+	// writes
+	batch batchConn
+	// shard is the index of the shard that holds sessions whose handshake
+	// arrived on this socket
+	shard int
 }
 
-func (s *Server) writePacket(pkt []byte, dst *net.UDPAddr) error {
-	_, _, err := s.udpConn.WriteMsgUDP(pkt, nil, dst)
+func (s *Server) writePacket(sock *serverSocket, pkt []byte, dst *net.UDPAddr) error {
+	_, _, err := sock.conn.WriteMsgUDP(pkt, nil, dst)
 	return err
 }
 
-func (s *Server) readPacket(rawRead []byte, handshakeWriteBuf []byte) error {
-	msgLen, oobn, flags, addr, err := s.udpConn.ReadMsgUDP(rawRead, nil)
-	if err != nil {
-		return err
-	}
+// handlePacket processes a single datagram received from addr on sock.
+// Handshake responses are written using handshakeWriteBuf.
+func (s *Server) handlePacket(sock *serverSocket, rawRead []byte, addr *net.UDPAddr, handshakeWriteBuf []byte) error {
+	msgLen := len(rawRead)
 	if common.Debug {
-		logrus.Trace(msgLen, oobn, flags, addr)
+		logrus.Trace(msgLen, addr)
 	}
 	if msgLen < 4 {
 		return ErrInvalidMessage
 	}
 	mt := MessageType(rawRead[0])
 
+	switch mt {
+	case MessageTypeClientHello, MessageTypeClientAck, MessageTypeClientAuth, MessageTypeClientRequestHidden:
+		if !s.guard.allow(addr) {
+			if common.Debug {
+				logrus.Tracef("server: rate limited handshake message from %s", addr)
+			}
+			return nil
+		}
+	}
+
 	switch mt {
 	case MessageTypeClientHello:
 		if !s.config.IsHidden {
+			difficulty := s.requiredPuzzleDifficulty()
 			s.cookieLock.Lock()
 			defer s.cookieLock.Unlock()
 			scratchHS, err := s.handlePQClientHello(rawRead[:msgLen])
@@ -168,14 +205,15 @@ func (s *Server) readPacket(rawRead []byte, handshakeWriteBuf []byte) error {
 				return err
 			}
 			logrus.Debugf("server: client ephemeral: %x", scratchHS.dh.remoteEphemeral)
-			scratchHS.cookieKey = s.cookieKey
+			scratchHS.cookieKey = s.cookieKeyLocked()
 			scratchHS.remoteAddr = addr
+			scratchHS.puzzleDifficulty = difficulty
 			n, err := writePQServerHello(scratchHS, handshakeWriteBuf)
 			if err != nil {
 				return err
 			}
 			logrus.Debugf("server: sh %x", handshakeWriteBuf[:n])
-			if err := s.writePacket(handshakeWriteBuf[:n], addr); err != nil {
+			if err := s.writePacket(sock, handshakeWriteBuf[:n], addr); err != nil {
 				return err
 			}
 		}
@@ -183,7 +221,13 @@ func (s *Server) readPacket(rawRead []byte, handshakeWriteBuf []byte) error {
 	case MessageTypeClientAck:
 		if !s.config.IsHidden {
 			logrus.Debug("server: about to handle client ack")
+			if !s.guard.admit(s.handshakesInProgress()) {
+				return nil
+			}
 			n, hs, err := s.readPQClientAck(rawRead[:msgLen], addr)
+			if err == errHandshakeDropped {
+				return nil
+			}
 			if err != nil {
 				logrus.Debugf("server: unable to handle client ack: %s", err)
 				return err
@@ -193,12 +237,13 @@ func (s *Server) readPacket(rawRead []byte, handshakeWriteBuf []byte) error {
 				return ErrInvalidMessage
 			}
 			hs.certVerify = s.config.ClientVerify
+			hs.socket = sock
 			s.setHandshakeState(addr, hs)
 			n, err = s.writePQServerAuth(handshakeWriteBuf, hs)
 			if err != nil {
 				return err
 			}
-			err = s.writePacket(handshakeWriteBuf[:n], addr)
+			err = s.writePacket(sock, handshakeWriteBuf[:n], addr)
 			if err != nil {
 				return err
 			}
@@ -215,6 +260,7 @@ func (s *Server) readPacket(rawRead []byte, handshakeWriteBuf []byte) error {
 				return err
 			}
 			logrus.Debug("server: finishHandshake")
+			hs.socket = sock
 			if err := s.finishHandshake(hs, false); err != nil {
 				return err
 			}
@@ -227,7 +273,7 @@ func (s *Server) readPacket(rawRead []byte, handshakeWriteBuf []byte) error {
 		if common.Debug {
 			logrus.Tracef("server: received transport/control message from %s", addr)
 		}
-		err := s.handleSessionMessage(addr, rawRead[:msgLen])
+		err := s.handleSessionMessage(sock, addr, rawRead[:msgLen])
 		if err != nil {
 			return err
 		}
@@ -235,6 +281,9 @@ func (s *Server) readPacket(rawRead []byte, handshakeWriteBuf []byte) error {
 
 	case MessageTypeClientRequestHidden:
 		logrus.Debug("server: receiving a hidden client request to handle")
+		if !s.guard.admit(s.handshakesInProgress()) {
+			return nil
+		}
 
 		n, hs, err := s.handlePQClientRequestHidden(rawRead[:msgLen])
 		if err != nil {
@@ -246,10 +295,11 @@ func (s *Server) readPacket(rawRead []byte, handshakeWriteBuf []byte) error {
 			return ErrInvalidMessage
 		}
 
+		hs.socket = sock
 		s.setHandshakeState(addr, hs)
 		n, err = s.writePQServerResponseHidden(hs, handshakeWriteBuf)
 		logrus.Debugf("server: sh %x", handshakeWriteBuf[:n])
-		if err := s.writePacket(handshakeWriteBuf[:n], addr); err != nil {
+		if err := s.writePacket(sock, handshakeWriteBuf[:n], addr); err != nil {
 			return err
 		}
 		if err != nil {
@@ -264,7 +314,7 @@ func (s *Server) readPacket(rawRead []byte, handshakeWriteBuf []byte) error {
 	default:
 		// If the message is authenticated, this will closed the connection
 		// TODO(dadrian)[2023-09-09]: Make this explicit
-		s.handleSessionMessage(addr, rawRead[:msgLen])
+		s.handleSessionMessage(sock, addr, rawRead[:msgLen])
 		return ErrInvalidMessage
 	}
 	return nil
@@ -457,7 +507,7 @@ func (s *Server) handleClientAuth(b []byte, addr *net.UDPAddr) (int, *HandshakeS
 	return pos, hs, nil
 }
 
-func (s *Server) handleSessionMessage(addr *net.UDPAddr, msg []byte) error {
+func (s *Server) handleSessionMessage(sock *serverSocket, addr *net.UDPAddr, msg []byte) error {
 	sessionID, err := PeekSession(msg)
 	if err != nil {
 		return err
@@ -475,16 +525,17 @@ func (s *Server) handleSessionMessage(addr *net.UDPAddr, msg []byte) error {
 		return nil
 	}
 
-	// TODO(dadrian): Can we avoid this allocation?
-	plaintext := make([]byte, PlaintextLen(len(msg)))
+	// Transport messages are returned to the pool once they have been read from
+	// the Handle. Control messages are handled before returning.
+	plaintext := getBuffer(max(PlaintextLen(len(msg)), 0))
 	_, mt, err := ss.readPacketLocked(plaintext, msg, ss.readKey)
 	if err != nil {
+		putBuffer(plaintext)
 		return err
 	}
 	if common.Debug {
 		logrus.Tracef("server: session %x: plaintextLen: %d type: %x from: %s", ss.sessionID, len(plaintext), mt, addr)
 	}
-
 	switch mt {
 	case MessageTypeTransport:
 		select {
@@ -492,23 +543,57 @@ func (s *Server) handleSessionMessage(addr *net.UDPAddr, msg []byte) error {
 			break
 		default:
 			logrus.Warnf("session %x: recv queue full, dropping packet", sessionID)
+			putBuffer(plaintext)
 		}
 	case MessageTypeControl:
-		if err := ss.handleControlLocked(plaintext); err != nil {
+		err := ss.handleControlLocked(plaintext)
+		putBuffer(plaintext)
+		if err != nil {
 			return err
 		}
 	default:
 		// Close the connection on an unknown message type
+		putBuffer(plaintext)
 		ss.closeLocked()
 		return ErrInvalidMessage
 	}
 
-	if !EqualUDPAddress(ss.remoteAddr, addr) {
+	if !EqualUDPAddress(ss.remoteAddr, addr) || ss.conn != sock.conn {
+		if ss.remoteAddr != nil && addr != nil && ss.handle.pmtu != nil {
+			ss.handle.pmtu.migrate()
+		}
 		ss.remoteAddr = addr
+		ss.conn = sock.conn
+		ss.batch = sock.batch
 	}
 	return nil
 }
 
+// serveSocket reads and handles packets from sock until the server stops
+// serving.
+func (s *Server) serveSocket(sock *serverSocket) {
+	defer s.wg.Done()
+
+	// TODO(dadrian): This should be a smaller buffer
+	handshakeWriteBuf := make([]byte, 65535)
+
+	for s.state.Load() == uint32(serverStateServing) {
+		pkts, err := sock.batch.readBatch()
+		if err != nil {
+			if serverState(s.state.Load()) == serverStateServing {
+				logrus.Errorf("server error: %s", err)
+			}
+			continue
+		}
+		for _, pkt := range pkts {
+			err := s.handlePacket(sock, pkt.b, pkt.addr, handshakeWriteBuf)
+			if err != nil && serverState(s.state.Load()) == serverStateServing {
+				logrus.Errorf("server error: %s", err)
+			}
+		}
+	}
+}
+
 // Serve blocks until the server is closed.
 func (s *Server) Serve() error {
 	s.lifecycleMu.Lock()
@@ -516,49 +601,12 @@ func (s *Server) Serve() error {
 		s.lifecycleMu.Unlock()
 		return errors.New("Serve called on non-ready Server")
 	}
-	s.wg.Add(2)
+	s.wg.Add(len(s.sockets))
 	s.lifecycleMu.Unlock()
 
-	go func() {
-		defer s.wg.Done()
-
-		// TODO(dadrian): These should be smaller buffers
-		rawRead := make([]byte, 65535)
-		handshakeWriteBuf := make([]byte, 65535)
-
-		for s.state.Load() == uint32(serverStateServing) {
-			err := s.readPacket(rawRead, handshakeWriteBuf)
-			if err != nil {
-				state := serverState(s.state.Load())
-				if state != serverStateServing {
-					continue
-				}
-				logrus.Errorf("server error: %s", err)
-			}
-		}
-	}()
-
-	go func() {
-		defer s.wg.Done()
-
-		ticker := time.NewTicker(2 * time.Minute)
-		defer ticker.Stop()
-
-		for s.state.Load() == uint32(serverStateServing) {
-			select {
-			case <-ticker.C:
-				s.cookieLock.Lock()
-				// TODO(dadrian)[2023-09-10]: Save the previous cookie
-				_, err := rand.Read(s.cookieKey[:])
-				if err != nil {
-					logrus.Panicf("rand.Read failed: %s", err.Error())
-				}
-				s.cookieLock.Unlock()
-			case <-s.stopCookieRotate:
-				return
-			}
-		}
-	}()
+	for _, sock := range s.sockets {
+		go s.serveSocket(sock)
+	}
 
 	s.wg.Wait()
 	<-s.closeDone
@@ -611,15 +659,16 @@ func (s *Server) handlePQClientHello(b []byte) (*HandshakeState, error) {
 }
 
 func (s *Server) finishHandshake(hs *HandshakeState, isHidden bool) error {
-	s.m.Lock()
-	defer s.m.Unlock()
+	sh := s.handshakeShard(hs.remoteAddr)
+	sh.hsMu.Lock()
+	defer sh.hsMu.Unlock()
 
 	if s.state.Load() != uint32(serverStateServing) {
 		return io.EOF
 	}
 
-	defer s.stopTrackingHandshakeStateLocked(hs.remoteAddr)
-	ss := s.fetchSessionLocked(hs.sessionID)
+	defer s.stopTrackingHandshakeStateLocked(sh, hs.remoteAddr)
+	ss := s.fetchSession(hs.sessionID)
 	if ss == nil {
 		return ErrUnknownSession
 	}
@@ -638,8 +687,15 @@ func (s *Server) finishHandshake(hs *HandshakeState, isHidden bool) error {
 
 	ss.isHiddenHS = isHidden
 
-	ss.handle = newHandleForSession(s.udpConn, ss, hs.parsedLeaf, s.config.maxBufferedPacketsPerConnection())
+	ss.handle = newHandleForSession(hs.socket.conn, ss, hs.parsedLeaf, s.config.maxBufferedPacketsPerConnection())
+	ss.batch = hs.socket.batch
 	ss.handleState = established
+	if !s.config.DisablePathMTUDiscovery {
+		// Probing starts once the client sends a probe of its own, which
+		// shows that it supports path MTU discovery and that it has
+		// finished the handshake.
+		ss.handle.enablePathMTUDiscovery()
+	}
 
 	h := ss.handle
 	select {
@@ -688,21 +744,34 @@ func (s *Server) handlePQClientRequestHidden(b []byte) (int, *HandshakeState, er
 	return n, hs, nil
 }
 
-// +checklocks:s.m
-func (s *Server) createSessionFromHandshakeLocked(hs *HandshakeState) *SessionState {
+// createSessionFromHandshake creates a session with a new session ID for hs.
+// The session ID encodes the shard of the socket the handshake arrived on, and
+// the server ID if there is one.
+func (s *Server) createSessionFromHandshake(hs *HandshakeState) *SessionState {
+	index := 0
+	if hs.socket != nil {
+		index = hs.socket.shard
+	}
+	sh := s.shards[index]
+	sh.sessMu.Lock()
+	defer sh.sessMu.Unlock()
 	for i := 0; i < 100; i++ {
 		n, err := rand.Read(hs.sessionID[:])
 		if n != SessionIDLen || err != nil {
 			panic("could not read random data")
 		}
-		if _, exists := s.sessions[hs.sessionID]; exists {
+		encodeShard(hs.sessionID[:], index, len(s.shards))
+		if s.config.ServerID != 0 {
+			encodeServerID(hs.sessionID[:], s.config.ServerID, s.config.ServerIDKey)
+		}
+		if _, exists := sh.sessions[hs.sessionID]; exists {
 			continue
 		}
 		ss := &SessionState{
 			sessionID:  hs.sessionID,
 			remoteAddr: hs.remoteAddr,
 		}
-		s.sessions[hs.sessionID] = ss
+		sh.sessions[hs.sessionID] = ss
 		return ss
 	}
 	panic("unable to generate a non-colliding sessionID")
@@ -734,10 +803,20 @@ func (s *Server) AcceptTimeout(duration time.Duration) (*Handle, error) {
 	}
 }
 
-// Addr returns the net.UDPAddr used by the underlying connection.
+// Addr returns the net.UDPAddr used by the underlying connection. When the
+// server has several sockets, it is the address of the first one.
 // It reflects the net.Listener API
 func (s *Server) Addr() net.Addr {
-	return s.udpConn.LocalAddr()
+	return s.sockets[0].conn.LocalAddr()
+}
+
+// Addrs returns the addresses of every socket served by the server.
+func (s *Server) Addrs() []net.Addr {
+	addrs := make([]net.Addr, 0, len(s.sockets))
+	for _, sock := range s.sockets {
+		addrs = append(addrs, sock.conn.LocalAddr())
+	}
+	return addrs
 }
 
 // Close stops the server, causing Serve() to return.
@@ -761,19 +840,28 @@ func (s *Server) Close() (err error) {
 closing:
 	// Closing the socket unblocks both the Serve read loop and any in-flight
 	// writes before we wait for workers or acquire per-session locks.
-	s.closeErr = s.udpConn.Close()
-	close(s.stopCookieRotate)
+	for _, sock := range s.sockets {
+		if err := sock.conn.Close(); err != nil && s.closeErr == nil {
+			s.closeErr = err
+		}
+	}
 	s.wg.Wait()
 
-	s.m.Lock()
 	close(s.pendingConnections)
-	sessions := make([]*SessionState, 0, len(s.sessions))
-	for _, ss := range s.sessions {
-		sessions = append(sessions, ss)
+	var sessions []*SessionState
+	for _, sh := range s.shards {
+		sh.hsMu.Lock()
+		s.inProgress.Add(-int64(len(sh.handshakes)))
+		clear(sh.handshakes)
+		sh.hsMu.Unlock()
+
+		sh.sessMu.Lock()
+		for _, ss := range sh.sessions {
+			sessions = append(sessions, ss)
+		}
+		clear(sh.sessions)
+		sh.sessMu.Unlock()
 	}
-	clear(s.handshakes)
-	clear(s.sessions)
-	s.m.Unlock()
 
 	for _, ss := range sessions {
 		if ss.handle != nil {
@@ -787,9 +875,6 @@ closing:
 }
 
 func (s *Server) init() error {
-	s.m.Lock()
-	defer s.m.Unlock()
-
 	if s.config.KeyPair == nil && s.config.KEMKeyPair == nil && s.config.GetCertificate == nil {
 		return errors.New("config.KeyPair, or s.config.KEMKeyPair, or config.GetCertificate must be set")
 	}
@@ -830,19 +915,19 @@ func (s *Server) init() error {
 		}
 	}
 
-	s.cookieLock.Lock()
-	_, err := rand.Read(s.cookieKey[:])
-	s.cookieLock.Unlock()
+	cookies, err := newCookieKeys(s.config.CookieSecret, s.config.CookieRotation, time.Now())
 	if err != nil {
-		panic(err.Error())
+		return err
 	}
+	s.cookieLock.Lock()
+	s.cookies = cookies
+	s.cookieLock.Unlock()
 
-	if err != nil {
-		panic(err.Error())
+	s.shards = make([]*serverShard, max(len(s.sockets), 1))
+	for i := range s.shards {
+		s.shards[i] = newServerShard()
 	}
-
-	s.handshakes = make(map[string]*HandshakeState)
-	s.sessions = make(map[SessionID]*SessionState)
+	s.guard = newHandshakeGuard(s.config.HandshakeLimits)
 	s.pendingConnections = make(chan *Handle, s.config.maxPendingConnections())
 	return nil
 }
@@ -850,11 +935,44 @@ func (s *Server) init() error {
 // NewServer returns a Server listening on the provided UDP connection. The
 // returned Server object is a valid net.Listener.
 func NewServer(conn UDPLike, config ServerConfig) (*Server, error) {
+	return NewMultiServer([]UDPLike{conn}, config)
+}
+
+// NewMultiServer returns a Server listening on each of the provided UDP
+// connections, e.g. an IPv4 and an IPv6 socket, or a group of sockets from
+// ListenReusePort. Each connection has its own receive loop and shard of the
+// session table, and a client can roam between the connections.
+//
+// When conns contains several groups from ListenReusePort, the groups must be
+// the same size for session packets to be steered to the right socket, and
+// conns must not contain anything else. Stream listeners should be served by
+// a Server of their own, since their clients' addresses can collide with those
+// of UDP clients.
+func NewMultiServer(conns []UDPLike, config ServerConfig) (*Server, error) {
+	if len(conns) == 0 {
+		return nil, errors.New("server needs at least one connection")
+	}
+	if len(conns) > MaxShards {
+		return nil, fmt.Errorf("server can serve at most %d connections", MaxShards)
+	}
 	s := Server{
-		udpConn:          conn,
-		config:           config,
-		stopCookieRotate: make(chan struct{}),
-		closeDone:        make(chan struct{}),
+		config:    config,
+		closeDone: make(chan struct{}),
+	}
+	for i, conn := range conns {
+		if udpConn, ok := conn.(*net.UDPConn); ok && !config.DisablePathMTUDiscovery {
+			if err := SetDontFragment(udpConn); err != nil {
+				logrus.Warnf("server: unable to set don't fragment: %s", err)
+			}
+		}
+		if config.Obfuscation != nil {
+			conn = NewObfuscatedConn(conn, *config.Obfuscation)
+		}
+		s.sockets = append(s.sockets, &serverSocket{
+			conn:  conn,
+			batch: newBatchConn(conn, true),
+			shard: i,
+		})
 	}
 	err := s.init()
 	return &s, err
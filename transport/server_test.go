@@ -336,3 +336,75 @@ func TestBufferBehavior(t *testing.T) {
 	assert.Equal(t, 0, buf.Len())
 	assert.Assert(t, buf.Cap() != 0)
 }
+
+func TestMultiServer(t *testing.T) {
+	a, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NilError(t, err)
+	b, err := net.ListenPacket("udp6", "[::1]:0")
+	if err != nil {
+		t.Logf("IPv6 is unavailable, using two IPv4 sockets: %s", err)
+		b, err = net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NilError(t, err)
+	}
+	serverConfig, verifyConfig := newTestServerConfig(t)
+	// Probes from the clients would move sessions back to the socket they
+	// were dialed on
+	serverConfig.DisablePathMTUDiscovery = true
+	s, err := NewMultiServer([]UDPLike{a.(*net.UDPConn), b.(*net.UDPConn)}, *serverConfig)
+	assert.NilError(t, err)
+	go s.Serve()
+	defer s.Close()
+	assert.DeepEqual(t, s.Addrs(), []net.Addr{a.LocalAddr(), b.LocalAddr()})
+	assert.Equal(t, s.Addr(), a.LocalAddr())
+
+	var clients []*Client
+	for _, pc := range []net.PacketConn{a, b} {
+		_, _, clientConfig := newClientAuthAndConfig(t, verifyConfig)
+		clientConfig.DisablePathMTUDiscovery = true
+		c, err := Dial("udp", pc.LocalAddr().String(), *clientConfig)
+		assert.NilError(t, err)
+		defer c.Close()
+		assert.NilError(t, c.Handshake())
+		clients = append(clients, c)
+
+		h, err := s.AcceptTimeout(time.Second)
+		assert.NilError(t, err)
+		assert.Equal(t, h.LocalAddr().String(), pc.LocalAddr().String())
+
+		// Replies come from the socket the client sent to
+		assert.NilError(t, h.WriteMsg([]byte("hello")))
+		buf := make([]byte, 100)
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := c.ReadMsg(buf)
+		assert.NilError(t, err)
+		assert.Equal(t, string(buf[:n]), "hello")
+	}
+
+	// A session moves to the other socket when the client roams to it
+	c := clients[0]
+	ss := s.fetchSession(c.ss.sessionID)
+	roamed, err := net.ListenPacket("udp", net.JoinHostPort(b.LocalAddr().(*net.UDPAddr).IP.String(), "0"))
+	assert.NilError(t, err)
+	defer roamed.Close()
+
+	c.ss.m.Lock()
+	pkt, err := c.ss.sealPacketLocked(nil, MessageTypeTransport, []byte("roamed"), c.ss.writeKey)
+	c.ss.m.Unlock()
+	assert.NilError(t, err)
+	_, err = roamed.WriteTo(pkt, b.LocalAddr())
+	assert.NilError(t, err)
+
+	h := ss.handle
+	buf := make([]byte, 100)
+	h.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := h.ReadMsg(buf)
+	assert.NilError(t, err)
+	assert.Equal(t, string(buf[:n]), "roamed")
+	assert.Equal(t, h.LocalAddr().String(), b.LocalAddr().String())
+
+	assert.NilError(t, h.WriteMsg([]byte("reply")))
+	roamed.SetReadDeadline(time.Now().Add(time.Second))
+	_, from, err := roamed.ReadFrom(buf)
+	assert.NilError(t, err)
+	assert.Equal(t, from.String(), b.LocalAddr().String())
+}
@@ -0,0 +1,143 @@
+package transport
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"net"
+	"time"
+
+	"hop.computer/hop/keys"
+)
+
+// Server IDs. Several servers can share an address behind a load balancer such
+// as hop-lb. To let the load balancer send every packet of a session to the
+// server that owns it, even after the client's address changes, each server
+// embeds its server ID in the session IDs it assigns. The first byte of a
+// session ID is the shard, so the server ID is the second byte, followed by
+// two random bytes.
+//
+// The server ID can also be encrypted with a key shared by the servers and the
+// load balancer, so that observers cannot tell which server holds a session.
+// The last three bytes of the session ID are then encrypted with a keyed
+// 24-bit Feistel permutation.
+
+// ServerIDKeyLen is the length of the key that encrypts server IDs
+const ServerIDKeyLen = KeyLen
+
+// ErrNoServerID is returned for messages that do not carry a session ID
+var ErrNoServerID = errors.New("message has no server ID")
+
+// ServerIDKeyFromSecret derives a key for server IDs from a shared secret
+func ServerIDKeyFromSecret(secret []byte) *[ServerIDKeyLen]byte {
+	h := sha256.New()
+	h.Write([]byte("hop server id key v1"))
+	h.Write(secret)
+	var key [ServerIDKeyLen]byte
+	copy(key[:], h.Sum(nil))
+	return &key
+}
+
+// feistelRound returns the round function of the server ID permutation for a
+// 12-bit half block
+func feistelRound(key *[ServerIDKeyLen]byte, round byte, half uint32) uint32 {
+	h := sha256.New()
+	h.Write(key[:])
+	h.Write([]byte{round, byte(half >> 8), byte(half)})
+	sum := h.Sum(nil)
+	return (uint32(sum[0])<<8 | uint32(sum[1])) & 0xfff
+}
+
+const feistelRounds = 4
+
+// encryptServerID permutes the last three bytes of sessionID with key
+func encryptServerID(sessionID []byte, key *[ServerIDKeyLen]byte) {
+	l := uint32(sessionID[1])<<4 | uint32(sessionID[2])>>4
+	r := (uint32(sessionID[2])&0xf)<<8 | uint32(sessionID[3])
+	for i := 0; i < feistelRounds; i++ {
+		l, r = r, l^feistelRound(key, byte(i), r)
+	}
+	sessionID[1] = byte(l >> 4)
+	sessionID[2] = byte(l<<4) | byte(r>>8)
+	sessionID[3] = byte(r)
+}
+
+// decryptServerID inverts encryptServerID
+func decryptServerID(sessionID []byte, key *[ServerIDKeyLen]byte) {
+	l := uint32(sessionID[1])<<4 | uint32(sessionID[2])>>4
+	r := (uint32(sessionID[2])&0xf)<<8 | uint32(sessionID[3])
+	for i := feistelRounds - 1; i >= 0; i-- {
+		l, r = r^feistelRound(key, byte(i), l), l
+	}
+	sessionID[1] = byte(l >> 4)
+	sessionID[2] = byte(l<<4) | byte(r>>8)
+	sessionID[3] = byte(r)
+}
+
+// encodeServerID sets the server ID of sessionID, keeping the last two bytes
+// random
+func encodeServerID(sessionID []byte, id byte, key *[ServerIDKeyLen]byte) {
+	sessionID[1] = id
+	if key != nil {
+		encryptServerID(sessionID, key)
+	}
+}
+
+// SessionServerID returns the server ID embedded in the session ID of a
+// transport or control message. key must be the key the server encrypted its
+// server ID with, or nil. Handshake messages carry no server ID.
+func SessionServerID(msg []byte, key *[ServerIDKeyLen]byte) (byte, error) {
+	if len(msg) == 0 {
+		return 0, ErrBufUnderflow
+	}
+	switch MessageType(msg[0]) {
+	case MessageTypeTransport, MessageTypeControl:
+	default:
+		return 0, ErrNoServerID
+	}
+	sessionID, err := PeekSession(msg)
+	if err != nil {
+		return 0, err
+	}
+	if key != nil {
+		decryptServerID(sessionID[:], key)
+	}
+	return sessionID[1], nil
+}
+
+// ProbeServer sends a Client Hello over conn and waits up to timeout for a
+// Server Hello, to check that a server is up. The handshake is abandoned after
+// the Server Hello. Servers in hidden mode never reply.
+func ProbeServer(conn net.Conn, timeout time.Duration) error {
+	hs := new(HandshakeState)
+	hs.duplex.InitializeEmpty()
+	hs.duplex.Absorb([]byte(PostQuantumProtocolName))
+	hs.kem = new(kemState)
+	ephemeral, err := keys.GenerateKEMKeyPair(rand.Reader)
+	if err != nil {
+		return err
+	}
+	hs.kem.ephemeral = *ephemeral
+
+	buf := getBuffer(65535)
+	defer putBuffer(buf)
+	n, err := writePQClientHello(hs, buf)
+	if err != nil {
+		return err
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	if _, err := conn.Write(buf[:n]); err != nil {
+		return err
+	}
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return err
+		}
+		if n >= HeaderLen && MessageType(buf[0]) == MessageTypeServerHello {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package transport
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestServerIDPermutation(t *testing.T) {
+	key := ServerIDKeyFromSecret([]byte("secret"))
+	seen := make(map[[3]byte]bool)
+	for i := 0; i < 1<<12; i++ {
+		sessionID := []byte{9, byte(i >> 8), byte(i), 0x5a}
+		encryptServerID(sessionID, key)
+		assert.Equal(t, sessionID[0], byte(9))
+		seen[[3]byte(sessionID[1:])] = true
+		decryptServerID(sessionID, key)
+		assert.DeepEqual(t, sessionID, []byte{9, byte(i >> 8), byte(i), 0x5a})
+	}
+	assert.Equal(t, len(seen), 1<<12)
+}
+
+func TestSessionServerID(t *testing.T) {
+	key := ServerIDKeyFromSecret([]byte("secret"))
+	msg := make([]byte, HeaderLen+SessionIDLen)
+	msg[0] = byte(MessageTypeTransport)
+	encodeServerID(msg[HeaderLen:], 42, key)
+
+	id, err := SessionServerID(msg, key)
+	assert.NilError(t, err)
+	assert.Equal(t, id, byte(42))
+
+	msg[0] = byte(MessageTypeClientHello)
+	_, err = SessionServerID(msg, key)
+	assert.Assert(t, errors.Is(err, ErrNoServerID))
+
+	msg[0] = byte(MessageTypeControl)
+	_, err = SessionServerID(msg[:HeaderLen], key)
+	assert.Assert(t, errors.Is(err, ErrBufUnderflow))
+}
+
+func TestServerIDInSessionIDs(t *testing.T) {
+	key := ServerIDKeyFromSecret([]byte("secret"))
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	serverConfig, verifyConfig := newTestServerConfig(t)
+	serverConfig.ServerID = 7
+	serverConfig.ServerIDKey = key
+	s, err := NewServer(pc.(*net.UDPConn), *serverConfig)
+	assert.NilError(t, err)
+	go s.Serve()
+	t.Cleanup(func() { s.Close() })
+	_, _, clientConfig := newClientAuthAndConfig(t, verifyConfig)
+
+	for i := 0; i < 4; i++ {
+		c, err := Dial("udp", s.Addr().String(), *clientConfig)
+		assert.NilError(t, err)
+		msg := make([]byte, HeaderLen+SessionIDLen)
+		msg[0] = byte(MessageTypeTransport)
+		copy(msg[HeaderLen:], c.ss.sessionID[:])
+		id, err := SessionServerID(msg, key)
+		assert.NilError(t, err)
+		assert.Equal(t, id, byte(7))
+		c.Close()
+	}
+}
+
+func TestProbeServer(t *testing.T) {
+	s, _ := newDialerTestServer(t)
+	conn, err := net.Dial("udp", s.Addr().String())
+	assert.NilError(t, err)
+	defer conn.Close()
+	assert.NilError(t, ProbeServer(conn, time.Second))
+
+	hole := newBlackHole(t)
+	conn, err = net.Dial("udp", hole.String())
+	assert.NilError(t, err)
+	defer conn.Close()
+	assert.Assert(t, ProbeServer(conn, 100*time.Millisecond) != nil)
+}
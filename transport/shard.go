@@ -0,0 +1,67 @@
+package transport
+
+import (
+	"hash/maphash"
+	"net"
+	"sync"
+)
+
+// Server state is sharded so that receive loops on different cores do not
+// contend on a single lock. Every socket served by a Server has its own
+// receive loop and shard. The first byte of a session ID encodes the shard
+// that holds the session, so any receive loop can find it after the client's
+// address changes, and on Linux ListenReusePort steers session packets to the
+// socket of that shard. Handshakes, which are identified by the client
+// address, are sharded by a hash of the address.
+
+// MaxShards is the largest number of sockets a Server can serve, since the
+// shard is encoded in one byte of the session ID.
+const MaxShards = 256
+
+// serverShard holds the handshakes and sessions of one shard of a Server
+type serverShard struct {
+	// hsMu is acquired before sessMu when both are needed. At most one lock of
+	// each kind is held at a time.
+	hsMu sync.RWMutex
+	// +checklocks:hsMu
+	handshakes map[string]*HandshakeState
+
+	sessMu sync.RWMutex
+	// +checklocks:sessMu
+	sessions map[SessionID]*SessionState
+}
+
+func newServerShard() *serverShard {
+	return &serverShard{
+		handshakes: make(map[string]*HandshakeState),
+		sessions:   make(map[SessionID]*SessionState),
+	}
+}
+
+// shardForSession returns the index of the shard that holds sessionID out of n
+// shards
+func shardForSession(sessionID SessionID, n int) int {
+	return int(sessionID[0]) % n
+}
+
+// encodeShard sets the first byte of sessionID so that it maps to shard index
+// out of n shards, keeping as much of the byte random as possible.
+func encodeShard(sessionID []byte, index, n int) {
+	sessionID[0] = byte(index + n*(int(sessionID[0])%(MaxShards/n)))
+}
+
+var handshakeShardSeed = maphash.MakeSeed()
+
+// handshakeShard returns the shard that holds handshake state for addr
+func (s *Server) handshakeShard(addr *net.UDPAddr) *serverShard {
+	if len(s.shards) == 1 {
+		return s.shards[0]
+	}
+	h := maphash.String(handshakeShardSeed, AddressHashKey(addr))
+	return s.shards[h%uint64(len(s.shards))]
+}
+
+// sessionShard returns the shard that holds sessionID
+func (s *Server) sessionShard(sessionID SessionID) *serverShard {
+	return s.shards[shardForSession(sessionID, len(s.shards))]
+}
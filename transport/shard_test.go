@@ -0,0 +1,88 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestEncodeShard(t *testing.T) {
+	for n := 1; n <= MaxShards; n++ {
+		for _, index := range []int{0, n / 2, n - 1} {
+			for b := 0; b < 256; b++ {
+				id := SessionID{byte(b), 1, 2, 3}
+				encodeShard(id[:], index, n)
+				assert.Equal(t, shardForSession(id, n), index, "n=%d index=%d byte=%d", n, index, b)
+			}
+		}
+	}
+
+	// A single shard leaves session IDs untouched
+	id := SessionID{0xab, 1, 2, 3}
+	encodeShard(id[:], 0, 1)
+	assert.Equal(t, id, SessionID{0xab, 1, 2, 3})
+}
+
+func TestShardedServer(t *testing.T) {
+	const shards = 4
+	conns, err := ListenReusePort("udp4", "127.0.0.1:0", shards)
+	if err != nil && runtime.GOOS != "linux" {
+		t.Skipf("SO_REUSEPORT sharding is unsupported: %s", err)
+	}
+	assert.NilError(t, err)
+	serverConfig, verifyConfig := newTestServerConfig(t)
+	serverConfig.DisablePathMTUDiscovery = true
+	s, err := NewMultiServer(conns, *serverConfig)
+	assert.NilError(t, err)
+	go s.Serve()
+	defer s.Close()
+	assert.Equal(t, len(s.shards), shards)
+
+	for i := 0; i < 2*shards; i++ {
+		_, _, clientConfig := newClientAuthAndConfig(t, verifyConfig)
+		clientConfig.DisablePathMTUDiscovery = true
+		c, err := Dial("udp", s.Addr().String(), *clientConfig)
+		assert.NilError(t, err)
+		defer c.Close()
+		assert.NilError(t, c.Handshake())
+		h, err := s.AcceptTimeout(time.Second)
+		assert.NilError(t, err)
+
+		// The session is in the shard encoded in its ID
+		id := c.ss.sessionID
+		shard := shardForSession(id, shards)
+		s.shards[shard].sessMu.RLock()
+		ss := s.shards[shard].sessions[id]
+		s.shards[shard].sessMu.RUnlock()
+		assert.Assert(t, ss != nil)
+
+		// Packets from new source ports are steered to the socket of the shard
+		for j := 0; j < 3; j++ {
+			rebound, err := net.ListenPacket("udp4", "127.0.0.1:0")
+			assert.NilError(t, err)
+			defer rebound.Close()
+			msg := fmt.Sprintf("client %d from port %d", i, j)
+			c.ss.m.Lock()
+			pkt, err := c.ss.sealPacketLocked(nil, MessageTypeTransport, []byte(msg), c.ss.writeKey)
+			c.ss.m.Unlock()
+			assert.NilError(t, err)
+			_, err = rebound.WriteTo(pkt, s.Addr())
+			assert.NilError(t, err)
+
+			buf := make([]byte, 100)
+			h.SetReadDeadline(time.Now().Add(time.Second))
+			n, err := h.ReadMsg(buf)
+			assert.NilError(t, err)
+			assert.Equal(t, string(buf[:n]), msg)
+			ss.m.Lock()
+			conn := ss.conn
+			ss.m.Unlock()
+			assert.Equal(t, conn, s.sockets[shard].conn)
+		}
+	}
+	assert.Equal(t, s.handshakesInProgress(), 0)
+}
@@ -0,0 +1,33 @@
+//go:build linux
+
+package transport
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// SetDontFragment sets the Don't Fragment bit on packets sent from conn, so that
+// path MTU discovery probes larger than the path MTU are dropped rather than
+// fragmented. The kernel's own path MTU estimate is ignored, since probing
+// replaces it.
+func SetDontFragment(conn *net.UDPConn) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var v4Err, v6Err error
+	err = rc.Control(func(fd uintptr) {
+		v4Err = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_PROBE)
+		v6Err = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, unix.IPV6_PMTUDISC_PROBE)
+	})
+	if err != nil {
+		return err
+	}
+	// A socket only needs the option for its own address family
+	if v4Err != nil && v6Err != nil {
+		return v4Err
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package transport
+
+import (
+	"net"
+)
+
+// SetDontFragment is a no-op on this platform. Packets larger than the path MTU
+// may be fragmented, so path MTU discovery can overestimate the path MTU.
+func SetDontFragment(conn *net.UDPConn) error {
+	return nil
+}
@@ -0,0 +1,401 @@
+package transport
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"hop.computer/hop/common"
+)
+
+// Stream carriers. Networks that block UDP usually allow TCP, so Hop datagrams
+// can also be carried over a byte stream, such as a TCP connection or a
+// WebSocket. Each datagram is framed as
+//
+//	length (uint16, big endian) || datagram
+//
+// Tubes already retransmit and reorder packets, so the carrier does not need to
+// do anything else. Carrying Hop over a reliable stream does suffer from
+// head-of-line blocking, so it is only a fallback for when UDP is unavailable.
+
+// streamFrameHeaderLen is the length of the header in front of each datagram
+const streamFrameHeaderLen = 2
+
+// maxStreamFrameLen is the length of the largest frame
+const maxStreamFrameLen = streamFrameHeaderLen + 65535
+
+// ErrNoStream is returned when writing to an address that has no open stream
+var ErrNoStream = errors.New("no open stream to address")
+
+// streamAddr converts the address of a stream to a *net.UDPAddr, which
+// identifies the stream to the Server
+func streamAddr(addr net.Addr) *net.UDPAddr {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return &net.UDPAddr{IP: a.IP, Port: a.Port, Zone: a.Zone}
+	case *net.UDPAddr:
+		return a
+	}
+	if addr == nil {
+		return &net.UDPAddr{}
+	}
+	if ap, err := netip.ParseAddrPort(addr.String()); err == nil {
+		return net.UDPAddrFromAddrPort(ap)
+	}
+	return &net.UDPAddr{}
+}
+
+// frameReader reads framed datagrams from a stream. A frame is only consumed
+// once all of it has arrived, so a read deadline never leaves the stream
+// partway through a frame.
+type frameReader struct {
+	br *bufio.Reader
+}
+
+func newFrameReader(conn net.Conn) frameReader {
+	return frameReader{br: bufio.NewReaderSize(conn, maxStreamFrameLen)}
+}
+
+// peekFrame returns the next datagram without consuming it. The datagram is
+// only valid until the next read.
+func (r frameReader) peekFrame() ([]byte, error) {
+	hdr, err := r.br.Peek(streamFrameHeaderLen)
+	if err != nil {
+		return nil, err
+	}
+	frame, err := r.br.Peek(streamFrameHeaderLen + int(binary.BigEndian.Uint16(hdr)))
+	if err != nil {
+		return nil, err
+	}
+	return frame[streamFrameHeaderLen:], nil
+}
+
+// discardFrame consumes a datagram of length n returned by peekFrame
+func (r frameReader) discardFrame(n int) {
+	r.br.Discard(streamFrameHeaderLen + n)
+}
+
+// readFrame reads the next datagram into b. Datagrams longer than b are
+// truncated.
+func (r frameReader) readFrame(b []byte) (int, error) {
+	datagram, err := r.peekFrame()
+	if err != nil {
+		return 0, err
+	}
+	n := copy(b, datagram)
+	r.discardFrame(len(datagram))
+	return n, nil
+}
+
+// writeFrame writes b to w as a single frame
+func writeFrame(w net.Conn, b []byte) error {
+	if len(b) > maxStreamFrameLen-streamFrameHeaderLen {
+		return ErrBufOverflow
+	}
+	frame := getBuffer(streamFrameHeaderLen + len(b))
+	defer putBuffer(frame)
+	binary.BigEndian.PutUint16(frame, uint16(len(b)))
+	copy(frame[streamFrameHeaderLen:], b)
+	_, err := w.Write(frame)
+	return err
+}
+
+// streamConn carries the datagrams of a Client over a stream
+type streamConn struct {
+	net.Conn
+	raddr *net.UDPAddr
+
+	readMu sync.Mutex
+	// +checklocks:readMu
+	r frameReader
+
+	writeMu sync.Mutex
+}
+
+var _ UDPLike = &streamConn{}
+
+// NewStreamConn returns a UDPLike that carries datagrams over conn, for a Client
+// connecting to a server with a StreamListener. Every datagram is sent to the
+// other end of conn, whatever its destination address.
+func NewStreamConn(conn net.Conn) UDPLike {
+	return &streamConn{
+		Conn:  conn,
+		raddr: streamAddr(conn.RemoteAddr()),
+		r:     newFrameReader(conn),
+	}
+}
+
+// WriteMsgUDP implements UDPLike
+func (c *streamConn) WriteMsgUDP(b, oob []byte, addr *net.UDPAddr) (n, oobn int, err error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := writeFrame(c.Conn, b); err != nil {
+		return 0, 0, err
+	}
+	return len(b), 0, nil
+}
+
+// ReadMsgUDP implements UDPLike. The address of every datagram is the remote
+// address of the stream.
+func (c *streamConn) ReadMsgUDP(b, oob []byte) (n, oobn, flags int, addr *net.UDPAddr, err error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	n, err = c.r.readFrame(b)
+	if err != nil {
+		return 0, 0, 0, nil, err
+	}
+	return n, 0, 0, c.raddr, nil
+}
+
+// Write implements net.Conn
+func (c *streamConn) Write(b []byte) (int, error) {
+	n, _, err := c.WriteMsgUDP(b, nil, nil)
+	return n, err
+}
+
+// Read implements net.Conn
+func (c *streamConn) Read(b []byte) (int, error) {
+	n, _, _, _, err := c.ReadMsgUDP(b, nil)
+	return n, err
+}
+
+// streamPacket is a datagram read from one of the streams of a StreamListener
+type streamPacket struct {
+	b    []byte
+	addr *net.UDPAddr
+}
+
+// serverStream is a stream accepted by a StreamListener
+type serverStream struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+}
+
+// StreamListener accepts streams from clients and presents the datagrams
+// carried over them as a single UDPLike that a Server can serve, alongside its
+// UDP sockets. Each stream is identified by its remote address.
+type StreamListener struct {
+	addr net.Addr
+
+	packets chan streamPacket
+	done    chan struct{}
+
+	readDeadline atomic.Pointer[time.Time]
+
+	m sync.Mutex
+	// +checklocks:m
+	streams map[netip.AddrPort]*serverStream
+	// +checklocks:m
+	listeners []net.Listener
+	// +checklocks:m
+	closed bool
+}
+
+var _ UDPLike = &StreamListener{}
+
+// NewStreamListener returns a StreamListener with local address addr. Streams
+// are added to it by Serve, ServeConn and ServeHTTP.
+func NewStreamListener(addr net.Addr) *StreamListener {
+	return &StreamListener{
+		addr:    addr,
+		packets: make(chan streamPacket, 256),
+		done:    make(chan struct{}),
+		streams: make(map[netip.AddrPort]*serverStream),
+	}
+}
+
+// ListenStream listens for TCP connections on address and returns a
+// StreamListener that serves them
+func ListenStream(network, address string) (*StreamListener, error) {
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	l := NewStreamListener(ln.Addr())
+	go l.Serve(ln)
+	return l, nil
+}
+
+// trackListener adds ln to the listeners closed by Close. It returns false if
+// the StreamListener is already closed.
+func (l *StreamListener) trackListener(ln net.Listener) bool {
+	l.m.Lock()
+	defer l.m.Unlock()
+	if l.closed {
+		return false
+	}
+	l.listeners = append(l.listeners, ln)
+	return true
+}
+
+// Serve accepts streams from ln until ln or the StreamListener is closed
+func (l *StreamListener) Serve(ln net.Listener) error {
+	if !l.trackListener(ln) {
+		ln.Close()
+		return net.ErrClosed
+	}
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go l.ServeConn(conn)
+	}
+}
+
+// ServeConn reads datagrams from conn until it is closed. The Server sees them
+// as coming from the remote address of conn.
+func (l *StreamListener) ServeConn(conn net.Conn) {
+	addr := streamAddr(conn.RemoteAddr())
+	key := addr.AddrPort()
+	s := &serverStream{conn: conn}
+
+	l.m.Lock()
+	if l.closed {
+		l.m.Unlock()
+		conn.Close()
+		return
+	}
+	if old, ok := l.streams[key]; ok {
+		old.conn.Close()
+	}
+	l.streams[key] = s
+	l.m.Unlock()
+
+	logrus.Debugf("stream: accepted stream from %s", addr)
+	defer func() {
+		l.m.Lock()
+		if l.streams[key] == s {
+			delete(l.streams, key)
+		}
+		l.m.Unlock()
+		conn.Close()
+		logrus.Debugf("stream: closed stream from %s", addr)
+	}()
+
+	r := newFrameReader(conn)
+	for {
+		datagram, err := r.peekFrame()
+		if err != nil {
+			if common.Debug {
+				logrus.Tracef("stream: read from %s failed: %s", addr, err)
+			}
+			return
+		}
+		buf := getBuffer(len(datagram))
+		copy(buf, datagram)
+		r.discardFrame(len(datagram))
+		select {
+		case l.packets <- streamPacket{b: buf, addr: addr}:
+		case <-l.done:
+			putBuffer(buf)
+			return
+		}
+	}
+}
+
+// ReadMsgUDP implements UDPLike
+func (l *StreamListener) ReadMsgUDP(b, oob []byte) (n, oobn, flags int, addr *net.UDPAddr, err error) {
+	var timeout <-chan time.Time
+	if deadline := l.readDeadline.Load(); deadline != nil && !deadline.IsZero() {
+		d := time.Until(*deadline)
+		if d <= 0 {
+			return 0, 0, 0, nil, ErrTimeout
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case pkt := <-l.packets:
+		n = copy(b, pkt.b)
+		putBuffer(pkt.b)
+		return n, 0, 0, pkt.addr, nil
+	case <-timeout:
+		return 0, 0, 0, nil, ErrTimeout
+	case <-l.done:
+		return 0, 0, 0, nil, net.ErrClosed
+	}
+}
+
+// WriteMsgUDP implements UDPLike. It writes b to the stream from addr.
+func (l *StreamListener) WriteMsgUDP(b, oob []byte, addr *net.UDPAddr) (n, oobn int, err error) {
+	if addr == nil {
+		return 0, 0, ErrNoStream
+	}
+	l.m.Lock()
+	s, ok := l.streams[addr.AddrPort()]
+	l.m.Unlock()
+	if !ok {
+		return 0, 0, ErrNoStream
+	}
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if err := writeFrame(s.conn, b); err != nil {
+		s.conn.Close()
+		return 0, 0, err
+	}
+	return len(b), 0, nil
+}
+
+// Read implements net.Conn
+func (l *StreamListener) Read(b []byte) (int, error) {
+	n, _, _, _, err := l.ReadMsgUDP(b, nil)
+	return n, err
+}
+
+// Write implements net.Conn. A StreamListener has no default destination.
+func (l *StreamListener) Write(b []byte) (int, error) {
+	return 0, ErrNoStream
+}
+
+// Close stops accepting streams and closes every open stream
+func (l *StreamListener) Close() error {
+	l.m.Lock()
+	defer l.m.Unlock()
+	if l.closed {
+		return net.ErrClosed
+	}
+	l.closed = true
+	close(l.done)
+	for _, ln := range l.listeners {
+		ln.Close()
+	}
+	for _, s := range l.streams {
+		s.conn.Close()
+	}
+	return nil
+}
+
+// LocalAddr implements net.Conn
+func (l *StreamListener) LocalAddr() net.Addr {
+	return l.addr
+}
+
+// RemoteAddr implements net.Conn. A StreamListener is not connected.
+func (l *StreamListener) RemoteAddr() net.Addr {
+	return nil
+}
+
+// SetDeadline implements net.Conn. Only the read deadline applies.
+func (l *StreamListener) SetDeadline(t time.Time) error {
+	return l.SetReadDeadline(t)
+}
+
+// SetReadDeadline implements net.Conn
+func (l *StreamListener) SetReadDeadline(t time.Time) error {
+	l.readDeadline.Store(&t)
+	return nil
+}
+
+// SetWriteDeadline implements net.Conn. Writes to streams do not time out.
+func (l *StreamListener) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,160 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestStreamConn(t *testing.T) {
+	a, b := net.Pipe()
+	ca, cb := NewStreamConn(a), NewStreamConn(b)
+	defer ca.Close()
+	defer cb.Close()
+
+	// A read that times out does not lose the stream's place
+	cb.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, _, _, _, err := cb.ReadMsgUDP(make([]byte, 10), nil)
+	assert.Assert(t, errors.Is(err, os.ErrDeadlineExceeded))
+	cb.SetReadDeadline(time.Time{})
+
+	sizes := []int{0, 1, 1500, 65535}
+	go func() {
+		for _, size := range sizes {
+			ca.WriteMsgUDP(bytes.Repeat([]byte{byte(size)}, size), nil, nil)
+		}
+	}()
+	buf := make([]byte, 65535)
+	for _, size := range sizes {
+		n, _, _, addr, err := cb.ReadMsgUDP(buf, nil)
+		assert.NilError(t, err)
+		assert.Assert(t, bytes.Equal(buf[:n], bytes.Repeat([]byte{byte(size)}, size)))
+		assert.Assert(t, addr != nil)
+	}
+
+	_, _, err = ca.WriteMsgUDP(make([]byte, 65536), nil, nil)
+	assert.Equal(t, err, ErrBufOverflow)
+}
+
+func TestWebSocketStream(t *testing.T) {
+	l := NewStreamListener(nil)
+	defer l.Close()
+	hs := httptest.NewServer(l)
+	defer hs.Close()
+
+	conn, err := DialWebSocket(context.Background(), "ws"+strings.TrimPrefix(hs.URL, "http")+DefaultWebSocketPath, nil)
+	assert.NilError(t, err)
+	c := NewStreamConn(conn)
+	defer c.Close()
+
+	// Larger datagrams span several WebSocket frame length encodings
+	for _, size := range []int{1, 200, 1500, 65535} {
+		msg := bytes.Repeat([]byte{byte(size)}, size)
+		_, _, err = c.WriteMsgUDP(msg, nil, nil)
+		assert.NilError(t, err)
+
+		buf := make([]byte, 65535)
+		l.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, _, addr, err := l.ReadMsgUDP(buf, nil)
+		assert.NilError(t, err)
+		assert.Assert(t, bytes.Equal(buf[:n], msg))
+		assert.Equal(t, addr.String(), conn.LocalAddr().String())
+
+		_, _, err = l.WriteMsgUDP(msg, nil, addr)
+		assert.NilError(t, err)
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, _, _, err = c.ReadMsgUDP(buf, nil)
+		assert.NilError(t, err)
+		assert.Assert(t, bytes.Equal(buf[:n], msg))
+	}
+
+	// A ping is answered and does not interrupt the stream
+	ws := conn.(*wsConn)
+	assert.NilError(t, ws.writeFrame(wsOpPing, []byte("ping")))
+	_, _, err = c.WriteMsgUDP([]byte("after ping"), nil, nil)
+	assert.NilError(t, err)
+	buf := make([]byte, 100)
+	n, _, _, _, err := l.ReadMsgUDP(buf, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, string(buf[:n]), "after ping")
+
+	_, _, err = l.WriteMsgUDP([]byte("x"), nil, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1})
+	assert.Equal(t, err, ErrNoStream)
+}
+
+func TestStreamServer(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	tcp, err := ListenStream("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	ws, err := ListenWebSocket("tcp", "127.0.0.1:0", DefaultWebSocketPath)
+	assert.NilError(t, err)
+	serverConfig, verifyConfig := newTestServerConfig(t)
+	s, err := NewMultiServer([]UDPLike{pc.(*net.UDPConn), tcp, ws}, *serverConfig)
+	assert.NilError(t, err)
+	go s.Serve()
+	defer s.Close()
+	_, _, clientConfig := newClientAuthAndConfig(t, verifyConfig)
+	clientConfig.HSTimeout = 5 * time.Second
+
+	for _, u := range []string{
+		"tcp://" + tcp.LocalAddr().String(),
+		"ws://" + ws.LocalAddr().String() + DefaultWebSocketPath,
+	} {
+		c, err := DialStream(context.Background(), u, *clientConfig)
+		assert.NilError(t, err, u)
+		h, err := s.AcceptTimeout(time.Second)
+		assert.NilError(t, err)
+
+		assert.NilError(t, c.WriteMsg([]byte("hello")))
+		buf := make([]byte, 100)
+		h.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := h.ReadMsg(buf)
+		assert.NilError(t, err)
+		assert.Equal(t, string(buf[:n]), "hello")
+
+		assert.NilError(t, h.WriteMsg([]byte("world")))
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		n, err = c.ReadMsg(buf)
+		assert.NilError(t, err)
+		assert.Equal(t, string(buf[:n]), "world")
+		c.Close()
+	}
+}
+
+func TestDialerFallback(t *testing.T) {
+	tcp, err := ListenStream("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	serverConfig, verifyConfig := newTestServerConfig(t)
+	_, _, clientConfig := newClientAuthAndConfig(t, verifyConfig)
+	clientConfig.HSTimeout = 200 * time.Millisecond
+	s, err := NewMultiServer([]UDPLike{tcp}, *serverConfig)
+	assert.NilError(t, err)
+	go s.Serve()
+	defer s.Close()
+
+	// UDP is blocked, so the dialer falls back to the stream
+	d := Dialer{FallbackURL: "tcp://" + tcp.LocalAddr().String()}
+	c, err := d.DialAddrs(context.Background(), []netip.AddrPort{newBlackHole(t)}, *clientConfig)
+	assert.NilError(t, err)
+	defer c.Close()
+	_, err = s.AcceptTimeout(time.Second)
+	assert.NilError(t, err)
+
+	// Without a fallback the UDP error is returned
+	d.FallbackURL = ""
+	_, err = d.DialAddrs(context.Background(), []netip.AddrPort{newBlackHole(t)}, *clientConfig)
+	var dialErr *DialError
+	assert.Assert(t, errors.As(err, &dialErr))
+	assert.Assert(t, udpUnreachable(err))
+	assert.Assert(t, !udpUnreachable(&DialError{Attempts: []*DialAttemptError{{Err: ErrInvalidMessage}}}))
+}
@@ -2,7 +2,7 @@ package transport
 
 import (
 	"bytes"
-	"io"
+	"encoding/binary"
 	"net"
 	"sync"
 
@@ -29,9 +29,6 @@ type SessionState struct {
 	readKey           *[KeyLen]byte
 	writeKey          *[KeyLen]byte
 
-	// TODO(dadrian)[2023-09-09]: Should this be lock protected?
-	rawWrite bytes.Buffer
-
 	m sync.Mutex
 
 	// +checklocks:m
@@ -40,6 +37,15 @@ type SessionState struct {
 	window      SlidingWindow
 	count       uint64
 	isHiddenHS  bool
+
+	// conn is the socket packets to the peer are written to, and batch writes
+	// several packets to it at once, or is nil. A Server with several sockets
+	// moves a session to the socket its peer last sent from.
+	//
+	// +checklocks:m
+	conn UDPLike
+	// +checklocks:m
+	batch batchConn
 }
 
 // PlaintextLen returns the expected length of plaintext given the length of a
@@ -81,17 +87,6 @@ func EqualUDPAddress(a, b *net.UDPAddr) bool {
 	return true
 }
 
-func (ss *SessionState) writeCounter(w io.ByteWriter) {
-	w.WriteByte(byte(ss.count >> 56))
-	w.WriteByte(byte(ss.count >> 48))
-	w.WriteByte(byte(ss.count >> 40))
-	w.WriteByte(byte(ss.count >> 32))
-	w.WriteByte(byte(ss.count >> 24))
-	w.WriteByte(byte(ss.count >> 16))
-	w.WriteByte(byte(ss.count >> 8))
-	w.WriteByte(byte(ss.count))
-}
-
 func (ss *SessionState) readCounter(b []byte) (count uint64) {
 	_ = b[7]
 	count += uint64(b[0]) << 56
@@ -105,23 +100,27 @@ func (ss *SessionState) readCounter(b []byte) (count uint64) {
 	return
 }
 
-func (ss *SessionState) sealPacketLocked(msgType MessageType, in []byte, key *[KeyLen]byte) ([]byte, error) {
-	length := HeaderLen + SessionIDLen + CounterLen + len(in) + TagLen
-	ss.rawWrite.Reset()
-	if ss.rawWrite.Cap() < length {
-		ss.rawWrite.Grow(length)
+// sealPacketLocked appends a sealed packet containing in to dst and returns
+// the updated slice. Callers can avoid an allocation by passing a dst with
+// enough spare capacity for SessionOverhead+len(in) bytes.
+func (ss *SessionState) sealPacketLocked(dst []byte, msgType MessageType, in []byte, key *[KeyLen]byte) ([]byte, error) {
+	length := AssociatedDataLen + len(in) + TagLen
+	start := len(dst)
+	if cap(dst)-start < length {
+		dst = append(dst, make([]byte, length)...)[:start]
 	}
 
-	ss.rawWrite.WriteByte(byte(msgType))
-	ss.rawWrite.WriteByte(0)
-	ss.rawWrite.WriteByte(0)
-	ss.rawWrite.WriteByte(0)
+	header := dst[start : start+AssociatedDataLen]
+	header[0] = byte(msgType)
+	header[1] = 0
+	header[2] = 0
+	header[3] = 0
 
 	// SessionID
-	ss.rawWrite.Write(ss.sessionID[:])
+	copy(header[HeaderLen:], ss.sessionID[:])
 
 	// Counter
-	ss.writeCounter(&ss.rawWrite)
+	binary.BigEndian.PutUint64(header[HeaderLen+SessionIDLen:], ss.count)
 	if common.Debug {
 		logrus.Tracef("ss: writing packet with count %d", ss.count)
 	}
@@ -132,19 +131,16 @@ func (ss *SessionState) sealPacketLocked(msgType MessageType, in []byte, key *[K
 	if err != nil {
 		return nil, err
 	}
-	buf := make([]byte, TagLen+len(in))
-	enc := aead.Seal(buf[:0], nil, in, ss.rawWrite.Bytes()[:AssociatedDataLen])
+	out := aead.Seal(dst[:start+AssociatedDataLen], nil, in, header)
 	if common.Debug {
-		logrus.Tracef("write: %x %x", buf[:12], enc)
-		logrus.Tracef("write(buf): %x", buf)
+		logrus.Tracef("write: %x", out[start:])
 	}
-	if len(enc) != len(buf) {
-		logrus.Panicf("expected len(buf) = len(enc), got: %d = %d + 12", len(buf), len(enc))
+	if len(out) != start+length {
+		logrus.Panicf("expected len(out) = %d, got: %d", start+length, len(out))
 	}
-	ss.rawWrite.Write(buf)
 
 	ss.count++
-	return append([]byte(nil), ss.rawWrite.Bytes()...), nil
+	return out, nil
 }
 
 func (ss *SessionState) readPacketLocked(plaintext, pkt []byte, key *[KeyLen]byte) (int, MessageType, error) {
@@ -213,17 +209,30 @@ func (ss *SessionState) readPacketLocked(plaintext, pkt []byte, key *[KeyLen]byt
 
 // +checklocks:ss.m
 func (ss *SessionState) handleControlLocked(msg []byte) (err error) {
-	if len(msg) != 1 {
-		logrus.Error("handle: invalid control message: ", msg)
+	if len(msg) == 0 {
+		logrus.Error("handle: empty control message")
 		ss.closeLocked()
 		return ErrInvalidMessage
 	}
 
 	ctrlMsg := ControlMessage(msg[0])
-	switch ctrlMsg {
-	case ControlMessageClose:
+	switch {
+	case ctrlMsg == ControlMessageClose && len(msg) == 1:
 		logrus.Debug("handle: got close message")
 		return ss.closeLocked()
+	case ctrlMsg == ControlMessagePMTUProbe && len(msg) >= pmtuControlLen:
+		// Sending requires the session lock, so acknowledge asynchronously
+		size := int(binary.BigEndian.Uint16(msg[1:pmtuControlLen]))
+		go ss.handle.sendPMTUAck(size)
+		if ss.handle.pmtu != nil {
+			ss.handle.startPathMTUDiscovery()
+		}
+		return nil
+	case ctrlMsg == ControlMessagePMTUAck && len(msg) == pmtuControlLen:
+		if ss.handle.pmtu != nil {
+			ss.handle.pmtu.ack(int(binary.BigEndian.Uint16(msg[1:pmtuControlLen])))
+		}
+		return nil
 	default:
 		logrus.Errorf("server: unexpected control message: %x", msg)
 		ss.closeLocked()
@@ -239,6 +248,9 @@ func (ss *SessionState) closeLocked() (err error) {
 	ss.handleState = closed
 	if ss.handle != nil {
 		_ = ss.handle.recv.Close()
+		if ss.handle.pmtu != nil {
+			ss.handle.pmtu.stop()
+		}
 	}
 	return nil
 }
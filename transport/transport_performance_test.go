@@ -2,8 +2,12 @@ package transport
 
 import (
 	"crypto/rand"
+	"fmt"
 	"net"
+	"runtime"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"gotest.tools/assert"
 )
@@ -45,9 +49,12 @@ func benchWriter(b *testing.B, writer, reader MsgConn, size int) {
 	n, err := rand.Read(data[:])
 	assert.NilError(b, err)
 	assert.Equal(b, len(data), n)
+	b.ReportAllocs()
+	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		writer.Write(data[:])
 	}
+	reportPacketRate(b, b.N)
 }
 
 func benchReader(b *testing.B, reader, writer MsgConn, size int) {
@@ -62,9 +69,16 @@ func benchReader(b *testing.B, reader, writer MsgConn, size int) {
 	}()
 
 	buf := make([]byte, size)
+	b.ReportAllocs()
+	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		reader.ReadMsg(buf[:])
 	}
+	reportPacketRate(b, b.N)
+}
+
+func reportPacketRate(b *testing.B, packets int) {
+	b.ReportMetric(float64(packets)/b.Elapsed().Seconds(), "pkts/s")
 }
 
 func BenchmarkClientTransportWrite(b *testing.B) {
@@ -96,3 +110,142 @@ func BenchmarkServerTransportRead(b *testing.B) {
 
 	benchReader(b, accepted, c, benchPacketSize)
 }
+
+func BenchmarkServerTransportWriteMsgs(b *testing.B) {
+	c, s := newClientAndServerForBench(b)
+	accepted, err := s.Accept()
+	assert.NilError(b, err)
+	go func() {
+		buf := make([]byte, benchPacketSize)
+		for {
+			c.ReadMsg(buf)
+		}
+	}()
+
+	msgs := make([][]byte, packetBatchSize)
+	for i := range msgs {
+		msgs[i] = make([]byte, benchPacketSize)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		accepted.WriteMsgs(msgs)
+	}
+	reportPacketRate(b, b.N*len(msgs))
+}
+
+// BenchmarkUDPRead compares reading datagrams one at a time against batched
+// reads. Each iteration reads one datagram.
+func BenchmarkUDPRead(b *testing.B) {
+	for _, bc := range []struct {
+		name string
+		new  func(*net.UDPConn) batchConn
+	}{
+		{"single", func(c *net.UDPConn) batchConn { return &singleConn{conn: c} }},
+		{"batch", func(c *net.UDPConn) batchConn { return newBatchConn(c, true) }},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			pc, err := net.ListenPacket("udp", "localhost:0")
+			assert.NilError(b, err)
+			defer pc.Close()
+			wc, err := net.ListenPacket("udp", "localhost:0")
+			assert.NilError(b, err)
+			defer wc.Close()
+
+			reader := bc.new(pc.(*net.UDPConn))
+			writer := newBatchConn(wc.(*net.UDPConn), false)
+			pkts := make([]datagram, packetBatchSize)
+			for i := range pkts {
+				pkts[i] = datagram{b: make([]byte, 1200), addr: pc.LocalAddr().(*net.UDPAddr)}
+			}
+
+			// Datagrams can be dropped, so keep writing until the reader is done
+			var done atomic.Bool
+			go func() {
+				for !done.Load() {
+					writer.writeBatch(pkts)
+				}
+			}()
+			defer done.Store(true)
+
+			pc.SetReadDeadline(time.Now().Add(time.Minute))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for read := 0; read < b.N; {
+				batch, err := reader.readBatch()
+				assert.NilError(b, err)
+				read += len(batch)
+			}
+			reportPacketRate(b, b.N)
+		})
+	}
+}
+
+// BenchmarkShardedServer measures how the rate of packets received by a Server
+// scales with the number of SO_REUSEPORT sockets and receive loops. Each
+// iteration receives one packet.
+func BenchmarkShardedServer(b *testing.B) {
+	for shards := 1; shards <= runtime.NumCPU() && shards <= MaxShards; shards *= 2 {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			conns, err := ListenReusePort("udp4", "127.0.0.1:0", shards)
+			if err != nil {
+				b.Skipf("SO_REUSEPORT sharding is unsupported: %s", err)
+			}
+			serverConfig, verifyConfig := newTestServerConfig(b)
+			s, err := NewMultiServer(conns, *serverConfig)
+			assert.NilError(b, err)
+			go s.Serve()
+			defer s.Close()
+
+			// Several clients per shard, so that the kernel's hash spreads
+			// them over every socket. Traffic starts once every handshake is
+			// done.
+			var clients []*Client
+			var handles []*Handle
+			for i := 0; i < 4*shards; i++ {
+				_, _, clientConfig := newClientAuthAndConfig(b, verifyConfig)
+				c, err := Dial("udp", s.Addr().String(), *clientConfig)
+				assert.NilError(b, err)
+				defer c.Close()
+				assert.NilError(b, c.Handshake())
+				h, err := s.AcceptTimeout(time.Second)
+				assert.NilError(b, err)
+				clients = append(clients, c)
+				handles = append(handles, h)
+			}
+
+			var received atomic.Int64
+			var done atomic.Bool
+			defer done.Store(true)
+			for i := range clients {
+				go func(h *Handle) {
+					buf := make([]byte, benchPacketSize)
+					for {
+						if _, err := h.ReadMsg(buf); err != nil {
+							return
+						}
+						received.Add(1)
+					}
+				}(handles[i])
+				// Datagrams can be dropped, so keep writing until the server is
+				// done
+				go func(c *Client) {
+					data := make([]byte, benchPacketSize)
+					for !done.Load() {
+						if err := c.WriteMsg(data); err != nil {
+							return
+						}
+					}
+				}(clients[i])
+			}
+
+			b.ReportAllocs()
+			received.Store(0)
+			b.ResetTimer()
+			for received.Load() < int64(b.N) {
+				time.Sleep(100 * time.Microsecond)
+			}
+			reportPacketRate(b, b.N)
+		})
+	}
+}
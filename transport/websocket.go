@@ -0,0 +1,423 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// A minimal WebSocket (RFC 6455) carrier for Hop datagrams, for networks that
+// only allow traffic through HTTP proxies. A WebSocket is used as a byte stream
+// of binary messages, and datagrams are framed on top of it the same way as on
+// a TCP stream. Extensions and HTTP/2 WebSockets (RFC 8441) are not supported.
+
+// DefaultWebSocketPath is the path of the WebSocket endpoint served by hopd
+const DefaultWebSocketPath = "/hop"
+
+// webSocketProtocol is the subprotocol negotiated for Hop WebSockets
+const webSocketProtocol = "hop"
+
+// webSocketGUID is appended to the key of a WebSocket handshake
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes
+const (
+	wsOpContinuation = 0x0
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+)
+
+// maxWSControlPayload is the largest payload of a WebSocket control frame
+const maxWSControlPayload = 125
+
+// ErrWebSocketHandshake is returned when a WebSocket upgrade fails
+var ErrWebSocketHandshake = errors.New("websocket handshake failed")
+
+// errWebSocketFrame is returned when a WebSocket frame is malformed
+var errWebSocketFrame = errors.New("invalid websocket frame")
+
+// webSocketAccept returns the Sec-WebSocket-Accept value for key
+func webSocketAccept(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key))
+	h.Write([]byte(webSocketGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// headerContains reports whether the comma separated header name in h contains
+// token, ignoring case
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsConn is a byte stream carried in the binary messages of a WebSocket
+type wsConn struct {
+	net.Conn
+	br *bufio.Reader
+	// client is true on the client end, which must mask the frames it sends
+	client bool
+
+	readMu sync.Mutex
+	// +checklocks:readMu
+	remaining uint64
+	// +checklocks:readMu
+	masked bool
+	// +checklocks:readMu
+	mask [4]byte
+	// +checklocks:readMu
+	maskPos int
+
+	writeMu sync.Mutex
+}
+
+// writeFrame writes a single WebSocket frame with the given opcode
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	hdr := make([]byte, 0, 14)
+	hdr = append(hdr, 0x80|opcode)
+	maskBit := byte(0)
+	if c.client {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) <= maxWSControlPayload:
+		hdr = append(hdr, maskBit|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		hdr = append(hdr, maskBit|126)
+		hdr = binary.BigEndian.AppendUint16(hdr, uint16(len(payload)))
+	default:
+		hdr = append(hdr, maskBit|127)
+		hdr = binary.BigEndian.AppendUint64(hdr, uint64(len(payload)))
+	}
+
+	frame := getBuffer(len(hdr) + 4 + len(payload))
+	defer putBuffer(frame)
+	n := copy(frame, hdr)
+	if c.client {
+		mask := frame[n : n+4]
+		if _, err := rand.Read(mask); err != nil {
+			return err
+		}
+		n += 4
+		for i, b := range payload {
+			frame[n+i] = b ^ mask[i%4]
+		}
+	} else {
+		copy(frame[n:], payload)
+	}
+	n += len(payload)
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := c.Conn.Write(frame[:n])
+	return err
+}
+
+// Write implements net.Conn. Each call is sent as one binary message.
+func (c *wsConn) Write(b []byte) (int, error) {
+	if err := c.writeFrame(wsOpBinary, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// readHeaderLocked reads the header of the next frame. The header is only
+// consumed once all of it has arrived.
+//
+// +checklocks:c.readMu
+func (c *wsConn) readHeaderLocked() (opcode byte, err error) {
+	hdr, err := c.br.Peek(2)
+	if err != nil {
+		return 0, err
+	}
+	if hdr[0]&0x70 != 0 {
+		return 0, errWebSocketFrame
+	}
+	opcode = hdr[0] & 0x0f
+	masked := hdr[1]&0x80 != 0
+	if masked == c.client {
+		// Clients must mask their frames, and servers must not
+		return 0, errWebSocketFrame
+	}
+	hdrLen := 2
+	switch hdr[1] & 0x7f {
+	case 126:
+		hdrLen += 2
+	case 127:
+		hdrLen += 8
+	}
+	if masked {
+		hdrLen += 4
+	}
+	if hdr, err = c.br.Peek(hdrLen); err != nil {
+		return 0, err
+	}
+
+	length := uint64(hdr[1] & 0x7f)
+	pos := 2
+	switch length {
+	case 126:
+		length = uint64(binary.BigEndian.Uint16(hdr[pos:]))
+		pos += 2
+	case 127:
+		length = binary.BigEndian.Uint64(hdr[pos:])
+		pos += 8
+	}
+	c.masked = masked
+	if masked {
+		copy(c.mask[:], hdr[pos:pos+4])
+	}
+	c.maskPos = 0
+	c.remaining = length
+	c.br.Discard(hdrLen)
+	return opcode, nil
+}
+
+// readPayloadLocked reads up to len(b) bytes of the current frame
+//
+// +checklocks:c.readMu
+func (c *wsConn) readPayloadLocked(b []byte) (int, error) {
+	if uint64(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err := c.br.Read(b)
+	if c.masked {
+		for i := range b[:n] {
+			b[i] ^= c.mask[(c.maskPos+i)%4]
+		}
+		c.maskPos = (c.maskPos + n) % 4
+	}
+	c.remaining -= uint64(n)
+	return n, err
+}
+
+// readControlLocked handles a control frame with the given opcode
+//
+// +checklocks:c.readMu
+func (c *wsConn) readControlLocked(opcode byte) error {
+	if c.remaining > maxWSControlPayload {
+		return errWebSocketFrame
+	}
+	payload := make([]byte, c.remaining)
+	if _, err := io.ReadFull(readerFunc(c.readPayloadLocked), payload); err != nil {
+		return err
+	}
+	switch opcode {
+	case wsOpPing:
+		return c.writeFrame(wsOpPong, payload)
+	case wsOpClose:
+		c.writeFrame(wsOpClose, nil)
+		return io.EOF
+	}
+	return nil
+}
+
+// readerFunc adapts a function to io.Reader
+type readerFunc func([]byte) (int, error)
+
+func (f readerFunc) Read(b []byte) (int, error) {
+	return f(b)
+}
+
+// Read implements net.Conn, returning the payloads of data messages
+func (c *wsConn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	for c.remaining == 0 {
+		opcode, err := c.readHeaderLocked()
+		if err != nil {
+			return 0, err
+		}
+		switch opcode {
+		case wsOpBinary, wsOpContinuation:
+		case wsOpPing, wsOpPong, wsOpClose:
+			if err := c.readControlLocked(opcode); err != nil {
+				return 0, err
+			}
+		default:
+			return 0, fmt.Errorf("%w: unexpected opcode %x", errWebSocketFrame, opcode)
+		}
+	}
+	return c.readPayloadLocked(b)
+}
+
+// DialWebSocket opens a WebSocket to rawURL, which must have a ws or wss
+// scheme, and returns it as a byte stream for NewStreamConn. If tlsConfig is
+// nil, wss URLs are verified against the system roots.
+func DialWebSocket(ctx context.Context, rawURL string, tlsConfig *tls.Config) (net.Conn, error) {
+	return dialWebSocket(ctx, rawURL, tlsConfig, nil)
+}
+
+// dialWebSocket is DialWebSocket through proxy, if it is not nil
+func dialWebSocket(ctx context.Context, rawURL string, tlsConfig *tls.Config, proxy *url.URL) (net.Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	switch u.Scheme {
+	case "ws":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "80")
+		}
+	case "wss":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported websocket scheme %q", u.Scheme)
+	}
+
+	var d net.Dialer
+	conn, err := dialProxyStream(ctx, &d, proxy, host)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "wss" {
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		if tlsConfig.ServerName == "" {
+			tlsConfig = tlsConfig.Clone()
+			tlsConfig.ServerName = u.Hostname()
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	ws, err := webSocketHandshake(ctx, conn, u)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ws, nil
+}
+
+// webSocketHandshake upgrades conn to a WebSocket to u
+func webSocketHandshake(ctx context.Context, conn net.Conn, u *url.URL) (*wsConn, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+
+	httpURL := *u
+	httpURL.Scheme = strings.Replace(u.Scheme, "ws", "http", 1)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, httpURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Protocol", webSocketProtocol)
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("%w: %s", ErrWebSocketHandshake, resp.Status)
+	}
+	if !headerContains(resp.Header, "Upgrade", "websocket") ||
+		resp.Header.Get("Sec-WebSocket-Accept") != webSocketAccept(key) {
+		return nil, fmt.Errorf("%w: invalid upgrade response", ErrWebSocketHandshake)
+	}
+	return &wsConn{Conn: conn, br: br, client: true}, nil
+}
+
+// ServeHTTP implements http.Handler. It upgrades requests to WebSockets and
+// serves each as a stream.
+func (l *StreamListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") ||
+		r.Header.Get("Sec-WebSocket-Version") != "13" || key == "" {
+		http.Error(w, "expected a websocket upgrade", http.StatusBadRequest)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket upgrade not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		logrus.Errorf("stream: websocket hijack failed: %s", err)
+		return
+	}
+
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + webSocketAccept(key) + "\r\n"
+	if headerContains(r.Header, "Sec-WebSocket-Protocol", webSocketProtocol) {
+		resp += "Sec-WebSocket-Protocol: " + webSocketProtocol + "\r\n"
+	}
+	if _, err := brw.WriteString(resp + "\r\n"); err != nil {
+		conn.Close()
+		return
+	}
+	if err := brw.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+	l.ServeConn(&wsConn{Conn: conn, br: brw.Reader})
+}
+
+// ListenWebSocket listens for HTTP connections on address and returns a
+// StreamListener that serves WebSocket upgrades at path. TLS is expected to be
+// terminated by a reverse proxy in front of it.
+func ListenWebSocket(network, address, path string) (*StreamListener, error) {
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	l := NewStreamListener(ln.Addr())
+	if !l.trackListener(ln) {
+		ln.Close()
+		return nil, net.ErrClosed
+	}
+	mux := http.NewServeMux()
+	mux.Handle(path, l)
+	go http.Serve(ln, mux)
+	return l, nil
+}
@@ -16,15 +16,13 @@ var ErrBadTubeState = errors.New("tube in bad state")
 
 var errFrameOutOfBounds = errors.New("received data frame out of receive window bounds") // +checklocksignore
 var errTooManyDuplicateACKs = errors.New("too many duplicate acknowledgements")          // +checklocksignore
+var errMalformedSack = errors.New("malformed SACK ranges")                               // +checklocksignore
 
 // TODO(hosono) create a config struct to pass to the muxer to set these things
 
-// MaxFrameDataLength is the maximum bytes per frame in a Reliable or Unreliable tube
-// TODO(hosono) IPv4 is only required to support packets up to 576 bytes long,
-// but usually internet routers can support much larger packets.
-// Correctly implementing MTU discovery is complicated. Setting this to a
-// value that is always safe (~500), leads to unacceptable performance loss.
-// Setting this a large value may cause unreliable tubes to intermittently fail.
+// MaxFrameDataLength is the maximum bytes per frame in a Reliable or Unreliable tube.
+// Frames are further limited to the MaxPayload of the underlying MsgConn, which
+// follows the path MTU discovered by the transport.
 const MaxFrameDataLength uint16 = 32768
 
 // maximum number of packet an unreliable tube will buffer
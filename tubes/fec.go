@@ -0,0 +1,282 @@
+package tubes
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Forward error correction (FEC) for unreliable tubes. When FEC is enabled,
+// the sender groups consecutive data frames and follows each group with a
+// parity frame holding the XOR of their data. The receiver can rebuild any
+// single missing data frame of a group from the parity frame and the rest of
+// the group, without retransmission.
+//
+// Every frame of an FEC-enabled sender carries the FEC flag, which tells the
+// receiver to keep recent data frames around. Unreliable tubes do not
+// acknowledge frames, so parity frames reuse ackNo to carry the number of data
+// frames in their group. A parity frame's frameNo is the frameNo of the first
+// data frame in its group. Its data is the XOR of the lengths of the data
+// frames, followed by the XOR of their data.
+
+// ErrInvalidFECConfig is returned when enabling FEC with an unusable FECConfig
+var ErrInvalidFECConfig = errors.New("invalid FEC configuration")
+
+// The number of bytes a parity frame adds before the XOR of the data
+const fecParityHeaderLen = 2
+
+// The largest number of data frames protected by a single parity frame
+const maxFECGroupSize = 64
+
+// How many frames behind the newest received frame are kept for recovery
+const fecWindow = 4 * maxFECGroupSize
+
+// FECConfig configures forward error correction for an unreliable tube
+type FECConfig struct {
+	// GroupSize is the number of datagrams protected by each parity frame. The
+	// bandwidth overhead is 1/GroupSize. Any single datagram lost from a group
+	// can be recovered.
+	GroupSize int
+}
+
+// FECStats counts forward error correction activity on an unreliable tube
+type FECStats struct {
+	// ParitySent is the number of parity frames sent
+	ParitySent uint64
+	// ParityReceived is the number of parity frames received
+	ParityReceived uint64
+	// Recovered is the number of lost datagrams rebuilt from parity frames
+	Recovered uint64
+	// Unrecovered is the number of datagrams lost from groups with a parity
+	// frame that had too many losses to recover
+	Unrecovered uint64
+}
+
+// fecEncoder builds parity frames for outgoing data frames
+type fecEncoder struct {
+	groupSize int
+
+	start  uint32
+	count  int
+	lenXor uint16
+	parity []byte
+}
+
+// Validate returns ErrInvalidFECConfig if config cannot be used to enable FEC
+func (config FECConfig) Validate() error {
+	if config.GroupSize < 1 || config.GroupSize > maxFECGroupSize {
+		return ErrInvalidFECConfig
+	}
+	return nil
+}
+
+func newFECEncoder(config FECConfig) (*fecEncoder, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return &fecEncoder{groupSize: config.GroupSize}, nil
+}
+
+// add adds a data frame to the current group. It returns the parity frame of
+// the group if the group is complete, or nil otherwise.
+func (e *fecEncoder) add(tubeID byte, frameNo uint32, data []byte) *frame {
+	if e.count == 0 {
+		e.start = frameNo
+	}
+	e.count++
+	e.lenXor ^= uint16(len(data))
+	if len(data) > len(e.parity) {
+		e.parity = append(e.parity, make([]byte, len(data)-len(e.parity))...)
+	}
+	xorBytes(e.parity, data)
+
+	if e.count < e.groupSize {
+		return nil
+	}
+	return e.flush(tubeID)
+}
+
+// flush returns the parity frame of the current group, even if it is not yet
+// complete. It returns nil if the group is empty.
+func (e *fecEncoder) flush(tubeID byte) *frame {
+	if e.count == 0 {
+		return nil
+	}
+	data := make([]byte, fecParityHeaderLen+len(e.parity))
+	binary.BigEndian.PutUint16(data, e.lenXor)
+	copy(data[fecParityHeaderLen:], e.parity)
+	pkt := &frame{
+		tubeID:     tubeID,
+		flags:      frameFlags{FEC: true},
+		ackNo:      uint32(e.count),
+		frameNo:    e.start,
+		dataLength: uint16(len(data)),
+		data:       data,
+	}
+
+	e.count = 0
+	e.lenXor = 0
+	e.parity = e.parity[:0]
+	return pkt
+}
+
+// fecParity is a received parity frame waiting for enough of its group
+type fecParity struct {
+	count   uint32
+	lenXor  uint16
+	payload []byte
+}
+
+// fecDecoder rebuilds lost data frames from received parity frames
+type fecDecoder struct {
+	// Recently received data frames by frameNo
+	frames map[uint32][]byte
+	// Parity frames that could not be used yet, by the frameNo of their group
+	parities map[uint32]*fecParity
+	// Frames that were rebuilt, so that late arrivals can be dropped
+	recovered map[uint32]bool
+	// The largest frameNo seen so far
+	newest uint32
+
+	stats *FECStats
+}
+
+func newFECDecoder(stats *FECStats) *fecDecoder {
+	return &fecDecoder{
+		frames:    make(map[uint32][]byte),
+		parities:  make(map[uint32]*fecParity),
+		recovered: make(map[uint32]bool),
+		stats:     stats,
+	}
+}
+
+// receiveData records a data frame. It returns false if the frame was already
+// rebuilt and must not be delivered again, along with any frames that it
+// allowed to be rebuilt.
+func (d *fecDecoder) receiveData(frameNo uint32, data []byte) (bool, [][]byte) {
+	if d.recovered[frameNo] {
+		delete(d.recovered, frameNo)
+		return false, nil
+	}
+	d.advance(frameNo)
+	if d.stale(frameNo) {
+		return true, nil
+	}
+	d.frames[frameNo] = data
+
+	var rebuilt [][]byte
+	for start, p := range d.parities {
+		if frameNo-start < p.count {
+			if b, done := d.tryRecover(start, p); done {
+				delete(d.parities, start)
+				if b != nil {
+					rebuilt = append(rebuilt, b)
+				}
+			}
+		}
+	}
+	return true, rebuilt
+}
+
+// receiveParity records a parity frame and returns the data frame it rebuilt,
+// if any.
+func (d *fecDecoder) receiveParity(pkt *frame) []byte {
+	if pkt.ackNo == 0 || pkt.ackNo > maxFECGroupSize || len(pkt.data) < fecParityHeaderLen {
+		return nil
+	}
+	d.stats.ParityReceived++
+	d.advance(pkt.frameNo + pkt.ackNo - 1)
+	if d.stale(pkt.frameNo) {
+		return nil
+	}
+	p := &fecParity{
+		count:   pkt.ackNo,
+		lenXor:  binary.BigEndian.Uint16(pkt.data),
+		payload: pkt.data[fecParityHeaderLen:],
+	}
+	b, done := d.tryRecover(pkt.frameNo, p)
+	if !done {
+		d.parities[pkt.frameNo] = p
+	}
+	return b
+}
+
+// tryRecover rebuilds the missing frame of a group if exactly one is missing.
+// It returns true when the parity frame is no longer needed.
+func (d *fecDecoder) tryRecover(start uint32, p *fecParity) ([]byte, bool) {
+	missing := 0
+	var missingNo uint32
+	for i := uint32(0); i < p.count; i++ {
+		if _, ok := d.frames[start+i]; !ok {
+			missing++
+			missingNo = start + i
+		}
+	}
+	if missing != 1 {
+		return nil, missing == 0
+	}
+
+	length := p.lenXor
+	payload := append([]byte(nil), p.payload...)
+	for i := uint32(0); i < p.count; i++ {
+		if data, ok := d.frames[start+i]; ok {
+			length ^= uint16(len(data))
+			if len(data) > len(payload) {
+				// Malformed parity frame
+				return nil, true
+			}
+			xorBytes(payload, data)
+		}
+	}
+	if int(length) > len(payload) {
+		return nil, true
+	}
+
+	d.frames[missingNo] = payload[:length]
+	d.recovered[missingNo] = true
+	d.stats.Recovered++
+	return payload[:length], true
+}
+
+// advance moves the window forward to include frameNo, and forgets frames that
+// fall out of it.
+func (d *fecDecoder) advance(frameNo uint32) {
+	if int32(frameNo-d.newest) <= 0 {
+		return
+	}
+	d.newest = frameNo
+	if len(d.frames) <= 2*fecWindow && len(d.recovered) <= fecWindow && len(d.parities) <= fecWindow {
+		return
+	}
+	for start, p := range d.parities {
+		if d.stale(start) {
+			for i := uint32(0); i < p.count; i++ {
+				if _, ok := d.frames[start+i]; !ok {
+					d.stats.Unrecovered++
+				}
+			}
+			delete(d.parities, start)
+		}
+	}
+	for n := range d.frames {
+		if d.stale(n) {
+			delete(d.frames, n)
+		}
+	}
+	for n := range d.recovered {
+		if d.stale(n) {
+			delete(d.recovered, n)
+		}
+	}
+}
+
+// stale reports whether frameNo is too far behind the newest frame to be kept
+func (d *fecDecoder) stale(frameNo uint32) bool {
+	return int32(d.newest-frameNo) > fecWindow
+}
+
+// xorBytes sets dst[i] ^= src[i] for each byte of src
+func xorBytes(dst, src []byte) {
+	for i := range src {
+		dst[i] ^= src[i]
+	}
+}
@@ -0,0 +1,161 @@
+package tubes
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func fecTestMessages(n int) [][]byte {
+	msgs := make([][]byte, n)
+	for i := range msgs {
+		msgs[i] = []byte(fmt.Sprintf("message %d%s", i, make([]byte, i%7)))
+	}
+	return msgs
+}
+
+// encodeFECGroup returns the parity frame of msgs, numbered from start
+func encodeFECGroup(t *testing.T, start uint32, msgs [][]byte) *frame {
+	e, err := newFECEncoder(FECConfig{GroupSize: len(msgs)})
+	assert.NilError(t, err)
+	var parity *frame
+	for i, m := range msgs {
+		parity = e.add(1, start+uint32(i), m)
+		if i < len(msgs)-1 {
+			assert.Assert(t, parity == nil)
+		}
+	}
+	assert.Assert(t, parity != nil)
+
+	// The parity frame must survive encoding
+	decoded, err := fromBytes(parity.toBytes())
+	assert.NilError(t, err)
+	assert.Assert(t, decoded.flags.FEC)
+	return decoded
+}
+
+func TestFECRecoversSingleLoss(t *testing.T) {
+	msgs := fecTestMessages(5)
+	for lost := range msgs {
+		stats := FECStats{}
+		d := newFECDecoder(&stats)
+		for i, m := range msgs {
+			if i != lost {
+				deliver, rebuilt := d.receiveData(uint32(10+i), m)
+				assert.Assert(t, deliver)
+				assert.Equal(t, len(rebuilt), 0)
+			}
+		}
+		b := d.receiveParity(encodeFECGroup(t, 10, msgs))
+		assert.DeepEqual(t, b, msgs[lost])
+		assert.Equal(t, stats.Recovered, uint64(1))
+
+		// A late copy of the lost frame is not delivered twice
+		deliver, _ := d.receiveData(uint32(10+lost), msgs[lost])
+		assert.Assert(t, !deliver)
+	}
+}
+
+func TestFECParityBeforeData(t *testing.T) {
+	msgs := fecTestMessages(4)
+	stats := FECStats{}
+	d := newFECDecoder(&stats)
+
+	// The parity frame overtakes the group and waits for enough of it
+	assert.Assert(t, d.receiveParity(encodeFECGroup(t, 0, msgs)) == nil)
+	for i := 0; i < 2; i++ {
+		_, rebuilt := d.receiveData(uint32(i), msgs[i])
+		assert.Equal(t, len(rebuilt), 0)
+	}
+	_, rebuilt := d.receiveData(3, msgs[3])
+	assert.DeepEqual(t, rebuilt, [][]byte{msgs[2]})
+	assert.Equal(t, stats.Recovered, uint64(1))
+}
+
+func TestFECTwoLosses(t *testing.T) {
+	msgs := fecTestMessages(4)
+	stats := FECStats{}
+	d := newFECDecoder(&stats)
+	d.receiveData(0, msgs[0])
+	d.receiveData(3, msgs[3])
+	assert.Assert(t, d.receiveParity(encodeFECGroup(t, 0, msgs)) == nil)
+	assert.Equal(t, stats.Recovered, uint64(0))
+
+	// Once the group falls out of the window, its losses are counted
+	for i := uint32(4); i < 4+4*fecWindow; i++ {
+		d.receiveData(i, msgs[0])
+	}
+	assert.Equal(t, stats.Unrecovered, uint64(2))
+	assert.Equal(t, len(d.parities), 0)
+}
+
+func TestFECMalformedParity(t *testing.T) {
+	msgs := fecTestMessages(3)
+	stats := FECStats{}
+	d := newFECDecoder(&stats)
+	d.receiveData(0, msgs[0])
+	d.receiveData(1, msgs[1])
+
+	// A parity frame claiming a length longer than its payload is ignored
+	parity := encodeFECGroup(t, 0, msgs)
+	binary.BigEndian.PutUint16(parity.data, 0xffff)
+	assert.Assert(t, d.receiveParity(parity) == nil)
+
+	parity.ackNo = maxFECGroupSize + 1
+	assert.Assert(t, d.receiveParity(parity) == nil)
+	assert.Equal(t, stats.Recovered, uint64(0))
+}
+
+func TestFECConfig(t *testing.T) {
+	_, err := newFECEncoder(FECConfig{GroupSize: 0})
+	assert.Equal(t, err, ErrInvalidFECConfig)
+	_, err = newFECEncoder(FECConfig{GroupSize: maxFECGroupSize + 1})
+	assert.Equal(t, err, ErrInvalidFECConfig)
+}
+
+func TestUnreliableFEC(t *testing.T) {
+	t1, t2, stop, _, err := makeConn(4, false, t)
+	assert.NilError(t, err)
+	defer stop()
+	sender := t1.(*Unreliable)
+	receiver := t2.(*Unreliable)
+
+	assert.NilError(t, sender.EnableFEC(FECConfig{GroupSize: 4}))
+	assert.Equal(t, sender.MaxPayload(), int(MaxFrameDataLength)-fecParityHeaderLen)
+
+	msgs := fecTestMessages(400)
+	for _, m := range msgs {
+		_, err := sender.Write(m)
+		assert.NilError(t, err)
+	}
+
+	// The read deadline is shorter than the muxer timeout, so reads stop before
+	// the muxers shut down
+	received := make(map[string]bool)
+	buf := make([]byte, 1024)
+	for len(received) < len(msgs) {
+		receiver.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, err := receiver.Read(buf)
+		if err != nil {
+			break
+		}
+		assert.Assert(t, !received[string(buf[:n])], "duplicate message %q", buf[:n])
+		received[string(buf[:n])] = true
+	}
+
+	stats := receiver.FECStats()
+	assert.Equal(t, sender.FECStats().ParitySent, uint64(len(msgs)/4))
+	assert.Assert(t, stats.ParityReceived > 0)
+	assert.Assert(t, stats.Recovered > 0)
+	sent := make(map[string]bool)
+	for _, m := range msgs {
+		sent[string(m)] = true
+	}
+	for m := range received {
+		assert.Assert(t, sent[m], "unexpected message %q", m)
+	}
+	t.Logf("received %d/%d messages, %+v", len(received), len(msgs), stats)
+}
@@ -0,0 +1,106 @@
+package tubes
+
+// Fragmentation for unreliable tubes. Frames are sized to fit a single packet
+// on the path to the peer, which can be as small as the transport's base packet
+// size before path MTU discovery confirms anything larger. Datagrams that do
+// not fit a single frame are split into fragments instead of being rejected, so
+// unreliable tubes accept datagrams of up to MaxDatagramLength bytes on any
+// path.
+//
+// Unreliable tubes do not acknowledge frames, so fragments reuse ackNo to carry
+// fragmentFlag, their index, and the number of fragments in their datagram. The
+// first fragment's frameNo identifies the datagram. Fragments are never
+// protected by forward error correction, and losing any fragment loses the
+// whole datagram.
+
+// MaxDatagramLength is the largest message that can be written to an unreliable
+// tube
+const MaxDatagramLength = int(MaxFrameDataLength)
+
+// fragmentFlag is set in the ackNo of every fragment. Parity frames carry small
+// group sizes in ackNo, so they never set it.
+const fragmentFlag = 1 << 31
+
+// The largest number of fragments a datagram is split into
+const maxFragments = 255
+
+// How many partially received datagrams are kept for reassembly
+const maxPartialDatagrams = 4
+
+// fragmentAckNo returns the ackNo of fragment index out of count
+func fragmentAckNo(index, count int) uint32 {
+	return fragmentFlag | uint32(index)<<8 | uint32(count)
+}
+
+// parseFragment returns the index and count carried by ackNo, and whether
+// ackNo marks a valid fragment at all
+func parseFragment(ackNo uint32) (index, count int, ok bool) {
+	if ackNo&fragmentFlag == 0 {
+		return 0, 0, false
+	}
+	index, count = int(ackNo>>8&0xff), int(ackNo&0xff)
+	return index, count, count >= 2 && index < count
+}
+
+// partialDatagram collects the fragments of one datagram
+type partialDatagram struct {
+	start     uint32
+	fragments [][]byte
+	received  int
+}
+
+// reassembler rebuilds datagrams from their fragments
+type reassembler struct {
+	// partial is ordered from oldest to newest datagram
+	partial []*partialDatagram
+}
+
+// add adds the fragment with frameNo, index and count. It returns the datagram
+// once all of its fragments have arrived, or nil otherwise.
+func (r *reassembler) add(frameNo uint32, index, count int, data []byte) []byte {
+	start := frameNo - uint32(index)
+	var p *partialDatagram
+	for i, q := range r.partial {
+		if q.start == start {
+			p = q
+			if len(p.fragments) != count {
+				// Inconsistent fragments cannot be reassembled
+				r.partial = append(r.partial[:i], r.partial[i+1:]...)
+				return nil
+			}
+			break
+		}
+	}
+	if p == nil {
+		if len(r.partial) == maxPartialDatagrams {
+			// The oldest datagram has most likely lost a fragment
+			r.partial = r.partial[1:]
+		}
+		p = &partialDatagram{start: start, fragments: make([][]byte, count)}
+		r.partial = append(r.partial, p)
+	}
+	if p.fragments[index] != nil {
+		return nil
+	}
+	p.fragments[index] = data
+	p.received++
+	if p.received < count {
+		return nil
+	}
+
+	for i, q := range r.partial {
+		if q == p {
+			r.partial = append(r.partial[:i], r.partial[i+1:]...)
+			break
+		}
+	}
+	n := 0
+	for _, f := range p.fragments {
+		n += len(f)
+	}
+	b := make([]byte, 0, n)
+	for _, f := range p.fragments {
+		b = append(b, f...)
+	}
+	return b
+}
@@ -0,0 +1,47 @@
+package tubes
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestParseFragment(t *testing.T) {
+	index, count, ok := parseFragment(fragmentAckNo(3, 7))
+	assert.Assert(t, ok)
+	assert.Equal(t, index, 3)
+	assert.Equal(t, count, 7)
+
+	// Parity frames carry a group size in ackNo
+	_, _, ok = parseFragment(4)
+	assert.Assert(t, !ok)
+	_, _, ok = parseFragment(fragmentAckNo(7, 7))
+	assert.Assert(t, !ok)
+	_, _, ok = parseFragment(fragmentAckNo(0, 1))
+	assert.Assert(t, !ok)
+}
+
+func TestReassembler(t *testing.T) {
+	var r reassembler
+
+	// Fragments can arrive out of order, and duplicates are ignored
+	assert.Assert(t, r.add(12, 2, 3, []byte("c")) == nil)
+	assert.Assert(t, r.add(10, 0, 3, []byte("a")) == nil)
+	assert.Assert(t, r.add(10, 0, 3, []byte("a")) == nil)
+	assert.DeepEqual(t, r.add(11, 1, 3, []byte("b")), []byte("abc"))
+	assert.Equal(t, len(r.partial), 0)
+
+	// A datagram that lost a fragment is eventually forgotten
+	assert.Assert(t, r.add(20, 0, 2, []byte("x")) == nil)
+	for i := 0; i < maxPartialDatagrams; i++ {
+		assert.Assert(t, r.add(uint32(30+2*i), 0, 2, []byte("y")) == nil)
+	}
+	assert.Equal(t, len(r.partial), maxPartialDatagrams)
+	assert.DeepEqual(t, r.add(31, 1, 2, []byte("z")), []byte("yz"))
+	assert.Assert(t, r.add(21, 1, 2, []byte("z")) == nil)
+
+	// Fragments that disagree on the number of fragments are dropped
+	assert.Assert(t, r.add(40, 0, 2, []byte("a")) == nil)
+	assert.Assert(t, r.add(41, 1, 3, []byte("b")) == nil)
+	assert.Assert(t, r.add(41, 1, 2, []byte("b")) == nil)
+}
@@ -12,6 +12,8 @@ type frame struct {
 	// To cover the case where the frame is queued
 	// by the reliable tube but the window shifts
 	queued bool
+	// Set when the receiver reported holding this frame in a SACK range
+	sacked bool
 }
 
 type initiateFrame struct {
@@ -36,6 +38,12 @@ type frameFlags struct {
 	FIN bool
 	// Flag to ask frame retransmission for packet loss
 	RTR bool
+	// Flag to indicate that the data of an ACK frame carries selective
+	// acknowledgement ranges.
+	SACK bool
+	// Flag to indicate that a frame of an unreliable tube is protected by
+	// forward error correction.
+	FEC bool
 }
 
 // The bit index for each of these flags.
@@ -46,6 +54,8 @@ const (
 	ACKIdx  = 3
 	FINIdx  = 4
 	RTRIdx  = 5
+	SACKIdx = 6
+	FECIdx  = 7
 )
 
 func flagsToMetaByte(p *frameFlags) byte {
@@ -68,6 +78,12 @@ func flagsToMetaByte(p *frameFlags) byte {
 	if p.RTR {
 		meta = meta | (1 << RTRIdx)
 	}
+	if p.SACK {
+		meta = meta | (1 << SACKIdx)
+	}
+	if p.FEC {
+		meta = meta | (1 << FECIdx)
+	}
 	return meta
 }
 
@@ -79,6 +95,8 @@ func metaToFlags(b byte) frameFlags {
 		ACK:  b&(1<<ACKIdx) != 0,
 		FIN:  b&(1<<FINIdx) != 0,
 		RTR:  b&(1<<RTRIdx) != 0,
+		SACK: b&(1<<SACKIdx) != 0,
+		FEC:  b&(1<<FECIdx) != 0,
 	}
 	return flags
 }
@@ -139,3 +157,46 @@ func fromInitiateBytes(b []byte) *initiateFrame {
 		data:       b[10 : 10+dataLength],
 	}
 }
+
+// sackRange is a half-open range [start, end) of frame numbers that the
+// receiver holds out of order, above its cumulative ackNo.
+type sackRange struct {
+	start uint32
+	end   uint32
+}
+
+// The number of bytes in the header of a data frame
+const frameHeaderLen = 12
+
+// The number of bytes used to encode each sackRange
+const sackRangeLength = 8
+
+// The maximum number of SACK ranges carried by a single ACK frame
+const maxSackRanges = 8
+
+func sackRangesToBytes(ranges []sackRange) []byte {
+	b := make([]byte, len(ranges)*sackRangeLength)
+	for i, sr := range ranges {
+		binary.BigEndian.PutUint32(b[i*sackRangeLength:], sr.start)
+		binary.BigEndian.PutUint32(b[i*sackRangeLength+4:], sr.end)
+	}
+	return b
+}
+
+// sackRangesFromBytes decodes the SACK ranges carried by an ACK frame. It
+// returns errMalformedSack if b is not a whole number of ranges or holds more
+// than maxSackRanges ranges.
+func sackRangesFromBytes(b []byte) ([]sackRange, error) {
+	if len(b)%sackRangeLength != 0 || len(b) > maxSackRanges*sackRangeLength {
+		return nil, errMalformedSack
+	}
+	n := len(b) / sackRangeLength
+	ranges := make([]sackRange, 0, n)
+	for i := 0; i < n; i++ {
+		ranges = append(ranges, sackRange{
+			start: binary.BigEndian.Uint32(b[i*sackRangeLength:]),
+			end:   binary.BigEndian.Uint32(b[i*sackRangeLength+4:]),
+		})
+	}
+	return ranges, nil
+}
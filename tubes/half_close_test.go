@@ -0,0 +1,122 @@
+package tubes
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+// TestReliableCloseWrite tests:
+// Scenario: One side calls CloseWrite, then the other side finishes writing
+// Initiator state flow: initiated → finWait1 → finWait2 → closed
+// Responder state flow: initiated → closeWait → lastAck → closed
+// Expected behavior: Data keeps flowing towards the half-closed side until the
+// peer closes too
+func TestReliableCloseWrite(t *testing.T) {
+	t1, t2, stop, _, err := makeConn(0, true, t)
+	assert.NilError(t, err)
+	defer stop()
+	client := t1.(*Reliable)
+	server := t2.(*Reliable)
+
+	request := []byte("request")
+	_, err = client.Write(request)
+	assert.NilError(t, err)
+	assert.NilError(t, client.CloseWrite())
+
+	_, err = client.Write(request)
+	assert.Equal(t, err, io.EOF)
+	assert.Equal(t, client.CloseWrite(), io.EOF)
+
+	// The server sees the request followed by EOF
+	got, err := io.ReadAll(server)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, got, request)
+
+	// The server can still respond
+	response := make([]byte, 100*1024)
+	for i := range response {
+		response[i] = byte(i)
+	}
+	_, err = server.Write(response)
+	assert.NilError(t, err)
+	assert.NilError(t, server.Close())
+
+	got, err = io.ReadAll(client)
+	assert.NilError(t, err)
+	assert.Assert(t, bytes.Equal(got, response))
+
+	// Both sides have closed writing, so the tubes close without Close
+	client.WaitForClose()
+	server.WaitForClose()
+	assert.NilError(t, client.Close())
+	assert.Equal(t, client.Close(), io.EOF)
+}
+
+// TestReliableCloseRead tests:
+// Scenario: One side calls CloseRead while the peer keeps writing
+// Expected behavior: Reads return io.EOF, and the peer's writes are still
+// acknowledged so that it can close normally
+func TestReliableCloseRead(t *testing.T) {
+	t1, t2, stop, _, err := makeConn(0, true, t)
+	assert.NilError(t, err)
+	defer stop()
+	client := t1.(*Reliable)
+	server := t2.(*Reliable)
+
+	readErr := make(chan error)
+	go func() {
+		_, err := client.Read(make([]byte, 10))
+		readErr <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	assert.NilError(t, client.CloseRead())
+
+	select {
+	case err := <-readErr:
+		assert.Equal(t, err, io.EOF)
+	case <-time.After(time.Second):
+		t.Fatal("pending read was not unblocked by CloseRead")
+	}
+
+	_, err = server.Write([]byte("discarded"))
+	assert.NilError(t, err)
+	assert.NilError(t, server.CloseWrite())
+	_, err = client.Read(make([]byte, 10))
+	assert.Equal(t, err, io.EOF)
+
+	// The client can still write after closing its reading side
+	_, err = client.Write([]byte("reply"))
+	assert.NilError(t, err)
+	assert.NilError(t, client.Close())
+	got, err := io.ReadAll(server)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, got, []byte("reply"))
+
+	client.WaitForClose()
+	server.WaitForClose()
+	assert.Equal(t, server.sender.unAckedFramesRemaining(), 0)
+}
+
+// TestReliableCloseReadBeforeInit verifies that CloseRead does not wait for an
+// initiation that will never finish once the tube was closed
+func TestReliableCloseReadBeforeInit(t *testing.T) {
+	r := &Reliable{
+		tubeState: created,
+		closed:    make(chan struct{}),
+		initDone:  make(chan struct{}),
+	}
+	close(r.closed)
+
+	done := make(chan error)
+	go func() { done <- r.CloseRead() }()
+	select {
+	case err := <-done:
+		assert.Equal(t, err, ErrBadTubeState)
+	case <-time.After(time.Second):
+		t.Fatal("CloseRead blocked on a closed tube")
+	}
+}
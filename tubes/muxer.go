@@ -27,6 +27,10 @@ const (
 	muxerStopped  muxerState = iota
 )
 
+// maxSendBatch is the largest number of frames the sender writes at once to an
+// underlying connection that implements transport.BatchMsgWriter
+const maxSendBatch = 32
+
 // Tube interface is shared between Reliable and Unreliable Tubes
 type Tube interface {
 	net.Conn
@@ -122,8 +126,8 @@ func newMuxer(msgConn transport.MsgConn, timeout time.Duration, isServer bool, l
 		unreliableTubes:   make(map[byte]*Unreliable),
 		tubeQueue:         make(chan Tube, 128),
 		m:                 sync.Mutex{},
-		sendQueue:         make(chan []byte),
-		prioritySendQueue: make(chan []byte),
+		sendQueue:         make(chan []byte, maxSendBatch),
+		prioritySendQueue: make(chan []byte, maxSendBatch),
 		state:             state,
 		stopped:           make(chan struct{}),
 		underlying:        msgConn,
@@ -276,6 +280,7 @@ func (m *Muxer) makeReliableTubeWithID(tType TubeType, tubeID byte, req bool) (*
 		tType:             tType,
 		log:               tubeLog,
 	}
+	r.sender.maxDataLength = m.maxFrameDataLength
 	r.lastAckSent.Store(0)
 	r.lastFrameSent.Store(0)
 	r.sender.closed.Store(true)
@@ -289,6 +294,19 @@ func (m *Muxer) makeReliableTubeWithID(tType TubeType, tubeID byte, req bool) (*
 	return r, nil
 }
 
+// maxFrameDataLength returns the largest data length of a frame that fits in a
+// single message of the underlying MsgConn.
+func (m *Muxer) maxFrameDataLength() uint16 {
+	n := m.underlying.MaxPayload() - frameHeaderLen
+	if n > int(MaxFrameDataLength) {
+		return MaxFrameDataLength
+	}
+	if n < 1 {
+		return 1
+	}
+	return uint16(n)
+}
+
 // CreateUnreliableTube starts a new unreliable tube. If this method returns
 // with a nil error, the created tube is ready for use. If it returns with an
 // error, then the tube it returns will be nil.
@@ -317,19 +335,20 @@ func (m *Muxer) makeUnreliableTubeWithID(tType TubeType, tubeID byte, req bool)
 		return nil, ErrMuxerStopping
 	}
 	tube := &Unreliable{
-		tType:        tType,
-		id:           tubeID,
-		sendQueue:    m.sendQueue,
-		localAddr:    m.underlying.LocalAddr(),
-		remoteAddr:   m.underlying.RemoteAddr(),
-		recv:         common.NewDeadlineChan[[]byte](maxBufferedPackets),
-		send:         common.NewDeadlineChan[[]byte](maxBufferedPackets),
-		state:        atomic.Value{},
-		initiated:    make(chan struct{}),
-		initiateDone: make(chan struct{}),
-		stopInitiate: make(chan struct{}),
-		senderDone:   make(chan struct{}),
-		closed:       make(chan struct{}),
+		tType:         tType,
+		id:            tubeID,
+		sendQueue:     m.sendQueue,
+		localAddr:     m.underlying.LocalAddr(),
+		remoteAddr:    m.underlying.RemoteAddr(),
+		recv:          common.NewDeadlineChan[[]byte](maxBufferedPackets),
+		send:          common.NewDeadlineChan[[]byte](maxBufferedPackets),
+		state:         atomic.Value{},
+		initiated:     make(chan struct{}),
+		initiateDone:  make(chan struct{}),
+		stopInitiate:  make(chan struct{}),
+		senderDone:    make(chan struct{}),
+		closed:        make(chan struct{}),
+		maxDataLength: m.maxFrameDataLength,
 		log: m.log.WithFields(logrus.Fields{
 			"tube":     tubeID,
 			"reliable": false,
@@ -376,9 +395,15 @@ func (m *Muxer) readMsg() (*frame, error) {
 
 // sender accepts frames from the Muxer queues and writes them synchronously to
 // the underlying MsgConn. Receiving a frame is only a queue handoff; WriteMsg
-// completion is the point at which the transport has accepted it. If a write
-// fails, sender starts Stop and drains both queues so tube producers can exit.
+// completion is the point at which the transport has accepted it. If the
+// underlying MsgConn is a transport.BatchMsgWriter, frames that are already
+// waiting in the queues are written along with the first one in a single
+// batch. If a write fails, sender starts Stop and drains both queues so tube
+// producers can exit.
 func (m *Muxer) sender() {
+	batcher, _ := m.underlying.(transport.BatchMsgWriter)
+	batch := make([][]byte, 0, maxSendBatch)
+
 	var err error
 	ok := true
 	var rawBytes []byte
@@ -387,17 +412,18 @@ func (m *Muxer) sender() {
 		// Priority send queue will have fewer packets and will be chosen pseudo randomly
 		// https://go.dev/ref/spec#Select_statements
 		case rawBytes, ok = <-m.prioritySendQueue:
-			if !ok {
-				break
-			}
-
-			err = m.underlying.WriteMsg(rawBytes)
-
 		case rawBytes, ok = <-m.sendQueue:
-			if !ok {
-				break
-			}
+		}
+		if !ok {
+			break
+		}
 
+		if batcher != nil {
+			batch = m.collectBatch(append(batch[:0], rawBytes))
+		}
+		if len(batch) > 1 {
+			err = batcher.WriteMsgs(batch)
+		} else {
 			err = m.underlying.WriteMsg(rawBytes)
 		}
 
@@ -419,6 +445,32 @@ func (m *Muxer) sender() {
 	m.senderErr <- err
 }
 
+// collectBatch appends frames that are already waiting in the send queues to
+// batch, up to maxSendBatch frames. Waiting priority frames are taken first.
+func (m *Muxer) collectBatch(batch [][]byte) [][]byte {
+	for len(batch) < maxSendBatch {
+		select {
+		case rawBytes, ok := <-m.prioritySendQueue:
+			if !ok {
+				return batch
+			}
+			batch = append(batch, rawBytes)
+			continue
+		default:
+		}
+		select {
+		case rawBytes, ok := <-m.sendQueue:
+			if !ok {
+				return batch
+			}
+			batch = append(batch, rawBytes)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
 // start begins the sender and receiver goroutines
 func (m *Muxer) start() {
 	go m.sender()
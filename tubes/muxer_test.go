@@ -1,9 +1,12 @@
 package tubes
 
 import (
+	"crypto/rand"
+	"io"
 	"net"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -84,6 +87,10 @@ func (c *blockingWriteMsgConn) ReadMsg([]byte) (int, error) {
 	return 0, net.ErrClosed
 }
 
+func (c *blockingWriteMsgConn) MaxPayload() int {
+	return int(MaxFrameDataLength) + frameHeaderLen
+}
+
 func (c *blockingWriteMsgConn) WriteMsg([]byte) error {
 	c.startOnce.Do(func() {
 		close(c.writeStarted)
@@ -408,3 +415,162 @@ func manyTubes(bits int, rel bool, waitForOpen bool, t *testing.T) {
  	})
  }
 */
+
+// smallPayloadMsgConn limits messages to maxPayload bytes and counts the
+// messages that exceed it
+type smallPayloadMsgConn struct {
+	*ProbabalisticUDPMsgConn
+	maxPayload int
+	oversized  atomic.Int32
+}
+
+func (c *smallPayloadMsgConn) MaxPayload() int {
+	return c.maxPayload
+}
+
+func (c *smallPayloadMsgConn) WriteMsg(b []byte) error {
+	if len(b) > c.maxPayload {
+		c.oversized.Add(1)
+	}
+	return c.ProbabalisticUDPMsgConn.WriteMsg(b)
+}
+
+func makeSmallPayloadConn(maxPayload int, rel bool, t *testing.T) (t1, t2 net.Conn, c1, c2 *smallPayloadMsgConn, stop func()) {
+	c2Addr, err := net.ResolveUDPAddr("udp", ":7777")
+	assert.NilError(t, err)
+
+	c1UDP, err := net.Dial("udp", c2Addr.String())
+	assert.NilError(t, err)
+	c1 = &smallPayloadMsgConn{ProbabalisticUDPMsgConn: MakeTestUDPMsgConn(0, 1, c1UDP.(*net.UDPConn)), maxPayload: maxPayload}
+
+	c2UDP, err := net.DialUDP("udp", c2Addr, c1.LocalAddr().(*net.UDPAddr))
+	assert.NilError(t, err)
+	c2 = &smallPayloadMsgConn{ProbabalisticUDPMsgConn: MakeTestUDPMsgConn(0, 2, c2UDP), maxPayload: maxPayload}
+
+	t1, t2, stop, _, err = makeMuxedConn(c1, c2, rel, t)
+	assert.NilError(t, err)
+	return t1, t2, c1, c2, stop
+}
+
+func TestReliableFramesFitMaxPayload(t *testing.T) {
+	t1, t2, c1, c2, stop := makeSmallPayloadConn(500, true, t)
+	defer stop()
+
+	data := make([]byte, 64*1024)
+	_, err := rand.Read(data)
+	assert.NilError(t, err)
+
+	go func() {
+		_, err := t1.Write(data)
+		assert.NilError(t, err)
+	}()
+	buf := make([]byte, len(data))
+	_, err = io.ReadFull(t2, buf)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, buf, data)
+
+	assert.Equal(t, c1.oversized.Load(), int32(0))
+	assert.Equal(t, c2.oversized.Load(), int32(0))
+}
+
+func TestUnreliableFragmentsLargeMessages(t *testing.T) {
+	t1, t2, c1, _, stop := makeSmallPayloadConn(500, false, t)
+	defer stop()
+	u := t1.(*Unreliable)
+	assert.Equal(t, u.MaxPayload(), 500-frameHeaderLen)
+	assert.NilError(t, u.EnableFEC(FECConfig{GroupSize: 2}))
+
+	buf := make([]byte, MaxDatagramLength)
+	for _, size := range []int{u.MaxPayload() - fecParityHeaderLen, 1400, 4096, 10000} {
+		msg := make([]byte, size)
+		_, err := rand.Read(msg)
+		assert.NilError(t, err)
+		_, err = u.Write(msg)
+		assert.NilError(t, err)
+
+		t2.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := t2.Read(buf)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, buf[:n], msg)
+	}
+	assert.Equal(t, c1.oversized.Load(), int32(0))
+
+	_, err := u.Write(make([]byte, MaxDatagramLength+1))
+	assert.Equal(t, err, transport.ErrBufOverflow)
+}
+
+// batchingMsgConn is a ProbabalisticUDPMsgConn that also writes batches of
+// messages, and counts the batches
+type batchingMsgConn struct {
+	*ProbabalisticUDPMsgConn
+	batches atomic.Int64
+}
+
+func (c *batchingMsgConn) WriteMsgs(msgs [][]byte) error {
+	c.batches.Add(1)
+	for _, b := range msgs {
+		if err := c.WriteMsg(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestMuxerCollectBatch(t *testing.T) {
+	m := &Muxer{
+		sendQueue:         make(chan []byte, 2*maxSendBatch),
+		prioritySendQueue: make(chan []byte, 2*maxSendBatch),
+	}
+	m.sendQueue <- []byte("n1")
+	m.sendQueue <- []byte("n2")
+	m.prioritySendQueue <- []byte("p1")
+
+	// Priority frames are taken before the rest
+	batch := m.collectBatch([][]byte{[]byte("first")})
+	assert.DeepEqual(t, batch, [][]byte{[]byte("first"), []byte("p1"), []byte("n1"), []byte("n2")})
+
+	// Batches are capped at maxSendBatch frames
+	for i := 0; i < 2*maxSendBatch; i++ {
+		m.sendQueue <- []byte{byte(i)}
+	}
+	batch = m.collectBatch(nil)
+	assert.Equal(t, len(batch), maxSendBatch)
+	assert.Equal(t, len(m.sendQueue), maxSendBatch)
+
+	// A closed queue ends the batch
+	close(m.prioritySendQueue)
+	batch = m.collectBatch(nil)
+	assert.Equal(t, len(batch), 0)
+}
+
+// TestMuxerBatchedWrites tests:
+// Scenario: A reliable tube transfers data over a MsgConn that writes batches
+// Expected behavior: The data arrives intact, and the muxer sender writes
+// waiting frames in batches
+func TestMuxerBatchedWrites(t *testing.T) {
+	c2Addr := must.Do(net.ResolveUDPAddr("udp", "127.0.0.1:0"))
+	c2UDP := must.Do(net.ListenUDP("udp", c2Addr))
+	c1UDP := must.Do(net.DialUDP("udp", nil, c2UDP.LocalAddr().(*net.UDPAddr)))
+	c2UDP.Close()
+	c2UDP = must.Do(net.DialUDP("udp", c2UDP.LocalAddr().(*net.UDPAddr), c1UDP.LocalAddr().(*net.UDPAddr)))
+	c1 := &batchingMsgConn{ProbabalisticUDPMsgConn: MakeTestUDPMsgConn(0, 1, c1UDP)}
+	c2 := &batchingMsgConn{ProbabalisticUDPMsgConn: MakeTestUDPMsgConn(0, 2, c2UDP)}
+
+	t1, t2, stop, _, err := makeMuxedConn(c1, c2, true, t)
+	assert.NilError(t, err)
+	defer stop()
+
+	data := make([]byte, 256*1024)
+	_, err = rand.Read(data)
+	assert.NilError(t, err)
+
+	go func() {
+		t1.Write(data)
+		t1.Close()
+	}()
+	got, err := io.ReadAll(t2)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, got, data)
+	t2.Close()
+	assert.Assert(t, c1.batches.Load() > 0)
+}
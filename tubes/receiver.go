@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"container/heap"
 	"io"
+	"slices"
 	"sync"
 	"sync/atomic"
 
@@ -24,7 +25,10 @@ type receiver struct {
 	windowStart uint64
 
 	closed atomic.Bool
-	m      sync.Mutex
+	// readClosed is set by closeRead. Frames are still acknowledged, but their
+	// data is discarded.
+	readClosed atomic.Bool
+	m          sync.Mutex
 	// +checklocks:m
 	fragments PriorityQueue
 
@@ -57,6 +61,50 @@ func (r *receiver) getAck() uint32 {
 	return uint32(r.ackNo)
 }
 
+// getSackRanges returns the ranges of frames buffered above the cumulative
+// ackNo, lowest first. At most maxSackRanges ranges are returned, so the holes
+// closest to the ackNo are always reported.
+func (r *receiver) getSackRanges() []sackRange {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if r.fragments.Len() == 0 {
+		return nil
+	}
+
+	frameNos := make([]uint64, 0, r.fragments.Len())
+	for _, frag := range r.fragments {
+		if frag.priority > r.windowStart {
+			frameNos = append(frameNos, frag.priority)
+		}
+	}
+	slices.Sort(frameNos)
+
+	var ranges []sackRange
+	var start, end uint64
+	for i, frameNo := range frameNos {
+		switch {
+		case i == 0:
+			start, end = frameNo, frameNo+1
+		case frameNo < end:
+			// Duplicate frame in the heap
+			continue
+		case frameNo == end:
+			end++
+		default:
+			ranges = append(ranges, sackRange{start: uint32(start), end: uint32(end)})
+			if len(ranges) == maxSackRanges {
+				return ranges
+			}
+			start, end = frameNo, frameNo+1
+		}
+	}
+	if len(frameNos) > 0 {
+		ranges = append(ranges, sackRange{start: uint32(start), end: uint32(end)})
+	}
+	return ranges
+}
+
 /*
 Processes window into buffer stream if the ordered fragments are ready (in order).
 Precondition: r.m mutex is held.
@@ -100,7 +148,9 @@ func (r *receiver) processIntoBuffer() bool {
 				r.closed.Store(true)
 				fin = true
 			}
-			r.buffer.Write(frag.value)
+			if !r.readClosed.Load() {
+				r.buffer.Write(frag.value)
+			}
 			r.windowStart++
 			r.ackNo++
 			if common.Debug {
@@ -120,6 +170,9 @@ func (r *receiver) processIntoBuffer() bool {
 }
 
 func (r *receiver) read(buf []byte) (int, error) {
+	if r.readClosed.Load() {
+		return 0, io.EOF
+	}
 	r.m.Lock()
 	if r.buffer.Len() == 0 && !r.closed.Load() {
 		r.m.Unlock()
@@ -217,7 +270,7 @@ func (r *receiver) receive(p *frame) (bool, error) {
 	}
 
 	// The flag ACK must be false to be processed in the heap memory.
-	// Prevent processing of RTR ACK with dataLength > 0
+	// Prevent processing of RTR ACK and SACK ranges with dataLength > 0
 	if ((p.dataLength > 0 && !p.flags.ACK) || p.flags.FIN) && frameInBounds(windowStart, windowEnd, frameNo) {
 		heap.Push(&r.fragments, &pqItem{
 			value:    p.data,
@@ -245,6 +298,16 @@ func (r *receiver) receive(p *frame) (bool, error) {
 	return fin, nil
 }
 
+// closeRead discards buffered data and causes future reads to return io.EOF
+// without closing the receive window.
+func (r *receiver) closeRead() {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.readClosed.Store(true)
+	r.buffer.Reset()
+	r.dataReady.Close()
+}
+
 // Close causes future reads to return io.EOF
 func (r *receiver) Close() {
 	r.closed.Store(true)
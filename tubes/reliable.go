@@ -1,6 +1,7 @@
 package tubes
 
 import (
+	"bytes"
 	"encoding/binary"
 	"io"
 	"net"
@@ -48,10 +49,17 @@ type Reliable struct {
 	// +checklocks:l
 	tubeState state
 	// +checklocks:l
-	lastAckTimer  *time.Timer
+	lastAckTimer *time.Timer
+	// closeCalled is set once Close has been called. CloseWrite alone sends a
+	// FIN without setting it.
+	// +checklocks:l
+	closeCalled   bool
 	lastAckSent   atomic.Uint32
 	lastFrameSent atomic.Uint32
 	unsend        uint16
+	// The encoded SACK ranges of the last ACK handed to the Muxer. Only the
+	// send goroutine accesses it.
+	lastSack []byte
 
 	// closed publishes completion of the lifecycle transition and sender drain.
 	closed chan struct{}
@@ -146,13 +154,33 @@ func (r *Reliable) sendOneFrame(pkt *frame, retransmission bool) {
 	// The ACK flag must be used only to signal an acknowledgement.
 	// At this point only the frames with a dataLength of 0 are
 	// considered as being regular acknowledgements (not RTR).
-	if pkt.dataLength == 0 {
+	pureAck := pkt.dataLength == 0
+	if pureAck {
 		pkt.flags.ACK = true
 	}
 
+	// Regular acknowledgements carry the ranges of frames held out of order
+	// by the receiver, so the peer only retransmits the real holes.
+	sackChanged := false
+	if pureAck && !pkt.flags.FIN {
+		ranges := r.recvWindow.getSackRanges()
+		var sack []byte
+		if len(ranges) > 0 {
+			sack = sackRangesToBytes(ranges)
+			pkt.data = sack
+			pkt.dataLength = uint16(len(sack))
+			pkt.flags.SACK = true
+		}
+		// The receiver buffered new frames or filled a hole since the last ACK.
+		// This usually happens while the ackNo is stuck at a hole, so the ACK
+		// must not be suppressed as a duplicate.
+		sackChanged = !bytes.Equal(sack, r.lastSack)
+		r.lastSack = sack
+	}
+
 	// Limit the retransmission of ACKs to the last value loaded through r.recvWindow.getAck()
-	if (pkt.dataLength > 0 ||
-		(pkt.dataLength == 0 && (ackNo != lastAckNo || pkt.frameNo != lastFrameNo ||
+	if (!pureAck ||
+		(pureAck && (ackNo != lastAckNo || pkt.frameNo != lastFrameNo || sackChanged ||
 			retransmission || pkt.flags.FIN || pkt.flags.RESP))) || r.unsend == 10 { // based on best practices for TCP loss detection RFC5681 and RFC6675. Should be 3 but 10 has a better mitigation for spurious loss detection
 
 		if retransmission {
@@ -174,6 +202,7 @@ func (r *Reliable) sendOneFrame(pkt *frame, retransmission bool) {
 			"ackno":   pkt.ackNo,
 			"ack":     pkt.flags.ACK,
 			"fin":     pkt.flags.FIN,
+			"sack":    pkt.flags.SACK,
 			"dataLen": pkt.dataLength,
 		}).Trace("handed packet to muxer")
 	}
@@ -223,6 +252,11 @@ func (r *Reliable) send() {
 			for i := 0; i < numFrames; i++ {
 				rtoFrame := &r.sender.frames[i]
 
+				// The receiver already holds this frame
+				if rtoFrame.sacked {
+					continue
+				}
+
 				r.log.WithFields(logrus.Fields{
 					"Frame N°": rtoFrame.frame.frameNo,
 					"Ack N°":   r.recvWindow.getAck(),
@@ -377,7 +411,22 @@ func (r *Reliable) receive(pkt *frame) error {
 			r.enterClosedState()
 			return ackErr
 		}
-		if missingFrameNo != 0 {
+		if pkt.flags.SACK {
+			// The SACK ranges identify the real holes, so there is no need to
+			// guess the missing frame from duplicate ACKs. recvAck still counts
+			// the duplicate ACK in onLoss: this congestion response is intended,
+			// since a hole in the receive window means the path dropped a frame.
+			ranges, sackErr := sackRangesFromBytes(pkt.data)
+			if sackErr != nil {
+				r.log.WithFields(logrus.Fields{
+					"dataLen": pkt.dataLength,
+					"error":   sackErr,
+				}).Warn("ignoring malformed SACK ranges")
+			}
+			for _, hole := range r.sender.recvSack(ranges) {
+				r.sender.prioritySendQueue <- hole
+			}
+		} else if missingFrameNo != 0 {
 			r.sender.m.Lock()
 			r.sendFrameByNumberLocked(missingFrameNo)
 			r.sender.m.Unlock()
@@ -420,7 +469,7 @@ func (r *Reliable) receive(pkt *frame) error {
 	}
 
 	// ACK every data packet
-	if pkt.dataLength > 0 && r.tubeState != closed && !pkt.flags.FIN {
+	if pkt.dataLength > 0 && r.tubeState != closed && !pkt.flags.FIN && !pkt.flags.SACK {
 		r.sender.sendEmptyPacket()
 	}
 
@@ -582,10 +631,88 @@ func (r *Reliable) Close() (err error) {
 	r.l.Lock()
 	defer r.l.Unlock()
 
-	switch r.tubeState {
-	case created:
+	if r.tubeState == created {
 		r.log.WithField("state", r.tubeState).Warn("tried to close tube in bad state")
 		return ErrBadTubeState
+	}
+	if r.closeCalled {
+		return io.EOF
+	}
+
+	// After CloseWrite, the FIN is already queued and only reads remain
+	if r.sender.finSent {
+		r.closeCalled = true
+		if r.tubeState != closed {
+			r.SetReadDeadline(time.Now())
+		}
+		return nil
+	}
+
+	err = r.closeWriteLocked()
+	if err != nil {
+		// In this case, the tube was already closed
+		return err
+	}
+	r.closeCalled = true
+
+	// Cancel all pending read and write operations
+	r.SetReadDeadline(time.Now())
+	r.sender.deadline = time.Now()
+
+	return r.sender.sendFin()
+}
+
+// CloseWrite shuts down the writing side of the tube, like
+// (*net.TCPConn).CloseWrite. A FIN is sent after all queued data, and later
+// writes return io.EOF. Reads continue until the peer closes its side, at which
+// point the tube is closed.
+func (r *Reliable) CloseWrite() error {
+	select {
+	case <-r.initDone:
+		break
+	case <-r.closed:
+		break
+	}
+
+	r.l.Lock()
+	defer r.l.Unlock()
+
+	if r.tubeState == created {
+		r.log.WithField("state", r.tubeState).Warn("tried to close tube in bad state")
+		return ErrBadTubeState
+	}
+	if err := r.closeWriteLocked(); err != nil {
+		return err
+	}
+	return r.sender.sendFin()
+}
+
+// CloseRead shuts down the reading side of the tube, like
+// (*net.TCPConn).CloseRead. Pending and future reads return io.EOF. Data from
+// the peer is still acknowledged but discarded.
+func (r *Reliable) CloseRead() error {
+	select {
+	case <-r.initDone:
+		break
+	case <-r.closed:
+		break
+	}
+
+	r.l.Lock()
+	defer r.l.Unlock()
+
+	if r.tubeState == created {
+		return ErrBadTubeState
+	}
+	r.recvWindow.closeRead()
+	return nil
+}
+
+// closeWriteLocked moves the state machine forward for a FIN about to be sent.
+// It returns io.EOF if the writing side is already closed.
+// +checklocks:r.l
+func (r *Reliable) closeWriteLocked() error {
+	switch r.tubeState {
 	case initiated:
 		r.tubeState = finWait1
 		r.log.Debug("call to close. going from initiated to finWait1")
@@ -594,17 +721,9 @@ func (r *Reliable) Close() (err error) {
 		r.log.Debug("call to close. going from closeWait to lastAck")
 		r.enterLastAckState()
 	default:
-		// In this case, Close() has already been called
 		return io.EOF
 	}
-
-	// Cancel all pending read and write operations
-	r.SetReadDeadline(time.Now())
-	r.sender.deadline = time.Now()
-
-	err = r.sender.sendFin()
-
-	return err
+	return nil
 }
 
 // WaitForInit blocks until the Tube is initiated
@@ -687,7 +806,7 @@ func (r *Reliable) sendFrameByNumberLocked(frameNo uint32) {
 	}
 	for i := 0; i < defaultWindowSize; i++ {
 		rtrFrameStruct := r.sender.frames[i]
-		if rtrFrameStruct.frameNo == frameNo && rtrFrameStruct.queued {
+		if rtrFrameStruct.frameNo == frameNo && rtrFrameStruct.queued && !rtrFrameStruct.sacked {
 			rtrFrameStruct.Time = time.Now()
 			r.sender.prioritySendQueue <- rtrFrameStruct.frame
 			if common.Debug {
@@ -0,0 +1,399 @@
+package tubes
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/sirupsen/logrus"
+
+	"gotest.tools/assert"
+)
+
+// sackMsgConn wraps a ProbabalisticUDPMsgConn and records the tube frames
+// crossing it. Packets are only dropped while lossy is set.
+type sackMsgConn struct {
+	*ProbabalisticUDPMsgConn
+	lossy atomic.Bool
+
+	m sync.Mutex
+	// The number of SACK frames written
+	sacksSent int
+	// The number of data frames written more than once
+	retransmissions int
+	// The number of data frames written after the peer reported holding them
+	sackedResent int
+	// When each frame was first reported in a SACK range read from the peer
+	sackedAt map[uint32]time.Time
+	written  map[uint32]bool
+}
+
+// Frames queued before a SACK is processed can still reach the socket shortly
+// after it is read, so only writes later than this count as violations.
+const sackGracePeriod = 100 * time.Millisecond
+
+func newSackMsgConn(seed uint64, underlying *net.UDPConn) *sackMsgConn {
+	c := &sackMsgConn{
+		ProbabalisticUDPMsgConn: MakeTestUDPMsgConn(4, seed, underlying),
+		sackedAt:                make(map[uint32]time.Time),
+		written:                 make(map[uint32]bool),
+	}
+	c.lossy.Store(true)
+	return c
+}
+
+// isDataFrame reports whether f carries stream data of a reliable tube
+func isDataFrame(f *frame) bool {
+	return f.flags.REL && f.dataLength > 0 && !f.flags.ACK && !f.flags.REQ && !f.flags.RESP
+}
+
+// ReadMsg implements the MsgConn interface
+func (c *sackMsgConn) ReadMsg(b []byte) (n int, err error) {
+	n, err = c.ProbabalisticUDPMsgConn.ReadMsg(b)
+	if err != nil || n < 12 {
+		return
+	}
+	f, _ := fromBytes(b[:n])
+	if !f.flags.SACK {
+		return
+	}
+	ranges, rangeErr := sackRangesFromBytes(f.data)
+	if rangeErr != nil {
+		return
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+	now := time.Now()
+	for _, sr := range ranges {
+		for frameNo := sr.start; frameNo != sr.end; frameNo++ {
+			if _, ok := c.sackedAt[frameNo]; !ok {
+				c.sackedAt[frameNo] = now
+			}
+		}
+	}
+	return
+}
+
+// WriteMsg implements the MsgConn interface
+func (c *sackMsgConn) WriteMsg(b []byte) error {
+	if len(b) >= 12 {
+		f, _ := fromBytes(b)
+		c.m.Lock()
+		if f.flags.SACK {
+			c.sacksSent++
+		}
+		if isDataFrame(f) {
+			if c.written[f.frameNo] {
+				c.retransmissions++
+			}
+			c.written[f.frameNo] = true
+			if at, ok := c.sackedAt[f.frameNo]; ok && time.Since(at) > sackGracePeriod {
+				c.sackedResent++
+			}
+		}
+		c.m.Unlock()
+	}
+
+	if c.lossy.Load() {
+		return c.ProbabalisticUDPMsgConn.WriteMsg(b)
+	}
+	_, _, err := c.WriteMsgUDP(b, nil, nil)
+	return err
+}
+
+func makeSackConn(t *testing.T) (t1, t2 *Reliable, c1, c2 *sackMsgConn, stop func()) {
+	c2Addr, err := net.ResolveUDPAddr("udp", ":7777")
+	assert.NilError(t, err)
+
+	c1UDP, err := net.Dial("udp", c2Addr.String())
+	assert.NilError(t, err)
+	c1 = newSackMsgConn(1, c1UDP.(*net.UDPConn))
+
+	c2UDP, err := net.DialUDP("udp", c2Addr, c1.LocalAddr().(*net.UDPAddr))
+	assert.NilError(t, err)
+	c2 = newSackMsgConn(2, c2UDP)
+
+	tube1, tube2, stop, _, err := makeMuxedConn(c1, c2, true, t)
+	assert.NilError(t, err)
+	return tube1.(*Reliable), tube2.(*Reliable), c1, c2, stop
+}
+
+// TestSackRangesEncoding tests:
+// Scenario: SACK ranges round trip through an ACK frame
+// Expected behavior: The decoded frame carries the SACK flag and the same ranges
+func TestSackRangesEncoding(t *testing.T) {
+	ranges := []sackRange{{start: 3, end: 5}, {start: 7, end: 8}, {start: 1<<32 - 1, end: 2}}
+	data := sackRangesToBytes(ranges)
+	pkt := frame{
+		tubeID:     1,
+		ackNo:      2,
+		frameNo:    9,
+		dataLength: uint16(len(data)),
+		data:       data,
+		flags:      frameFlags{ACK: true, SACK: true},
+	}
+
+	decoded, err := fromBytes(pkt.toBytes())
+	assert.NilError(t, err)
+	assert.Check(t, decoded.flags.ACK)
+	assert.Check(t, decoded.flags.SACK)
+	got, err := sackRangesFromBytes(decoded.data)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, got, ranges, cmp.AllowUnexported(sackRange{}))
+
+	// Truncated and oversized payloads are rejected
+	_, err = sackRangesFromBytes(data[:len(data)-1])
+	assert.Equal(t, err, errMalformedSack)
+	_, err = sackRangesFromBytes(make([]byte, (maxSackRanges+1)*sackRangeLength))
+	assert.Equal(t, err, errMalformedSack)
+}
+
+// TestReceiverSackRanges tests:
+// Scenario: Receiver buffers frames out of order
+// Condition: Frames 1, 3, 4, 4, 6 and 9 arrive, frame 2 is lost
+// Expected behavior: The receiver reports [3,5), [6,7) and [9,10)
+func TestReceiverSackRanges(t *testing.T) {
+	r := newReceiver(logrus.WithField("test", t.Name()))
+	assert.Check(t, r.getSackRanges() == nil)
+
+	for _, frameNo := range []uint32{1, 3, 4, 4, 6, 9} {
+		_, err := r.receive(makePacket(frameNo, []byte{byte(frameNo)}))
+		assert.NilError(t, err)
+	}
+
+	assert.Equal(t, r.getAck(), uint32(1))
+	assert.DeepEqual(t, r.getSackRanges(), []sackRange{
+		{start: 3, end: 5},
+		{start: 6, end: 7},
+		{start: 9, end: 10},
+	}, cmp.AllowUnexported(sackRange{}))
+
+	// Filling the hole moves the ackNo past the first range
+	_, err := r.receive(makePacket(2, []byte{2}))
+	assert.NilError(t, err)
+	assert.Equal(t, r.getAck(), uint32(4))
+	assert.DeepEqual(t, r.getSackRanges(), []sackRange{
+		{start: 6, end: 7},
+		{start: 9, end: 10},
+	}, cmp.AllowUnexported(sackRange{}))
+}
+
+// TestReceiverSackRangesLimit tests:
+// Scenario: More holes than fit in a single ACK frame
+// Expected behavior: Only the maxSackRanges lowest ranges are reported
+func TestReceiverSackRangesLimit(t *testing.T) {
+	r := newReceiver(logrus.WithField("test", t.Name()))
+	for i := uint32(0); i < 2*maxSackRanges; i++ {
+		_, err := r.receive(makePacket(3+2*i, []byte{0}))
+		assert.NilError(t, err)
+	}
+
+	ranges := r.getSackRanges()
+	assert.Equal(t, len(ranges), maxSackRanges)
+	assert.Equal(t, ranges[0], sackRange{start: 3, end: 4})
+}
+
+// TestSenderRetransmitsOnlySackHoles tests:
+// Scenario: Sender receives a SACK for a window with holes
+// Condition: ackNo is 1, the receiver holds frames 3-4 and 6-10
+// Expected behavior: Only frames 1, 2 and 5 are retransmitted, once per RTT
+func TestSenderRetransmitsOnlySackHoles(t *testing.T) {
+	s := newSender(logrus.WithField("test", t.Name()))
+	defer s.RetransmitTicker.Stop()
+
+	_, err := s.write(make([]byte, 10*int(MaxFrameDataLength)))
+	assert.NilError(t, err)
+	assert.Equal(t, len(s.frames), 10)
+
+	sent := time.Now().Add(-2 * s.RTT)
+	for i := range s.frames {
+		s.frames[i].queued = true
+		s.frames[i].Time = sent
+	}
+
+	ranges := []sackRange{{start: 3, end: 5}, {start: 6, end: 11}}
+	holes := s.recvSack(ranges)
+
+	var holeNos []uint32
+	for _, h := range holes {
+		holeNos = append(holeNos, h.frameNo)
+	}
+	assert.DeepEqual(t, holeNos, []uint32{1, 2, 5})
+
+	for _, f := range s.frames {
+		covered := f.frameNo >= 3 && f.frameNo != 5
+		assert.Equal(t, f.sacked, covered, "frame %d", f.frameNo)
+	}
+
+	// The holes were just retransmitted, so a duplicate SACK does not resend them
+	assert.Equal(t, len(s.recvSack(ranges)), 0)
+
+	// Ranges below the cumulative ackNo are stale and ignored
+	_, err = s.recvAck(6)
+	assert.NilError(t, err)
+	assert.Equal(t, len(s.recvSack([]sackRange{{start: 3, end: 5}})), 0)
+}
+
+// TestSackUpdatesAreNotSuppressed tests:
+// Scenario: ackNo is stuck at a hole while out-of-order frames keep arriving
+// Condition: Each new frame extends the same SACK range
+// Expected behavior: Every ACK carrying new SACK information is handed to the Muxer
+func TestSackUpdatesAreNotSuppressed(t *testing.T) {
+	log := logrus.WithField("test", t.Name())
+	r := &Reliable{
+		id:                1,
+		sender:            newSender(log),
+		recvWindow:        newReceiver(log),
+		sendQueue:         make(chan []byte, 16),
+		prioritySendQueue: make(chan []byte, 16),
+		tubeState:         initiated,
+		log:               log,
+	}
+	defer r.sender.RetransmitTicker.Stop()
+
+	_, err := r.recvWindow.receive(makePacket(1, []byte{1}))
+	assert.NilError(t, err)
+
+	for frameNo := uint32(3); frameNo < 8; frameNo++ {
+		_, err := r.recvWindow.receive(makePacket(frameNo, []byte{byte(frameNo)}))
+		assert.NilError(t, err)
+		r.sendOneFrame(&frame{frameNo: 1, data: []byte{}}, false)
+
+		select {
+		case raw := <-r.sendQueue:
+			pkt, err := fromBytes(raw)
+			assert.NilError(t, err)
+			assert.Check(t, pkt.flags.ACK)
+			assert.Check(t, pkt.flags.SACK)
+			assert.Equal(t, pkt.ackNo, uint32(1))
+			ranges, err := sackRangesFromBytes(pkt.data)
+			assert.NilError(t, err)
+			assert.DeepEqual(t, ranges, []sackRange{{start: 3, end: frameNo + 1}}, cmp.AllowUnexported(sackRange{}))
+		default:
+			t.Fatalf("ACK with SACK up to frame %d was suppressed", frameNo)
+		}
+	}
+
+	// Nothing changed, so the duplicate ACK is suppressed
+	r.sendOneFrame(&frame{frameNo: 1, data: []byte{}}, false)
+	assert.Equal(t, len(r.sendQueue), 0)
+}
+
+// TestSackDoesNotAcknowledgeFIN tests:
+// Scenario: SACK ACK in finWait1
+// Condition: The peer holds the FIN out of order, but not the data frame before it
+// Expected behavior: The tube stays in finWait1 and only the hole is
+// retransmitted; a cumulative ACK past the FIN then moves to finWait2
+func TestSackDoesNotAcknowledgeFIN(t *testing.T) {
+	log := logrus.WithField("test", t.Name())
+	s := newSender(log)
+	defer s.RetransmitTicker.Stop()
+
+	r := &Reliable{
+		id:                1,
+		sender:            s,
+		recvWindow:        newReceiver(log),
+		sendQueue:         make(chan []byte, 16),
+		prioritySendQueue: make(chan []byte, 16),
+		tubeState:         finWait1,
+		log:               log,
+	}
+
+	_, err := s.write([]byte("hello"))
+	assert.NilError(t, err)
+	assert.NilError(t, s.sendFin())
+	assert.Equal(t, s.unAckedFramesRemaining(), 2)
+	sent := time.Now().Add(-2 * s.RTT)
+	for i := range s.frames {
+		s.frames[i].queued = true
+		s.frames[i].Time = sent
+	}
+	// Drain the frames queued by write and sendFin
+	for len(s.sendQueue) > 0 {
+		<-s.sendQueue
+	}
+
+	sack := sackRangesToBytes([]sackRange{{start: 2, end: 3}})
+	err = r.receive(&frame{
+		ackNo:      1,
+		frameNo:    1,
+		dataLength: uint16(len(sack)),
+		data:       sack,
+		flags:      frameFlags{ACK: true, SACK: true, REL: true},
+	})
+	assert.NilError(t, err)
+
+	assert.Equal(t, r.tubeState, finWait1)
+	assert.Equal(t, s.unAckedFramesRemaining(), 2)
+	assert.Equal(t, len(s.prioritySendQueue), 1)
+	hole := <-s.prioritySendQueue
+	assert.Equal(t, hole.frameNo, uint32(1))
+
+	// A SACK ACK is not data, so it is neither buffered nor acknowledged
+	assert.Equal(t, len(s.sendQueue), 0)
+	buf := make([]byte, 1)
+	r.recvWindow.dataReady.SetDeadline(time.Now())
+	n, _ := r.recvWindow.read(buf)
+	assert.Equal(t, n, 0)
+
+	err = r.receive(&frame{
+		ackNo:   3,
+		frameNo: 1,
+		data:    []byte{},
+		flags:   frameFlags{ACK: true, REL: true},
+	})
+	assert.NilError(t, err)
+	assert.Equal(t, r.tubeState, finWait2)
+	assert.Equal(t, s.unAckedFramesRemaining(), 0)
+}
+
+// TestSackLossyLink tests:
+// Scenario: Bulk transfer and close over a lossy simulated link
+// Condition: Roughly 1 in 16 packets is dropped in each direction
+// Expected behavior: Full payload delivered in order, the receiver sends SACKs,
+// the sender never resends a frame the receiver reported holding, and both
+// tubes close with every frame acknowledged
+func TestSackLossyLink(t *testing.T) {
+	t1, t2, c1, c2, stop := makeSackConn(t)
+	defer stop()
+
+	want := make([]byte, 1<<19)
+	_, err := rand.Read(want)
+	assert.NilError(t, err)
+
+	go func() {
+		if err := chunkedCopy(t1, bytes.NewReader(want)); err != nil {
+			t.Errorf("unexpected t1.Write error: %v", err)
+		}
+		t1.Close()
+	}()
+
+	got := new(bytes.Buffer)
+	t2.SetReadDeadline(time.Now().Add(30 * time.Second))
+	assert.NilError(t, chunkedCopy(got, t2))
+	assert.Check(t, bytes.Equal(got.Bytes(), want), "transmitted data differs")
+	t2.Close()
+
+	t1.WaitForClose()
+	t2.WaitForClose()
+	for _, r := range []*Reliable{t1, t2} {
+		r.l.Lock()
+		assert.Equal(t, r.tubeState, closed)
+		assert.Equal(t, r.sender.unAckedFramesRemaining(), 0)
+		r.l.Unlock()
+	}
+
+	c1.m.Lock()
+	defer c1.m.Unlock()
+	c2.m.Lock()
+	defer c2.m.Unlock()
+	assert.Check(t, c2.sacksSent > 0, "receiver never sent a SACK")
+	assert.Check(t, c1.retransmissions > 0, "sender never retransmitted")
+	assert.Equal(t, c1.sackedResent, 0, "sender resent frames the receiver holds")
+}
@@ -58,6 +58,10 @@ type sender struct {
 	// the time after which writes will expire
 	deadline time.Time
 
+	// maxDataLength returns the largest data length of a frame. If it is nil,
+	// MaxFrameDataLength is used.
+	maxDataLength func() uint16
+
 	// sendQueue and prioritySendQueue contain frames admitted by the reliable
 	// state machine but not necessarily handed to the Muxer or transport.
 	sendQueue         chan *frame
@@ -135,8 +139,13 @@ func (s *sender) write(b []byte) (int, error) {
 
 	startFrame := len(s.frames)
 
+	maxDataLength := MaxFrameDataLength
+	if s.maxDataLength != nil {
+		maxDataLength = s.maxDataLength()
+	}
+
 	for len(s.buffer) > 0 {
-		dataLength := MaxFrameDataLength
+		dataLength := maxDataLength
 		if len(s.buffer) < int(dataLength) {
 			dataLength = uint16(len(s.buffer))
 		}
@@ -244,6 +253,60 @@ func (s *sender) recvAck(ackNo uint32) (uint32, error) {
 	return missingFrameNo, nil
 }
 
+// recvSack marks the frames covered by ranges as selectively acknowledged. It
+// returns the frames below the highest SACKed frame that the receiver does not
+// hold. These are the real holes in the receive window. A hole is returned at
+// most once per RTT so that repeated SACKs do not flood the link.
+func (s *sender) recvSack(ranges []sackRange) []*frame {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if len(ranges) == 0 || len(s.frames) == 0 {
+		return nil
+	}
+
+	// Frame numbers are compared as offsets from the cumulative ackNo so that
+	// wraparound is handled. Ranges that are stale or that straddle the ackNo
+	// do not satisfy start < end and are ignored.
+	base := uint32(s.ackNo)
+	highest := uint32(0)
+	for _, sr := range ranges {
+		start, end := sr.start-base, sr.end-base
+		if start >= end || start >= uint32(len(s.frames)) {
+			continue
+		}
+		end = min(end, uint32(len(s.frames)))
+		for i := start; i < end; i++ {
+			if s.frames[i].frameNo == sr.start+(i-start) {
+				s.frames[i].sacked = true
+			}
+		}
+		if end > highest {
+			highest = end
+		}
+	}
+
+	var holes []*frame
+	now := time.Now()
+	for i := uint32(0); i < highest; i++ {
+		f := &s.frames[i]
+		if f.sacked || !f.queued || now.Sub(f.Time) < s.RTT {
+			continue
+		}
+		f.Time = now
+		holes = append(holes, f.frame)
+	}
+
+	if common.Debug && len(holes) > 0 {
+		s.log.WithFields(logrus.Fields{
+			"ranges": len(ranges),
+			"holes":  len(holes),
+		}).Trace("retransmitting SACK holes")
+	}
+
+	return holes
+}
+
 func (s *sender) onSuccess(ackNo uint32) {
 
 	if !s.frames[0].Time.Equal(time.Time{}) && ackNo == s.frames[0].frame.frameNo+1 && !s.frames[0].flags.RTR {
@@ -55,11 +55,15 @@ func (c *ProbabalisticUDPMsgConn) WriteMsg(b []byte) (err error) {
 	return
 }
 
+// MaxPayload implements the MsgConn interface
+func (c *ProbabalisticUDPMsgConn) MaxPayload() int {
+	return int(MaxFrameDataLength) + frameHeaderLen
+}
+
 // bits controls the probability that a packet will be sent using a deterministic
 // coin flipper. A value of 0 sends all packets, while larger values drop more
 // packets. rel is true for reliable tubes and false for unreliable ones.
 func makeConn(bits int, rel bool, t testing.TB) (t1, t2 net.Conn, stop func(), r bool, err error) {
-	r = rel
 	var c1, c2 transport.MsgConn
 	c2Addr, err := net.ResolveUDPAddr("udp", ":7777")
 	assert.NilError(t, err)
@@ -72,6 +76,13 @@ func makeConn(bits int, rel bool, t testing.TB) (t1, t2 net.Conn, stop func(), r
 	assert.NilError(t, err)
 	c2 = MakeTestUDPMsgConn(bits, 2, c2UDP)
 
+	return makeMuxedConn(c1, c2, rel, t)
+}
+
+// makeMuxedConn runs a muxer over each of c1 and c2 and opens a tube between
+// them. rel is true for reliable tubes and false for unreliable ones.
+func makeMuxedConn(c1, c2 transport.MsgConn, rel bool, t testing.TB) (t1, t2 net.Conn, stop func(), r bool, err error) {
+	r = rel
 	var muxer1 *Muxer
 	var muxer2 *Muxer
 	wg := sync.WaitGroup{}
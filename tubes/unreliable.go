@@ -52,6 +52,20 @@ type Unreliable struct {
 	localAddr  net.Addr
 	remoteAddr net.Addr
 
+	// maxDataLength returns the largest message that fits in a single frame. If
+	// it is nil, MaxFrameDataLength is used.
+	maxDataLength func() uint16
+
+	// fecEncoder is nil unless forward error correction was enabled locally
+	fecEncoder *fecEncoder // +checklocks:lifecycleMu
+	// fecDecoder is nil until the peer sends a frame protected by forward
+	// error correction
+	fecDecoder *fecDecoder // +checklocks:lifecycleMu
+	fecStats   FECStats    // +checklocks:lifecycleMu
+
+	// fragments reassembles datagrams that were split over several frames
+	fragments reassembler // +checklocks:lifecycleMu
+
 	log *logrus.Entry
 }
 
@@ -170,8 +184,20 @@ func (u *Unreliable) receive(pkt *frame) error {
 		return ErrBadTubeState
 	}
 
+	if pkt.flags.FEC {
+		u.receiveFECLocked(pkt)
+		return nil
+	}
+
+	data := pkt.data
+	if index, count, ok := parseFragment(pkt.ackNo); ok {
+		if data = u.fragments.add(pkt.frameNo, index, count, pkt.data); data == nil {
+			return nil
+		}
+	}
+
 	select {
-	case u.recv.C <- pkt.data:
+	case u.recv.C <- data:
 	default:
 		return nil
 	}
@@ -181,6 +207,40 @@ func (u *Unreliable) receive(pkt *frame) error {
 	return nil
 }
 
+// receiveFECLocked handles a frame protected by forward error correction,
+// delivering it along with any frames it allowed to be rebuilt.
+// +checklocks:u.lifecycleMu
+func (u *Unreliable) receiveFECLocked(pkt *frame) {
+	if u.fecDecoder == nil {
+		u.fecDecoder = newFECDecoder(&u.fecStats)
+	}
+
+	recovered := u.fecStats.Recovered
+	var msgs [][]byte
+	if pkt.ackNo != 0 {
+		if b := u.fecDecoder.receiveParity(pkt); b != nil {
+			msgs = append(msgs, b)
+		}
+	} else {
+		deliver, rebuilt := u.fecDecoder.receiveData(pkt.frameNo, pkt.data)
+		if deliver {
+			msgs = append(msgs, pkt.data)
+		}
+		msgs = append(msgs, rebuilt...)
+	}
+	if u.fecStats.Recovered != recovered {
+		u.log.WithField("frameNo", pkt.frameNo).Trace("recovered packet with FEC")
+	}
+
+	for _, b := range msgs {
+		select {
+		case u.recv.C <- b:
+		default:
+			return
+		}
+	}
+}
+
 // Read implements net.Conn. It wraps ReadMsgUDP
 func (u *Unreliable) Read(b []byte) (n int, err error) {
 	n, _, _, _, err = u.ReadMsgUDP(b, nil)
@@ -226,8 +286,9 @@ func (u *Unreliable) WriteMsg(b []byte) (err error) {
 }
 
 // WriteMsgUDP queues one message for the Unreliable sender. It may return before
-// the message is handed to the Muxer or written to the transport. oob and addr
-// are ignored.
+// the message is handed to the Muxer or written to the transport. Messages
+// longer than MaxPayload are split into fragments, and messages longer than
+// MaxDatagramLength are rejected. oob and addr are ignored.
 func (u *Unreliable) WriteMsgUDP(b, oob []byte, addr *net.UDPAddr) (n, oobn int, err error) {
 	select {
 	case <-u.initiated:
@@ -242,11 +303,15 @@ func (u *Unreliable) WriteMsgUDP(b, oob []byte, addr *net.UDPAddr) (n, oobn int,
 		return 0, 0, io.EOF
 	}
 
-	dataLength := uint16(len(b))
-	if uint16(len(b)) > MaxFrameDataLength {
+	if len(b) > MaxDatagramLength {
 		err = transport.ErrBufOverflow
 		return n, oobn, err
 	}
+	if maxPayload := u.maxPayloadLocked(); len(b) > maxPayload {
+		n, err = u.writeFragmentsLocked(b, maxPayload)
+		return n, 0, err
+	}
+	dataLength := uint16(len(b))
 
 	pkt := frame{
 		tubeID: u.id,
@@ -256,6 +321,7 @@ func (u *Unreliable) WriteMsgUDP(b, oob []byte, addr *net.UDPAddr) (n, oobn int,
 			REQ:  false,
 			RESP: false,
 			REL:  false,
+			FEC:  u.fecEncoder != nil,
 		},
 
 		dataLength: dataLength,
@@ -269,6 +335,11 @@ func (u *Unreliable) WriteMsgUDP(b, oob []byte, addr *net.UDPAddr) (n, oobn int,
 	if err != nil {
 		return n, oobn, err
 	}
+	if u.fecEncoder != nil {
+		if parity := u.fecEncoder.add(u.id, pkt.frameNo, b); parity != nil {
+			u.sendParityLocked(parity)
+		}
+	}
 	n = len(b)
 	u.log.WithFields(logrus.Fields{
 		"frameNo":    pkt.frameNo,
@@ -277,6 +348,40 @@ func (u *Unreliable) WriteMsgUDP(b, oob []byte, addr *net.UDPAddr) (n, oobn int,
 	return n, 0, err
 }
 
+// writeFragmentsLocked queues b as fragments of at most size bytes each
+// +checklocks:u.lifecycleMu
+func (u *Unreliable) writeFragmentsLocked(b []byte, size int) (int, error) {
+	count := (len(b) + size - 1) / size
+	if count > maxFragments {
+		return 0, transport.ErrBufOverflow
+	}
+	// Fragments are not protected by FEC, so they must not split a group
+	if u.fecEncoder != nil {
+		if parity := u.fecEncoder.flush(u.id); parity != nil {
+			u.sendParityLocked(parity)
+		}
+	}
+	for i := 0; i < count; i++ {
+		data := b[i*size : min((i+1)*size, len(b))]
+		pkt := frame{
+			tubeID:     u.id,
+			dataLength: uint16(len(data)),
+			ackNo:      fragmentAckNo(i, count),
+			frameNo:    u.frameNo.Load(),
+			data:       data,
+		}
+		u.frameNo.Add(1)
+		if err := u.send.Send(pkt.toBytes()); err != nil {
+			return 0, err
+		}
+	}
+	u.log.WithFields(logrus.Fields{
+		"fragments":  count,
+		"dataLength": len(b),
+	}).Trace("queued fragmented packet")
+	return len(b), nil
+}
+
 // Close rejects new packets, places FIN after accepted writes, and waits until
 // the sender hands its queue to the Muxer. It does not wait for transport writes
 // or peer receipt. Future operations return io.EOF after buffered reads drain.
@@ -299,6 +404,12 @@ func (u *Unreliable) Close() error {
 
 	var err error
 	if oldState == initiated {
+		// Protect the final partial group before sending FIN
+		if u.fecEncoder != nil {
+			if parity := u.fecEncoder.flush(u.id); parity != nil {
+				u.sendParityLocked(parity)
+			}
+		}
 		pkt := frame{
 			tubeID: u.id,
 			flags: frameFlags{
@@ -393,3 +504,63 @@ func (u *Unreliable) WaitForClose() {
 func (u *Unreliable) getLog() *logrus.Entry {
 	return u.log
 }
+
+// MaxPayload returns the largest message that is sent in a single frame. Longer
+// messages of up to MaxDatagramLength bytes are fragmented.
+func (u *Unreliable) MaxPayload() int {
+	u.lifecycleMu.Lock()
+	defer u.lifecycleMu.Unlock()
+	return u.maxPayloadLocked()
+}
+
+// +checklocks:u.lifecycleMu
+func (u *Unreliable) maxPayloadLocked() int {
+	n := int(MaxFrameDataLength)
+	if u.maxDataLength != nil {
+		n = int(u.maxDataLength())
+	}
+	// Parity frames must fit the largest message of their group
+	if u.fecEncoder != nil {
+		n -= fecParityHeaderLen
+	}
+	return n
+}
+
+// EnableFEC turns on forward error correction for messages written to the
+// tube. After every config.GroupSize messages, a parity frame is sent that
+// allows the peer to rebuild any one lost message of the group. Receiving
+// FEC-protected messages does not require enabling FEC locally.
+func (u *Unreliable) EnableFEC(config FECConfig) error {
+	encoder, err := newFECEncoder(config)
+	if err != nil {
+		return err
+	}
+	u.lifecycleMu.Lock()
+	defer u.lifecycleMu.Unlock()
+	if u.fecEncoder != nil {
+		// Finish the current group so that it is not split between configurations
+		if parity := u.fecEncoder.flush(u.id); parity != nil {
+			u.sendParityLocked(parity)
+		}
+	}
+	u.fecEncoder = encoder
+	return nil
+}
+
+// FECStats returns forward error correction statistics for the tube
+func (u *Unreliable) FECStats() FECStats {
+	u.lifecycleMu.Lock()
+	defer u.lifecycleMu.Unlock()
+	return u.fecStats
+}
+
+// sendParityLocked queues a parity frame. Losing a parity frame only reduces
+// protection, so errors are logged and ignored.
+// +checklocks:u.lifecycleMu
+func (u *Unreliable) sendParityLocked(parity *frame) {
+	if err := u.send.Send(parity.toBytes()); err != nil {
+		u.log.WithError(err).Debug("unable to queue FEC parity frame")
+		return
+	}
+	u.fecStats.ParitySent++
+}